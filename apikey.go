@@ -0,0 +1,208 @@
+package web
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Default APIKeyConfig.Header
+const API_KEY_HEADER = "X-API-Key"
+
+// API key for the authenticated identity, with an optional rate limit
+type APIKey struct {
+	Key      string
+	Identity string
+
+	// Requests per second, or 0 for unlimited, and the burst, defaulting to one second's worth
+	Rate  float64
+	Burst int
+}
+
+// Lookup API keys, returning false for unknown keys
+type APIKeyStore interface {
+	LookupAPIKey(key string) (APIKey, bool, error)
+}
+
+// Lookup API keys using a callback
+type APIKeyFunc func(key string) (APIKey, bool, error)
+
+func (f APIKeyFunc) LookupAPIKey(key string) (APIKey, bool, error) {
+	return f(key)
+}
+
+// Static list of API keys
+type APIKeys []APIKey
+
+// Compare against each key in constant time
+func (apiKeys APIKeys) LookupAPIKey(key string) (APIKey, bool, error) {
+	var found APIKey
+	var ok bool
+
+	for _, apiKey := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(apiKey.Key), []byte(key)) == 1 {
+			found, ok = apiKey, true
+		}
+	}
+
+	return found, ok, nil
+}
+
+// Load API keys from a file with lines of "KEY IDENTITY [RATE [BURST]]", ignoring blank lines and # comments
+func LoadAPIKeys(path string) (APIKeys, error) {
+	var apiKeys APIKeys
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var scanner = bufio.NewScanner(file)
+	var lineNumber = 0
+
+	for scanner.Scan() {
+		var fields = strings.Fields(scanner.Text())
+		var apiKey APIKey
+
+		lineNumber++
+
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		} else if len(fields) < 2 || len(fields) > 4 {
+			return nil, fmt.Errorf("%v:%d: Invalid line, expected KEY IDENTITY [RATE [BURST]]", path, lineNumber)
+		}
+
+		apiKey.Key = fields[0]
+		apiKey.Identity = fields[1]
+
+		if len(fields) > 2 {
+			if apiKey.Rate, err = strconv.ParseFloat(fields[2], 64); err != nil {
+				return nil, fmt.Errorf("%v:%d: Invalid rate: %v", path, lineNumber, err)
+			}
+		}
+		if len(fields) > 3 {
+			if apiKey.Burst, err = strconv.Atoi(fields[3]); err != nil {
+				return nil, fmt.Errorf("%v:%d: Invalid burst: %v", path, lineNumber, err)
+			}
+		}
+
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	return apiKeys, scanner.Err()
+}
+
+type APIKeyConfig struct {
+	Store APIKeyStore
+
+	// Request header for the API key, defaults to API_KEY_HEADER
+	Header string
+
+	// Also accept the API key using the query parameter, if set, e.g. "api_key"
+	Query string
+}
+
+// Authenticate requests using API keys, with per-key rate limits
+type APIKeyAuth struct {
+	config APIKeyConfig
+
+	mutex    sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func MakeAPIKeyAuth(config APIKeyConfig) *APIKeyAuth {
+	if config.Header == "" {
+		config.Header = API_KEY_HEADER
+	}
+
+	return &APIKeyAuth{
+		config:   config,
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// Return the rate limiter for the API key, or nil if not limited
+func (auth *APIKeyAuth) limiter(apiKey APIKey) *rate.Limiter {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+
+	if apiKey.Rate <= 0 {
+		return nil
+	} else if limiter, ok := auth.limiters[apiKey.Key]; ok {
+		return limiter
+	}
+
+	var limiter = makeRateLimiter(apiKey.Rate, apiKey.Burst)
+
+	auth.limiters[apiKey.Key] = limiter
+
+	return limiter
+}
+
+// Return the API key from the request header or query
+func (auth *APIKeyAuth) requestKey(r *http.Request) string {
+	if key := r.Header.Get(auth.config.Header); key != "" {
+		return key
+	} else if auth.config.Query != "" {
+		return r.URL.Query().Get(auth.config.Query)
+	} else {
+		return ""
+	}
+}
+
+// Authenticate the request, returning the API key identity.
+//
+// Returns an Error with HTTP 401 for missing or unknown API keys, or HTTP 429 if the API key is over its rate limit.
+// Use for APIConfig.AuthFunc or EventConfig.AuthFunc.
+func (auth *APIKeyAuth) AuthFunc(r *http.Request) (string, error) {
+	var key = auth.requestKey(r)
+
+	if key == "" {
+		return "", Errorf(http.StatusUnauthorized, "Missing API key")
+	}
+
+	apiKey, ok, err := auth.config.Store.LookupAPIKey(key)
+	if err != nil {
+		return "", err
+	} else if !ok {
+		return "", Errorf(http.StatusUnauthorized, "Invalid API key")
+	}
+
+	if limiter := auth.limiter(apiKey); limiter != nil && !limiter.Allow() {
+		apiLog.Info("API key rate limited", "identity", apiKey.Identity, "path", r.URL.Path)
+
+		return "", Errorf(http.StatusTooManyRequests, "Rate limit exceeded")
+	}
+
+	return apiKey.Identity, nil
+}
+
+// Return a handler rejecting requests per AuthFunc, and serving the handler with the API key identity for RequestIdentity()
+func (auth *APIKeyAuth) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identity, err := auth.AuthFunc(r); err != nil {
+			writeError(w, r, err)
+		} else {
+			handler.ServeHTTP(w, WithIdentity(r, identity))
+		}
+	})
+}
+
+// Return an APIKeyAuth using the --http-api-keys file, or nil if not set
+func (options Options) APIKeyAuth() (*APIKeyAuth, error) {
+	if options.APIKeys == "" {
+		return nil, nil
+	} else if apiKeys, err := LoadAPIKeys(options.APIKeys); err != nil {
+		return nil, fmt.Errorf("Invalid --http-api-keys=%v: %v", options.APIKeys, err)
+	} else {
+		return MakeAPIKeyAuth(APIKeyConfig{Store: apiKeys}), nil
+	}
+}
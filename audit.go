@@ -0,0 +1,60 @@
+package web
+
+import (
+	"context"
+	"net/http"
+)
+
+type identityKey struct{}
+
+// Return request with the authenticated identity, for use by authentication handlers
+func WithIdentity(r *http.Request, identity string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+}
+
+// Return authenticated identity for request, or empty if not authenticated
+func RequestIdentity(r *http.Request) string {
+	if identity, ok := r.Context().Value(identityKey{}).(string); ok {
+		return identity
+	} else {
+		return ""
+	}
+}
+
+// Request methods audited by APIConfig.AuditFunc
+var auditMethods = map[string]bool{
+	"POST":   true,
+	"PUT":    true,
+	"PATCH":  true,
+	"DELETE": true,
+}
+
+// Audit record for mutating requests, for APIConfig.AuditFunc
+type APIAudit struct {
+	Method   string
+	Path     string
+	Identity string
+
+	// Decoded request body, or nil
+	Request interface{}
+
+	Status int
+	Error  error
+}
+
+func (w *statusResponseWriter) audit(r *http.Request, object interface{}, err error) APIAudit {
+	var audit = APIAudit{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Identity: RequestIdentity(r),
+		Request:  object,
+		Status:   w.status,
+		Error:    err,
+	}
+
+	if audit.Status == 0 {
+		audit.Status = http.StatusOK
+	}
+
+	return audit
+}
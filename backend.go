@@ -0,0 +1,54 @@
+package web
+
+import (
+	"encoding/json"
+)
+
+// Distribute published events between multiple Events instances, e.g. using Redis pub/sub
+//
+// Events published using the EventPush chan or Publish() are sent to the backend, and events received from the backend
+// are sent to the local clients. Events targeted at specific clients are only sent to local clients.
+type EventBackend interface {
+	// Publish event to all instances, including this one
+	Publish(event Event) error
+
+	// Return events published by all instances
+	Subscribe() (<-chan Event, error)
+}
+
+// Wire format for EventBackend implementations
+type backendEvent struct {
+	Topic string          `json:"topic,omitempty"`
+	Event json.RawMessage `json:"event"`
+}
+
+// Encode event for an EventBackend, preserving any TopicEvent topic
+func MarshalBackendEvent(event Event) ([]byte, error) {
+	var message backendEvent
+
+	if topicEvent, ok := event.(TopicEvent); ok {
+		message.Topic = topicEvent.Topic
+		event = topicEvent.Event
+	}
+
+	if buf, err := json.Marshal(event); err != nil {
+		return nil, err
+	} else {
+		message.Event = buf
+	}
+
+	return json.Marshal(message)
+}
+
+// Decode event encoded using MarshalBackendEvent, returning the event as a json.RawMessage or TopicEvent
+func UnmarshalBackendEvent(buf []byte) (Event, error) {
+	var message backendEvent
+
+	if err := json.Unmarshal(buf, &message); err != nil {
+		return nil, err
+	} else if message.Topic != "" {
+		return TopicEvent{Topic: message.Topic, Event: message.Event}, nil
+	} else {
+		return message.Event, nil
+	}
+}
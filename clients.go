@@ -0,0 +1,56 @@
+package web
+
+import (
+	"sort"
+)
+
+// Return the currently registered clients, ordered by ID
+//
+// Returns nil after the server has stopped.
+func (events Events) Clients() []ClientInfo {
+	var clientsChan = make(chan []ClientInfo, 1)
+
+	select {
+	case events.clientsChan <- clientsChan:
+		return <-clientsChan
+	case <-events.doneChan:
+		return nil
+	}
+}
+
+func (clientSet *clientSet) list() []ClientInfo {
+	var clients = make([]ClientInfo, 0, len(clientSet.clients))
+
+	for _, register := range clientSet.clients {
+		clients = append(clients, register.info)
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ID < clients[j].ID
+	})
+
+	return clients
+}
+
+// Admin resource listing the registered Events clients
+type ClientsResource struct {
+	events Events
+}
+
+// Return resource for Clients(), e.g. api.Mount("_clients", MakeAPI(events.ClientsResource()))
+func (events Events) ClientsResource() ClientsResource {
+	return ClientsResource{events}
+}
+
+// Allow use as the root of a mounted API
+func (resource ClientsResource) Index(name string) (Resource, error) {
+	if name == "" {
+		return resource, nil
+	} else {
+		return nil, nil
+	}
+}
+
+func (resource ClientsResource) GetREST() (Resource, error) {
+	return resource.events.Clients(), nil
+}
@@ -0,0 +1,77 @@
+package web
+
+import (
+	"time"
+)
+
+// Return the EventConfig.CoalesceKey for the event, defaulting to the TopicEvent topic
+func (config EventConfig) coalesceKey(event Event) string {
+	if config.CoalesceKey != nil {
+		return config.CoalesceKey(event)
+	} else if topicEvent, ok := event.(TopicEvent); ok {
+		return topicEvent.Topic
+	} else {
+		return ""
+	}
+}
+
+// Pending events for EventConfig.CoalesceWindow, in order of first publish
+type eventsCoalescer struct {
+	config EventConfig
+	events []Event
+	keys   map[string]int
+}
+
+func makeEventsCoalescer(config EventConfig) eventsCoalescer {
+	return eventsCoalescer{
+		config: config,
+		keys:   make(map[string]int),
+	}
+}
+
+// Add event, replacing any pending event with the same key
+func (coalescer *eventsCoalescer) push(event Event) {
+	if key := coalescer.config.coalesceKey(event); key == "" {
+		coalescer.events = append(coalescer.events, event)
+	} else if i, ok := coalescer.keys[key]; ok {
+		coalescer.events[i] = event
+	} else {
+		coalescer.keys[key] = len(coalescer.events)
+		coalescer.events = append(coalescer.events, event)
+	}
+}
+
+// Return and reset pending events
+func (coalescer *eventsCoalescer) flush() []Event {
+	var events = coalescer.events
+
+	coalescer.events = nil
+	coalescer.keys = make(map[string]int)
+
+	return events
+}
+
+// Collect further messages received within the EventConfig.BatchWindow, up to the BatchSize.
+//
+// Returns false if the client was closed.
+func (events Events) batch(eventsClient eventsClient, message eventsMessage) ([]eventsMessage, bool) {
+	var messages = []eventsMessage{message}
+	var timer = time.NewTimer(events.config.BatchWindow)
+	defer timer.Stop()
+
+	for events.config.BatchSize == 0 || len(messages) < events.config.BatchSize {
+		select {
+		case message, ok := <-eventsClient:
+			if !ok {
+				return messages, false
+			}
+
+			messages = append(messages, message)
+
+		case <-timer.C:
+			return messages, true
+		}
+	}
+
+	return messages, true
+}
@@ -0,0 +1,176 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Options fields by config file key
+var optionsFields = makeOptionsFields()
+
+func makeOptionsFields() map[string]reflect.StructField {
+	var optionsType = reflect.TypeOf(Options{})
+	var fields = make(map[string]reflect.StructField)
+
+	for i := 0; i < optionsType.NumField(); i++ {
+		if key := optionsFileKey(optionsType.Field(i)); key != "" {
+			fields[key] = optionsType.Field(i)
+		}
+	}
+
+	return fields
+}
+
+// Config file key for the Options field, e.g. static-cache-control for --http-static-cache-control
+func optionsFileKey(field reflect.StructField) string {
+	return strings.TrimPrefix(field.Tag.Get("long"), "http-")
+}
+
+// Accept keys like static_cache_control or http-static-cache-control
+func normalizeOptionsKey(key string) string {
+	return strings.TrimPrefix(strings.ReplaceAll(strings.ToLower(key), "_", "-"), "http-")
+}
+
+// Read the config file values for each key, per the .json, .yaml, .yml or .toml extension
+func readOptionsFile(path string) (map[string][]string, error) {
+	var object map[string]interface{}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+		err = json.Unmarshal(data, &object)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &object)
+	case ".toml":
+		err = toml.Unmarshal(data, &object)
+	default:
+		return nil, fmt.Errorf("Unknown config file type: %v", ext)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseOptionsObject(object)
+}
+
+// Format a string, bool or number value
+func formatOptionsValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case int:
+		return strconv.Itoa(value), nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case uint64:
+		return strconv.FormatUint(value, 10), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("Unsupported value: %#v", value)
+	}
+}
+
+// Flatten a decoded object with string, bool, number or array values, without any nested objects
+func parseOptionsObject(object map[string]interface{}) (map[string][]string, error) {
+	var values = make(map[string][]string)
+
+	for key, value := range object {
+		var items []interface{}
+		var list []string
+
+		key = normalizeOptionsKey(key)
+
+		if array, ok := value.([]interface{}); ok {
+			items = array
+		} else if value != nil {
+			items = []interface{}{value}
+		}
+
+		for _, item := range items {
+			if s, err := formatOptionsValue(item); err != nil {
+				return nil, fmt.Errorf("%v: %v", key, err)
+			} else {
+				list = append(list, s)
+			}
+		}
+
+		values[key] = list
+	}
+
+	return values, nil
+}
+
+// Set any Options from the config file, except for the given flags that were explicitly set on the command-line,
+// so that those override the config file values. When using go-flags, check each option using IsSet().
+//
+// The config file keys are the long flag names without the http- prefix, e.g. "listen" or "static-cache-control".
+// The flags may be given with or without the http- prefix, e.g. "http-listen".
+func (options *Options) LoadFile(path string, flags ...string) error {
+	var set = make(map[string]bool)
+	var unknown []string
+
+	for _, flag := range flags {
+		set[normalizeOptionsKey(strings.TrimLeft(flag, "-"))] = true
+	}
+
+	values, err := readOptionsFile(path)
+	if err != nil {
+		return fmt.Errorf("Load %v: %v", path, err)
+	}
+
+	for key := range values {
+		if _, ok := optionsFields[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+
+	if unknown != nil {
+		sort.Strings(unknown)
+
+		return fmt.Errorf("Load %v: Unknown options: %v", path, strings.Join(unknown, ", "))
+	}
+
+	if err := options.setFields(func(field reflect.StructField) (string, []string, bool) {
+		var key = optionsFileKey(field)
+
+		if value, ok := values[key]; key == "" || !ok {
+			return key, nil, false
+		} else if set[key] {
+			return key, nil, false
+		} else {
+			return key, value, true
+		}
+	}); err != nil {
+		return fmt.Errorf("Load %v: %v", path, err)
+	}
+
+	return nil
+}
+
+// Return the DefaultOptions, with any values from the .json, .yaml or .toml config file
+func LoadOptions(path string) (Options, error) {
+	var options = DefaultOptions()
+
+	if err := options.LoadFile(path); err != nil {
+		return options, err
+	}
+
+	return options, nil
+}
@@ -0,0 +1,103 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cache duration for CORS preflight responses
+const CORS_MAX_AGE = 10 * time.Minute
+
+// Request headers allowed for CORS preflight requests, in addition to any --http-cors-header
+var corsHeaders = []string{
+	"Accept",
+	"Accept-Language",
+	"Accept-Version",
+	"Authorization",
+	"Content-Language",
+	"Content-Type",
+	"Idempotency-Key",
+	"If-Match",
+	"If-None-Match",
+	"Last-Event-ID",
+	"Traceparent",
+	API_KEY_HEADER,
+	"X-CSRF-Token",
+}
+
+// Allow cross-origin requests from any of the origins, or * for any origin.
+//
+// Credentials are only allowed for the listed origins, not for *.
+type corsHandler struct {
+	origins []string
+	headers []string
+	handler http.Handler
+}
+
+// Return true if the origin is allowed, and false for credentials if only allowed by *
+func (h corsHandler) allowOrigin(origin string) (allow bool, credentials bool) {
+	for _, allowOrigin := range h.origins {
+		if allowOrigin == "*" {
+			allow = true
+		} else if strings.EqualFold(allowOrigin, origin) {
+			return true, true
+		}
+	}
+
+	return allow, false
+}
+
+// Return the allowed subset of the comma-separated request headers
+func (h corsHandler) allowHeaders(requestHeaders string) []string {
+	var headers []string
+
+	for _, header := range strings.Split(requestHeaders, ",") {
+		header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+
+		for _, allowHeader := range append(corsHeaders, h.headers...) {
+			if strings.EqualFold(allowHeader, header) {
+				headers = append(headers, header)
+				break
+			}
+		}
+	}
+
+	return headers
+}
+
+func (h corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var origin = r.Header.Get("Origin")
+
+	w.Header().Add("Vary", "Origin")
+
+	allow, credentials := h.allowOrigin(origin)
+
+	if origin == "" || !allow {
+		h.handler.ServeHTTP(w, r)
+
+		return
+	} else if credentials {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+
+	if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+		// preflight
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE")
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(CORS_MAX_AGE.Seconds())))
+
+		if headers := h.allowHeaders(r.Header.Get("Access-Control-Request-Headers")); len(headers) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+		return
+	}
+
+	h.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,170 @@
+package web
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Request and response bodies captured for APIConfig.DebugSize
+type APIDebug struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	Request  string    `json:"request,omitempty"`
+	Response string    `json:"response,omitempty"`
+}
+
+// Truncate debug body to the size limit
+func debugBody(buf []byte, limit int) string {
+	if len(buf) > limit {
+		return string(buf[:limit]) + "..."
+	} else {
+		return string(buf)
+	}
+}
+
+// Record response status and body, up to the size limit.
+//
+// Streamed responses are only recorded up to the first Flush, and hijacked connections are not recorded.
+type debugResponseWriter struct {
+	http.ResponseWriter
+
+	limit     int
+	status    int
+	body      []byte
+	streaming bool
+}
+
+func (w *debugResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *debugResponseWriter) Write(buf []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	if w.streaming {
+
+	} else if n := w.limit + 1 - len(w.body); n <= 0 {
+
+	} else if n < len(buf) {
+		w.body = append(w.body, buf[:n]...)
+	} else {
+		w.body = append(w.body, buf...)
+	}
+
+	return w.ResponseWriter.Write(buf)
+}
+
+func (w *debugResponseWriter) Flush() {
+	w.streaming = true
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *debugResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("http.Hijacker not supported")
+	}
+
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+
+	w.streaming = true
+
+	return hijacker.Hijack()
+}
+
+func (w *debugResponseWriter) debug(r *http.Request, object interface{}) APIDebug {
+	var debug = APIDebug{
+		Time:     time.Now(),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Status:   w.status,
+		Response: debugBody(w.body, w.limit),
+	}
+
+	if object == nil {
+
+	} else if buf, err := json.Marshal(object); err != nil {
+		debug.Request = err.Error()
+	} else {
+		debug.Request = debugBody(buf, w.limit)
+	}
+
+	if debug.Status == 0 {
+		debug.Status = http.StatusOK
+	}
+
+	return debug
+}
+
+// Ring buffer of the most recent APIDebug entries for APIConfig.DebugBuffer.
+//
+// Can be used as an admin resource, e.g. api.Mount("_debug", MakeAPI(debugBuffer))
+type DebugBuffer struct {
+	mutex   sync.Mutex
+	entries []APIDebug
+	next    int
+}
+
+func MakeDebugBuffer(size int) *DebugBuffer {
+	return &DebugBuffer{
+		entries: make([]APIDebug, 0, size),
+	}
+}
+
+func (buffer *DebugBuffer) push(debug APIDebug) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	if cap(buffer.entries) == 0 {
+
+	} else if len(buffer.entries) < cap(buffer.entries) {
+		buffer.entries = append(buffer.entries, debug)
+	} else {
+		buffer.entries[buffer.next] = debug
+		buffer.next = (buffer.next + 1) % len(buffer.entries)
+	}
+}
+
+// Return entries, oldest first
+func (buffer *DebugBuffer) Entries() []APIDebug {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	var entries = make([]APIDebug, 0, len(buffer.entries))
+
+	entries = append(entries, buffer.entries[buffer.next:]...)
+	entries = append(entries, buffer.entries[:buffer.next]...)
+
+	return entries
+}
+
+// Allow use as the root of a mounted API
+func (buffer *DebugBuffer) Index(name string) (Resource, error) {
+	if name == "" {
+		return buffer, nil
+	} else {
+		return nil, nil
+	}
+}
+
+func (buffer *DebugBuffer) GetREST() (Resource, error) {
+	return buffer.Entries(), nil
+}
@@ -0,0 +1,133 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Fail reads beyond the limit with HTTP 413
+type limitReader struct {
+	reader io.Reader
+	limit  int64
+	read   int64
+}
+
+func (r *limitReader) Read(buf []byte) (int, error) {
+	if r.read > r.limit {
+		return 0, Errorf(http.StatusRequestEntityTooLarge, "Request body too large: limit is %d bytes", r.limit)
+	}
+
+	// read one byte beyond the limit to detect overflow
+	if remaining := r.limit - r.read + 1; int64(len(buf)) > remaining {
+		buf = buf[:remaining]
+	}
+
+	n, err := r.reader.Read(buf)
+
+	r.read += int64(n)
+
+	if r.read > r.limit {
+		return n, Errorf(http.StatusRequestEntityTooLarge, "Request body too large: limit is %d bytes", r.limit)
+	}
+
+	return n, err
+}
+
+// Apply APIConfig.MaxBodySize to request body
+func limitBody(r *http.Request, limit int64) error {
+	if limit <= 0 {
+		return nil
+	} else if r.ContentLength > limit {
+		return Errorf(http.StatusRequestEntityTooLarge, "Request body too large: limit is %d bytes", limit)
+	}
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{&limitReader{reader: r.Body, limit: limit}, r.Body}
+
+	return nil
+}
+
+type jsonDepthError struct {
+	path  []string
+	limit int
+}
+
+func (err jsonDepthError) Error() string {
+	return fmt.Sprintf("Nesting too deep for field %v: limit is %d", strings.Join(err.path, "."), err.limit)
+}
+
+// Check nesting depth of the next JSON value, returning jsonDepthError naming the field if the limit is exceeded
+func checkJSONDepth(decoder *json.Decoder, path []string, limit int) error {
+	token, err := decoder.Token()
+
+	if err != nil {
+		return err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		if len(path) >= limit {
+			return jsonDepthError{path, limit}
+		}
+
+		for decoder.More() {
+			if key, err := decoder.Token(); err != nil {
+				return err
+			} else if err := checkJSONDepth(decoder, append(path, fmt.Sprintf("%v", key)), limit); err != nil {
+				return err
+			}
+		}
+
+	case json.Delim('['):
+		if len(path) >= limit {
+			return jsonDepthError{path, limit}
+		}
+
+		for i := 0; decoder.More(); i++ {
+			if err := checkJSONDepth(decoder, append(path, strconv.Itoa(i)), limit); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return nil
+	}
+
+	// closing delim
+	_, err = decoder.Token()
+
+	return err
+}
+
+// Decode JSON request body, subject to APIConfig limits
+func decodeJSON(body io.Reader, object interface{}, config APIConfig) error {
+	if config.MaxBodyDepth > 0 {
+		var buf bytes.Buffer
+
+		if _, err := buf.ReadFrom(body); err != nil {
+			return err
+		} else if err := checkJSONDepth(json.NewDecoder(bytes.NewReader(buf.Bytes())), nil, config.MaxBodyDepth); err == nil {
+
+		} else if depthError, ok := err.(jsonDepthError); ok {
+			return depthError
+		}
+
+		// any syntax errors are reported by the decode
+		body = &buf
+	}
+
+	var decoder = json.NewDecoder(body)
+
+	if config.DisallowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+
+	return decoder.Decode(object)
+}
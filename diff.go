@@ -0,0 +1,100 @@
+package web
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JSON Patch (RFC 6902) operation
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// Event published by Events.PublishState, with the JSON Patch operations to apply to the previous state
+type StatePatch struct {
+	Patch []PatchOperation `json:"patch"`
+}
+
+// Escape object key for JSON Pointer path
+var patchPathReplacer = strings.NewReplacer("~", "~0", "/", "~1")
+
+// Return state as generic JSON values
+func jsonValue(state State) (interface{}, error) {
+	var value interface{}
+
+	if buf, err := json.Marshal(state); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(buf, &value); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// Append patch operations to transform the old JSON value into the new value
+func diffJSON(patch []PatchOperation, path string, oldValue interface{}, newValue interface{}) []PatchOperation {
+	switch newValue := newValue.(type) {
+	case map[string]interface{}:
+		if oldValue, ok := oldValue.(map[string]interface{}); ok {
+			var oldKeys = make([]string, 0, len(oldValue))
+			var newKeys = make([]string, 0, len(newValue))
+
+			for key := range oldValue {
+				oldKeys = append(oldKeys, key)
+			}
+			for key := range newValue {
+				newKeys = append(newKeys, key)
+			}
+
+			sort.Strings(oldKeys)
+			sort.Strings(newKeys)
+
+			for _, key := range oldKeys {
+				if _, ok := newValue[key]; !ok {
+					patch = append(patch, PatchOperation{Op: "remove", Path: path + "/" + patchPathReplacer.Replace(key)})
+				}
+			}
+
+			for _, key := range newKeys {
+				var keyPath = path + "/" + patchPathReplacer.Replace(key)
+
+				if value, ok := oldValue[key]; ok {
+					patch = diffJSON(patch, keyPath, value, newValue[key])
+				} else {
+					patch = append(patch, PatchOperation{Op: "add", Path: keyPath, Value: newValue[key]})
+				}
+			}
+
+			return patch
+		}
+
+	case []interface{}:
+		// arrays of a different length are replaced
+		if oldValue, ok := oldValue.([]interface{}); ok && len(oldValue) == len(newValue) {
+			for i := range newValue {
+				patch = diffJSON(patch, path+"/"+strconv.Itoa(i), oldValue[i], newValue[i])
+			}
+
+			return patch
+		}
+	}
+
+	if !reflect.DeepEqual(oldValue, newValue) {
+		patch = append(patch, PatchOperation{Op: "replace", Path: path, Value: newValue})
+	}
+
+	return patch
+}
+
+// Publish the changes from the previously published state, if any, as a StatePatch event
+//
+// Clients connecting later receive the most recently published state, instead of the StateFunc.
+// Safe to call concurrently, and after the server has stopped.
+func (events Events) PublishState(state State) {
+	events.publish(eventsPublish{event: state, state: true})
+}
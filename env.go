@@ -0,0 +1,119 @@
+package web
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Set the Options field from the string value, per go-flags
+func setOptionsValue(value reflect.Value, s string) error {
+	switch value.Interface().(type) {
+	case time.Duration:
+		if duration, err := time.ParseDuration(s); err != nil {
+			return err
+		} else {
+			value.SetInt(int64(duration))
+		}
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(s)
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(s); err != nil {
+			return err
+		} else {
+			value.SetBool(b)
+		}
+	case reflect.Int, reflect.Int64:
+		if i, err := strconv.ParseInt(s, 10, 64); err != nil {
+			return err
+		} else {
+			value.SetInt(i)
+		}
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("Unsupported type: %v", value.Type())
+		}
+		value.Set(reflect.Append(value, reflect.ValueOf(s)))
+	default:
+		return fmt.Errorf("Unsupported type: %v", value.Type())
+	}
+
+	return nil
+}
+
+// Set each Options field from the values returned by the lookup func, replacing any existing slice values
+func (options *Options) setFields(lookup func(field reflect.StructField) (name string, values []string, ok bool)) error {
+	var value = reflect.ValueOf(options).Elem()
+
+	for i := 0; i < value.NumField(); i++ {
+		var field = value.Type().Field(i)
+		var fieldValue = value.Field(i)
+
+		name, values, ok := lookup(field)
+		if !ok {
+			continue
+		}
+
+		if fieldValue.Kind() == reflect.Slice {
+			fieldValue.Set(reflect.Zero(fieldValue.Type()))
+		}
+
+		for _, s := range values {
+			if err := setOptionsValue(fieldValue, s); err != nil {
+				return fmt.Errorf("Invalid %v=%v: %v", name, s, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Return Options with the go-flags default values, for use without go-flags
+func DefaultOptions() Options {
+	var options Options
+
+	options.setFields(func(field reflect.StructField) (string, []string, bool) {
+		value, ok := field.Tag.Lookup("default")
+
+		return field.Name, []string{value}, ok
+	})
+
+	return options
+}
+
+// Set any Options from the HTTP_* environment variables, e.g. HTTP_LISTEN for --http-listen.
+//
+// Not needed when using go-flags, which also uses the env:"..." tags.
+func (options *Options) LoadEnv() error {
+	return options.setFields(func(field reflect.StructField) (string, []string, bool) {
+		var name = field.Tag.Get("env")
+
+		if name == "" {
+			return name, nil, false
+		} else if value, ok := os.LookupEnv(name); !ok {
+			return name, nil, false
+		} else if delim := field.Tag.Get("env-delim"); delim != "" {
+			return name, strings.Split(value, delim), true
+		} else {
+			return name, []string{value}, true
+		}
+	})
+}
+
+// Return the DefaultOptions, with any HTTP_* environment variables
+func LoadOptionsEnv() (Options, error) {
+	var options = DefaultOptions()
+
+	if err := options.LoadEnv(); err != nil {
+		return options, err
+	}
+
+	return options, nil
+}
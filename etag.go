@@ -0,0 +1,53 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Resource that supports conditional requests using ETag and If-Match
+type ETagResource interface {
+	// Return opaque version of the current resource state, without quotes
+	ETagREST() (string, error)
+}
+
+// Check If-Match header against ETagResource for PUT/DELETE
+//
+// Fails with HTTP 412 if the resource has changed, or HTTP 428 for APIConfig.RequireIfMatch if the header is missing.
+func (api API) checkIfMatch(r *http.Request, resource Resource) error {
+	var ifMatch = r.Header.Get("If-Match")
+
+	if etagResource, ok := resource.(ETagResource); !ok {
+		return nil
+	} else if ifMatch == "" && api.config.RequireIfMatch {
+		return Errorf(http.StatusPreconditionRequired, "Missing If-Match header")
+	} else if ifMatch == "" || ifMatch == "*" {
+		return nil
+	} else if etag, err := etagResource.ETagREST(); err != nil {
+		return err
+	} else {
+		for _, match := range strings.Split(ifMatch, ",") {
+			// only strong validators match
+			if strings.TrimSpace(match) == `"`+etag+`"` {
+				return nil
+			}
+		}
+
+		return Errorf(http.StatusPreconditionFailed, "Resource has been modified")
+	}
+}
+
+// Set ETag response header for GET/PUT of an ETagResource
+func writeETag(w http.ResponseWriter, r *http.Request, resource Resource) error {
+	if r.Method != "GET" && r.Method != "PUT" {
+		return nil
+	} else if etagResource, ok := resource.(ETagResource); !ok {
+		return nil
+	} else if etag, err := etagResource.ETagREST(); err != nil {
+		return err
+	} else if etag != "" {
+		w.Header().Set("ETag", `"`+etag+`"`)
+	}
+
+	return nil
+}
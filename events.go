@@ -1,103 +1,836 @@
 package web
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"golang.org/x/net/websocket"
+	"github.com/gorilla/schema"
+	"github.com/gorilla/websocket"
 )
 
 const EVENTS_BUFFER = 100
 
+// Maximum size of messages received from websocket clients
+const WEBSOCKET_READ_LIMIT = 32 << 20
+
 type State interface{}
 type Event interface{}
 
-type clientSet map[chan Event]bool
+// Event sent as a binary websocket frame, instead of JSON
+//
+// Events of type []byte are also sent as binary websocket frames as-is.
+type BinaryEvent interface {
+	MarshalEvent() ([]byte, error)
+}
+
+// Marshal BinaryEvent or []byte events as binary frames, and anything else as JSON text frames
+func marshalEvent(v interface{}) ([]byte, int, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, websocket.BinaryMessage, nil
+
+	case BinaryEvent:
+		buf, err := v.MarshalEvent()
+
+		return buf, websocket.BinaryMessage, err
+
+	default:
+		buf, err := json.Marshal(v)
+
+		return buf, websocket.TextMessage, err
+	}
+}
+
+// Websocket message encoding for EventConfig.Codecs
+type WebsocketCodec struct {
+	// Return the encoded message and its websocket.TextMessage or websocket.BinaryMessage type
+	Marshal func(v interface{}) ([]byte, int, error)
+}
+
+func (codec WebsocketCodec) send(conn *eventsConn, v interface{}) error {
+	if data, messageType, err := codec.Marshal(v); err != nil {
+		return err
+	} else {
+		return conn.writeMessage(messageType, data)
+	}
+}
+
+// Send websocket events using marshalEvent
+var eventCodec = WebsocketCodec{Marshal: marshalEvent}
+
+// Return a WebsocketCodec for EventConfig.Codecs sending binary frames using the given marshal func, e.g. msgpack.Marshal
+func BinaryCodec(marshal func(interface{}) ([]byte, error)) WebsocketCodec {
+	return WebsocketCodec{
+		Marshal: func(v interface{}) ([]byte, int, error) {
+			buf, err := marshal(v)
+
+			return buf, websocket.BinaryMessage, err
+		},
+	}
+}
+
+// Event published to a topic, only sent to clients subscribed to a matching topic pattern, if any
+type TopicEvent struct {
+	Topic string `json:"topic"`
+	Event Event  `json:"event"`
+}
+
+// Topic patterns using path.Match syntax, e.g. "lights/*"; nil to subscribe to all events
+type eventsTopics []string
+
+// Client subscription options, decoded from the websocket or SSE request query using github.com/gorilla/schema
+type eventsOptions struct {
+	// Only send events matching the ?topic=... patterns
+	Topics eventsTopics `schema:"topic"`
+
+	// Replay up to ?history=N recent events after the initial state, limited by EventConfig.History
+	History int `schema:"history"`
+
+	// Resume from the ?last-id=N or Last-Event-ID sequence number, replaying any missed events from the EventConfig.History
+	// instead of sending the initial state
+	LastID uint64 `schema:"last-id"`
+
+	// Resume from the ?since=N sequence number, as used by ServeLongPoll
+	Since uint64 `schema:"since"`
+
+	// Resume a disconnected websocket client using the ?resume=... token, see EventConfig.ResumeTimeout
+	Resume string `schema:"resume"`
+
+	// Decoded EventConfig.QueryFunc object
+	Query interface{} `schema:"-"`
+}
+
+// Return client subscription options from the request query params
+func parseEventsOptions(r *http.Request) (eventsOptions, error) {
+	var decoder = schema.NewDecoder()
+	var options eventsOptions
+
+	decoder.IgnoreUnknownKeys(true)
+
+	if err := decoder.Decode(&options, r.URL.Query()); err != nil {
+		return options, validationError(err)
+	}
+
+	if options.LastID == 0 {
+		options.LastID = options.Since
+	}
+
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID == "" || options.LastID != 0 {
+
+	} else if lastID, err := strconv.ParseUint(lastEventID, 10, 64); err != nil {
+		return options, RequestErrorf("Invalid Last-Event-ID: %v", lastEventID)
+	} else {
+		options.LastID = lastID
+	}
+
+	for _, pattern := range options.Topics {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return options, RequestErrorf("Invalid topic pattern %v: %v", pattern, err)
+		}
+	}
+
+	return options, nil
+}
+
+// Return client subscription options, including any EventConfig.QueryFunc object decoded from the request query params
+func (events Events) parseOptions(r *http.Request) (eventsOptions, error) {
+	options, err := parseEventsOptions(r)
+	if err != nil {
+		return options, err
+	}
+
+	if events.config.QueryFunc != nil {
+		var decoder = schema.NewDecoder()
+		var query = events.config.QueryFunc()
+
+		decoder.IgnoreUnknownKeys(true)
+
+		if err := decoder.Decode(query, r.URL.Query()); err != nil {
+			return options, validationError(err)
+		}
+
+		options.Query = query
+	}
+
+	return options, nil
+}
+
+// Test if event matches the topic patterns, or there are no topic patterns
+func (topics eventsTopics) match(event Event) bool {
+	if topics == nil {
+		return true
+	}
+
+	var topic string
+
+	if topicEvent, ok := event.(TopicEvent); ok {
+		topic = topicEvent.Topic
+	}
+
+	for _, pattern := range topics {
+		if ok, _ := path.Match(pattern, topic); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Published event, with sequence number
+type eventsMessage struct {
+	seq    uint64
+	time   time.Time
+	event  Event
+	target func(ClientInfo) bool
+
+	// full State for resync, instead of an Event
+	state bool
+}
+
+// Registered Events client
+type ClientInfo struct {
+	ID       ClientID `json:"id"`
+	Identity string   `json:"identity,omitempty"`
+
+	RemoteAddr  string    `json:"remote_addr,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	ConnectTime time.Time `json:"connect_time"`
+
+	// Decoded EventConfig.QueryFunc object, or nil
+	Query interface{} `json:"query,omitempty"`
+
+	// websocket or SSE request, or nil
+	Request *http.Request `json:"-"`
+}
+
+// Initial state for registered client
+type eventsSnapshot struct {
+	// sequence number of the most recent event at the time of registration
+	seq uint64
+
+	// client resumed from the LastID, and does not need the initial state
+	resumed bool
+
+	state State
+
+	// token for resuming a disconnected websocket client
+	token string
+
+	// set once the server has dropped the client, before closing the clientChan
+	disconnect *DisconnectReason
+}
+
+// Registered client
+type eventsRegister struct {
+	clientChan     chan eventsMessage
+	registeredChan chan eventsSnapshot
+	disconnect     *DisconnectReason
+
+	info    ClientInfo
+	options eventsOptions
+}
+
+// Reason for EventConfig.OnDisconnect
+type DisconnectReason string
+
+const (
+	// Client closed the connection
+	DisconnectClosed DisconnectReason = "closed"
+
+	// Client was dropped for falling behind, per the DropPolicy
+	DisconnectDropped DisconnectReason = "dropped"
+
+	// Server was stopped using Close()
+	DisconnectShutdown DisconnectReason = "shutdown"
+)
+
+// Policy for clients whose event buffer is full
+type DropPolicy int
+
+const (
+	// Drop the client, closing the connection
+	DropClient DropPolicy = iota
+
+	// Drop the oldest buffered event to make room for the new event
+	DropOldest
+
+	// Block publishing until the client has room in its buffer, dropping the client after the DropTimeout.
+	// This blocks publishing to all other clients.
+	DropBlock
+)
+
+type clientSet struct {
+	config   EventConfig
+	stats    *eventsStats
+	overflow *overflowLog
+	clients  map[chan eventsMessage]eventsRegister
+	seq      uint64
+	history  []eventsMessage
+
+	// most recent PublishState, as generic JSON values
+	state interface{}
+}
+
+func makeClientSet(config EventConfig, stats *eventsStats) *clientSet {
+	return &clientSet{
+		config:   config,
+		stats:    stats,
+		overflow: makeOverflowLog(),
+		clients:  make(map[chan eventsMessage]eventsRegister),
+	}
+}
+
+// Return history for client resuming from the given sequence number, or false if unable to resume
+func (clientSet *clientSet) resume(lastID uint64) ([]eventsMessage, bool) {
+	if lastID == 0 || lastID > clientSet.seq {
+		return nil, false
+	} else if lastID == clientSet.seq {
+		return nil, true
+	}
+
+	for i, message := range clientSet.history {
+		if message.seq == lastID+1 {
+			return clientSet.history[i:], true
+		}
+	}
+
+	return nil, false
+}
+
+// add to set of clients, replaying any requested history
+func (clientSet *clientSet) register(register eventsRegister) eventsSnapshot {
+	var snapshot = eventsSnapshot{seq: clientSet.seq, state: clientSet.state, disconnect: register.disconnect}
+	var history []eventsMessage
+
+	clientSet.clients[register.clientChan] = register
+	clientSet.updateClients()
+
+	if clientSet.config.OnConnect != nil {
+		clientSet.config.OnConnect(register.info)
+	}
+
+	if resumeHistory, ok := clientSet.resume(register.options.LastID); ok {
+		history = resumeHistory
+		snapshot.resumed = true
+	} else if register.options.History <= 0 {
+
+	} else if len(clientSet.history) > register.options.History {
+		history = clientSet.history[len(clientSet.history)-register.options.History:]
+	} else {
+		history = clientSet.history
+	}
+
+	for _, message := range history {
+		if _, ok := clientSet.clients[register.clientChan]; !ok {
+			// dropped
+			break
+		} else if message, ok := clientSet.filter(register, message); ok {
+			clientSet.send(register.clientChan, message)
+		}
+	}
 
-// add to set of clients
-func (clientSet clientSet) register(clientChan chan Event) {
-	clientSet[clientChan] = true
+	return snapshot
 }
 
 // remove from set on behalf of client requesting stop(); the clientChan may already be closed
-func (clientSet clientSet) unregister(clientChan chan Event) {
-	delete(clientSet, clientChan)
+func (clientSet *clientSet) unregister(clientChan chan eventsMessage) {
+	if _, ok := clientSet.clients[clientChan]; ok {
+		clientSet.remove(clientChan, DisconnectClosed)
+	}
 }
 
 // remove from set on behalf of server; closes the clientChan to tell the client
 //
 // the client may trigger .unregister() later, which will be a no-op
-func (clientSet clientSet) drop(clientChan chan Event) {
+func (clientSet *clientSet) drop(clientChan chan eventsMessage, reason DisconnectReason) {
+	*clientSet.clients[clientChan].disconnect = reason
+
 	close(clientChan)
-	delete(clientSet, clientChan)
+	clientSet.remove(clientChan, reason)
 }
 
-// write event to client, drop client if stuck
-func (clientSet clientSet) send(clientChan chan Event, event Event) {
-	select {
-	case clientChan <- event:
+func (clientSet *clientSet) remove(clientChan chan eventsMessage, reason DisconnectReason) {
+	var register = clientSet.clients[clientChan]
 
+	delete(clientSet.clients, clientChan)
+	clientSet.updateClients()
+
+	if clientSet.config.OnDisconnect != nil {
+		clientSet.config.OnDisconnect(register.info, reason)
+	}
+}
+
+func (clientSet *clientSet) updateClients() {
+	clientSet.stats.update(func(stats *EventStats) {
+		stats.Clients = len(clientSet.clients)
+	})
+}
+
+// write event to client, applying the event Priority and DropPolicy if stuck
+func (clientSet *clientSet) send(clientChan chan eventsMessage, message eventsMessage) {
+	var priority = eventPriority(message.event)
+	var dropPolicy = clientSet.config.DropPolicy
+
+	if priority == PriorityLow && len(clientChan) >= clientSet.lowPriorityBuffer(clientChan) {
+		clientSet.stats.update(func(stats *EventStats) {
+			stats.DroppedEvents++
+		})
+
+		return
+	} else if priority == PriorityHigh && dropPolicy == DropClient {
+		dropPolicy = DropOldest
+	}
+
+	select {
+	case clientChan <- message:
+		return
 	default:
-		// client dropped behind
-		clientSet.drop(clientChan)
 	}
+
+	// client dropped behind
+	clientSet.stats.update(func(stats *EventStats) {
+		stats.Overflows++
+	})
+
+	switch dropPolicy {
+	case DropOldest:
+		select {
+		case <-clientChan:
+			clientSet.stats.update(func(stats *EventStats) {
+				stats.DroppedEvents++
+			})
+		default:
+		}
+
+		select {
+		case clientChan <- message:
+			return
+		default:
+		}
+
+	case DropBlock:
+		var timer = time.NewTimer(clientSet.config.DropTimeout)
+		defer timer.Stop()
+
+		select {
+		case clientChan <- message:
+			return
+		case <-timer.C:
+		}
+	}
+
+	// pending events, including this one
+	var behind = uint64(len(clientChan)) + 1
+
+	clientSet.stats.update(func(stats *EventStats) {
+		stats.DroppedClients++
+
+		if behind > stats.DroppedBehind {
+			stats.DroppedBehind = behind
+		}
+	})
+
+	clientSet.overflow.dropped(clientSet.clients[clientChan].info, behind)
+
+	if dropFunc := clientSet.config.DropFunc; dropFunc != nil {
+		dropFunc(clientSet.clients[clientChan].info.Request)
+	}
+
+	clientSet.drop(clientChan, DisconnectDropped)
 }
 
-// distribute events to clients, dropping clients if they are stuck
-func (clientSet clientSet) publish(event Event) {
-	for clientChan, _ := range clientSet {
-		clientSet.send(clientChan, event)
+// Return the number of buffered events for shedding PriorityLow events
+func (clientSet *clientSet) lowPriorityBuffer(clientChan chan eventsMessage) int {
+	if clientSet.config.LowPriorityBuffer > 0 {
+		return clientSet.config.LowPriorityBuffer
+	} else {
+		return cap(clientChan) / 2
 	}
 }
 
-func (clientSet clientSet) close() {
-	for clientChan, _ := range clientSet {
-		clientSet.drop(clientChan)
+// Return message for client per the target, topics and FilterFunc, or false to skip
+func (clientSet *clientSet) filter(register eventsRegister, message eventsMessage) (eventsMessage, bool) {
+	if message.target != nil && !message.target(register.info) {
+		return message, false
+	} else if !register.options.Topics.match(message.event) {
+		return message, false
+	} else if clientSet.config.FilterFunc == nil {
+		return message, true
+	} else if event, ok := clientSet.config.FilterFunc(register.info, message.event); !ok {
+		return message, false
+	} else {
+		message.event = event
+
+		return message, true
+	}
+}
+
+// distribute events to clients matching the optional target, dropping clients if they are stuck
+func (clientSet *clientSet) publish(event Event, target func(ClientInfo) bool) {
+	clientSet.seq++
+
+	var message = eventsMessage{seq: clientSet.seq, time: time.Now(), event: event, target: target}
+
+	clientSet.stats.update(func(stats *EventStats) {
+		stats.Published++
+		stats.LastSeq = message.seq
+		stats.LastTime = message.time
+
+		if topicEvent, ok := event.(TopicEvent); !ok {
+
+		} else if stats.PublishedTopics == nil {
+			stats.PublishedTopics = map[string]uint64{topicEvent.Topic: 1}
+		} else {
+			stats.PublishedTopics[topicEvent.Topic]++
+		}
+	})
+
+	if clientSet.config.Journal == nil || target != nil {
+
+	} else if err := clientSet.journal(message); err != nil {
+		eventsLog.Warn("journal append", "err", err)
+	}
+
+	if clientSet.config.History > 0 {
+		clientSet.history = append(clientSet.history, message)
+
+		if len(clientSet.history) > clientSet.config.History {
+			clientSet.history = clientSet.history[1:]
+		}
+	}
+
+	for clientChan, register := range clientSet.clients {
+		if message, ok := clientSet.filter(register, message); ok {
+			clientSet.send(clientChan, message)
+		}
+	}
+}
+
+// send fresh state to all clients, dropping clients if they are stuck
+func (clientSet *clientSet) resync(state func(ClientInfo) State) {
+	for clientChan, register := range clientSet.clients {
+		var message = eventsMessage{seq: clientSet.seq, time: time.Now(), event: clientSet.state, state: true}
+
+		if message.event == nil {
+			message.event = state(register.info)
+		}
+
+		clientSet.send(clientChan, message)
+	}
+}
+
+// update the PublishState, returning the StatePatch to publish, if any
+func (clientSet *clientSet) updateState(state State) (Event, error) {
+	value, err := jsonValue(state)
+	if err != nil {
+		return nil, err
+	}
+
+	var prevState = clientSet.state
+
+	clientSet.state = value
+
+	if prevState == nil {
+		// initial state for new clients
+		return nil, nil
+	} else if patch := diffJSON(nil, "", prevState, value); patch == nil {
+		return nil, nil
+	} else {
+		return StatePatch{patch}, nil
+	}
+}
+
+func (clientSet *clientSet) close() {
+	for clientChan, _ := range clientSet.clients {
+		clientSet.drop(clientChan, DisconnectShutdown)
 	}
 }
 
 type EventConfig struct {
 	// recv from Events
+	//
+	// Use the ClientStateFunc instead to scope the initial state to each client.
 	StateFunc func() State
 
+	// Return the initial state for each client, instead of the StateFunc.
+	// The ClientInfo includes the websocket, SSE or GET request, any authenticated Identity and the decoded QueryFunc object.
+	ClientStateFunc func(client ClientInfo) State
+
+	// Return a new object to decode each client's request query params into using github.com/gorilla/schema, as for
+	// QueryResource, e.g. ?device=42. Passed to the ClientStateFunc and FilterFunc as the ClientInfo.Query.
+	QueryFunc func() interface{}
+
 	// send to Events
 	EventPush <-chan Event
+
+	// Additional chans to send to Events, see AddSource()
+	EventSources []<-chan Event
+
+	// Distribute events between multiple Events instances
+	Backend EventBackend
+
+	// Reconnection delay hint for ServeSSE clients
+	SSERetry time.Duration
+
+	// Maximum time for ServeLongPoll requests to wait for new events, defaults to EVENTS_LONGPOLL_TIMEOUT
+	LongPollTimeout time.Duration
+
+	// Handle JSON messages received from websocket clients, returning an optional reply Event to send to the client.
+	// Any error is sent to the client as a MessageError.
+	MessageFunc func(r *http.Request, message json.RawMessage) (Event, error)
+
+	// Send websocket pings at the given interval, and drop clients that have not responded within PingTimeout.
+	// The PingTimeout defaults to the PingInterval.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	// Reject websocket, SSE and long-poll clients with HTTP 503 once the given number of clients are connected
+	MaxClients int
+
+	// Only send up to the given number of events to websocket clients before waiting for an AckMessage acknowledging the
+	// received sequence numbers, as sent with the Sequence option. Further events are buffered, per the Buffer and DropPolicy.
+	AckWindow int
+
+	// Limit sending to each websocket client to the given number of messages and bytes per second, with the given burst sizes
+	// defaulting to one second's worth. Events are buffered while waiting, per the Buffer and DropPolicy.
+	SendRate      float64
+	SendBurst     int
+	SendByteRate  float64
+	SendByteBurst int
+
+	// Keep disconnected websocket clients registered for the given time, buffering events until they reconnect using the
+	// ?resume=... token sent in the initial state EventMessage. Any events being sent when the client disconnected are lost.
+	ResumeTimeout time.Duration
+
+	// Drop websocket clients that do not accept each write within the timeout, e.g. for stalled TCP connections
+	WriteTimeout time.Duration
+
+	// Send the current state to all clients at the given interval, see Resync()
+	ResyncInterval time.Duration
+
+	// Per-client event buffer, defaults to EVENTS_BUFFER
+	Buffer int
+
+	// Drop PriorityLow events for clients with the given number of events buffered, defaults to half of the Buffer
+	LowPriorityBuffer int
+
+	// Policy for clients whose event buffer is full, defaults to DropClient
+	DropPolicy  DropPolicy
+	DropTimeout time.Duration
+
+	// Called with the client's request, or nil, when a client is dropped for falling behind
+	DropFunc func(r *http.Request)
+
+	// Called when clients are registered and unregistered, blocking any publishing
+	OnConnect    func(client ClientInfo)
+	OnDisconnect func(client ClientInfo, reason DisconnectReason)
+
+	// Keep the given number of recent events for clients to replay on connect using ?history=N, or resume using ?last-id=N
+	History int
+
+	// Store published events, restoring the sequence number and History on startup. Events targeted at specific clients
+	// are not stored. Blocks publishing while writing.
+	Journal EventJournal
+
+	// Wrap websocket events in an EventMessage with the sequence number
+	Sequence bool
+
+	// Wrap the initial websocket state in an EventMessage, in addition to events
+	Envelope bool
+
+	// Include the registered name of each event's Go type in the EventMessage, as the EventType
+	EventTypes EventTypes
+
+	// Additional websocket encodings for state and events, negotiated using the websocket subprotocol, e.g. "msgpack".
+	// Defaults to JSON, with binary frames for []byte and BinaryEvent.
+	Codecs map[string]WebsocketCodec
+
+	// Negotiate permessage-deflate compression with websocket clients, compressing messages of at least CompressionThreshold
+	// bytes using the compress/flate CompressionLevel, defaulting to flate.BestSpeed
+	Compression          bool
+	CompressionThreshold int
+	CompressionLevel     int
+
+	// Reject websocket and SSE requests with HTTP 403 if the Origin header does not match any of the path.Match patterns,
+	// e.g. "https://*.example.com". Requests without any Origin header are allowed.
+	Origins []string
+
+	// Authenticate websocket and SSE requests before the client is registered, returning the identity used for RequestIdentity().
+	// Return an Error with HTTP 401 or 403 to reject the request.
+	AuthFunc func(r *http.Request) (string, error)
+
+	// Delay publishing events for the window, only publishing the most recent event for each CoalesceKey.
+	// The CoalesceKey defaults to the TopicEvent topic; events with an empty key are not coalesced.
+	CoalesceWindow time.Duration
+	CoalesceKey    func(Event) string
+
+	// Filter or transform events for each client, returning false to skip the event
+	FilterFunc func(client ClientInfo, event Event) (Event, bool)
+
+	// Send events received by each websocket client within the window as a single JSON array message of up to BatchSize events
+	BatchWindow time.Duration
+	BatchSize   int
+}
+
+// Websocket message types for EventMessage
+const (
+	EventMessageState = "state"
+	EventMessageEvent = "event"
+)
+
+// Websocket message for EventConfig.Sequence and Envelope
+type EventMessage struct {
+	Type string    `json:"type"`
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Data Event     `json:"data"`
+
+	// Registered EventConfig.EventTypes name of the Data, or the TopicEvent's event
+	EventType string `json:"event_type,omitempty"`
+
+	// Initial state token for EventConfig.ResumeTimeout
+	Token string `json:"token,omitempty"`
+}
+
+// Message sent by websocket clients to acknowledge all events up to the sequence number, for EventConfig.AckWindow
+type AckMessage struct {
+	Ack uint64 `json:"ack"`
+}
+
+// Reply sent to websocket clients for MessageFunc errors
+type MessageError struct {
+	Error string `json:"error"`
 }
 
 // WebSocket publish/subscribe
 type Events struct {
 	config         EventConfig
-	registerChan   chan chan Event
-	unregisterChan chan chan Event
+	registerChan   chan eventsRegister
+	unregisterChan chan chan eventsMessage
+	publishChan    chan eventsPublish
+	resyncChan     chan struct{}
+	clientsChan    chan chan []ClientInfo
+	closeChan      chan struct{}
+	closeOnce      *sync.Once
+
+	// closed once the server has stopped, and closed all clients
+	doneChan chan struct{}
+
+	stats    *eventsStats
+	clientID *uint64
+	sessions *eventsSessions
+
+	// reverse mapping of EventConfig.EventTypes
+	eventTypes map[reflect.Type]string
+
+	// number of connected clients for MaxClients
+	clients *int64
 }
 
-// Publish events from chan
+// Publish events from the optional EventPush chan, or using Publish()
 //
-// Close chan to stop
+// Close the EventPush chan, or use Close() to stop
 func MakeEvents(config EventConfig) Events {
 	events := Events{
 		config:         config,
-		registerChan:   make(chan chan Event),
-		unregisterChan: make(chan chan Event),
+		registerChan:   make(chan eventsRegister),
+		unregisterChan: make(chan chan eventsMessage),
+		publishChan:    make(chan eventsPublish),
+		resyncChan:     make(chan struct{}),
+		clientsChan:    make(chan chan []ClientInfo),
+		closeChan:      make(chan struct{}),
+		closeOnce:      new(sync.Once),
+		doneChan:       make(chan struct{}),
+		stats:          makeEventsStats(),
+		clientID:       new(uint64),
+		sessions:       makeEventsSessions(),
+		clients:        new(int64),
+		eventTypes:     config.EventTypes.names(),
 	}
 
 	go events.run(config)
 
+	for _, source := range config.EventSources {
+		events.AddSource(source)
+	}
+
 	return events
 }
 
 func (events Events) run(config EventConfig) {
-	clients := make(clientSet)
+	clients := makeClientSet(config, events.stats)
 	defer clients.close()
 
-	// panics any subscribed clients
-	defer close(events.registerChan)
-	defer close(events.unregisterChan)
+	if config.Journal == nil {
+
+	} else if err := clients.loadJournal(config.Journal); err != nil {
+		eventsLog.Error("journal load", "err", err)
+	}
+
+	// any further listen() or stop() calls return immediately
+	defer close(events.doneChan)
+
+	var resyncTicker <-chan time.Time
+
+	if config.ResyncInterval > 0 {
+		var ticker = time.NewTicker(config.ResyncInterval)
+		defer ticker.Stop()
+
+		resyncTicker = ticker.C
+	}
+
+	var coalescer = makeEventsCoalescer(config)
+	var coalesceTimer <-chan time.Time
+	var backendChan <-chan Event
+	var publishLocal = func(event Event) {
+		if config.CoalesceWindow == 0 {
+			clients.publish(event, nil)
+		} else {
+			coalescer.push(event)
+
+			if coalesceTimer == nil {
+				coalesceTimer = time.After(config.CoalesceWindow)
+			}
+		}
+	}
+	var publish = func(event Event) {
+		if backendChan == nil {
+			publishLocal(event)
+		} else if err := config.Backend.Publish(event); err != nil {
+			eventsLog.Warn("backend publish", "err", err)
+
+			publishLocal(event)
+		}
+	}
+
+	if config.Backend == nil {
+
+	} else if subscribeChan, err := config.Backend.Subscribe(); err != nil {
+		eventsLog.Error("backend subscribe", "err", err)
+	} else {
+		backendChan = subscribeChan
+	}
+
+	// flush on stop
+	defer func() {
+		for _, event := range coalescer.flush() {
+			clients.publish(event, nil)
+		}
+	}()
 
 	for {
 		select {
-		case clientChan := <-events.registerChan:
-			clients.register(clientChan)
+		case register := <-events.registerChan:
+			register.registeredChan <- clients.register(register)
 
 		case clientChan := <-events.unregisterChan:
 			clients.unregister(clientChan)
@@ -107,16 +840,103 @@ func (events Events) run(config EventConfig) {
 				return
 			}
 
-			// log.Printf("web:Events: publish: %v", event)
+			publish(event)
+
+		case eventsPublish := <-events.publishChan:
+			if eventsPublish.state {
+				if event, err := clients.updateState(eventsPublish.event); err != nil {
+					eventsLog.Warn("publish state", "err", err)
+				} else if event != nil {
+					publish(event)
+				}
+			} else if eventsPublish.target == nil {
+				publish(eventsPublish.event)
+			} else {
+				clients.publish(eventsPublish.event, eventsPublish.target)
+			}
+
+		case event, ok := <-backendChan:
+			if !ok {
+				eventsLog.Warn("backend closed")
+
+				backendChan = nil
+			} else {
+				publishLocal(event)
+			}
+
+		case clientsChan := <-events.clientsChan:
+			clientsChan <- clients.list()
+
+		case <-events.resyncChan:
+			clients.resync(events.state)
+
+		case <-resyncTicker:
+			clients.resync(events.state)
+
+		case <-events.closeChan:
+			return
 
-			clients.publish(event)
+		case <-coalesceTimer:
+			coalesceTimer = nil
+
+			for _, event := range coalescer.flush() {
+				clients.publish(event, nil)
+			}
 		}
 	}
 }
 
+// Publish event to all clients, as an alternative to the EventPush chan
+//
+// Safe to call concurrently, and after the server has stopped.
+func (events Events) Publish(event Event) {
+	events.publish(eventsPublish{event: event})
+}
+
+// Publish events from an additional chan, until the chan is closed
+//
+// Closing the source does not stop the Events.
+func (events Events) AddSource(source <-chan Event) {
+	go func() {
+		for {
+			select {
+			case event, ok := <-source:
+				if !ok {
+					return
+				}
+
+				events.Publish(event)
+
+			case <-events.doneChan:
+				return
+			}
+		}
+	}()
+}
+
+// Send the current state to all clients, e.g. for clients that may have missed events
+//
+// The StateFunc or ClientStateFunc is called for each client, blocking any publishing.
+// Safe to call concurrently, and after the server has stopped.
+func (events Events) Resync() {
+	select {
+	case events.resyncChan <- struct{}{}:
+	case <-events.doneChan:
+	}
+}
+
+// Stop publishing events, closing all clients
+func (events Events) Close() {
+	events.closeOnce.Do(func() {
+		close(events.closeChan)
+	})
+}
+
 // pull current state from sender
-func (events Events) state() State {
-	if events.config.StateFunc != nil {
+func (events Events) state(client ClientInfo) State {
+	if events.config.ClientStateFunc != nil {
+		return events.config.ClientStateFunc(client)
+	} else if events.config.StateFunc != nil {
 		return events.config.StateFunc()
 	} else {
 		return struct{}{}
@@ -124,56 +944,480 @@ func (events Events) state() State {
 }
 
 // each subscriber has its own chan to receive from Events
-type eventsClient chan Event
+type eventsClient chan eventsMessage
 
-// Register new client
+// Register new client for the optional request, with subscription options
 //
 // recv on the returned chan
-func (events Events) listen() (State, eventsClient) {
-	eventChan := make(chan Event, EVENTS_BUFFER)
+func (events Events) listen(r *http.Request, options eventsOptions) (eventsSnapshot, eventsClient) {
+	var buffer = events.config.Buffer
 
-	events.registerChan <- eventChan
+	if buffer == 0 {
+		buffer = EVENTS_BUFFER
+	}
 
-	return events.state(), eventChan
+	var snapshot eventsSnapshot
+	var register = eventsRegister{
+		clientChan:     make(chan eventsMessage, buffer),
+		registeredChan: make(chan eventsSnapshot, 1),
+		disconnect:     new(DisconnectReason),
+		info: ClientInfo{
+			ID:          events.requestClientID(r),
+			ConnectTime: time.Now(),
+			Query:       options.Query,
+			Request:     r,
+		},
+		options: options,
+	}
+
+	if r != nil {
+		register.info.Identity = RequestIdentity(r)
+		register.info.RemoteAddr = r.RemoteAddr
+		register.info.UserAgent = r.UserAgent()
+	}
+
+	select {
+	case events.registerChan <- register:
+		snapshot = <-register.registeredChan
+	case <-events.doneChan:
+		// server has stopped
+		*register.disconnect = DisconnectShutdown
+		snapshot.disconnect = register.disconnect
+
+		close(register.clientChan)
+	}
+
+	if !snapshot.resumed && snapshot.state == nil {
+		snapshot.state = events.state(register.info)
+	}
+
+	return snapshot, register.clientChan
+}
+
+// Reserve a connection for a new client, returning an HTTP 503 error if there are already MaxClients connected
+//
+// Call release() once the client has disconnected.
+func (events Events) acquire() error {
+	if events.config.MaxClients == 0 {
+		return nil
+	} else if clients := atomic.AddInt64(events.clients, 1); clients <= int64(events.config.MaxClients) {
+		return nil
+	}
+
+	atomic.AddInt64(events.clients, -1)
+
+	events.stats.update(func(stats *EventStats) {
+		stats.RejectedClients++
+	})
+
+	return Errorf(http.StatusServiceUnavailable, "Too many clients")
+}
+
+func (events Events) release() {
+	if events.config.MaxClients != 0 {
+		atomic.AddInt64(events.clients, -1)
+	}
 }
 
 // Request server to stop sending us events
 //
-// XXX: panics with send on closed chan if server has stopped
+// Safe to call after the server has stopped, or dropped the client.
 func (events Events) stop(eventsClient eventsClient) {
-	events.unregisterChan <- eventsClient
+	select {
+	case events.unregisterChan <- eventsClient:
+	case <-events.doneChan:
+		// server has stopped, and already closed the client
+	}
+}
+
+// Record sent event
+func (events Events) sent(message eventsMessage) {
+	if message.state {
+		return
+	}
+
+	var duration = time.Since(message.time)
+
+	events.stats.update(func(stats *EventStats) {
+		stats.Sent++
+		stats.SendDuration += duration
+	})
+}
+
+// Return websocket message for event, or resync state
+func (events Events) websocketEvent(message eventsMessage) Event {
+	if message.state {
+		return events.websocketState(eventsSnapshot{seq: message.seq, state: message.event})
+	} else if events.config.Sequence || events.config.Envelope {
+		return events.eventMessage(message)
+	} else {
+		return message.event
+	}
+}
+
+// Return websocket message for initial state
+func (events Events) websocketState(snapshot eventsSnapshot) State {
+	if events.config.Envelope || snapshot.token != "" {
+		return EventMessage{Type: EventMessageState, Seq: snapshot.seq, Time: time.Now(), Data: snapshot.state, Token: snapshot.token}
+	} else {
+		return snapshot.state
+	}
+}
+
+// Send messages to websocket, as a single batch if using BatchWindow
+func (events Events) sendWebsocket(conn *eventsConn, codec WebsocketCodec, messages []eventsMessage) error {
+	if events.config.BatchWindow > 0 {
+		var batch = make([]Event, len(messages))
+
+		for i, message := range messages {
+			batch[i] = events.websocketEvent(message)
+		}
+
+		if err := codec.send(conn, batch); err != nil {
+			return fmt.Errorf("websocket send: %v", err)
+		}
+	} else {
+		for _, message := range messages {
+			if err := codec.send(conn, events.websocketEvent(message)); err != nil {
+				return fmt.Errorf("websocket send: %v", err)
+			}
+		}
+	}
+
+	for _, message := range messages {
+		events.sent(message)
+	}
+
+	return nil
+}
+
+// Websocket close status codes sent to clients dropped by the server
+const (
+	// Server is stopping, see RFC 6455
+	CloseGoingAway = 1001
+
+	// Client fell behind, and must reconnect to resync the state
+	CloseDropped = 4000
+)
+
+// Send a websocket close frame with the status code and reason for the client being dropped by the server
+func (events Events) closeWebsocket(conn *eventsConn, disconnect *DisconnectReason) {
+	var status int
+
+	if disconnect == nil {
+		return
+	} else if *disconnect == DisconnectDropped {
+		status = CloseDropped
+	} else if *disconnect == DisconnectShutdown {
+		status = CloseGoingAway
+	} else {
+		return
+	}
+
+	if err := conn.writeMessage(websocket.CloseMessage, websocket.FormatCloseMessage(status, string(*disconnect))); err != nil {
+		eventsLog.Debug("websocket close", "err", err)
+	}
 }
 
 // Return error if aborting, nil if events closed
-func (eventsClient eventsClient) serveWebsocket(websocketConn *websocket.Conn, state State) error {
+//
+// Waits for acknowledgements on the ackChan when using AckWindow.
+func (events Events) serveWebsocket(ctx context.Context, eventsClient eventsClient, conn *eventsConn, codec WebsocketCodec, snapshot eventsSnapshot, ackChan <-chan uint64) error {
+	var sentSeq, ackSeq = snapshot.seq, snapshot.seq
+
 	// initial state
-	if err := websocket.JSON.Send(websocketConn, state); err != nil {
-		return fmt.Errorf("webSocket.JSON.Send: %v", err)
+	if snapshot.resumed {
+
+	} else if err := codec.send(conn, events.websocketState(snapshot)); err != nil {
+		return fmt.Errorf("websocket send: %v", err)
 	}
 
 	// update events
-	for event := range eventsClient {
-		if err := websocket.JSON.Send(websocketConn, event); err != nil {
-			return fmt.Errorf("webSocket.JSON.Send: %v", err)
+	for {
+		var recvChan = eventsClient
+
+		if events.config.AckWindow > 0 && sentSeq > ackSeq && sentSeq-ackSeq >= uint64(events.config.AckWindow) {
+			// wait for ack
+			recvChan = nil
+		}
+
+		select {
+		case message, ok := <-recvChan:
+			if !ok {
+				events.closeWebsocket(conn, snapshot.disconnect)
+
+				return nil
+			}
+
+			var messages = []eventsMessage{message}
+
+			if events.config.BatchWindow > 0 {
+				messages, ok = events.batch(eventsClient, message)
+			}
+
+			if err := events.sendWebsocket(conn, codec, messages); err != nil {
+				return err
+			} else if !ok {
+				events.closeWebsocket(conn, snapshot.disconnect)
+
+				return nil
+			}
+
+			if seq := messages[len(messages)-1].seq; seq > sentSeq {
+				sentSeq = seq
+			}
+
+		case seq := <-ackChan:
+			if seq > ackSeq {
+				ackSeq = seq
+			}
+
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
+}
 
-	return nil
+// Return the first supported websocket subprotocol offered by the client, if any
+func (events Events) websocketProtocol(r *http.Request) string {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if _, ok := events.config.Codecs[protocol]; ok {
+			return protocol
+		}
+	}
+
+	return ""
 }
 
-// goroutine-safe websocket subscriber
-func (events Events) ServeWebsocket(websocketConn *websocket.Conn) {
-	var state, eventsClient = events.listen()
+// Return codec for the negotiated websocket subprotocol
+func (events Events) websocketCodec(websocketConn *websocket.Conn) WebsocketCodec {
+	if codec, ok := events.config.Codecs[websocketConn.Subprotocol()]; ok {
+		return codec
+	}
 
-	if err := eventsClient.serveWebsocket(websocketConn, state); err != nil {
-		// stop, assuming that server is still alive
-		// will panic if server has stopped
-		events.stop(eventsClient)
+	return eventCodec
+}
+
+// Read messages until the websocket is closed, dispatching them to any MessageFunc, or the ackChan for any AckMessage
+func (events Events) receiveWebsocket(ctx context.Context, conn *eventsConn, codec WebsocketCodec, ackChan chan<- uint64) error {
+	for {
+		var ack AckMessage
+
+		_, message, err := conn.ReadMessage()
+		if _, ok := err.(*websocket.CloseError); ok {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("websocket read: %v", err)
+		}
+
+		conn.activity.touch()
+
+		if ackChan == nil {
+
+		} else if err := json.Unmarshal(message, &ack); err != nil || ack.Ack == 0 {
+			// not an ack
+		} else {
+			select {
+			case ackChan <- ack.Ack:
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		if events.config.MessageFunc == nil {
+			continue
+		}
+
+		reply, err := events.config.MessageFunc(conn.request, json.RawMessage(message))
+
+		if err != nil {
+			reply = MessageError{err.Error()}
+		} else if reply == nil {
+			continue
+		}
+
+		// eventsConn serializes concurrent writes
+		if err := codec.send(conn, reply); err != nil {
+			return fmt.Errorf("websocket send: %v", err)
+		}
+	}
+}
+
+// goroutine-safe websocket subscriber for the upgraded request, until the request context is done or the client disconnects
+//
+// Subscribes to topic patterns given by any ?topic=... query params, and replays ?history=N events or resumes from ?last-id=N.
+//
+// API change: this previously took a golang.org/x/net/websocket *Conn for use as a websocket.Handler, which does not
+// support permessage-deflate compression. Serve the Events using ServeHTTP, which upgrades the request per the
+// EventConfig, or upgrade the request using a github.com/gorilla/websocket Upgrader and pass the upgraded request.
+func (events Events) ServeWebsocket(websocketConn *websocket.Conn, r *http.Request) {
+	defer websocketConn.Close()
+
+	options, err := events.parseOptions(r)
+	if err != nil {
+		eventsLog.Warn("websocket options", "path", r.URL.Path, "client", r.RemoteAddr, "err", err)
+		return
+	}
+
+	// stop on server shutdown
+	var ctx, cancel = context.WithCancel(r.Context())
+	defer cancel()
+
+	var conn = events.makeConn(websocketConn, r)
+	var codec = events.websocketCodec(websocketConn)
+
+	var snapshot eventsSnapshot
+	var eventsClient eventsClient
+	var ackChan chan uint64
+
+	if events.config.ResumeTimeout == 0 {
+		snapshot, eventsClient = events.listen(r, options)
+	} else if resumeSnapshot, resumeClient, ok := events.sessions.take(options.Resume); ok {
+		snapshot, eventsClient = resumeSnapshot, resumeClient
+	} else if token, err := makeResumeToken(); err != nil {
+		eventsLog.Error("websocket resume token", "err", err)
+		return
 	} else {
+		snapshot, eventsClient = events.listen(r, options)
+		snapshot.token = token
+	}
+
+	if events.config.AckWindow > 0 {
+		ackChan = make(chan uint64)
+	}
+
+	// also required to handle control frames
+	go func() {
+		defer cancel()
+
+		if err := events.receiveWebsocket(ctx, conn, codec, ackChan); err != nil && ctx.Err() == nil {
+			eventsLog.Warn("websocket receive", "client", r.RemoteAddr, "err", err)
+		}
+	}()
+
+	if events.config.PingInterval > 0 {
+		go func() {
+			defer cancel()
+
+			if err := events.pingWebsocket(ctx, conn); err != nil {
+				eventsLog.Info("websocket ping", "client", r.RemoteAddr, "err", err)
+			}
+		}()
+	}
+
+	if err := events.serveWebsocket(ctx, eventsClient, conn, events.rateLimitCodec(ctx, codec), snapshot, ackChan); err == nil {
 		// we do not need to request stop, server has unregistered us
+	} else if snapshot.token != "" {
+		events.park(snapshot, eventsClient)
+	} else {
+		events.stop(eventsClient)
 	}
 }
 
+// Check the request Origin and AuthFunc, returning the request with any authenticated identity
+func (events Events) authorize(r *http.Request) (*http.Request, error) {
+	if origin := r.Header.Get("Origin"); origin == "" || events.config.Origins == nil {
+
+	} else if !matchOrigin(events.config.Origins, origin) {
+		return r, Errorf(http.StatusForbidden, "Origin not allowed: %v", origin)
+	}
+
+	if events.config.AuthFunc == nil {
+		return r, nil
+	} else if identity, err := events.config.AuthFunc(r); err != nil {
+		return r, err
+	} else {
+		return WithIdentity(r, identity), nil
+	}
+}
+
+func matchOrigin(patterns []string, origin string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, origin); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Test for a websocket handshake request
+func isWebsocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+
+	for _, value := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(value), "upgrade") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Serve websocket subscribers, or the current state as JSON for other GET requests
 func (events Events) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	websocket.Handler(events.ServeWebsocket).ServeHTTP(w, r)
+	options, err := events.parseOptions(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if authRequest, err := events.authorize(r); err != nil {
+		writeError(w, r, err)
+		return
+	} else {
+		r = events.withClientID(authRequest)
+	}
+
+	if isWebsocket(r) {
+
+	} else if r.Method != "GET" && r.Method != "HEAD" {
+		writeError(w, r, MethodError{Method: r.Method, Allow: []string{"GET"}})
+		return
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+
+		var client = ClientInfo{
+			ID:       RequestClientID(r),
+			Identity: RequestIdentity(r),
+			Query:    options.Query,
+			Request:  r,
+		}
+
+		if err := writeResponse(w, r, events.state(client)); err != nil {
+			eventsLog.Warn("write state", "method", r.Method, "path", r.URL.Path, "client", r.RemoteAddr, "err", err)
+		}
+
+		return
+	}
+
+	if err := events.acquire(); err != nil {
+		writeError(w, r, err)
+		return
+	} else {
+		defer events.release()
+	}
+
+	var upgrader = websocket.Upgrader{
+		// allowed origins are checked by authorize() per the EventConfig.Origins, but browsers always send one
+		CheckOrigin:       func(r *http.Request) bool { return r.Header.Get("Origin") != "" },
+		EnableCompression: events.config.Compression,
+	}
+	var header = make(http.Header)
+
+	if protocol := events.websocketProtocol(r); protocol != "" {
+		header.Set("Sec-WebSocket-Protocol", protocol)
+	}
+
+	websocketConn, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		// upgrader has already responded with an HTTP error
+		eventsLog.Info("websocket upgrade", "path", r.URL.Path, "client", r.RemoteAddr, "err", err)
+		return
+	}
+
+	events.ServeWebsocket(websocketConn, r)
 }
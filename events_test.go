@@ -1,10 +1,23 @@
 package web
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 // run COUNT goroutines to read messages, every 0..INTERVAL
@@ -24,6 +37,13 @@ const WRITER_COUNT = 5
 const EVENT_INTERVAL = 0.001 * float32(time.Second)
 const EVENT_COUNT = 1000
 
+// Dial websocket using the given Origin header
+func dialWebsocket(url string, origin string) (*websocket.Conn, error) {
+	websocketConn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {origin}})
+
+	return websocketConn, err
+}
+
 type testEvent struct {
 	writer int
 }
@@ -95,7 +115,7 @@ func TestEvents(t *testing.T) {
 		for count := 0; count <= READER_COUNT; count++ {
 			time.Sleep(time.Duration(rand.Float32() * READER_INTERVAL))
 
-			_, eventsClient := test.events.listen()
+			_, eventsClient := test.events.listen(nil, eventsOptions{})
 
 			test.waitGroup.Add(1)
 			go test.reader(t, eventsClient)
@@ -117,9 +137,1936 @@ func TestEvents(t *testing.T) {
 		test.writeGroup.Wait()
 
 		t.Log("Completed writers...")
-		//close(test.eventChan)
+		close(test.eventChan)
 	}()
 
 	t.Log("Running...")
 	test.waitGroup.Wait()
 }
+
+func TestEventsSSE(t *testing.T) {
+	var eventChan = make(chan Event)
+	var events = MakeEvents(EventConfig{
+		StateFunc: func() State { return "state" },
+		EventPush: eventChan,
+		SSERetry:  time.Second,
+	})
+	var server = httptest.NewServer(http.HandlerFunc(events.ServeSSE))
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer response.Body.Close()
+
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Content-Type: %v", contentType)
+	}
+
+	var reader = bufio.NewReader(response.Body)
+	var readMessage = func() string {
+		var message string
+
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			} else if line == "\n" {
+				return message
+			} else {
+				message += line
+			}
+		}
+	}
+
+	if message := readMessage(); message != "retry: 1000\n" {
+		t.Errorf("retry: %#v", message)
+	}
+	if message := readMessage(); message != "id: 0\nevent: state\ndata: \"state\"\n" {
+		t.Errorf("state: %#v", message)
+	}
+
+	eventChan <- "test"
+
+	if message := readMessage(); message != "id: 1\ndata: \"test\"\n" {
+		t.Errorf("event: %#v", message)
+	}
+
+	close(eventChan)
+}
+
+func TestEventsTopics(t *testing.T) {
+	var eventChan = make(chan Event)
+	var events = MakeEvents(EventConfig{EventPush: eventChan})
+	defer close(eventChan)
+
+	var _, allClient = events.listen(nil, eventsOptions{})
+	var _, lightsClient = events.listen(nil, eventsOptions{Topics: eventsTopics{"lights/*"}})
+
+	eventChan <- TopicEvent{Topic: "sensors/1", Event: "sensor"}
+	eventChan <- TopicEvent{Topic: "lights/1", Event: "light"}
+	eventChan <- "untagged"
+
+	for _, expected := range []Event{TopicEvent{"sensors/1", "sensor"}, TopicEvent{"lights/1", "light"}, "untagged"} {
+		if message := <-allClient; message.event != expected {
+			t.Errorf("all client: %#v, expected %#v", message.event, expected)
+		}
+	}
+
+	if message := <-lightsClient; message.event != (TopicEvent{"lights/1", "light"}) {
+		t.Errorf("lights client: %#v", message.event)
+	}
+
+	select {
+	case message := <-lightsClient:
+		t.Errorf("lights client: unexpected %#v", message.event)
+	default:
+	}
+}
+
+func TestEventsMessage(t *testing.T) {
+	var eventChan = make(chan Event)
+	var events = MakeEvents(EventConfig{
+		EventPush: eventChan,
+		MessageFunc: func(r *http.Request, message json.RawMessage) (Event, error) {
+			var request struct {
+				Echo string
+			}
+
+			if err := json.Unmarshal(message, &request); err != nil {
+				return nil, err
+			} else if request.Echo == "" {
+				return nil, fmt.Errorf("missing echo")
+			} else {
+				return request.Echo, nil
+			}
+		},
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer close(eventChan)
+
+	websocketConn, err := dialWebsocket("ws"+strings.TrimPrefix(server.URL, "http"), server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	var state State
+	var reply Event
+
+	if err := websocketConn.ReadJSON(&state); err != nil {
+		t.Fatalf("receive state: %v", err)
+	}
+
+	if err := websocketConn.WriteJSON(map[string]string{"Echo": "test"}); err != nil {
+		t.Fatalf("send: %v", err)
+	} else if err := websocketConn.ReadJSON(&reply); err != nil {
+		t.Fatalf("receive: %v", err)
+	} else if reply != "test" {
+		t.Errorf("reply: %#v", reply)
+	}
+
+	if err := websocketConn.WriteJSON(map[string]string{}); err != nil {
+		t.Fatalf("send: %v", err)
+	} else if err := websocketConn.ReadJSON(&reply); err != nil {
+		t.Fatalf("receive: %v", err)
+	} else if reply, ok := reply.(map[string]interface{}); !ok || reply["error"] != "missing echo" {
+		t.Errorf("reply: %#v", reply)
+	}
+}
+
+func TestEventsPing(t *testing.T) {
+	var eventChan = make(chan Event)
+	var events = MakeEvents(EventConfig{
+		EventPush:    eventChan,
+		PingInterval: 10 * time.Millisecond,
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer close(eventChan)
+
+	var url = "ws" + strings.TrimPrefix(server.URL, "http")
+	var state State
+
+	// reading client responds to pings
+	aliveConn, err := dialWebsocket(url, server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer aliveConn.Close()
+
+	// client that never reads does not respond to pings
+	deadConn, err := dialWebsocket(url, server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer deadConn.Close()
+
+	var aliveChan = make(chan Event)
+
+	go func() {
+		defer close(aliveChan)
+
+		for {
+			var event Event
+
+			if err := aliveConn.ReadJSON(&event); err != nil {
+				return
+			}
+
+			aliveChan <- event
+		}
+	}()
+
+	if state := <-aliveChan; state == nil {
+		t.Fatalf("alive client: no state")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	eventChan <- "test"
+
+	if event := <-aliveChan; event != "test" {
+		t.Errorf("alive client: %#v", event)
+	}
+
+	// the dead client has been dropped, and reads the initial state before the connection closes
+	deadConn.SetReadDeadline(time.Now().Add(time.Second))
+
+	if err := deadConn.ReadJSON(&state); err != nil {
+		t.Fatalf("dead client: receive state: %v", err)
+	}
+
+	for {
+		var event Event
+
+		if err := deadConn.ReadJSON(&event); err == nil {
+			t.Errorf("dead client: received %#v", event)
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Fatalf("dead client: not dropped")
+		} else {
+			break
+		}
+	}
+}
+
+func TestEventsStopped(t *testing.T) {
+	var eventChan = make(chan Event)
+	var events = MakeEvents(EventConfig{EventPush: eventChan})
+
+	var _, eventsClient = events.listen(nil, eventsOptions{})
+
+	close(eventChan)
+
+	if _, ok := <-eventsClient; ok {
+		t.Errorf("client not closed")
+	}
+
+	// does not panic
+	events.stop(eventsClient)
+
+	var _, stoppedClient = events.listen(nil, eventsOptions{})
+
+	if _, ok := <-stoppedClient; ok {
+		t.Errorf("client not closed after stop")
+	}
+
+	events.stop(stoppedClient)
+}
+
+func TestEventsDropPolicy(t *testing.T) {
+	var eventChan = make(chan Event)
+	var dropped = make(chan *http.Request, 1)
+	var events = MakeEvents(EventConfig{
+		EventPush:  eventChan,
+		Buffer:     2,
+		DropPolicy: DropOldest,
+		DropFunc:   func(r *http.Request) { dropped <- r },
+	})
+	defer close(eventChan)
+
+	var _, eventsClient = events.listen(nil, eventsOptions{})
+
+	for i := 1; i <= 4; i++ {
+		eventChan <- i
+	}
+
+	// sync
+	events.stop(eventsClient)
+
+	for _, expected := range []Event{3, 4} {
+		if message, ok := <-eventsClient; !ok {
+			t.Fatalf("client dropped")
+		} else if message.event != expected {
+			t.Errorf("event %#v, expected %#v", message.event, expected)
+		}
+	}
+
+	select {
+	case <-dropped:
+		t.Errorf("DropFunc called")
+	default:
+	}
+
+	if stats := events.Stats(); stats.Overflows != 2 || stats.DroppedEvents != 2 || stats.DroppedClients != 0 {
+		t.Errorf("stats: %#v", stats)
+	}
+}
+
+func TestEventsDropBlock(t *testing.T) {
+	var eventChan = make(chan Event)
+	var dropped = make(chan *http.Request, 1)
+	var events = MakeEvents(EventConfig{
+		EventPush:   eventChan,
+		Buffer:      1,
+		DropPolicy:  DropBlock,
+		DropTimeout: 10 * time.Millisecond,
+		DropFunc:    func(r *http.Request) { dropped <- r },
+	})
+	defer close(eventChan)
+
+	var _, eventsClient = events.listen(nil, eventsOptions{})
+
+	eventChan <- 1
+	eventChan <- 2 // blocks until timeout, then drops
+
+	select {
+	case <-dropped:
+	case <-time.After(time.Second):
+		t.Fatalf("DropFunc not called")
+	}
+
+	if stats := events.Stats(); stats.Overflows != 1 || stats.DroppedClients != 1 || stats.DroppedBehind != 2 {
+		t.Errorf("stats: %#v", stats)
+	}
+
+	if message := <-eventsClient; message.event != 1 {
+		t.Errorf("event %#v", message.event)
+	}
+	if _, ok := <-eventsClient; ok {
+		t.Errorf("client not dropped")
+	}
+}
+
+// record everything read from the conn
+type testRecordConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (conn *testRecordConn) Read(buf []byte) (int, error) {
+	n, err := conn.Conn.Read(buf)
+
+	conn.buf.Write(buf[:n])
+
+	return n, err
+}
+
+func TestEventsDisconnect(t *testing.T) {
+	var events = MakeEvents(EventConfig{})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+
+	var recordConn *testRecordConn
+	var dialer = websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			netConn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			recordConn = &testRecordConn{Conn: netConn}
+
+			return recordConn, nil
+		},
+	}
+
+	websocketConn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), http.Header{"Origin": {server.URL}})
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	var state State
+
+	if err := websocketConn.ReadJSON(&state); err != nil {
+		t.Fatalf("websocket.Receive state: %v", err)
+	}
+
+	events.Close()
+
+	if err := websocketConn.ReadJSON(&state); err == nil {
+		t.Fatalf("websocket.Receive: expected error")
+	}
+
+	var closeFrame = append([]byte{0x88, 2 + 8, CloseGoingAway >> 8, CloseGoingAway & 0xff}, "shutdown"...)
+
+	if !bytes.Contains(recordConn.buf.Bytes(), closeFrame) {
+		t.Errorf("close frame not found: %q", recordConn.buf.Bytes())
+	}
+}
+
+type testPriorityEvent struct {
+	Priority Priority
+	Value    string
+}
+
+func (event testPriorityEvent) EventPriority() Priority {
+	return event.Priority
+}
+
+func TestEventsPriority(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		Buffer: 4,
+	})
+	defer events.Close()
+
+	var _, eventsClient = events.listen(nil, eventsOptions{})
+
+	events.Publish(1)
+	events.Publish(2)
+	events.Publish(testPriorityEvent{PriorityLow, "telemetry"})
+	events.Publish(3)
+	events.Publish(4)
+	events.Publish(TopicEvent{"alerts", testPriorityEvent{PriorityHigh, "alert"}})
+
+	// sync
+	events.listen(nil, eventsOptions{})
+
+	for _, expected := range []Event{2, 3, 4, TopicEvent{"alerts", testPriorityEvent{PriorityHigh, "alert"}}} {
+		if message, ok := <-eventsClient; !ok {
+			t.Fatalf("client dropped")
+		} else if message.event != expected {
+			t.Errorf("event %#v, expected %#v", message.event, expected)
+		}
+	}
+
+	if stats := events.Stats(); stats.DroppedEvents != 2 || stats.DroppedClients != 0 {
+		t.Errorf("stats: %#v", stats)
+	}
+}
+
+func TestEventsWriteTimeout(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		WriteTimeout: 50 * time.Millisecond,
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer events.Close()
+
+	websocketConn, err := dialWebsocket("ws"+strings.TrimPrefix(server.URL, "http"), server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	var state State
+
+	if err := websocketConn.ReadJSON(&state); err != nil {
+		t.Fatalf("websocket.Receive state: %v", err)
+	}
+
+	// stall the client until the socket buffers fill up
+	var event = strings.Repeat("x", 1024*1024)
+
+	for i := 0; i < 50; i++ {
+		events.Publish(event)
+	}
+
+	for start := time.Now(); events.Stats().Clients > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("stats: %#v", events.Stats())
+		}
+	}
+}
+
+func TestEventsHistory(t *testing.T) {
+	var eventChan = make(chan Event)
+	var events = MakeEvents(EventConfig{
+		EventPush: eventChan,
+		History:   3,
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer close(eventChan)
+
+	for i := 1; i <= 5; i++ {
+		eventChan <- TopicEvent{Topic: "test", Event: i}
+	}
+
+	websocketConn, err := dialWebsocket("ws"+strings.TrimPrefix(server.URL, "http")+"?history=2", server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	var state State
+
+	if err := websocketConn.ReadJSON(&state); err != nil {
+		t.Fatalf("receive state: %v", err)
+	}
+
+	for _, expected := range []float64{4, 5} {
+		var event TopicEvent
+
+		if err := websocketConn.ReadJSON(&event); err != nil {
+			t.Fatalf("receive: %v", err)
+		} else if event.Event != expected {
+			t.Errorf("event %#v, expected %v", event.Event, expected)
+		}
+	}
+}
+
+func TestEventsResume(t *testing.T) {
+	var eventChan = make(chan Event)
+	var events = MakeEvents(EventConfig{
+		StateFunc: func() State { return "state" },
+		EventPush: eventChan,
+		History:   10,
+		Sequence:  true,
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer close(eventChan)
+
+	for i := 1; i <= 3; i++ {
+		eventChan <- i
+	}
+
+	var url = "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// resume
+	websocketConn, err := dialWebsocket(url+"?last-id=1", server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	for _, expected := range []uint64{2, 3} {
+		var message EventMessage
+
+		if err := websocketConn.ReadJSON(&message); err != nil {
+			t.Fatalf("receive: %v", err)
+		} else if message.Seq != expected || message.Data != float64(expected) {
+			t.Errorf("message %#v, expected seq %v", message, expected)
+		}
+	}
+
+	// unable to resume
+	staleConn, err := dialWebsocket(url+"?last-id=99", server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer staleConn.Close()
+
+	var state State
+
+	if err := staleConn.ReadJSON(&state); err != nil {
+		t.Fatalf("receive: %v", err)
+	} else if state != "state" {
+		t.Errorf("state %#v", state)
+	}
+}
+
+type testBinaryEvent uint16
+
+func (event testBinaryEvent) MarshalEvent() ([]byte, error) {
+	return []byte{byte(event >> 8), byte(event)}, nil
+}
+
+func TestEventsBinary(t *testing.T) {
+	var eventChan = make(chan Event)
+	var events = MakeEvents(EventConfig{EventPush: eventChan})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer close(eventChan)
+
+	websocketConn, err := dialWebsocket("ws"+strings.TrimPrefix(server.URL, "http"), server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	var state State
+
+	if err := websocketConn.ReadJSON(&state); err != nil {
+		t.Fatalf("receive state: %v", err)
+	}
+
+	eventChan <- []byte("raw")
+	eventChan <- testBinaryEvent(0x0102)
+	eventChan <- "text"
+
+	for _, expected := range []string{"2:raw", "2:\x01\x02", "1:\"text\""} {
+		if messageType, data, err := websocketConn.ReadMessage(); err != nil {
+			t.Fatalf("receive: %v", err)
+		} else if frame := fmt.Sprintf("%d:%s", messageType, data); frame != expected {
+			t.Errorf("frame %#v, expected %#v", frame, expected)
+		}
+	}
+}
+
+func TestEventsCodecs(t *testing.T) {
+	var eventChan = make(chan Event)
+	var events = MakeEvents(EventConfig{
+		StateFunc: func() State { return "state" },
+		EventPush: eventChan,
+		Codecs: map[string]WebsocketCodec{
+			"test": BinaryCodec(func(v interface{}) ([]byte, error) {
+				return []byte(fmt.Sprintf("test:%v", v)), nil
+			}),
+		},
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer close(eventChan)
+
+	var dialer = websocket.Dialer{Subprotocols: []string{"other", "test"}}
+
+	websocketConn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), http.Header{"Origin": {server.URL}})
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	if protocol := websocketConn.Subprotocol(); protocol != "test" {
+		t.Errorf("protocol: %#v", protocol)
+	}
+
+	for _, expected := range []string{"test:state", "test:event"} {
+		if _, message, err := websocketConn.ReadMessage(); err != nil {
+			t.Fatalf("receive: %v", err)
+		} else if string(message) != expected {
+			t.Errorf("message %#v, expected %#v", string(message), expected)
+		}
+
+		if expected == "test:state" {
+			eventChan <- "event"
+		}
+	}
+}
+
+func TestEventsCompression(t *testing.T) {
+	var eventChan = make(chan Event)
+	var events = MakeEvents(EventConfig{
+		StateFunc:            func() State { return "state" },
+		EventPush:            eventChan,
+		Compression:          true,
+		CompressionThreshold: 100,
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer close(eventChan)
+
+	var recordConn *testRecordConn
+	var dialer = websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			netConn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			recordConn = &testRecordConn{Conn: netConn}
+
+			return recordConn, nil
+		},
+	}
+
+	websocketConn, response, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), http.Header{"Origin": {server.URL}})
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	if extensions := response.Header.Get("Sec-Websocket-Extensions"); !strings.HasPrefix(extensions, "permessage-deflate") {
+		t.Errorf("extensions: %#v", extensions)
+	}
+
+	var largeEvent = strings.Repeat("compressed", 1000)
+
+	eventChan <- largeEvent
+
+	for _, expected := range []string{"state", largeEvent} {
+		var message string
+
+		if err := websocketConn.ReadJSON(&message); err != nil {
+			t.Fatalf("receive: %v", err)
+		} else if message != expected {
+			t.Errorf("message %#v, expected %#v", message, expected)
+		}
+	}
+
+	// small messages are sent uncompressed, large messages compressed
+	if !bytes.Contains(recordConn.buf.Bytes(), []byte(`"state"`)) {
+		t.Errorf("uncompressed state not found: %q", recordConn.buf.Bytes())
+	}
+
+	if size := recordConn.buf.Len(); size > len(largeEvent)/10 {
+		t.Errorf("read %d bytes for %d byte event", size, len(largeEvent))
+	}
+}
+
+func TestEventsAuthorize(t *testing.T) {
+	var eventChan = make(chan Event)
+	var events = MakeEvents(EventConfig{
+		StateFunc: func() State { return "state" },
+		EventPush: eventChan,
+		Origins:   []string{"https://*.example.com"},
+		AuthFunc: func(r *http.Request) (string, error) {
+			if token := r.URL.Query().Get("token"); token == "" {
+				return "", Errorf(http.StatusUnauthorized, "Missing token")
+			} else if token != "secret" {
+				return "", Errorf(http.StatusForbidden, "Invalid token")
+			} else {
+				return "test", nil
+			}
+		},
+	})
+	defer close(eventChan)
+
+	var server = httptest.NewServer(events)
+	defer server.Close()
+
+	var url = "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for _, test := range []struct {
+		url    string
+		origin string
+		status int
+	}{
+		{url + "?token=secret", "https://www.example.com", 101},
+		{url + "?token=secret", "https://www.example.net", 403},
+		{url, "https://www.example.com", 401},
+		{url + "?token=wrong", "https://www.example.com", 403},
+	} {
+		websocketConn, response, err := websocket.DefaultDialer.Dial(test.url, http.Header{"Origin": {test.origin}})
+
+		if test.status == 101 && err != nil {
+			t.Errorf("%v from %v: %v", test.url, test.origin, err)
+		} else if test.status != 101 && err == nil {
+			t.Errorf("%v from %v: expected HTTP %v", test.url, test.origin, test.status)
+		} else if response == nil {
+			t.Errorf("%v from %v: %v", test.url, test.origin, err)
+		} else if response.StatusCode != test.status {
+			t.Errorf("%v from %v: HTTP %v, expected HTTP %v", test.url, test.origin, response.StatusCode, test.status)
+		}
+
+		if websocketConn != nil {
+			websocketConn.Close()
+		}
+	}
+
+	// SSE requests are also authenticated
+	var sseServer = httptest.NewServer(http.HandlerFunc(events.ServeSSE))
+	defer sseServer.Close()
+
+	response, err := http.Get(sseServer.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET => HTTP %v, expected 401", response.StatusCode)
+	}
+}
+
+func TestEventsStats(t *testing.T) {
+	var eventChan = make(chan Event)
+	var events = MakeEvents(EventConfig{
+		EventPush:  eventChan,
+		Buffer:     1,
+		DropPolicy: DropOldest,
+	})
+	defer close(eventChan)
+
+	var _, eventsClient = events.listen(nil, eventsOptions{})
+
+	eventChan <- 1
+	eventChan <- 2
+
+	// sync
+	events.listen(nil, eventsOptions{})
+
+	if stats := events.Stats(); stats.Clients != 2 || stats.Published != 2 || stats.DroppedEvents != 1 {
+		t.Errorf("stats: %#v", stats)
+	}
+
+	events.stop(eventsClient)
+	events.listen(nil, eventsOptions{})
+
+	if stats := events.Stats(); stats.Clients != 2 {
+		t.Errorf("stats after stop: %#v", stats)
+	}
+}
+
+func TestEventsMaxClients(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		MaxClients: 1,
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer events.Close()
+
+	var url = "ws" + strings.TrimPrefix(server.URL, "http")
+
+	websocketConn, err := dialWebsocket(url, server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	if _, err := dialWebsocket(url, server.URL); err == nil {
+		t.Errorf("websocket.Dial: expected error")
+	}
+
+	if stats := events.Stats(); stats.RejectedClients != 1 {
+		t.Errorf("stats: %#v", stats)
+	}
+
+	if resp, err := http.Get(server.URL); err != nil {
+		t.Fatalf("http.Get: %v", err)
+	} else if resp.Body.Close(); resp.StatusCode != 200 {
+		t.Errorf("http.Get: %v", resp.Status)
+	}
+}
+
+func TestEventsContext(t *testing.T) {
+	var ctx, cancel = context.WithCancel(context.Background())
+	var events = MakeEvents(EventConfig{})
+	var server = httptest.NewUnstartedServer(events)
+
+	server.Config.BaseContext = func(net.Listener) context.Context { return ctx }
+	server.Start()
+
+	defer server.Close()
+	defer events.Close()
+
+	websocketConn, err := dialWebsocket("ws"+strings.TrimPrefix(server.URL, "http"), server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	var state State
+
+	if err := websocketConn.ReadJSON(&state); err != nil {
+		t.Fatalf("websocket.Receive state: %v", err)
+	}
+
+	cancel()
+
+	if err := websocketConn.ReadJSON(&state); err == nil {
+		t.Errorf("websocket.Receive: expected error")
+	}
+
+	// sync
+	events.listen(nil, eventsOptions{})
+
+	if stats := events.Stats(); stats.Clients != 1 {
+		t.Errorf("stats: %#v", stats)
+	}
+}
+
+func TestEventsCoalesce(t *testing.T) {
+	var eventChan = make(chan Event)
+	var events = MakeEvents(EventConfig{
+		EventPush:      eventChan,
+		CoalesceWindow: 10 * time.Millisecond,
+	})
+	defer close(eventChan)
+
+	var _, eventsClient = events.listen(nil, eventsOptions{})
+
+	eventChan <- TopicEvent{"a", 1}
+	eventChan <- TopicEvent{"b", 1}
+	eventChan <- "untagged"
+	eventChan <- TopicEvent{"a", 2}
+
+	for _, expected := range []Event{TopicEvent{"a", 2}, TopicEvent{"b", 1}, "untagged"} {
+		if message := <-eventsClient; message.event != expected {
+			t.Errorf("event %#v, expected %#v", message.event, expected)
+		}
+	}
+}
+
+func TestEventsBatch(t *testing.T) {
+	var eventChan = make(chan Event)
+	var events = MakeEvents(EventConfig{
+		EventPush:   eventChan,
+		BatchWindow: 50 * time.Millisecond,
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer close(eventChan)
+
+	websocketConn, err := dialWebsocket("ws"+strings.TrimPrefix(server.URL, "http"), server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	var state State
+	var batch []Event
+
+	if err := websocketConn.ReadJSON(&state); err != nil {
+		t.Fatalf("receive state: %v", err)
+	}
+
+	eventChan <- "a"
+	eventChan <- "b"
+
+	if err := websocketConn.ReadJSON(&batch); err != nil {
+		t.Fatalf("receive: %v", err)
+	} else if len(batch) != 2 || batch[0] != "a" || batch[1] != "b" {
+		t.Errorf("batch: %#v", batch)
+	}
+}
+
+func TestEventsPublishClient(t *testing.T) {
+	var eventChan = make(chan Event)
+	var events = MakeEvents(EventConfig{EventPush: eventChan})
+	defer close(eventChan)
+
+	var aliceRequest = events.withClientID(WithIdentity(httptest.NewRequest("GET", "/events", nil), "alice"))
+	var bobRequest = events.withClientID(WithIdentity(httptest.NewRequest("GET", "/events", nil), "bob"))
+
+	var _, aliceClient = events.listen(aliceRequest, eventsOptions{})
+	var _, bobClient = events.listen(bobRequest, eventsOptions{})
+
+	events.PublishClient(RequestClientID(aliceRequest), "client")
+	events.PublishIdentity("bob", "identity")
+	events.PublishWhere("where", func(client ClientInfo) bool {
+		return strings.HasPrefix(client.Identity, "a")
+	})
+	eventChan <- "all"
+
+	for _, expected := range []Event{"client", "where", "all"} {
+		if message := <-aliceClient; message.event != expected {
+			t.Errorf("alice: %#v, expected %#v", message.event, expected)
+		}
+	}
+
+	for _, expected := range []Event{"identity", "all"} {
+		if message := <-bobClient; message.event != expected {
+			t.Errorf("bob: %#v, expected %#v", message.event, expected)
+		}
+	}
+}
+
+func TestEventsPublish(t *testing.T) {
+	var events = MakeEvents(EventConfig{})
+	var _, eventsClient = events.listen(nil, eventsOptions{})
+
+	var waitGroup sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+
+			events.Publish(i)
+		}(i)
+	}
+
+	waitGroup.Wait()
+	events.Close()
+
+	var count = 0
+
+	for range eventsClient {
+		count++
+	}
+
+	if count != 10 {
+		t.Errorf("received %d events, expected 10", count)
+	}
+
+	// safe after close
+	events.Publish("closed")
+	events.Close()
+}
+
+func TestEventsPublishResource(t *testing.T) {
+	var events = MakeEvents(EventConfig{})
+	defer events.Close()
+
+	var api = MakeAPI(events.PublishResource())
+	var _, eventsClient = events.listen(nil, eventsOptions{})
+
+	for _, test := range []struct {
+		body   string
+		status int
+	}{
+		{`{"topic": "test", "event": {"value": 1}}`, 204},
+		{`{"event": "untagged"}`, 204},
+		{`{"topic": "test"}`, 422},
+	} {
+		var request = httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+
+		request.Header.Set("Content-Type", "application/json")
+
+		if response, body := testRequest(api, request); response.StatusCode != test.status {
+			t.Errorf("POST %v => HTTP %v: %v", test.body, response.StatusCode, body)
+		}
+	}
+
+	if message := <-eventsClient; fmt.Sprintf("%s", message.event) != `{test {"value": 1}}` {
+		t.Errorf("event: %#v", message.event)
+	}
+	if message := <-eventsClient; fmt.Sprintf("%s", message.event) != `"untagged"` {
+		t.Errorf("event: %#v", message.event)
+	}
+}
+
+func TestEventsStatus(t *testing.T) {
+	var events = MakeEvents(EventConfig{})
+	defer events.Close()
+
+	var api = MakeAPI(events.StatusResource())
+	var _, eventsClient = events.listen(nil, eventsOptions{})
+
+	events.Publish(TopicEvent{Topic: "test", Event: "a"})
+	events.Publish(TopicEvent{Topic: "test", Event: "b"})
+	events.Publish("untagged")
+
+	for i := 0; i < 3; i++ {
+		<-eventsClient
+	}
+
+	var response, body = testRequest(api, httptest.NewRequest("GET", "/", nil))
+	var status EventStatus
+
+	if response.StatusCode != 200 {
+		t.Fatalf("GET => HTTP %v: %v", response.StatusCode, body)
+	} else if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+
+	if status.Clients != 1 || status.Published != 3 || status.LastSeq != 3 || status.LastTime.IsZero() {
+		t.Errorf("status: %#v", status)
+	}
+	if status.PublishedTopics["test"] != 2 || status.TopicRates["test"] <= 0 {
+		t.Errorf("status topics: %#v %#v", status.PublishedTopics, status.TopicRates)
+	}
+}
+
+func TestEventsSubscribe(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		StateFunc: func() State { return "state" },
+	})
+	defer events.Close()
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	var state, messageChan = events.Subscribe(ctx, "lights/*")
+
+	if state.Type != EventMessageState || state.Data != "state" {
+		t.Errorf("state: %#v", state)
+	}
+
+	events.Publish(TopicEvent{"sensors/1", "sensor"})
+	events.Publish(TopicEvent{"lights/1", "light"})
+
+	if message := <-messageChan; message.Type != EventMessageEvent || message.Seq != 2 || message.Data != (TopicEvent{"lights/1", "light"}) {
+		t.Errorf("event: %#v", message)
+	}
+
+	cancel()
+
+	for range messageChan {
+
+	}
+
+	// sync
+	events.listen(nil, eventsOptions{})
+
+	if stats := events.Stats(); stats.Clients != 1 {
+		t.Errorf("stats: %#v", stats)
+	}
+}
+
+type testLightEvent struct {
+	Light string `json:"light"`
+	On    bool   `json:"on"`
+}
+
+func TestEventsEventTypes(t *testing.T) {
+	var eventTypes = EventTypes{"light": testLightEvent{}}
+	var events = MakeEvents(EventConfig{EventTypes: eventTypes})
+	defer events.Close()
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	var _, messageChan = events.Subscribe(ctx)
+
+	events.Publish(TopicEvent{Topic: "lights", Event: &testLightEvent{"test", true}})
+	events.Publish("untyped")
+
+	if message := <-messageChan; message.EventType != "light" {
+		t.Errorf("event type: %#v", message)
+	} else if buf, err := json.Marshal(message.Data.(TopicEvent).Event); err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	} else if event, err := eventTypes.Decode(message.EventType, buf); err != nil {
+		t.Errorf("Decode: %v", err)
+	} else if event != (testLightEvent{"test", true}) {
+		t.Errorf("Decode: %#v", event)
+	}
+
+	if message := <-messageChan; message.EventType != "" {
+		t.Errorf("event type: %#v", message)
+	}
+
+	if _, err := eventTypes.Decode("unknown", []byte(`{}`)); err == nil {
+		t.Errorf("Decode unknown type")
+	}
+}
+
+func TestEventHubs(t *testing.T) {
+	var hubs = MakeEventHubs(map[string]EventConfig{
+		"lights":  {StateFunc: func() State { return "lights" }},
+		"sensors": {StateFunc: func() State { return "sensors" }},
+	})
+	defer hubs.Close()
+
+	var route = Options{}.RouteEventHubs("/events/", hubs)
+
+	for _, test := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/events/lights", 200, `"lights"`},
+		{"/events/sensors", 200, `"sensors"`},
+		{"/events/other", 404, ""},
+	} {
+		var response, body = testRequest(route.Handler, httptest.NewRequest("GET", test.path, nil))
+
+		if response.StatusCode != test.status {
+			t.Errorf("GET %v => HTTP %v", test.path, response.StatusCode)
+		} else if test.body != "" && strings.TrimSpace(body) != test.body {
+			t.Errorf("GET %v => %v", test.path, body)
+		}
+	}
+}
+
+func TestEventsSources(t *testing.T) {
+	var sourceA = make(chan Event)
+	var sourceB = make(chan Event)
+	var sourceC = make(chan Event)
+	var events = MakeEvents(EventConfig{EventSources: []<-chan Event{sourceA, sourceB}})
+	defer events.Close()
+
+	var _, eventsClient = events.listen(nil, eventsOptions{})
+
+	events.AddSource(sourceC)
+
+	sourceA <- "a"
+	close(sourceA)
+
+	sourceB <- "b"
+	sourceC <- "c"
+
+	var received = make(map[Event]bool)
+
+	for len(received) < 3 {
+		select {
+		case message := <-eventsClient:
+			received[message.event] = true
+		case <-time.After(time.Second):
+			t.Fatalf("timeout: received %v", received)
+		}
+	}
+}
+
+func TestEventsFilter(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		FilterFunc: func(client ClientInfo, event Event) (Event, bool) {
+			if event == "secret" && client.Identity != "admin" {
+				return "redacted", true
+			} else if event == "admin" && client.Identity != "admin" {
+				return nil, false
+			} else {
+				return event, true
+			}
+		},
+	})
+	defer events.Close()
+
+	var _, adminClient = events.listen(WithIdentity(httptest.NewRequest("GET", "/events", nil), "admin"), eventsOptions{})
+	var _, userClient = events.listen(WithIdentity(httptest.NewRequest("GET", "/events", nil), "user"), eventsOptions{})
+
+	events.Publish("admin")
+	events.Publish("secret")
+
+	for _, expected := range []Event{"admin", "secret"} {
+		if message := <-adminClient; message.event != expected {
+			t.Errorf("admin: %#v, expected %#v", message.event, expected)
+		}
+	}
+
+	if message := <-userClient; message.event != "redacted" {
+		t.Errorf("user: %#v", message.event)
+	}
+}
+
+func TestEventsClientState(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		AuthFunc: func(r *http.Request) (string, error) {
+			return r.Header.Get("X-User"), nil
+		},
+		ClientStateFunc: func(client ClientInfo) State {
+			return fmt.Sprintf("%v %v", client.Request.URL.Path, client.Identity)
+		},
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer events.Close()
+
+	websocketConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/lights", http.Header{"Origin": {server.URL}, "X-User": {"test"}})
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	var state State
+
+	if err := websocketConn.ReadJSON(&state); err != nil {
+		t.Fatalf("websocket.Receive state: %v", err)
+	} else if state != "/lights test" {
+		t.Errorf("state: %#v", state)
+	}
+}
+
+func TestEventsClients(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		AuthFunc: func(r *http.Request) (string, error) {
+			return "test", nil
+		},
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer events.Close()
+
+	websocketConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), http.Header{"Origin": {server.URL}, "User-Agent": {"test"}})
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	var state State
+
+	if err := websocketConn.ReadJSON(&state); err != nil {
+		t.Fatalf("websocket.Receive state: %v", err)
+	}
+
+	if clients := events.Clients(); len(clients) != 1 {
+		t.Errorf("clients: %#v", clients)
+	} else if client := clients[0]; client.ID == 0 || client.Identity != "test" || client.RemoteAddr == "" || client.UserAgent != "test" || client.ConnectTime.IsZero() {
+		t.Errorf("client: %#v", client)
+	}
+}
+
+func TestEventsConnect(t *testing.T) {
+	var connectChan = make(chan ClientID, 3)
+	var disconnectChan = make(chan DisconnectReason, 3)
+	var events = MakeEvents(EventConfig{
+		Buffer: 1,
+		OnConnect: func(client ClientInfo) {
+			connectChan <- client.ID
+		},
+		OnDisconnect: func(client ClientInfo, reason DisconnectReason) {
+			disconnectChan <- reason
+		},
+	})
+
+	var _, closedClient = events.listen(nil, eventsOptions{})
+	events.listen(nil, eventsOptions{})
+	events.stop(closedClient)
+
+	events.Publish(1)
+	events.Publish(2)
+
+	events.listen(nil, eventsOptions{})
+	events.Close()
+
+	for _, expected := range []ClientID{1, 2, 3} {
+		if id := <-connectChan; id != expected {
+			t.Errorf("connect %v, expected %v", id, expected)
+		}
+	}
+
+	for _, expected := range []DisconnectReason{DisconnectClosed, DisconnectDropped, DisconnectShutdown} {
+		if reason := <-disconnectChan; reason != expected {
+			t.Errorf("disconnect %v, expected %v", reason, expected)
+		}
+	}
+}
+
+type testEventsQuery struct {
+	Device int `schema:"device"`
+}
+
+func TestEventsQuery(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		QueryFunc: func() interface{} { return &testEventsQuery{} },
+		ClientStateFunc: func(client ClientInfo) State {
+			return fmt.Sprintf("device %d", client.Query.(*testEventsQuery).Device)
+		},
+		FilterFunc: func(client ClientInfo, event Event) (Event, bool) {
+			return event, event == client.Query.(*testEventsQuery).Device
+		},
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer events.Close()
+
+	websocketConn, err := dialWebsocket("ws"+strings.TrimPrefix(server.URL, "http")+"?device=42", server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	var state State
+	var event Event
+
+	if err := websocketConn.ReadJSON(&state); err != nil {
+		t.Fatalf("websocket.Receive state: %v", err)
+	} else if state != "device 42" {
+		t.Errorf("state: %#v", state)
+	}
+
+	events.Publish(1)
+	events.Publish(42)
+
+	if err := websocketConn.ReadJSON(&event); err != nil {
+		t.Fatalf("websocket.Receive event: %v", err)
+	} else if event != float64(42) {
+		t.Errorf("event: %#v", event)
+	}
+
+	if resp, err := http.Get(server.URL + "?device=x"); err != nil {
+		t.Fatalf("http.Get: %v", err)
+	} else if resp.Body.Close(); resp.StatusCode != 422 {
+		t.Errorf("http.Get: %v", resp.Status)
+	}
+}
+
+func TestEventsResync(t *testing.T) {
+	var state = 0
+	var events = MakeEvents(EventConfig{
+		StateFunc: func() State {
+			state++
+
+			return state
+		},
+	})
+	defer events.Close()
+
+	var snapshot, eventsClient = events.listen(nil, eventsOptions{})
+
+	if snapshot.state != 1 {
+		t.Errorf("state: %#v", snapshot.state)
+	}
+
+	events.Publish("event")
+	events.Resync()
+
+	if message := <-eventsClient; message.state || message.event != "event" {
+		t.Errorf("event: %#v", message)
+	}
+	if message := <-eventsClient; !message.state || message.seq != 1 || message.event != 2 {
+		t.Errorf("resync: %#v", message)
+	}
+}
+
+func TestEventsAck(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		AckWindow: 2,
+		Sequence:  true,
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer events.Close()
+
+	websocketConn, err := dialWebsocket("ws"+strings.TrimPrefix(server.URL, "http"), server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	var state State
+	var event EventMessage
+
+	if err := websocketConn.ReadJSON(&state); err != nil {
+		t.Fatalf("websocket.Receive state: %v", err)
+	}
+
+	events.Publish(1)
+	events.Publish(2)
+	events.Publish(3)
+
+	for _, expected := range []uint64{1, 2} {
+		if err := websocketConn.ReadJSON(&event); err != nil {
+			t.Fatalf("websocket.Receive event: %v", err)
+		} else if event.Seq != expected {
+			t.Errorf("event: %#v, expected seq %v", event, expected)
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if stats := events.Stats(); stats.Sent != 2 {
+		t.Errorf("stats before ack: %#v", stats)
+	}
+
+	if err := websocketConn.WriteJSON(AckMessage{Ack: 2}); err != nil {
+		t.Fatalf("websocket.Send ack: %v", err)
+	} else if err := websocketConn.ReadJSON(&event); err != nil {
+		t.Fatalf("websocket.Receive event: %v", err)
+	} else if event.Seq != 3 {
+		t.Errorf("event after ack: %#v", event)
+	}
+}
+
+func TestEventsSendRate(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		SendRate:  20,
+		SendBurst: 1,
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer events.Close()
+
+	websocketConn, err := dialWebsocket("ws"+strings.TrimPrefix(server.URL, "http"), server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	var state State
+	var event Event
+
+	if err := websocketConn.ReadJSON(&state); err != nil {
+		t.Fatalf("websocket.Receive state: %v", err)
+	}
+
+	var startTime = time.Now()
+
+	events.Publish(1)
+	events.Publish(2)
+
+	for i := 0; i < 2; i++ {
+		if err := websocketConn.ReadJSON(&event); err != nil {
+			t.Fatalf("websocket.Receive event: %v", err)
+		}
+	}
+
+	if duration := time.Since(startTime); duration < 75*time.Millisecond {
+		t.Errorf("rate limit: received events after %v", duration)
+	}
+}
+
+func TestEventsResumeToken(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		StateFunc:     func() State { return "state" },
+		ResumeTimeout: time.Second,
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer events.Close()
+
+	var url = "ws" + strings.TrimPrefix(server.URL, "http")
+	var state EventMessage
+	var event Event
+
+	websocketConn, err := dialWebsocket(url, server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+
+	if err := websocketConn.ReadJSON(&state); err != nil {
+		t.Fatalf("websocket.Receive state: %v", err)
+	} else if state.Type != EventMessageState || state.Data != "state" || state.Token == "" {
+		t.Fatalf("state: %#v", state)
+	}
+
+	websocketConn.Close()
+
+	// wait for server to notice disconnect
+	time.Sleep(50 * time.Millisecond)
+
+	events.Publish("missed")
+
+	resumeConn, err := dialWebsocket(url+"?resume="+state.Token, server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer resumeConn.Close()
+
+	if err := resumeConn.ReadJSON(&event); err != nil {
+		t.Fatalf("websocket.Receive event: %v", err)
+	} else if event != "missed" {
+		t.Errorf("event: %#v", event)
+	}
+
+	if stats := events.Stats(); stats.Clients != 1 {
+		t.Errorf("stats: %#v", stats)
+	}
+}
+
+func TestEventsPublishState(t *testing.T) {
+	type testState struct {
+		Name   string            `json:"name"`
+		Lights map[string]int    `json:"lights"`
+		Tags   []string          `json:"tags"`
+		Extra  map[string]string `json:"extra,omitempty"`
+	}
+
+	var events = MakeEvents(EventConfig{})
+	defer events.Close()
+
+	events.PublishState(testState{Name: "test", Lights: map[string]int{"a/1": 1, "b": 2}, Tags: []string{"x"}, Extra: map[string]string{"x": "y"}})
+
+	var snapshot, eventsClient = events.listen(nil, eventsOptions{})
+
+	if state, ok := snapshot.state.(map[string]interface{}); !ok || state["name"] != "test" {
+		t.Errorf("state: %#v", snapshot.state)
+	}
+
+	events.PublishState(testState{Name: "test", Lights: map[string]int{"a/1": 3, "b": 2, "c": 0}, Tags: []string{"x", "y"}})
+	events.PublishState(testState{Name: "test", Lights: map[string]int{"a/1": 3, "b": 2, "c": 0}, Tags: []string{"x", "y"}})
+
+	var message = <-eventsClient
+	var expected = []PatchOperation{
+		{Op: "remove", Path: "/extra"},
+		{Op: "replace", Path: "/lights/a~11", Value: float64(3)},
+		{Op: "add", Path: "/lights/c", Value: float64(0)},
+		{Op: "replace", Path: "/tags", Value: []interface{}{"x", "y"}},
+	}
+
+	if patch, ok := message.event.(StatePatch); !ok {
+		t.Fatalf("event: %#v", message.event)
+	} else if len(patch.Patch) != len(expected) {
+		t.Fatalf("patch: %#v", patch.Patch)
+	} else {
+		for i, op := range patch.Patch {
+			if op.Op != expected[i].Op || op.Path != expected[i].Path || fmt.Sprint(op.Value) != fmt.Sprint(expected[i].Value) {
+				t.Errorf("patch[%d]: %#v, expected %#v", i, op, expected[i])
+			}
+		}
+	}
+
+	select {
+	case message := <-eventsClient:
+		t.Errorf("unexpected patch: %#v", message.event)
+	default:
+	}
+}
+
+func TestEventsEnvelope(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		StateFunc: func() State { return "state" },
+		Envelope:  true,
+	})
+	var server = httptest.NewServer(events)
+	defer server.Close()
+	defer events.Close()
+
+	events.Publish("before")
+
+	websocketConn, err := dialWebsocket("ws"+strings.TrimPrefix(server.URL, "http"), server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer websocketConn.Close()
+
+	var state, event EventMessage
+
+	if err := websocketConn.ReadJSON(&state); err != nil {
+		t.Fatalf("receive state: %v", err)
+	} else if state.Type != EventMessageState || state.Seq != 1 || state.Data != "state" || state.Time.IsZero() {
+		t.Errorf("state: %#v", state)
+	}
+
+	events.Publish("after")
+
+	if err := websocketConn.ReadJSON(&event); err != nil {
+		t.Fatalf("receive: %v", err)
+	} else if event.Type != EventMessageEvent || event.Seq != 2 || event.Data != "after" || event.Time.IsZero() {
+		t.Errorf("event: %#v", event)
+	}
+}
+
+func TestEventsLongPoll(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		StateFunc:       func() State { return "state" },
+		History:         10,
+		LongPollTimeout: 10 * time.Millisecond,
+	})
+	var server = httptest.NewServer(http.HandlerFunc(events.ServeLongPoll))
+	defer server.Close()
+	defer events.Close()
+
+	var poll = func(query string) LongPollResponse {
+		var response LongPollResponse
+
+		if httpResponse, err := http.Get(server.URL + query); err != nil {
+			t.Fatalf("GET %v: %v", query, err)
+		} else if err := json.NewDecoder(httpResponse.Body).Decode(&response); err != nil {
+			t.Fatalf("GET %v: decode: %v", query, err)
+		} else {
+			httpResponse.Body.Close()
+		}
+
+		return response
+	}
+
+	events.Publish("a")
+
+	if response := poll(""); response.Seq != 1 || response.State != "state" || len(response.Events) != 0 {
+		t.Errorf("initial: %#v", response)
+	}
+
+	// timeout
+	if response := poll("?since=1"); response.Seq != 1 || response.State != nil || len(response.Events) != 0 {
+		t.Errorf("timeout: %#v", response)
+	}
+
+	events.Publish("b")
+	events.Publish("c")
+
+	if response := poll("?since=1"); response.Seq != 3 || response.State != nil || len(response.Events) != 2 {
+		t.Errorf("events: %#v", response)
+	} else if response.Events[0].Data != "b" || response.Events[1].Data != "c" {
+		t.Errorf("events: %#v", response.Events)
+	}
+}
+
+func TestEventsLongPollMaxClients(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		MaxClients:      1,
+		LongPollTimeout: 10 * time.Millisecond,
+	})
+	var serveMux = http.NewServeMux()
+
+	serveMux.Handle("/events", events)
+	serveMux.HandleFunc("/poll", events.ServeLongPoll)
+
+	var server = httptest.NewServer(serveMux)
+	defer server.Close()
+	defer events.Close()
+
+	var poll = func() int {
+		if response, err := http.Get(server.URL + "/poll"); err != nil {
+			t.Fatalf("GET /poll: %v", err)
+			return 0
+		} else {
+			response.Body.Close()
+
+			return response.StatusCode
+		}
+	}
+
+	// each long-poll request releases the client
+	for i := 0; i < 2; i++ {
+		if status := poll(); status != 200 {
+			t.Errorf("GET /poll => HTTP %v", status)
+		}
+	}
+
+	websocketConn, err := dialWebsocket("ws"+strings.TrimPrefix(server.URL, "http")+"/events", server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+
+	if status := poll(); status != 503 {
+		t.Errorf("GET /poll with websocket client => HTTP %v, expected 503", status)
+	}
+
+	if stats := events.Stats(); stats.RejectedClients != 1 {
+		t.Errorf("stats: %#v", stats)
+	}
+
+	websocketConn.Close()
+
+	for start := time.Now(); poll() != 200; {
+		if time.Since(start) > time.Second {
+			t.Fatalf("GET /poll after websocket close => HTTP 503")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEventsLongPollHistory(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		StateFunc:       func() State { return "state" },
+		History:         10,
+		LongPollTimeout: time.Minute,
+	})
+	var server = httptest.NewServer(http.HandlerFunc(events.ServeLongPoll))
+	defer server.Close()
+	defer events.Close()
+
+	var poll = func(query string) LongPollResponse {
+		var response LongPollResponse
+
+		if httpResponse, err := http.Get(server.URL + query); err != nil {
+			t.Fatalf("GET %v: %v", query, err)
+		} else if err := json.NewDecoder(httpResponse.Body).Decode(&response); err != nil {
+			t.Fatalf("GET %v: decode: %v", query, err)
+		} else {
+			httpResponse.Body.Close()
+		}
+
+		return response
+	}
+
+	events.Publish("a")
+	events.Publish("b")
+	events.Publish("c")
+
+	// replayed history is always returned, without waiting for the LongPollTimeout
+	for i := 0; i < 100; i++ {
+		if response := poll("?history=2"); response.Seq != 3 || response.State != "state" || len(response.Events) != 2 {
+			t.Fatalf("history: %#v", response)
+		} else if response.Events[0].Data != "b" || response.Events[1].Data != "c" {
+			t.Fatalf("history: %#v", response.Events)
+		}
+
+		if response := poll("?since=1"); response.Seq != 3 || response.State != nil || len(response.Events) != 2 {
+			t.Fatalf("resume: %#v", response)
+		}
+	}
+}
+
+func TestEventsState(t *testing.T) {
+	var events = MakeEvents(EventConfig{
+		StateFunc: func() State { return map[string]int{"count": 1} },
+	})
+	defer events.Close()
+
+	var request = httptest.NewRequest("GET", "/events", nil)
+	var response = httptest.NewRecorder()
+
+	events.ServeHTTP(response, request)
+
+	if response.Code != 200 {
+		t.Errorf("GET => HTTP %v", response.Code)
+	} else if contentType := response.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("GET => Content-Type %v", contentType)
+	} else if body := response.Body.String(); body != "{\"count\":1}\n" {
+		t.Errorf("GET => %#v", body)
+	}
+
+	response = httptest.NewRecorder()
+	events.ServeHTTP(response, httptest.NewRequest("POST", "/events", nil))
+
+	if response.Code != 405 {
+		t.Errorf("POST => HTTP %v", response.Code)
+	}
+}
+
+// in-memory EventBackend shared between multiple Events
+type testBackend struct {
+	mutex       sync.Mutex
+	subscribers []chan Event
+}
+
+func (backend *testBackend) Publish(event Event) error {
+	buf, err := MarshalBackendEvent(event)
+	if err != nil {
+		return err
+	}
+
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	for _, subscriber := range backend.subscribers {
+		if event, err := UnmarshalBackendEvent(buf); err != nil {
+			return err
+		} else {
+			subscriber <- event
+		}
+	}
+
+	return nil
+}
+
+func (backend *testBackend) Subscribe() (<-chan Event, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	var subscriber = make(chan Event, 10)
+
+	backend.subscribers = append(backend.subscribers, subscriber)
+
+	return subscriber, nil
+}
+
+func TestEventsJournal(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "events.journal")
+
+	journal, err := OpenFileJournal(path, 3, 0)
+	if err != nil {
+		t.Fatalf("OpenFileJournal: %v", err)
+	}
+
+	var events = MakeEvents(EventConfig{Journal: journal})
+
+	for _, event := range []Event{"a", TopicEvent{"test", "b"}, "c", "d"} {
+		events.Publish(event)
+	}
+
+	events.Close()
+	<-events.doneChan
+	journal.Close()
+
+	// restart
+	journal, err = OpenFileJournal(path, 3, 0)
+	if err != nil {
+		t.Fatalf("OpenFileJournal: %v", err)
+	}
+	defer journal.Close()
+
+	events = MakeEvents(EventConfig{Journal: journal, History: 2})
+	defer events.Close()
+
+	var snapshot, eventsClient = events.listen(nil, eventsOptions{History: 2})
+
+	if snapshot.seq != 4 {
+		t.Errorf("snapshot seq %v", snapshot.seq)
+	}
+
+	for _, expected := range []string{`"c"`, `"d"`} {
+		if message := <-eventsClient; string(message.event.(json.RawMessage)) != expected {
+			t.Errorf("history: %#v, expected %v", message.event, expected)
+		}
+	}
+
+	var api = MakeAPI(MakeJournalResource(journal))
+	var response, body = testRequest(api, httptest.NewRequest("GET", "/?since=1&limit=1", nil))
+	var messages []EventMessage
+
+	if response.StatusCode != 200 {
+		t.Fatalf("GET => HTTP %v: %v", response.StatusCode, body)
+	} else if err := json.Unmarshal([]byte(body), &messages); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	} else if len(messages) != 1 || messages[0].Seq != 2 || fmt.Sprint(messages[0].Data) != "map[event:b topic:test]" {
+		t.Errorf("GET => %#v", messages)
+	}
+}
+
+func TestFileJournalCompact(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "events.journal")
+
+	journal, err := OpenFileJournal(path, 2, 0)
+	if err != nil {
+		t.Fatalf("OpenFileJournal: %v", err)
+	}
+	defer journal.Close()
+
+	for seq := uint64(1); seq <= 6; seq++ {
+		if err := journal.Append(JournalEntry{Seq: seq, Time: time.Now(), Event: json.RawMessage(`null`)}); err != nil {
+			t.Fatalf("Append %d: %v", seq, err)
+		}
+	}
+
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("compacted tmp file: %v", err)
+	}
+
+	// entries are on disk without closing the journal
+	reopened, err := OpenFileJournal(path, 0, 0)
+	if err != nil {
+		t.Fatalf("OpenFileJournal: %v", err)
+	}
+	defer reopened.Close()
+
+	var seqs []uint64
+
+	if entries, err := reopened.Read(0, 0); err != nil {
+		t.Fatalf("Read: %v", err)
+	} else {
+		for _, entry := range entries {
+			seqs = append(seqs, entry.Seq)
+		}
+	}
+
+	// compacted to the last 2 entries at 5, with 6 appended to the rewritten file
+	if fmt.Sprint(seqs) != "[4 5 6]" {
+		t.Errorf("journal file entries: %v", seqs)
+	}
+}
+
+func TestEventsBackend(t *testing.T) {
+	var backend = new(testBackend)
+	var events1 = MakeEvents(EventConfig{Backend: backend})
+	var events2 = MakeEvents(EventConfig{Backend: backend})
+	defer events1.Close()
+	defer events2.Close()
+
+	var _, client1 = events1.listen(nil, eventsOptions{})
+	var _, client2 = events2.listen(nil, eventsOptions{Topics: eventsTopics{"test"}})
+
+	events1.Publish(TopicEvent{Topic: "test", Event: "a"})
+
+	for _, eventsClient := range []eventsClient{client1, client2} {
+		select {
+		case message := <-eventsClient:
+			if topicEvent, ok := message.event.(TopicEvent); !ok || topicEvent.Topic != "test" || string(topicEvent.Event.(json.RawMessage)) != `"a"` {
+				t.Errorf("event: %#v", message.event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+}
+
+func TestEventsMetrics(t *testing.T) {
+	var events = MakeEvents(EventConfig{})
+	defer events.Close()
+
+	var options = Options{Metrics: true}
+	var handler = options.Handler(
+		options.RouteAPI("/api/", MakeAPI(events.StatusResource())),
+		options.RouteEvents("/events", events),
+		options.RouteEventsSSE("/events/sse", events),
+	)
+	var _, eventsClient = events.listen(nil, eventsOptions{})
+
+	events.Publish("test")
+
+	<-eventsClient
+
+	testRequest(handler, httptest.NewRequest("GET", "/api/", nil))
+	testRequest(handler, httptest.NewRequest("GET", "/api/missing", nil))
+
+	var response, body = testRequest(handler, httptest.NewRequest("GET", "/metrics", nil))
+
+	if response.StatusCode != 200 {
+		t.Fatalf("GET /metrics => HTTP %v: %v", response.StatusCode, body)
+	}
+
+	for _, line := range []string{
+		`http_requests_total{route="/api/",method="GET",code="200"} 1`,
+		`http_requests_total{route="/api/",method="GET",code="404"} 1`,
+		`http_request_duration_seconds_count{route="/api/"} 2`,
+		`http_request_duration_seconds_bucket{route="/api/",le="+Inf"} 2`,
+		`http_requests_in_flight{route="/api/"} 0`,
+		`events_clients{events="/events"} 1`,
+		`events_published_total{events="/events"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("GET /metrics missing %#v:\n%v", line, body)
+		}
+	}
+
+	if strings.Contains(body, `events="/events/sse"`) {
+		t.Errorf("GET /metrics duplicate events:\n%v", body)
+	}
+}
@@ -0,0 +1,74 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Registry of stable wire type names for Go event types, e.g. EventTypes{"light": Light{}}, for EventConfig.EventTypes
+//
+// Pointers to a registered type use the same name. Each type should only be registered under a single name.
+type EventTypes map[string]Event
+
+// Return the reverse mapping of Go types to names
+func (types EventTypes) names() map[reflect.Type]string {
+	var names = make(map[reflect.Type]string, len(types))
+
+	for name, event := range types {
+		names[eventType(event)] = name
+	}
+
+	return names
+}
+
+// Return the Go type for the event, dereferencing any pointers
+func eventType(event Event) reflect.Type {
+	var t = reflect.TypeOf(event)
+
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return t
+}
+
+// Decode a JSON event of the given registered type name, returning a value of the registered type
+func (types EventTypes) Decode(name string, data []byte) (Event, error) {
+	event, ok := types[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown event type: %v", name)
+	}
+
+	var value = reflect.New(eventType(event))
+
+	if err := json.Unmarshal(data, value.Interface()); err != nil {
+		return nil, fmt.Errorf("Decode %v event: %v", name, err)
+	}
+
+	return value.Elem().Interface(), nil
+}
+
+// Return the registered EventConfig.EventTypes name for the event, or the TopicEvent's event; empty if not registered
+func (events Events) eventTypeName(event Event) string {
+	if topicEvent, ok := event.(TopicEvent); ok {
+		event = topicEvent.Event
+	}
+
+	if event == nil {
+		return ""
+	} else {
+		return events.eventTypes[eventType(event)]
+	}
+}
+
+// Return EventMessage for event
+func (events Events) eventMessage(message eventsMessage) EventMessage {
+	return EventMessage{
+		Type:      EventMessageEvent,
+		EventType: events.eventTypeName(message.event),
+		Seq:       message.seq,
+		Time:      message.time,
+		Data:      message.event,
+	}
+}
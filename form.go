@@ -0,0 +1,132 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/schema"
+)
+
+// Rewrite form keys like items[0][name] or tags[] into the items.0.name or tags paths used by github.com/gorilla/schema
+var formKeyReplacer = strings.NewReplacer("][", ".", "[", ".", "]", "")
+
+func formKey(key string) string {
+	return strings.TrimSuffix(formKeyReplacer.Replace(key), ".")
+}
+
+// Check if the given struct type uses the given tag for any (nested) field
+func hasStructTag(t reflect.Type, tag string, visited map[reflect.Type]bool) bool {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct || visited[t] {
+		return false
+	}
+
+	visited[t] = true
+
+	for i := 0; i < t.NumField(); i++ {
+		var field = t.Field(i)
+
+		if _, ok := field.Tag.Lookup(tag); ok {
+			return true
+		} else if hasStructTag(field.Type, tag, visited) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Decode form values into object, optionally using the same field names as for encoding/json, per APIConfig.FormJSONNames.
+//
+// Objects using `schema:"..."` tags are always decoded using those tags.
+func decodeForm(object interface{}, form url.Values, jsonNames bool) error {
+	var decoder = schema.NewDecoder()
+	var values = make(url.Values, len(form))
+
+	if !jsonNames {
+
+	} else if !hasStructTag(reflect.TypeOf(object), "schema", make(map[reflect.Type]bool)) {
+		decoder.SetAliasTag("json")
+	}
+
+	for key, value := range form {
+		key = formKey(key)
+
+		values[key] = append(values[key], value...)
+	}
+
+	return decoder.Decode(object, values)
+}
+
+// HTTP 422 error with a JSON body listing each invalid field, as returned for query parameters and form bodies
+type ValidationError struct {
+	Fields map[string]string `json:"fields"`
+}
+
+func (err ValidationError) Error() string {
+	var keys = make([]string, 0, len(err.Fields))
+	var errs = make([]string, 0, len(err.Fields))
+
+	for key := range err.Fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		errs = append(errs, err.Fields[key])
+	}
+
+	return strings.Join(errs, "; ")
+}
+
+// Return ValidationError for all github.com/gorilla/schema errors, or a human-readable error naming the offending field
+func validationError(err error) error {
+	if multiError, ok := err.(schema.MultiError); ok {
+		var validationError = ValidationError{
+			Fields: make(map[string]string, len(multiError)),
+		}
+
+		for key, err := range multiError {
+			validationError.Fields[key] = fieldError(err).Error()
+		}
+
+		return validationError
+	} else {
+		return RequestError(fieldError(err))
+	}
+}
+
+// Return a human-readable error naming the offending field
+func fieldError(err error) error {
+	switch err := err.(type) {
+	case schema.ConversionError:
+		if err.Err != nil {
+			return fmt.Errorf("Invalid value for field %v: %v", err.Key, err.Err)
+		} else {
+			return fmt.Errorf("Invalid value for field %v: expected %v", err.Key, err.Type)
+		}
+
+	case schema.UnknownKeyError:
+		return fmt.Errorf("Unknown field %v", err.Key)
+
+	case schema.EmptyFieldError:
+		return fmt.Errorf("Missing field %v", err.Key)
+
+	case *json.UnmarshalTypeError:
+		return fmt.Errorf("Invalid value for field %v: expected %v, got JSON %v", err.Field, err.Type, err.Value)
+
+	case *json.SyntaxError:
+		return fmt.Errorf("Invalid JSON at offset %d: %v", err.Offset, err)
+
+	default:
+		return err
+	}
+}
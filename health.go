@@ -0,0 +1,122 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Timeout for running the RouteHealth readiness checks
+const HEALTH_TIMEOUT = 5 * time.Second
+
+// Named readiness check for RouteHealth, returning an error if not ready
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// Result of each HealthCheck
+type HealthCheckStatus struct {
+	OK       bool          `json:"ok"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Response for RouteHealth, with the status of each check for readiness
+type HealthStatus struct {
+	OK     bool                         `json:"ok"`
+	Checks map[string]HealthCheckStatus `json:"checks,omitempty"`
+}
+
+// Run the check, subject to the ctx timeout
+func runHealthCheck(ctx context.Context, check HealthCheck) HealthCheckStatus {
+	var startTime = time.Now()
+	var errChan = make(chan error, 1)
+
+	go func() {
+		errChan <- check.Check(ctx)
+	}()
+
+	var err error
+
+	select {
+	case err = <-errChan:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		return HealthCheckStatus{Error: err.Error(), Duration: time.Since(startTime)}
+	} else {
+		return HealthCheckStatus{OK: true, Duration: time.Since(startTime)}
+	}
+}
+
+// Run all checks concurrently
+func runHealthChecks(ctx context.Context, checks []HealthCheck) HealthStatus {
+	var status = HealthStatus{OK: true, Checks: make(map[string]HealthCheckStatus, len(checks))}
+	var mutex sync.Mutex
+	var waitGroup sync.WaitGroup
+
+	ctx, cancel := context.WithTimeout(ctx, HEALTH_TIMEOUT)
+	defer cancel()
+
+	for _, check := range checks {
+		waitGroup.Add(1)
+
+		go func(check HealthCheck) {
+			defer waitGroup.Done()
+
+			var checkStatus = runHealthCheck(ctx, check)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if !checkStatus.OK {
+				serverLog.Warn("health check failed", "check", check.Name, "err", checkStatus.Error)
+
+				status.OK = false
+			}
+
+			status.Checks[check.Name] = checkStatus
+		}(check)
+	}
+
+	waitGroup.Wait()
+
+	return status
+}
+
+func writeHealthStatus(w http.ResponseWriter, r *http.Request, status HealthStatus) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+
+	if !status.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if err := writeResponse(w, r, status); err != nil {
+		serverLog.Warn("write health status", "err", err)
+	}
+}
+
+// Return a route that serves liveness under live, and readiness under ready, e.g. /healthz/ready for "/healthz/".
+//
+// Liveness always returns HTTP 200 without running any checks. Readiness runs each of the checks concurrently,
+// returning HTTP 503 if any check fails or does not return within the HEALTH_TIMEOUT.
+func (options Options) RouteHealth(prefix string, checks ...HealthCheck) Route {
+	return Route{
+		Pattern: prefix,
+		Handler: http.StripPrefix(prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "live":
+				writeHealthStatus(w, r, HealthStatus{OK: true})
+			case "", "ready":
+				writeHealthStatus(w, r, runHealthChecks(r.Context(), checks))
+			default:
+				http.NotFound(w, r)
+			}
+		})),
+	}
+}
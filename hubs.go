@@ -0,0 +1,55 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Independent Events namespaces, each with their own EventConfig, clients and stats.
+//
+// Serves each Events using the first name in the request path, e.g. lights for /events/lights with RouteEventHubs("/events/", ...)
+type EventHubs map[string]Events
+
+func MakeEventHubs(configs map[string]EventConfig) EventHubs {
+	var hubs = make(EventHubs, len(configs))
+
+	for name, config := range configs {
+		hubs[name] = MakeEvents(config)
+	}
+
+	return hubs
+}
+
+// Return Events for the request path, or false if not found
+func (hubs EventHubs) lookup(r *http.Request) (Events, bool) {
+	var name = strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+	var events, ok = hubs[name]
+
+	return events, ok
+}
+
+func (hubs EventHubs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if events, ok := hubs.lookup(r); !ok {
+		writeError(w, r, Errorf(http.StatusNotFound, "Events not found: %v", r.URL.Path))
+	} else {
+		events.ServeHTTP(w, r)
+	}
+}
+
+// Return current statistics for each Events
+func (hubs EventHubs) Stats() map[string]EventStats {
+	var stats = make(map[string]EventStats, len(hubs))
+
+	for name, events := range hubs {
+		stats[name] = events.Stats()
+	}
+
+	return stats
+}
+
+// Stop all Events
+func (hubs EventHubs) Close() {
+	for _, events := range hubs {
+		events.Close()
+	}
+}
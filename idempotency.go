@@ -0,0 +1,240 @@
+package web
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Record response for replay
+type idempotencyResponse struct {
+	key  string
+	hash [sha256.Size]byte
+
+	done   bool
+	expire time.Time
+
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+// Completed response for replay, copied from the idempotencyResponse
+type idempotencyReplay struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (replay idempotencyReplay) write(w http.ResponseWriter) {
+	for key, values := range replay.header {
+		w.Header()[key] = values
+	}
+
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(replay.status)
+	w.Write(replay.body)
+}
+
+// Tee response into idempotencyResponse
+type idempotencyResponseWriter struct {
+	http.ResponseWriter
+
+	response *idempotencyResponse
+}
+
+func (w idempotencyResponseWriter) WriteHeader(status int) {
+	if w.response.status == 0 {
+		w.response.status = status
+		w.response.header = w.Header().Clone()
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w idempotencyResponseWriter) Write(buf []byte) (int, error) {
+	if w.response.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	w.response.body.Write(buf)
+
+	return w.ResponseWriter.Write(buf)
+}
+
+type idempotencyCache struct {
+	ttl time.Duration
+
+	mutex     sync.Mutex
+	responses map[string]*idempotencyResponse
+
+	// completed responses in order of expiry
+	expiry *list.List
+}
+
+func makeIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:       ttl,
+		responses: make(map[string]*idempotencyResponse),
+		expiry:    list.New(),
+	}
+}
+
+// Forget expired responses
+func (cache *idempotencyCache) expire(now time.Time) {
+	for element := cache.expiry.Front(); element != nil; element = cache.expiry.Front() {
+		var response = element.Value.(*idempotencyResponse)
+
+		if now.Before(response.expire) {
+			break
+		}
+
+		cache.expiry.Remove(element)
+
+		delete(cache.responses, response.key)
+	}
+}
+
+// Return any existing response for the key, or reserve the key for a new response
+func (cache *idempotencyCache) reserve(key string) (*idempotencyResponse, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.expire(time.Now())
+
+	if response, exists := cache.responses[key]; exists {
+		return response, false
+	} else {
+		response = &idempotencyResponse{key: key}
+
+		cache.responses[key] = response
+
+		return response, true
+	}
+}
+
+// Store completed response with the request body hash, or forget it to allow retries
+func (cache *idempotencyCache) complete(key string, response *idempotencyResponse, hash [sha256.Size]byte, hashErr error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if response.status == 0 || response.status >= 500 || hashErr != nil {
+		delete(cache.responses, key)
+	} else {
+		response.hash = hash
+		response.done = true
+		response.expire = time.Now().Add(cache.ttl)
+
+		cache.expiry.PushBack(response)
+	}
+}
+
+// Return a copy of the completed response with a matching request body hash, for replay without holding the mutex
+func (cache *idempotencyCache) lookup(response *idempotencyResponse, hash [sha256.Size]byte) (idempotencyReplay, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if !response.done {
+		return idempotencyReplay{}, Errorf(http.StatusConflict, "Request with Idempotency-Key is still in progress")
+	} else if response.hash != hash {
+		return idempotencyReplay{}, RequestErrorf("Idempotency-Key was already used for a different request body")
+	}
+
+	return idempotencyReplay{
+		status: response.status,
+		header: response.header.Clone(),
+		body:   append([]byte(nil), response.body.Bytes()...),
+	}, nil
+}
+
+// Hash the request body as it is streamed to the request handler, without buffering it
+type idempotencyBody struct {
+	io.ReadCloser
+
+	hash hash.Hash
+}
+
+func makeIdempotencyBody(body io.ReadCloser) *idempotencyBody {
+	return &idempotencyBody{ReadCloser: body, hash: sha256.New()}
+}
+
+func (body *idempotencyBody) Read(buf []byte) (int, error) {
+	n, err := body.ReadCloser.Read(buf)
+
+	body.hash.Write(buf[:n])
+
+	return n, err
+}
+
+// Keep the body open for sum(), the http.Server closes the request body
+func (body *idempotencyBody) Close() error {
+	return nil
+}
+
+// Return the hash of the request body, reading any remainder not read by the request handler
+func (body *idempotencyBody) sum() ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	if _, err := io.Copy(body.hash, body.ReadCloser); err != nil {
+		return sum, requestBodyError(err)
+	}
+
+	copy(sum[:], body.hash.Sum(nil))
+
+	return sum, nil
+}
+
+// Serve request, or replay a completed response for the same Idempotency-Key.
+//
+// Fails with HTTP 422 if the Idempotency-Key was used for a request with a different body.
+func (cache *idempotencyCache) serve(w http.ResponseWriter, r *http.Request, key string, limit int64, serve func(w http.ResponseWriter) error) error {
+	key = fmt.Sprintf("%v %v %v: %v", RequestIdentity(r), r.Method, r.URL.Path, key)
+
+	if err := limitBody(r, limit); err != nil {
+		writeError(w, r, err)
+
+		return err
+	}
+
+	var body = makeIdempotencyBody(r.Body)
+
+	r.Body = body
+
+	response, reserved := cache.reserve(key)
+
+	if reserved {
+		var err = serve(idempotencyResponseWriter{w, response})
+
+		hash, hashErr := body.sum()
+
+		cache.complete(key, response, hash, hashErr)
+
+		return err
+	}
+
+	hash, err := body.sum()
+	if err != nil {
+		writeError(w, r, err)
+
+		return err
+	}
+
+	replay, err := cache.lookup(response, hash)
+	if err != nil {
+		writeError(w, r, err)
+
+		return err
+	}
+
+	apiLog.Info("replay Idempotency-Key response", "method", r.Method, "path", r.URL.Path, "status", replay.status)
+
+	replay.write(w)
+
+	return nil
+}
@@ -0,0 +1,332 @@
+package web
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Default ?limit=N for JournalResource
+const JOURNAL_LIMIT = 1000
+
+// Published event, as stored in an EventJournal
+type JournalEntry struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+
+	// Encoded using MarshalBackendEvent
+	Event json.RawMessage `json:"event"`
+}
+
+// Durable storage for published events, used to replay the EventConfig.History and continue the sequence numbers after a
+// restart, and to fetch older events using the JournalResource.
+type EventJournal interface {
+	// Store published event
+	Append(entry JournalEntry) error
+
+	// Return up to limit entries after the given sequence number, oldest first
+	Read(since uint64, limit int) ([]JournalEntry, error)
+
+	// Return the most recent sequence number, or zero if empty
+	Last() (uint64, error)
+}
+
+// Append-only EventJournal using a file of JSON lines, keeping up to the given number of entries within the given age.
+//
+// Entries are also kept in memory. The file is compacted once it contains twice as many entries as retained.
+//
+// Each appended entry is synced to disk before Append returns, and compaction syncs the rewritten file and its
+// directory around the rename, so that a crash does not lose published events.
+type FileJournal struct {
+	mutex      sync.Mutex
+	path       string
+	maxEntries int
+	maxAge     time.Duration
+	file       *os.File
+	entries    []JournalEntry
+	fileCount  int
+}
+
+// Open the journal file, creating it if it does not exist. Use zero for no maxEntries or maxAge limit.
+func OpenFileJournal(path string, maxEntries int, maxAge time.Duration) (*FileJournal, error) {
+	var journal = FileJournal{
+		path:       path,
+		maxEntries: maxEntries,
+		maxAge:     maxAge,
+	}
+
+	if err := journal.load(); err != nil {
+		return nil, err
+	}
+
+	if file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+		return nil, err
+	} else {
+		journal.file = file
+	}
+
+	return &journal, nil
+}
+
+func (journal *FileJournal) load() error {
+	file, err := os.Open(journal.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var scanner = bufio.NewScanner(file)
+
+	scanner.Buffer(nil, 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		var entry JournalEntry
+
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("Invalid journal entry at %v:%d: %v", journal.path, line, err)
+		}
+
+		journal.entries = append(journal.entries, entry)
+		journal.fileCount++
+	}
+
+	journal.expire()
+
+	return scanner.Err()
+}
+
+// Drop entries exceeding the retention limits from memory
+func (journal *FileJournal) expire() {
+	if journal.maxEntries > 0 && len(journal.entries) > journal.maxEntries {
+		journal.entries = journal.entries[len(journal.entries)-journal.maxEntries:]
+	}
+
+	if journal.maxAge > 0 {
+		var expire = time.Now().Add(-journal.maxAge)
+		var i = 0
+
+		for i < len(journal.entries) && journal.entries[i].Time.Before(expire) {
+			i++
+		}
+
+		journal.entries = journal.entries[i:]
+	}
+}
+
+// Sync the directory containing the path, persisting a rename
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// Rewrite the file with only the retained entries
+func (journal *FileJournal) compact() error {
+	var tmpPath = journal.path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	var writer = bufio.NewWriter(file)
+	var encoder = json.NewEncoder(writer)
+
+	for _, entry := range journal.entries {
+		if err := encoder.Encode(entry); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	} else if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	} else if err := os.Rename(tmpPath, journal.path); err != nil {
+		file.Close()
+		return err
+	}
+
+	journal.file.Close()
+	journal.file = file
+	journal.fileCount = len(journal.entries)
+
+	// the renamed file is already in use
+	return syncDir(journal.path)
+}
+
+func (journal *FileJournal) Append(entry JournalEntry) error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	if buf, err := json.Marshal(entry); err != nil {
+		return err
+	} else if _, err := journal.file.Write(append(buf, '\n')); err != nil {
+		return err
+	} else if err := journal.file.Sync(); err != nil {
+		return err
+	}
+
+	journal.entries = append(journal.entries, entry)
+	journal.fileCount++
+	journal.expire()
+
+	if journal.fileCount > 2*len(journal.entries) {
+		return journal.compact()
+	}
+
+	return nil
+}
+
+func (journal *FileJournal) Read(since uint64, limit int) ([]JournalEntry, error) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	var entries []JournalEntry
+
+	for _, entry := range journal.entries {
+		if entry.Seq <= since {
+			continue
+		} else if limit > 0 && len(entries) >= limit {
+			break
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (journal *FileJournal) Last() (uint64, error) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	if len(journal.entries) == 0 {
+		return 0, nil
+	} else {
+		return journal.entries[len(journal.entries)-1].Seq, nil
+	}
+}
+
+func (journal *FileJournal) Close() error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	return journal.file.Close()
+}
+
+// Restore the sequence number and history from the journal
+func (clientSet *clientSet) loadJournal(journal EventJournal) error {
+	last, err := journal.Last()
+	if err != nil {
+		return err
+	}
+
+	clientSet.seq = last
+
+	if clientSet.config.History == 0 || last == 0 {
+		return nil
+	}
+
+	var since uint64
+
+	if last > uint64(clientSet.config.History) {
+		since = last - uint64(clientSet.config.History)
+	}
+
+	entries, err := journal.Read(since, clientSet.config.History)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if event, err := UnmarshalBackendEvent(entry.Event); err != nil {
+			return fmt.Errorf("Invalid journal entry %d: %v", entry.Seq, err)
+		} else {
+			clientSet.history = append(clientSet.history, eventsMessage{seq: entry.Seq, time: entry.Time, event: event})
+		}
+	}
+
+	return nil
+}
+
+// Store published event in the journal
+func (clientSet *clientSet) journal(message eventsMessage) error {
+	if buf, err := MarshalBackendEvent(message.event); err != nil {
+		return err
+	} else {
+		return clientSet.config.Journal.Append(JournalEntry{Seq: message.seq, Time: message.time, Event: buf})
+	}
+}
+
+// Resource returning events from an EventJournal, e.g. api.Mount("_journal", MakeAPI(MakeJournalResource(journal)))
+//
+// Returns the EventMessage for up to ?limit=N events after the ?since=N sequence number, defaulting to JOURNAL_LIMIT.
+type JournalResource struct {
+	journal EventJournal
+}
+
+func MakeJournalResource(journal EventJournal) JournalResource {
+	return JournalResource{journal: journal}
+}
+
+type journalQuery struct {
+	Since uint64 `schema:"since"`
+	Limit int    `schema:"limit"`
+}
+
+type journalRequest struct {
+	journal EventJournal
+	query   journalQuery
+}
+
+// Allow use as the root of a mounted API
+func (resource JournalResource) Index(name string) (Resource, error) {
+	if name == "" {
+		return &journalRequest{journal: resource.journal}, nil
+	} else {
+		return nil, nil
+	}
+}
+
+func (request *journalRequest) QueryREST() interface{} {
+	return &request.query
+}
+
+func (request *journalRequest) GetREST() (Resource, error) {
+	var limit = request.query.Limit
+
+	if limit <= 0 || limit > JOURNAL_LIMIT {
+		limit = JOURNAL_LIMIT
+	}
+
+	entries, err := request.journal.Read(request.query.Since, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages = make([]EventMessage, len(entries))
+
+	for i, entry := range entries {
+		if event, err := UnmarshalBackendEvent(entry.Event); err != nil {
+			return nil, err
+		} else {
+			messages[i] = EventMessage{Type: EventMessageEvent, Seq: entry.Seq, Time: entry.Time, Data: event}
+		}
+	}
+
+	return messages, nil
+}
@@ -0,0 +1,126 @@
+package web
+
+import (
+	"compress/flate"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Time of the last message or pong received from a websocket client
+type connActivity struct {
+	nanos int64
+}
+
+func makeConnActivity() *connActivity {
+	var activity = new(connActivity)
+
+	activity.touch()
+
+	return activity
+}
+
+func (activity *connActivity) touch() {
+	atomic.StoreInt64(&activity.nanos, time.Now().UnixNano())
+}
+
+func (activity *connActivity) since() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&activity.nanos)))
+}
+
+// Upgraded websocket connection, serializing writes from concurrent goroutines
+type eventsConn struct {
+	*websocket.Conn
+
+	request  *http.Request
+	activity *connActivity
+
+	writeMutex           sync.Mutex
+	writeTimeout         time.Duration
+	compressionThreshold int
+}
+
+func (events Events) makeConn(websocketConn *websocket.Conn, r *http.Request) *eventsConn {
+	var conn = eventsConn{
+		Conn:                 websocketConn,
+		request:              r,
+		activity:             makeConnActivity(),
+		writeTimeout:         events.config.WriteTimeout,
+		compressionThreshold: events.config.CompressionThreshold,
+	}
+
+	if events.config.CompressionLevel != 0 {
+		websocketConn.SetCompressionLevel(events.config.CompressionLevel)
+	} else {
+		websocketConn.SetCompressionLevel(flate.BestSpeed)
+	}
+
+	websocketConn.SetReadLimit(WEBSOCKET_READ_LIMIT)
+	websocketConn.SetPongHandler(func(string) error {
+		conn.activity.touch()
+
+		return nil
+	})
+
+	return &conn
+}
+
+// Write a websocket message, setting the WriteTimeout deadline after any marshaling or rate-limiting
+//
+// Only compresses messages of at least the CompressionThreshold, if compression was negotiated.
+func (conn *eventsConn) writeMessage(messageType int, data []byte) error {
+	var deadline time.Time
+
+	if conn.writeTimeout > 0 {
+		deadline = time.Now().Add(conn.writeTimeout)
+	}
+
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	switch messageType {
+	case websocket.CloseMessage, websocket.PingMessage:
+		return conn.WriteControl(messageType, data, deadline)
+	}
+
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+
+	conn.EnableWriteCompression(len(data) >= conn.compressionThreshold)
+
+	return conn.WriteMessage(messageType, data)
+}
+
+// Send pings at the configured interval, returning an error if the client has not responded within the timeout
+func (events Events) pingWebsocket(ctx context.Context, conn *eventsConn) error {
+	var interval = events.config.PingInterval
+	var timeout = events.config.PingTimeout
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	if timeout == 0 {
+		timeout = interval
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+			if since := conn.activity.since(); since > interval+timeout {
+				return fmt.Errorf("websocket ping timeout: no response for %v", since)
+			}
+
+			if err := conn.writeMessage(websocket.PingMessage, nil); err != nil {
+				return fmt.Errorf("websocket ping: %v", err)
+			}
+		}
+	}
+}
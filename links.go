@@ -0,0 +1,87 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Resource that lists its sub-resources for the APIConfig.Links envelope
+type LinksResource interface {
+	// Return names of sub-resources supported by Index()
+	LinksREST() ([]string, error)
+}
+
+type Links struct {
+	Self     string            `json:"self"`
+	Parent   string            `json:"parent,omitempty"`
+	Children map[string]string `json:"children,omitempty"`
+}
+
+// Response envelope used for APIConfig.Links
+type LinksResponse struct {
+	Links    Links    `json:"links"`
+	Resource Resource `json:"resource"`
+}
+
+// Return the URL path prefix stripped from the request by http.StripPrefix, including any trailing /
+func requestPrefix(r *http.Request) string {
+	var requestPath = r.URL.Path
+
+	if r.RequestURI == "" {
+
+	} else if requestURL, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		requestPath = requestURL.Path
+	}
+
+	return strings.TrimSuffix(requestPath, strings.TrimPrefix(r.URL.Path, "/"))
+}
+
+// Return links for the resource at the request path, using the optional LinksResource to list children
+func (api API) makeLinks(r *http.Request, resource LinksResource) (Links, error) {
+	var prefix = requestPrefix(r)
+	var names, err = api.requestPath(r)
+	var path string
+
+	if err != nil {
+		return Links{}, err
+	}
+
+	for i, name := range names {
+		if i > 0 {
+			path += "/"
+		}
+
+		path += url.PathEscape(name)
+	}
+
+	var links = Links{
+		Self: prefix + path,
+	}
+
+	if path == "" {
+
+	} else if i := strings.LastIndex(path, "/"); i >= 0 {
+		links.Parent = prefix + path[:i]
+	} else {
+		links.Parent = prefix
+	}
+
+	if resource == nil {
+		return links, nil
+	} else if childNames, err := resource.LinksREST(); err != nil {
+		return links, err
+	} else {
+		if path != "" && !strings.HasSuffix(path, "/") {
+			path += "/"
+		}
+
+		links.Children = make(map[string]string, len(childNames))
+
+		for _, name := range childNames {
+			links.Children[name] = prefix + path + url.PathEscape(name)
+		}
+	}
+
+	return links, nil
+}
@@ -0,0 +1,160 @@
+package web
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Resource that is locked during requests, serializing mutating requests while allowing concurrent GET requests
+//
+// Also read-locked during the lookup of any sub-resources, and during their requests.
+// Each resource must use a different lock than any of its parents.
+type LockableResource interface {
+	LockREST() *sync.RWMutex
+}
+
+type pathLock struct {
+	sync.RWMutex
+	refs int
+}
+
+// Reference-counted locks per resource path, for APIConfig.Locking
+type pathLocks struct {
+	mutex sync.Mutex
+	locks map[string]*pathLock
+}
+
+func makePathLocks() *pathLocks {
+	return &pathLocks{
+		locks: make(map[string]*pathLock),
+	}
+}
+
+func (locks *pathLocks) get(path string) *pathLock {
+	locks.mutex.Lock()
+	defer locks.mutex.Unlock()
+
+	var lock = locks.locks[path]
+
+	if lock == nil {
+		lock = &pathLock{}
+		locks.locks[path] = lock
+	}
+
+	lock.refs++
+
+	return lock
+}
+
+func (locks *pathLocks) put(path string, lock *pathLock) {
+	locks.mutex.Lock()
+	defer locks.mutex.Unlock()
+
+	if lock.refs--; lock.refs == 0 {
+		delete(locks.locks, path)
+	}
+}
+
+// Lock path for reading or writing, returning func to unlock
+func (locks *pathLocks) lock(path string, write bool) func() {
+	var lock = locks.get(path)
+
+	if write {
+		lock.Lock()
+	} else {
+		lock.RLock()
+	}
+
+	return func() {
+		if write {
+			lock.Unlock()
+		} else {
+			lock.RUnlock()
+		}
+
+		locks.put(path, lock)
+	}
+}
+
+// Locks held by a request, unlocked in reverse order
+type requestLocks struct {
+	mutexes []*sync.RWMutex
+	unlocks []func()
+}
+
+func (locks *requestLocks) push(unlock func()) {
+	locks.unlocks = append(locks.unlocks, unlock)
+}
+
+// Lock the resource mutex for reading or writing, unless already locked for reading as a parent
+func (locks *requestLocks) lockMutex(mutex *sync.RWMutex, write bool) {
+	for _, locked := range locks.mutexes {
+		if locked == mutex && !write {
+			return
+		}
+	}
+
+	locks.mutexes = append(locks.mutexes, mutex)
+
+	if write {
+		mutex.Lock()
+		locks.push(mutex.Unlock)
+	} else {
+		mutex.RLock()
+		locks.push(mutex.RUnlock)
+	}
+}
+
+// Unlock all locks, allowing the request to be unlocked early
+func (locks *requestLocks) unlock() {
+	for i := len(locks.unlocks) - 1; i >= 0; i-- {
+		locks.unlocks[i]()
+	}
+
+	locks.mutexes = nil
+	locks.unlocks = nil
+}
+
+// Return true if the request mutates the resource
+func lockWrite(r *http.Request) bool {
+	return r.Method != "GET" && r.Method != "HEAD"
+}
+
+// Lock the request path for APIConfig.Locking before lookup, read-locking each parent path including the root.
+//
+// Does not lock invalid paths, which fail the lookup.
+func (api API) lockPath(r *http.Request, locks *requestLocks) {
+	if api.locks == nil {
+		return
+	}
+
+	names, err := api.requestPath(r)
+	if err != nil {
+		return
+	}
+
+	// names cannot contain any /
+	var path = ""
+
+	for _, name := range names {
+		locks.push(api.locks.lock(path, false))
+
+		path += name + "/"
+	}
+
+	locks.push(api.locks.lock(path, lockWrite(r)))
+}
+
+// Read-lock any LockableResource before indexing it during lookup
+func (locks *requestLocks) lockParent(resource Resource) {
+	if lockableResource, ok := resource.(LockableResource); ok {
+		locks.lockMutex(lockableResource.LockREST(), false)
+	}
+}
+
+// Lock any resolved LockableResource for the request
+func (locks *requestLocks) lockResource(r *http.Request, resource Resource) {
+	if lockableResource, ok := resource.(LockableResource); ok {
+		locks.lockMutex(lockableResource.LockREST(), lockWrite(r))
+	}
+}
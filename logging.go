@@ -1,11 +1,206 @@
 package web
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
 	"github.com/qmsk/go-logging"
 )
 
-var log logging.Logging
+// Components for per-component log levels
+const (
+	LogAPI    = "api"
+	LogEvents = "events"
+	LogStatic = "static"
+	LogServer = "server"
+)
+
+var logComponents = []string{LogAPI, LogEvents, LogStatic, LogServer}
+
+var logState = struct {
+	mutex   sync.RWMutex
+	handler slog.Handler
+	levels  map[string]slog.Level
+}{
+	handler: loggingHandler{},
+	levels:  make(map[string]slog.Level),
+}
+
+var apiLog = makeLogger(LogAPI)
+var eventsLog = makeLogger(LogEvents)
+var staticLog = makeLogger(LogStatic)
+var serverLog = makeLogger(LogServer)
 
+// Log using the go-logging levels, as free-form messages with key=value fields
 func SetLogging(l logging.Logging) {
-	log = l
+	setLogHandler(loggingHandler{logging: l})
+}
+
+// Log using the slog.Logger, with a "component" field for each message
+func SetLogger(logger *slog.Logger) {
+	setLogHandler(logger.Handler())
+}
+
+// Only log messages at or above the level for the given component, e.g. LogEvents
+func SetLogLevel(component string, level slog.Level) {
+	logState.mutex.Lock()
+	defer logState.mutex.Unlock()
+
+	logState.levels[component] = level
+}
+
+func setLogHandler(handler slog.Handler) {
+	logState.mutex.Lock()
+	defer logState.mutex.Unlock()
+
+	logState.handler = handler
+}
+
+// Parse log levels like "info" for all components, or "info,events=debug" for specific components
+func parseLogLevels(value string) (map[string]slog.Level, error) {
+	var levels = make(map[string]slog.Level)
+
+	for _, field := range strings.Split(value, ",") {
+		var components = logComponents
+		var level slog.Level
+
+		if field == "" {
+			continue
+		} else if i := strings.Index(field, "="); i >= 0 {
+			components = []string{field[:i]}
+			field = field[i+1:]
+		}
+
+		if err := level.UnmarshalText([]byte(field)); err != nil {
+			return nil, fmt.Errorf("Invalid log level %v: %v", field, err)
+		}
+
+		for _, component := range components {
+			levels[component] = level
+		}
+	}
+
+	return levels, nil
+}
+
+func makeLogger(component string) *slog.Logger {
+	return slog.New(componentHandler{component: component})
+}
+
+// Handler applying the component log level, and forwarding to the SetLogging or SetLogger handler
+type componentHandler struct {
+	component string
+
+	// WithAttrs or WithGroup, applied to the current handler
+	with []func(slog.Handler) slog.Handler
+}
+
+func (h componentHandler) handler() (slog.Handler, slog.Level, bool) {
+	logState.mutex.RLock()
+	defer logState.mutex.RUnlock()
+
+	var level, ok = logState.levels[h.component]
+
+	return logState.handler, level, ok
+}
+
+func (h componentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	var handler, minLevel, ok = h.handler()
+
+	if ok && level < minLevel {
+		return false
+	}
+
+	return handler.Enabled(ctx, level)
+}
+
+func (h componentHandler) Handle(ctx context.Context, record slog.Record) error {
+	var handler, _, _ = h.handler()
+
+	handler = handler.WithAttrs([]slog.Attr{slog.String("component", h.component)})
+
+	for _, with := range h.with {
+		handler = with(handler)
+	}
+
+	return handler.Handle(ctx, record)
+}
+
+func (h componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return componentHandler{
+		component: h.component,
+		with:      append(h.with[:len(h.with):len(h.with)], func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) }),
+	}
+}
+
+func (h componentHandler) WithGroup(name string) slog.Handler {
+	return componentHandler{
+		component: h.component,
+		with:      append(h.with[:len(h.with):len(h.with)], func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) }),
+	}
+}
+
+// Handler formatting messages for the go-logging levels; the zero value does not log anything
+type loggingHandler struct {
+	logging logging.Logging
+	attrs   []slog.Attr
+}
+
+func (h loggingHandler) logger(level slog.Level) logging.Logger {
+	switch {
+	case level >= slog.LevelError:
+		return h.logging.Error
+	case level >= slog.LevelWarn:
+		return h.logging.Warn
+	case level >= slog.LevelInfo:
+		return h.logging.Info
+	default:
+		return h.logging.Debug
+	}
+}
+
+func (h loggingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.logger(level) != nil
+}
+
+func (h loggingHandler) Handle(ctx context.Context, record slog.Record) error {
+	var logger = h.logger(record.Level)
+	var message strings.Builder
+
+	if logger == nil {
+		return nil
+	}
+
+	message.WriteString(record.Message)
+
+	var writeAttr = func(attr slog.Attr) bool {
+		fmt.Fprintf(&message, " %v=%v", attr.Key, attr.Value)
+
+		return true
+	}
+
+	for _, attr := range h.attrs {
+		writeAttr(attr)
+	}
+
+	record.Attrs(writeAttr)
+
+	logger.Printf("%s", message.String())
+
+	return nil
+}
+
+func (h loggingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return loggingHandler{
+		logging: h.logging,
+		attrs:   append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...),
+	}
+}
+
+// Groups are not supported
+func (h loggingHandler) WithGroup(name string) slog.Handler {
+	return h
 }
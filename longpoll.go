@@ -0,0 +1,140 @@
+package web
+
+import (
+	"net/http"
+	"time"
+)
+
+// Default timeout for ServeLongPoll
+const EVENTS_LONGPOLL_TIMEOUT = 30 * time.Second
+
+// Response for ServeLongPoll
+type LongPollResponse struct {
+	// Sequence number to use for the next ?since=N request
+	Seq uint64 `json:"seq"`
+
+	// Initial state, if unable to resume from the ?since=N sequence number
+	State State `json:"state,omitempty"`
+
+	Events []EventMessage `json:"events"`
+}
+
+// Collect any buffered messages without waiting
+//
+// Returns false if the client was closed.
+func drainMessages(eventsClient eventsClient, messages []eventsMessage) ([]eventsMessage, bool) {
+	for {
+		select {
+		case message, ok := <-eventsClient:
+			if !ok {
+				return messages, false
+			}
+
+			messages = append(messages, message)
+
+		default:
+			return messages, true
+		}
+	}
+}
+
+// Collect any buffered messages, including any replayed history, or wait up to the timeout for the first message
+//
+// Returns false if the client was closed.
+func (events Events) poll(r *http.Request, eventsClient eventsClient, timeout time.Duration) ([]eventsMessage, bool) {
+	if messages, ok := drainMessages(eventsClient, nil); !ok || len(messages) > 0 || timeout == 0 {
+		return messages, ok
+	}
+
+	var timer = time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case message, ok := <-eventsClient:
+		if !ok {
+			return nil, false
+		}
+
+		return drainMessages(eventsClient, []eventsMessage{message})
+
+	case <-timer.C:
+		return nil, true
+
+	case <-r.Context().Done():
+		return nil, true
+	}
+}
+
+// HTTP long-polling subscriber, for clients that cannot use websockets or SSE
+//
+// Returns a LongPollResponse with the initial state, unless resuming from the ?since=N sequence number given by a previous
+// response using the EventConfig.History. Otherwise blocks for up to the EventConfig.LongPollTimeout for new events.
+// Subscribes to topic patterns given by any ?topic=... query params.
+func (events Events) ServeLongPoll(w http.ResponseWriter, r *http.Request) {
+	options, err := events.parseOptions(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if authRequest, err := events.authorize(r); err != nil {
+		writeError(w, r, err)
+		return
+	} else {
+		r = events.withClientID(authRequest)
+	}
+
+	if err := events.acquire(); err != nil {
+		writeError(w, r, err)
+		return
+	} else {
+		defer events.release()
+	}
+
+	var timeout = events.config.LongPollTimeout
+
+	if timeout == 0 {
+		timeout = EVENTS_LONGPOLL_TIMEOUT
+	}
+
+	var snapshot, eventsClient = events.listen(r, options)
+	var response = LongPollResponse{
+		Seq:    snapshot.seq,
+		Events: []EventMessage{},
+	}
+
+	if !snapshot.resumed {
+		response.State = snapshot.state
+
+		// only return any replayed ?history=N events, without waiting
+		timeout = 0
+	}
+
+	messages, ok := events.poll(r, eventsClient, timeout)
+
+	if ok {
+		events.stop(eventsClient)
+	}
+
+	for _, message := range messages {
+		response.Seq = message.seq
+
+		if message.state {
+			// resync replaces any previous events
+			response.State = message.event
+			response.Events = []EventMessage{}
+
+			continue
+		}
+
+		response.Events = append(response.Events, events.eventMessage(message))
+
+		events.sent(message)
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if err := writeResponse(w, r, response); err != nil {
+		eventsLog.Warn("long-poll", "method", r.Method, "path", r.URL.Path, "client", r.RemoteAddr, "err", err)
+	}
+}
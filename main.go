@@ -5,17 +5,37 @@ import (
 	"net"
 	"net/http"
 	"path"
+	"time"
 )
 
 type Options struct {
-	Listen             string `long:"http-listen" value-name:"[HOST]:PORT | /PATH" default:":8284"`
-	Static             string `long:"http-static" value-name:"PATH"`
-	StaticCacheControl string `long:"http-static-cache-control" value-name:"HEADER-VALUE" default:"no-cache"`
+	Listen             string        `long:"http-listen" env:"HTTP_LISTEN" value-name:"[HOST]:PORT | /PATH" default:":8284"`
+	TLSCert            string        `long:"http-tls-cert" env:"HTTP_TLS_CERT" value-name:"PATH"`
+	TLSKey             string        `long:"http-tls-key" env:"HTTP_TLS_KEY" value-name:"PATH"`
+	ReadTimeout        time.Duration `long:"http-read-timeout" env:"HTTP_READ_TIMEOUT" value-name:"DURATION"`
+	WriteTimeout       time.Duration `long:"http-write-timeout" env:"HTTP_WRITE_TIMEOUT" value-name:"DURATION"`
+	IdleTimeout        time.Duration `long:"http-idle-timeout" env:"HTTP_IDLE_TIMEOUT" value-name:"DURATION"`
+	CORSOrigins        []string      `long:"http-cors-origin" env:"HTTP_CORS_ORIGINS" env-delim:"," value-name:"ORIGIN"`
+	CORSHeaders        []string      `long:"http-cors-header" env:"HTTP_CORS_HEADERS" env-delim:"," value-name:"HEADER"`
+	Static             string        `long:"http-static" env:"HTTP_STATIC" value-name:"PATH"`
+	StaticCacheControl string        `long:"http-static-cache-control" env:"HTTP_STATIC_CACHE_CONTROL" value-name:"HEADER-VALUE" default:"no-cache"`
+	LogLevel           string        `long:"http-log-level" env:"HTTP_LOG_LEVEL" value-name:"[COMPONENT=]LEVEL,..."`
+	Metrics            bool          `long:"http-metrics" env:"HTTP_METRICS"`
+	Debug              bool          `long:"http-debug" env:"HTTP_DEBUG"`
+	DebugLocal         bool          `long:"http-debug-local" env:"HTTP_DEBUG_LOCAL"`
+	DebugToken         string        `long:"http-debug-token" env:"HTTP_DEBUG_TOKEN" value-name:"TOKEN"`
+	APIKeys            string        `long:"http-api-keys" env:"HTTP_API_KEYS" value-name:"PATH"`
+
+	// Trace each route using TraceHandler, if set
+	Tracer Tracer
 }
 
 type Route struct {
 	Pattern string
 	Handler http.Handler
+
+	// served Events by pattern, for --http-metrics
+	events map[string]Events
 }
 
 type CacheFilter struct {
@@ -50,7 +70,7 @@ func (options Options) RouteStatic(prefix string) Route {
 	var handler http.Handler
 
 	if options.Static != "" {
-		log.Infof("Serve %v from %v", prefix, options.Static)
+		staticLog.Info("serve static files", "path", prefix, "dir", options.Static)
 
 		handler = http.FileServer(http.Dir(options.Static))
 
@@ -91,46 +111,139 @@ func (options Options) RouteEvents(url string, events Events) Route {
 	return Route{
 		Pattern: url,
 		Handler: events,
+		events:  map[string]Events{url: events},
 	}
 }
 
-func (options Options) Server(routes ...Route) error {
+// Return a route that serves each of the EventHubs under the prefix, e.g. /events/lights for "/events/"
+func (options Options) RouteEventHubs(prefix string, hubs EventHubs) Route {
+	var route = Route{
+		Pattern: prefix,
+		Handler: http.StripPrefix(prefix, hubs),
+		events:  make(map[string]Events, len(hubs)),
+	}
+
+	for name, events := range hubs {
+		route.events[prefix+name] = events
+	}
+
+	return route
+}
+
+// Return a route that serves events using Server-Sent Events, for clients that cannot use websockets
+func (options Options) RouteEventsSSE(url string, events Events) Route {
+	return Route{
+		Pattern: url,
+		Handler: http.HandlerFunc(events.ServeSSE),
+		events:  map[string]Events{url: events},
+	}
+}
+
+// Return a route that serves events using HTTP long-polling, for clients that cannot use websockets or SSE
+func (options Options) RouteEventsLongPoll(url string, events Events) Route {
+	return Route{
+		Pattern: url,
+		Handler: http.HandlerFunc(events.ServeLongPoll),
+		events:  map[string]Events{url: events},
+	}
+}
+
+// Return a handler serving the routes, skipping any routes without a Handler.
+//
+// Also serves /metrics for --http-metrics, and allows cross-origin requests for --http-cors-origin.
+func (options Options) Handler(routes ...Route) http.Handler {
 	var serveMux = http.NewServeMux()
+	var metrics *Metrics
+
+	if options.Metrics {
+		metrics = MakeMetrics()
+
+		serveMux.Handle("/metrics", metrics)
+	}
 
 	for _, route := range routes {
-		if route.Handler == nil {
+		var handler = route.Handler
+
+		if handler == nil {
 			continue
 		}
 
-		serveMux.Handle(route.Pattern, route.Handler)
+		if metrics != nil {
+			handler = metrics.Handler(route.Pattern, handler)
+
+			for name, events := range route.events {
+				metrics.AddEvents(name, events)
+			}
+		}
+		if options.Tracer != nil {
+			handler = TraceHandler(options.Tracer, route.Pattern, handler)
+		}
+
+		serveMux.Handle(route.Pattern, handler)
 	}
 
-	if options.Listen == "" {
+	if len(options.CORSOrigins) > 0 {
+		return corsHandler{options.CORSOrigins, options.CORSHeaders, serveMux}
+	}
 
-	} else if options.Listen[0] == '/' || options.Listen[0] == '.' {
-		var server = http.Server{
-			Handler: serveMux,
-		}
+	return serveMux
+}
+
+// Apply the --http-log-level= for each component, e.g. "info,events=debug"
+func (options Options) SetLogLevels() error {
+	levels, err := parseLogLevels(options.LogLevel)
+	if err != nil {
+		return fmt.Errorf("Invalid --http-log-level=%v: %v", options.LogLevel, err)
+	}
 
-		log.Infof("Listen on unix:%v...", options.Listen)
+	for component, level := range levels {
+		SetLogLevel(component, level)
+	}
 
-		if listener, err := net.Listen("unix", options.Listen); err != nil {
-			return err
-		} else if err := server.Serve(listener); err != nil {
-			return fmt.Errorf("Server %v: %v", options.Listen, err)
-		}
+	return nil
+}
 
+// Return a server for the --http-read-timeout, --http-write-timeout and --http-idle-timeout.
+//
+// Any --http-write-timeout also applies to websocket and SSE clients.
+func (options Options) httpServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:      handler,
+		ReadTimeout:  options.ReadTimeout,
+		WriteTimeout: options.WriteTimeout,
+		IdleTimeout:  options.IdleTimeout,
+	}
+}
+
+// Serve HTTPS if using --http-tls-cert and --http-tls-key
+func (options Options) serve(server *http.Server, listener net.Listener) error {
+	if options.TLSCert != "" || options.TLSKey != "" {
+		return server.ServeTLS(listener, options.TLSCert, options.TLSKey)
 	} else {
-		var server = http.Server{
-			Addr:    options.Listen,
-			Handler: serveMux,
-		}
+		return server.Serve(listener)
+	}
+}
 
-		log.Infof("Listen on %v...", options.Listen)
+func (options Options) Server(routes ...Route) error {
+	if err := options.SetLogLevels(); err != nil {
+		return err
+	}
 
-		if err := server.ListenAndServe(); err != nil {
-			return fmt.Errorf("ListenAndServe %v: %v", options.Listen, err)
-		}
+	var server = options.httpServer(options.Handler(routes...))
+	var network = "tcp"
+
+	if options.Listen == "" {
+		return nil
+	} else if options.Listen[0] == '/' || options.Listen[0] == '.' {
+		network = "unix"
+	}
+
+	serverLog.Info("listen", "network", network, "addr", options.Listen, "tls", options.TLSCert != "")
+
+	if listener, err := net.Listen(network, options.Listen); err != nil {
+		return err
+	} else if err := options.serve(server, listener); err != nil {
+		return fmt.Errorf("Server %v: %v", options.Listen, err)
 	}
 
 	return nil
@@ -0,0 +1,98 @@
+package web
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Per-request metrics for APIConfig.MetricsFunc
+type APIMetrics struct {
+	Method string
+	Path   string
+
+	// Type of the resolved resource, or empty if the lookup failed.
+	// Suitable as a low-cardinality label for the resource path pattern.
+	Resource string
+
+	Status       int
+	Duration     time.Duration
+	RequestSize  int64 // -1 if unknown
+	ResponseSize int64
+}
+
+// Return HTTP status class, e.g. "2xx"
+func (metrics APIMetrics) StatusClass() string {
+	return fmt.Sprintf("%dxx", metrics.Status/100)
+}
+
+// Record response status and size
+type statusResponseWriter struct {
+	http.ResponseWriter
+
+	status int
+	size   int64
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(buf []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(buf)
+
+	w.size += int64(n)
+
+	return n, err
+}
+
+// Support streaming responses and websockets within the wrapped handler
+func (w *statusResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("http.Hijacker not supported")
+	}
+
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+
+	return hijacker.Hijack()
+}
+
+func (w *statusResponseWriter) metrics(r *http.Request, resource Resource, duration time.Duration) APIMetrics {
+	var metrics = APIMetrics{
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		Status:       w.status,
+		Duration:     duration,
+		RequestSize:  r.ContentLength,
+		ResponseSize: w.size,
+	}
+
+	if resource != nil {
+		metrics.Resource = fmt.Sprintf("%T", resource)
+	}
+
+	if metrics.Status == 0 {
+		metrics.Status = http.StatusOK
+	}
+
+	return metrics
+}
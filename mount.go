@@ -0,0 +1,58 @@
+package web
+
+import (
+	"sort"
+	"strings"
+)
+
+type apiMount struct {
+	names []string
+	api   API
+}
+
+// Return a copy of the API with the given sub-API mounted at the given path, e.g. "plugins/foo".
+//
+// Requests for the mounted path are handled by the sub-API, bypassing the root resource.
+func (api API) Mount(path string, subAPI API) API {
+	var mounts = make([]apiMount, len(api.mounts), len(api.mounts)+1)
+
+	copy(mounts, api.mounts)
+
+	mounts = append(mounts, apiMount{
+		names: strings.Split(strings.Trim(path, "/"), "/"),
+		api:   subAPI,
+	})
+
+	// longest path first
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return len(mounts[i].names) > len(mounts[j].names)
+	})
+
+	api.mounts = mounts
+
+	return api
+}
+
+// Return the longest mount matching the names
+func (api API) lookupMount(names []string) (apiMount, bool) {
+	for _, mount := range api.mounts {
+		if len(names) < len(mount.names) {
+			continue
+		}
+
+		var match = true
+
+		for i, name := range mount.names {
+			if names[i] != name {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			return mount, true
+		}
+	}
+
+	return apiMount{}, false
+}
@@ -0,0 +1,32 @@
+package web
+
+import "golang.org/x/time/rate"
+
+// Log at most this many dropped clients per second, after an initial burst
+const OVERFLOW_LOG_RATE = 1
+const OVERFLOW_LOG_BURST = 10
+
+// Rate-limited logging for clients dropped after overflowing
+type overflowLog struct {
+	limiter    *rate.Limiter
+	suppressed uint64
+}
+
+func makeOverflowLog() *overflowLog {
+	return &overflowLog{
+		limiter: rate.NewLimiter(OVERFLOW_LOG_RATE, OVERFLOW_LOG_BURST),
+	}
+}
+
+// Log dropped client, behind by the given number of pending events
+func (overflowLog *overflowLog) dropped(info ClientInfo, behind uint64) {
+	if !overflowLog.limiter.Allow() {
+		overflowLog.suppressed++
+	} else if overflowLog.suppressed > 0 {
+		eventsLog.Warn("client dropped", "id", info.ID, "identity", info.Identity, "client", info.RemoteAddr, "behind", behind, "suppressed", overflowLog.suppressed)
+
+		overflowLog.suppressed = 0
+	} else {
+		eventsLog.Warn("client dropped", "id", info.ID, "identity", info.Identity, "client", info.RemoteAddr, "behind", behind)
+	}
+}
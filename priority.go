@@ -0,0 +1,31 @@
+package web
+
+// Priority for shedding events when a client's buffer is congested
+type Priority int
+
+const (
+	// Dropped for clients with more than the EventConfig.LowPriorityBuffer events buffered
+	PriorityLow Priority = -1
+
+	// Subject to the EventConfig.DropPolicy
+	PriorityNormal Priority = 0
+
+	// Drops the oldest buffered event instead of the client, if using DropClient
+	PriorityHigh Priority = 1
+)
+
+// Event with a priority other than PriorityNormal, also used for the TopicEvent.Event
+type PriorityEvent interface {
+	EventPriority() Priority
+}
+
+func eventPriority(event Event) Priority {
+	switch event := event.(type) {
+	case PriorityEvent:
+		return event.EventPriority()
+	case TopicEvent:
+		return eventPriority(event.Event)
+	default:
+		return PriorityNormal
+	}
+}
@@ -0,0 +1,82 @@
+package web
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// Serve net/http/pprof under pprof/ and expvar under vars, relative to the stripped prefix
+func serveDebug(w http.ResponseWriter, r *http.Request) {
+	var path = r.URL.Path
+
+	switch {
+	case path == "vars":
+		expvar.Handler().ServeHTTP(w, r)
+	case path == "pprof/cmdline":
+		pprof.Cmdline(w, r)
+	case path == "pprof/profile":
+		pprof.Profile(w, r)
+	case path == "pprof/symbol":
+		pprof.Symbol(w, r)
+	case path == "pprof/trace":
+		pprof.Trace(w, r)
+	case path == "pprof/":
+		pprof.Index(w, r)
+	case strings.HasPrefix(path, "pprof/"):
+		pprof.Handler(strings.TrimPrefix(path, "pprof/")).ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Loopback or unix socket clients, treating any unknown RemoteAddr as remote
+func isLocalRequest(r *http.Request) bool {
+	if _, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); ok {
+		return true
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err != nil {
+		return false
+	} else if ip := net.ParseIP(host); ip == nil {
+		return false
+	} else {
+		return ip.IsLoopback()
+	}
+}
+
+// Require the token using either an Authorization: Bearer header or ?token= query
+func checkDebugToken(r *http.Request, token string) bool {
+	var requestToken = r.URL.Query().Get("token")
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		requestToken = strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(requestToken), []byte(token)) == 1
+}
+
+// Return a route that serves net/http/pprof profiles under pprof/ and expvar variables under vars, e.g. /debug/pprof/ for "/debug/".
+//
+// Only served for --http-debug, skipping the route otherwise. Only serves loopback or unix socket clients for
+// --http-debug-local, and requires the --http-debug-token as a bearer token or ?token= query.
+func (options Options) RouteDebug(prefix string) Route {
+	if !options.Debug {
+		return Route{Pattern: prefix}
+	}
+
+	return Route{
+		Pattern: prefix,
+		Handler: http.StripPrefix(prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if options.DebugLocal && !isLocalRequest(r) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+			} else if options.DebugToken != "" && !checkDebugToken(r, options.DebugToken) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			} else {
+				serveDebug(w, r)
+			}
+		})),
+	}
+}
@@ -0,0 +1,253 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the request duration histogram buckets, in seconds
+var METRICS_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestsKey struct {
+	route  string
+	method string
+	code   int
+}
+
+type durationHistogram struct {
+	buckets []uint64 // per METRICS_BUCKETS, not cumulative
+	count   uint64
+	sum     float64
+}
+
+func (histogram *durationHistogram) observe(duration time.Duration) {
+	var seconds = duration.Seconds()
+
+	for i, bound := range METRICS_BUCKETS {
+		if seconds <= bound {
+			histogram.buckets[i]++
+			break
+		}
+	}
+
+	histogram.count++
+	histogram.sum += seconds
+}
+
+// Collects metrics for HTTP requests per route and the Events served, using the Prometheus text format
+type Metrics struct {
+	mutex     sync.Mutex
+	requests  map[requestsKey]uint64
+	durations map[string]*durationHistogram
+	inFlight  map[string]int64
+
+	// by route pattern, e.g. /events/lights for RouteEventHubs("/events/", ...)
+	events map[string]Events
+}
+
+func MakeMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[requestsKey]uint64),
+		durations: make(map[string]*durationHistogram),
+		inFlight:  make(map[string]int64),
+		events:    make(map[string]Events),
+	}
+}
+
+// Report the EventStats for the Events, unless already added under a different name
+func (metrics *Metrics) AddEvents(name string, events Events) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	for _, e := range metrics.events {
+		if e.stats == events.stats {
+			return
+		}
+	}
+
+	metrics.events[name] = events
+}
+
+func (metrics *Metrics) start(route string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.inFlight[route]++
+}
+
+func (metrics *Metrics) done(key requestsKey, duration time.Duration) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	var histogram = metrics.durations[key.route]
+
+	if histogram == nil {
+		histogram = &durationHistogram{buckets: make([]uint64, len(METRICS_BUCKETS))}
+		metrics.durations[key.route] = histogram
+	}
+
+	metrics.inFlight[key.route]--
+	metrics.requests[key]++
+
+	histogram.observe(duration)
+}
+
+// Return a handler recording the request count, duration and in-flight requests for the route pattern
+func (metrics *Metrics) Handler(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var startTime = time.Now()
+		var statusWriter = &statusResponseWriter{ResponseWriter: w}
+
+		metrics.start(route)
+
+		handler.ServeHTTP(statusWriter, r)
+
+		if statusWriter.status == 0 {
+			statusWriter.status = http.StatusOK
+		}
+
+		metrics.done(requestsKey{route, r.Method, statusWriter.status}, time.Since(startTime))
+	})
+}
+
+var metricsLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Format labels as {name="value",...} from pairs of names and values
+func metricsLabels(labels ...string) string {
+	var parts = make([]string, 0, len(labels)/2)
+
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, labels[i]+`="`+metricsLabelReplacer.Replace(labels[i+1])+`"`)
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func writeMetricsHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	var keys = make([]string, 0, len(m))
+
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (metrics *Metrics) writeRequests(w io.Writer) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	var requestsKeys = make([]requestsKey, 0, len(metrics.requests))
+
+	for key := range metrics.requests {
+		requestsKeys = append(requestsKeys, key)
+	}
+
+	sort.Slice(requestsKeys, func(i, j int) bool {
+		var a, b = requestsKeys[i], requestsKeys[j]
+
+		if a.route != b.route {
+			return a.route < b.route
+		} else if a.method != b.method {
+			return a.method < b.method
+		} else {
+			return a.code < b.code
+		}
+	})
+
+	writeMetricsHeader(w, "http_requests_total", "counter", "Number of completed HTTP requests by route, method and status code")
+
+	for _, key := range requestsKeys {
+		fmt.Fprintf(w, "http_requests_total%s %d\n", metricsLabels("route", key.route, "method", key.method, "code", fmt.Sprint(key.code)), metrics.requests[key])
+	}
+
+	writeMetricsHeader(w, "http_request_duration_seconds", "histogram", "Duration of completed HTTP requests by route")
+
+	for _, route := range sortedKeys(metrics.inFlight) {
+		var histogram = metrics.durations[route]
+		var cumulative uint64
+
+		if histogram == nil {
+			continue
+		}
+
+		for i, bound := range METRICS_BUCKETS {
+			cumulative += histogram.buckets[i]
+
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket%s %d\n", metricsLabels("route", route, "le", fmt.Sprint(bound)), cumulative)
+		}
+
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket%s %d\n", metricsLabels("route", route, "le", "+Inf"), histogram.count)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum%s %v\n", metricsLabels("route", route), histogram.sum)
+		fmt.Fprintf(w, "http_request_duration_seconds_count%s %d\n", metricsLabels("route", route), histogram.count)
+	}
+
+	writeMetricsHeader(w, "http_requests_in_flight", "gauge", "Number of HTTP requests currently being served by route, including websocket and SSE clients")
+
+	for _, route := range sortedKeys(metrics.inFlight) {
+		fmt.Fprintf(w, "http_requests_in_flight%s %d\n", metricsLabels("route", route), metrics.inFlight[route])
+	}
+}
+
+type eventsMetric struct {
+	name       string
+	metricType string
+	help       string
+	value      func(stats EventStats) uint64
+}
+
+var eventsMetrics = []eventsMetric{
+	{"events_clients", "gauge", "Number of connected websocket, SSE and long-polling clients", func(stats EventStats) uint64 { return uint64(stats.Clients) }},
+	{"events_published_total", "counter", "Number of events published", func(stats EventStats) uint64 { return stats.Published }},
+	{"events_sent_total", "counter", "Number of events sent to clients", func(stats EventStats) uint64 { return stats.Sent }},
+	{"events_dropped_total", "counter", "Number of events dropped for slow clients", func(stats EventStats) uint64 { return stats.DroppedEvents }},
+	{"events_overflows_total", "counter", "Number of events published to clients with a full buffer", func(stats EventStats) uint64 { return stats.Overflows }},
+	{"events_dropped_clients_total", "counter", "Number of clients dropped for falling behind", func(stats EventStats) uint64 { return stats.DroppedClients }},
+	{"events_rejected_clients_total", "counter", "Number of clients rejected for exceeding MaxClients", func(stats EventStats) uint64 { return stats.RejectedClients }},
+}
+
+func (metrics *Metrics) writeEvents(w io.Writer) {
+	var names []string
+	var stats = make(map[string]EventStats)
+
+	metrics.mutex.Lock()
+	for name, events := range metrics.events {
+		names = append(names, name)
+		stats[name] = events.Stats()
+	}
+	metrics.mutex.Unlock()
+
+	if names == nil {
+		return
+	}
+
+	sort.Strings(names)
+
+	for _, metric := range eventsMetrics {
+		writeMetricsHeader(w, metric.name, metric.metricType, metric.help)
+
+		for _, name := range names {
+			fmt.Fprintf(w, "%s%s %d\n", metric.name, metricsLabels("events", name), metric.value(stats[name]))
+		}
+	}
+}
+
+// Serve the metrics in the Prometheus text format
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	metrics.writeRequests(w)
+	metrics.writeEvents(w)
+}
@@ -0,0 +1,125 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// Unique ID for each registered Events client
+type ClientID uint64
+
+type clientIDKey struct{}
+
+// Return the Events client ID for the websocket or SSE request, e.g. within EventConfig.MessageFunc
+func RequestClientID(r *http.Request) ClientID {
+	if r == nil {
+
+	} else if id, ok := r.Context().Value(clientIDKey{}).(ClientID); ok {
+		return id
+	}
+
+	return 0
+}
+
+// Return request with a newly allocated client ID
+func (events Events) withClientID(r *http.Request) *http.Request {
+	var id = ClientID(atomic.AddUint64(events.clientID, 1))
+
+	return r.WithContext(context.WithValue(r.Context(), clientIDKey{}, id))
+}
+
+// Return client ID for request, or allocate a new one
+func (events Events) requestClientID(r *http.Request) ClientID {
+	if id := RequestClientID(r); id != 0 {
+		return id
+	} else {
+		return ClientID(atomic.AddUint64(events.clientID, 1))
+	}
+}
+
+// Event to publish, only to clients matching the target, if any
+type eventsPublish struct {
+	event  Event
+	target func(ClientInfo) bool
+
+	// full state for PublishState
+	state bool
+}
+
+func (events Events) publish(publish eventsPublish) {
+	select {
+	case events.publishChan <- publish:
+	case <-events.doneChan:
+		// server has stopped
+	}
+}
+
+// Publish event to all clients matching the predicate, e.g. using the ClientInfo.Identity or Query
+//
+// The predicate is called for each client, blocking any publishing.
+func (events Events) PublishWhere(event Event, where func(client ClientInfo) bool) {
+	events.publish(eventsPublish{event: event, target: where})
+}
+
+// Publish event to the client with the given ID, see RequestClientID()
+func (events Events) PublishClient(id ClientID, event Event) {
+	events.PublishWhere(event, func(client ClientInfo) bool {
+		return client.ID == id
+	})
+}
+
+// Publish event to all clients authenticated with the given identity, see EventConfig.AuthFunc
+func (events Events) PublishIdentity(identity string, event Event) {
+	events.PublishWhere(event, func(client ClientInfo) bool {
+		return client.Identity == identity
+	})
+}
+
+// Request body for PublishResource, using the same format as TopicEvent
+type PublishRequest struct {
+	Topic string          `json:"topic"`
+	Event json.RawMessage `json:"event"`
+}
+
+// API resource publishing events POSTed as a PublishRequest, e.g. api.Mount("_publish", MakeAPI(events.PublishResource()))
+//
+// Events with a topic are published as a TopicEvent. Returns HTTP 204 once published.
+type PublishResource struct {
+	events Events
+}
+
+func (events Events) PublishResource() PublishResource {
+	return PublishResource{events}
+}
+
+type publishRequest struct {
+	events  Events
+	request PublishRequest
+}
+
+// Allow use as the root of a mounted API
+func (resource PublishResource) Index(name string) (Resource, error) {
+	if name == "" {
+		return &publishRequest{events: resource.events}, nil
+	} else {
+		return nil, nil
+	}
+}
+
+func (request *publishRequest) IntoREST() interface{} {
+	return &request.request
+}
+
+func (request *publishRequest) PostREST() (Resource, error) {
+	if request.request.Event == nil {
+		return nil, RequestErrorf("Missing event")
+	} else if request.request.Topic != "" {
+		request.events.Publish(TopicEvent{Topic: request.request.Topic, Event: request.request.Event})
+	} else {
+		request.events.Publish(request.request.Event)
+	}
+
+	return nil, nil
+}
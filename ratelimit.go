@@ -0,0 +1,59 @@
+package web
+
+import (
+	"context"
+	"math"
+
+	"golang.org/x/time/rate"
+)
+
+// Return limiter for the given rate per second and burst, defaulting to one second's worth; nil if not limited
+func makeRateLimiter(limit float64, burst int) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	} else if burst <= 0 {
+		burst = int(math.Ceil(limit))
+	}
+
+	return rate.NewLimiter(rate.Limit(limit), burst)
+}
+
+// Return codec waiting for the SendRate and SendByteRate limits before sending each websocket message
+func (events Events) rateLimitCodec(ctx context.Context, codec WebsocketCodec) WebsocketCodec {
+	var messageLimiter = makeRateLimiter(events.config.SendRate, events.config.SendBurst)
+	var byteLimiter = makeRateLimiter(events.config.SendByteRate, events.config.SendByteBurst)
+
+	if messageLimiter == nil && byteLimiter == nil {
+		return codec
+	}
+
+	return WebsocketCodec{
+		Marshal: func(v interface{}) ([]byte, int, error) {
+			if messageLimiter == nil {
+
+			} else if err := messageLimiter.Wait(ctx); err != nil {
+				return nil, 0, err
+			}
+
+			data, payloadType, err := codec.Marshal(v)
+			if err != nil {
+				return data, payloadType, err
+			}
+
+			var size = len(data)
+
+			if byteLimiter == nil {
+				return data, payloadType, nil
+			} else if size > byteLimiter.Burst() {
+				// larger messages use up the entire burst
+				size = byteLimiter.Burst()
+			}
+
+			if err := byteLimiter.WaitN(ctx, size); err != nil {
+				return nil, 0, err
+			}
+
+			return data, payloadType, nil
+		},
+	}
+}
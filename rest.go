@@ -1,11 +1,20 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/schema"
+	"io"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Go 1.6 compat
@@ -13,6 +22,11 @@ const (
 	StatusUnprocessableEntity = 422 // RFC 4918, 11.2
 )
 
+// Non-standard
+const (
+	StatusClientClosedRequest = 499 // nginx
+)
+
 type Error struct {
 	Status int
 	Err    error
@@ -26,6 +40,34 @@ func (err Error) Error() string {
 	}
 }
 
+func (err Error) Unwrap() error {
+	return err.Err
+}
+
+// Return any Error within the error chain, or map context.DeadlineExceeded and context.Canceled to HTTP 504 and 499 errors.
+func AsError(err error) (Error, bool) {
+	var httpError Error
+
+	if errors.As(err, &httpError) {
+		return httpError, true
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		return Error{http.StatusGatewayTimeout, err}, true
+	} else if errors.Is(err, context.Canceled) {
+		return Error{StatusClientClosedRequest, err}, true
+	} else {
+		return Error{}, false
+	}
+}
+
+// Test if the error maps to the given HTTP status, per AsError()
+func IsStatus(err error, status int) bool {
+	if httpError, ok := AsError(err); ok {
+		return httpError.Status == status
+	} else {
+		return false
+	}
+}
+
 func Errorf(status int, f string, args ...interface{}) Error {
 	return Error{status, fmt.Errorf(f, args...)}
 }
@@ -36,30 +78,39 @@ func RequestErrorf(f string, args ...interface{}) Error {
 	return Errorf(StatusUnprocessableEntity, f, args...)
 }
 
-func readRequest(request *http.Request, resource IntoResource) error {
+func readRequest(request *http.Request, resource IntoResource, config APIConfig) (interface{}, error) {
 	var contentType = request.Header.Get("Content-Type")
 	var object = resource.IntoREST()
 
 	switch contentType {
 	case "application/x-www-form-urlencoded":
 		if err := request.ParseForm(); err != nil {
-			return RequestError(err)
-		} else if err := schema.NewDecoder().Decode(object, request.PostForm); err != nil {
-			return RequestError(err)
+			return nil, requestBodyError(err)
+		} else if err := decodeForm(object, request.PostForm, config.FormJSONNames); err != nil {
+			return nil, validationError(err)
 		}
 
 	case "application/json":
-		if err := json.NewDecoder(request.Body).Decode(object); err != nil {
-			return RequestError(err)
+		if err := decodeJSON(request.Body, object, config); err != nil {
+			return nil, requestBodyError(err)
 		}
 
 	default:
-		return Errorf(http.StatusUnsupportedMediaType, "Unknown Content-Type: %v", contentType)
+		return nil, Errorf(http.StatusUnsupportedMediaType, "Unknown Content-Type: %v", contentType)
 	}
 
-	log.Debugf("Decode %v request for %T => %T: %#v", contentType, resource, object, object)
+	apiLog.Debug("decode request", "content_type", contentType, "resource", fmt.Sprintf("%T", resource), "object", fmt.Sprintf("%#v", object))
 
-	return nil
+	return object, nil
+}
+
+// Return HTTP 413 errors from limitBody as-is, otherwise HTTP 422 naming the offending field(s)
+func requestBodyError(err error) error {
+	if httpError, ok := err.(Error); ok {
+		return httpError
+	} else {
+		return validationError(err)
+	}
 }
 
 func readQuery(request *http.Request, resource QueryResource) error {
@@ -69,28 +120,186 @@ func readQuery(request *http.Request, resource QueryResource) error {
 	decoder.IgnoreUnknownKeys(true)
 
 	if err := decoder.Decode(obj, request.URL.Query()); err != nil {
-		return RequestError(fmt.Errorf("Decode query for %T => %T: %v", resource, obj, err))
+		apiLog.Debug("decode query", "resource", fmt.Sprintf("%T", resource), "err", err)
+
+		return validationError(err)
 	} else {
-		log.Debugf("Decode query for %T => %T: %#v", resource, obj, obj)
+		apiLog.Debug("decode query", "resource", fmt.Sprintf("%T", resource), "query", fmt.Sprintf("%#v", obj))
 		return nil
 	}
 }
 
-func writeResponse(responseWriter http.ResponseWriter, object interface{}) error {
+// Default indent for ?pretty=1
+const PrettyIndent = "  "
+
+// Return indent for pretty-printed JSON responses, requested using either ?pretty=1 or Accept: application/json; indent=N
+func responseIndent(request *http.Request) string {
+	if pretty := request.URL.Query().Get("pretty"); pretty == "" {
+
+	} else if ok, err := strconv.ParseBool(pretty); err == nil && ok {
+		return PrettyIndent
+	}
+
+	for _, accept := range strings.Split(request.Header.Get("Accept"), ",") {
+		if mediaType, params, err := mime.ParseMediaType(accept); err != nil {
+			continue
+		} else if mediaType != "application/json" {
+			continue
+		} else if indent, err := strconv.Atoi(params["indent"]); err == nil && indent > 0 {
+			return strings.Repeat(" ", indent)
+		}
+	}
+
+	return ""
+}
+
+func writeResponse(responseWriter http.ResponseWriter, request *http.Request, object interface{}) error {
+	var encoder = json.NewEncoder(responseWriter)
+
+	if indent := responseIndent(request); indent != "" {
+		encoder.SetIndent("", indent)
+	}
+
 	responseWriter.Header().Set("Content-Type", "application/json")
 
-	return json.NewEncoder(responseWriter).Encode(object)
+	return encoder.Encode(object)
+}
+
+// HTTP 405 error for a resource that does not support the request method
+type MethodError struct {
+	Method string   `json:"method"`
+	Allow  []string `json:"allow"`
+}
+
+func (err MethodError) Error() string {
+	return fmt.Sprintf("Method %v not allowed, allowed methods: %v", err.Method, strings.Join(err.Allow, ", "))
+}
+
+// HTTP 404 error with a JSON body, returned by IndexResource.Index() for unknown names
+type NotFoundError struct {
+	Name        string   `json:"name"`
+	Reason      string   `json:"reason,omitempty"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+func (err NotFoundError) Error() string {
+	if err.Reason != "" {
+		return fmt.Sprintf("Not found: %v: %v", err.Name, err.Reason)
+	} else {
+		return fmt.Sprintf("Not found: %v", err.Name)
+	}
+}
+
+// Return the methods supported by the resource
+func resourceMethods(resource Resource) []string {
+	var methods []string
+
+	if _, ok := resource.(GetResource); ok {
+		methods = append(methods, "GET")
+	}
+	if _, ok := resource.(PostResource); ok {
+		methods = append(methods, "POST")
+	}
+	if _, ok := resource.(PutResource); ok {
+		methods = append(methods, "PUT")
+	}
+	if _, ok := resource.(DeleteResource); ok {
+		methods = append(methods, "DELETE")
+	}
+
+	return methods
+}
+
+func makeMethodError(method string, resource Resource) MethodError {
+	return MethodError{
+		Method: method,
+		Allow:  resourceMethods(resource),
+	}
 }
 
 // Encodable resource
 type Resource interface{}
 
+// Resource that is bound to each request during lookup, before any Index or GetREST/PostREST/PutREST/DeleteREST methods
+//
+// Use for access to the request context, which is cancelled on APIConfig.Timeout, RequestIdentity() and RequestSession().
+type RequestResource interface {
+	// Return the Resource for the request, which may be the same Resource
+	RequestREST(r *http.Request) (Resource, error)
+}
+
 // Resource collection with sub-Resources
 type IndexResource interface {
 	// TODO: List() ([]Resource, error)
 	Index(name string) (Resource, error)
 }
 
+// Resource collection with sub-Resources addressed by integer IDs
+//
+// Names that are not valid integers fail with HTTP 404.
+type IndexIntResource interface {
+	IndexInt(id int) (Resource, error)
+}
+
+// Resource collection with sub-Resources addressed by unsigned integer IDs
+//
+// Names that are not valid unsigned integers fail with HTTP 404.
+type IndexUintResource interface {
+	IndexUint(id uint) (Resource, error)
+}
+
+// Lookup sub-resource using IndexIntResource, IndexUintResource or IndexResource
+//
+// Returns false if the resource does not support indexing.
+func lookupIndex(resource Resource, name string) (Resource, bool, error) {
+	if indexResource, ok := resource.(IndexIntResource); ok {
+		if id, err := strconv.ParseInt(name, 10, 0); err != nil {
+			return nil, true, Errorf(http.StatusNotFound, "Invalid ID: %v", name)
+		} else {
+			next, err := indexResource.IndexInt(int(id))
+
+			return next, true, err
+		}
+	} else if indexResource, ok := resource.(IndexUintResource); ok {
+		if id, err := strconv.ParseUint(name, 10, 0); err != nil {
+			return nil, true, Errorf(http.StatusNotFound, "Invalid ID: %v", name)
+		} else {
+			next, err := indexResource.IndexUint(uint(id))
+
+			return next, true, err
+		}
+	} else if indexResource, ok := resource.(IndexResource); ok {
+		next, err := indexResource.Index(name)
+
+		return next, true, err
+	} else {
+		return nil, false, nil
+	}
+}
+
+// Resource collection with sub-Resources addressed by the remaining path, e.g. a/b/c
+//
+// Takes precedence over IndexResource.
+type PathResource interface {
+	// The path is given as the remaining /-separated names, which may be empty
+	IndexPath(path string) (Resource, error)
+}
+
+// Resource collection that supports creating new sub-Resources using PUT
+//
+// Used for a PUT request where the final name is not found by Index(), with the new Resource handling the PUT as usual.
+type CreateIndexResource interface {
+	// Return a new Resource for the given name, which should implement PutResource
+	CreateIndex(name string) (Resource, error)
+}
+
+// Resource that handles all requests for its subtree, with the request path stripped to the remaining names
+//
+// Allows embedding arbitrary handlers such as websockets or uploads within the API.
+type HandlerResource interface {
+	http.Handler
+}
+
 // Resoruce that decodes ?... query vars ussing github.com/gorilla/schema
 type QueryResource interface {
 	// Return object to unmarshal query params into
@@ -103,6 +312,13 @@ type IntoResource interface {
 	IntoREST() interface{}
 }
 
+// Resource that reads the raw request body, instead of decoding it using IntoResource
+type BodyResource interface {
+	// Read request body with the declared Content-Type and Content-Length, which is -1 if unknown.
+	// Called before PostREST/PutREST, instead of IntoREST.
+	BodyREST(body io.Reader, contentType string, contentLength int64) error
+}
+
 // Resource that supports GET
 type GetResource interface {
 	// Return marshalable response resource
@@ -144,58 +360,233 @@ type MutableResource interface {
 	ApplyREST() error
 }
 
+type APIConfig struct {
+	// Wrap responses in a LinksResponse envelope
+	Links bool
+
+	// Fail requests with HTTP 504 if the resource methods do not return within the timeout, including any Locking.
+	//
+	// The request context is cancelled on timeout, see RequestResource. Any resource method that does not return will
+	// continue running in the background, holding any Locking until it returns.
+	Timeout time.Duration
+
+	// Called with APIMetrics after each request
+	MetricsFunc func(APIMetrics)
+
+	// Called with APIAudit after each mutating request
+	AuditFunc func(APIAudit)
+
+	// Authenticate each request, returning the identity used for RequestIdentity() and APIAudit.
+	// Return an Error with HTTP 401 to reject the request.
+	AuthFunc func(r *http.Request) (string, error)
+
+	// Load the Session for RequestSession() on each request, before any AuthFunc, saving any changes to the session
+	// before writing the response headers.
+	Sessions *Sessions
+
+	// Lock each resource path during requests, serializing mutating requests while allowing concurrent GET requests.
+	// The parent paths are read-locked before lookup, serializing any lookups with mutating requests on the parents.
+	Locking bool
+
+	// Fail PUT and DELETE requests for an ETagResource with HTTP 428 if they do not include an If-Match header
+	RequireIfMatch bool
+
+	// Fail requests with HTTP 413 if the request body is larger than MaxBodySize bytes
+	MaxBodySize int64
+
+	// Decode form request bodies using the encoding/json field names, for objects without any `schema:"..."` tags
+	FormJSONNames bool
+
+	// Fail requests with HTTP 422 if the JSON request body has fields not present in the IntoREST object
+	DisallowUnknownFields bool
+
+	// Fail requests with HTTP 422 if the JSON request body is nested deeper than MaxBodyDepth objects/arrays
+	MaxBodyDepth int
+
+	// Replay responses to POST requests with a repeated Idempotency-Key header within the TTL
+	IdempotencyTTL time.Duration
+
+	// Fail requests with HTTP 400 if the path has more than MaxDepth names, including any trailing /
+	MaxDepth int
+
+	// Log the decoded request and encoded response bodies, truncated to DebugSize bytes
+	DebugSize int
+
+	// Also record the DebugSize request and response bodies into the DebugBuffer
+	DebugBuffer *DebugBuffer
+}
+
 type API struct {
-	root Resource
+	config      APIConfig
+	root        Resource
+	mounts      []apiMount
+	idempotency *idempotencyCache
+	locks       *pathLocks
 }
 
 func MakeAPI(root Resource) API {
-	return API{
-		root: root,
+	return MakeAPIConfig(root, APIConfig{})
+}
+
+func MakeAPIConfig(root Resource, config APIConfig) API {
+	var api = API{
+		config: config,
+		root:   root,
 	}
+
+	if config.Locking {
+		api.locks = makePathLocks()
+	}
+
+	if config.IdempotencyTTL > 0 {
+		api.idempotency = makeIdempotencyCache(config.IdempotencyTTL)
+	}
+
+	return api
 }
 
-func (api API) lookup(r *http.Request) (Resource, []MutableResource, error) {
-	var path = r.URL.Path
+// Split request path into unescaped names for lookup
+//
+// Empty and . names are collapsed, except for a trailing / which is looked up as an empty name.
+// Fails with HTTP 400 for any .. names, or names containing an escaped /.
+func (api API) requestPath(r *http.Request) ([]string, error) {
+	var path = r.URL.EscapedPath()
 
 	// normalize path (per http.StripPrefix behavior)
-	if path[0] == '/' {
+	if path != "" && path[0] == '/' {
 		path = path[1:]
 	}
 
+	var parts = strings.Split(path, "/")
+	var names = make([]string, 0, len(parts))
+
+	for i, part := range parts {
+		name, err := url.PathUnescape(part)
+
+		if err != nil {
+			return nil, Errorf(http.StatusBadRequest, "Invalid path: %v", err)
+		} else if strings.Contains(name, "/") {
+			// an escaped / would allow .. traversal within a single name, e.g. for PathResource
+			return nil, Errorf(http.StatusBadRequest, "Invalid path: %v", path)
+		}
+
+		switch name {
+		case "..":
+			return nil, Errorf(http.StatusBadRequest, "Invalid path: %v", path)
+		case "", ".":
+			if i < len(parts)-1 {
+				continue
+			}
+
+			name = ""
+		}
+
+		names = append(names, name)
+	}
+
+	if api.config.MaxDepth > 0 && len(names) > api.config.MaxDepth {
+		return nil, Errorf(http.StatusBadRequest, "Invalid path: too deep")
+	}
+
+	return names, nil
+}
+
+// Bind the resource to the request, per RequestResource
+func requestResource(r *http.Request, resource Resource) (Resource, error) {
+	if requestResource, ok := resource.(RequestResource); !ok {
+		return resource, nil
+	} else if resource, err := requestResource.RequestREST(r); err != nil {
+		return nil, err
+	} else if resource == nil {
+		return nil, Error{http.StatusNotFound, nil}
+	} else {
+		return resource, nil
+	}
+}
+
+// Returns the remaining names for any HandlerResource.
+//
+// Read-locks each LockableResource before indexing it.
+func (api API) lookup(r *http.Request, locks *requestLocks) (Resource, []MutableResource, []string, error) {
 	// lookup from root
-	var resource = api.root
+	var resource, err = requestResource(r, api.root)
 	var mutables []MutableResource
 
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	if mutableResource, ok := resource.(MutableResource); ok {
 		mutables = append(mutables, mutableResource)
 	}
 
-	for _, name := range strings.Split(path, "/") {
+	names, err := api.requestPath(r)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if mount, ok := api.lookupMount(names); ok {
+		return mount.api, nil, names[len(mount.names):], nil
+	}
+
+	for i, name := range names {
+		var nextResource Resource
+		var err error
+		var last = false
+
+		if _, ok := resource.(HandlerResource); ok {
+			// handles all remaining names
+			return resource, nil, names[i:], nil
+		}
+
 		if queryResource, ok := resource.(QueryResource); !ok {
 
 		} else if err := readQuery(r, queryResource); err != nil {
-			return resource, nil, err
+			return resource, nil, nil, err
 		}
 
-		if indexResource, ok := resource.(IndexResource); !ok {
-			return resource, nil, Error{http.StatusNotFound, nil}
-		} else if nextResource, err := indexResource.Index(name); err != nil {
-			return resource, nil, err
-		} else if nextResource == nil {
-			return nil, nil, Error{http.StatusNotFound, nil}
+		locks.lockParent(resource)
+
+		if pathResource, ok := resource.(PathResource); ok {
+			// consumes all remaining names
+			nextResource, err = pathResource.IndexPath(strings.Join(names[i:], "/"))
+			last = true
+		} else if next, ok, indexErr := lookupIndex(resource, name); ok {
+			nextResource, err = next, indexErr
 		} else {
-			resource = nextResource
+			return resource, nil, nil, Error{http.StatusNotFound, nil}
+		}
+
+		if err != nil {
+			return resource, nil, nil, err
+		} else if nextResource != nil {
+
+		} else if createResource, ok := resource.(CreateIndexResource); !ok || last || i < len(names)-1 || r.Method != "PUT" {
+			return nil, nil, nil, Error{http.StatusNotFound, nil}
+		} else if nextResource, err = createResource.CreateIndex(name); err != nil {
+			return resource, nil, nil, err
+		} else if nextResource == nil {
+			return nil, nil, nil, Error{http.StatusNotFound, nil}
+		}
+
+		if resource, err = requestResource(r, nextResource); err != nil {
+			return nil, nil, nil, err
 		}
 
 		if mutableResource, ok := resource.(MutableResource); ok {
 			mutables = append(mutables, mutableResource)
 		}
+
+		if last {
+			break
+		}
 	}
 
 	if queryResource, ok := resource.(QueryResource); !ok {
 
 	} else if err := readQuery(r, queryResource); err != nil {
-		return resource, nil, err
+		return resource, nil, nil, err
 	}
 
 	// reverse
@@ -203,17 +594,137 @@ func (api API) lookup(r *http.Request) (Resource, []MutableResource, error) {
 		mutables[i], mutables[j] = mutables[j], mutables[i]
 	}
 
-	return resource, mutables, nil
+	return resource, mutables, nil, nil
+}
+
+// Serve request using HandlerResource, with the path stripped to the remaining names, per http.StripPrefix
+func serveHandler(w http.ResponseWriter, r *http.Request, handler HandlerResource, names []string) {
+	var request = new(http.Request)
+	var requestURL = new(url.URL)
+	var escapedNames = make([]string, len(names))
+
+	for i, name := range names {
+		escapedNames[i] = url.PathEscape(name)
+	}
+
+	*request = *r
+	*requestURL = *r.URL
+
+	requestURL.Path = strings.Join(names, "/")
+	requestURL.RawPath = strings.Join(escapedNames, "/")
+	request.URL = requestURL
+
+	handler.ServeHTTP(w, request)
+}
+
+type callResult struct {
+	resource Resource
+	err      error
+}
+
+// HTTP 504 error with a JSON body, for resource methods that do not return within the APIConfig.Timeout
+type TimeoutError struct {
+	Method  string `json:"method"`
+	Timeout string `json:"timeout"`
+}
+
+func (err TimeoutError) Error() string {
+	return fmt.Sprintf("%v timeout after %v", err.Method, err.Timeout)
+}
+
+func (err TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// Call resource method, converting any panic into a HTTP 500 error
+func callRecover(method func() (Resource, error)) (resource Resource, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			apiLog.Error("panic in resource method", "panic", p, "stack", string(debug.Stack()))
+
+			err = Error{http.StatusInternalServerError, nil}
+		}
+	}()
+
+	return method()
+}
+
+// Call named resource method, subject to APIConfig.Timeout
+//
+// Any timed out method is left running as the request.pending.
+func (api API) call(r *http.Request, request *apiRequest, name string, method func() (Resource, error)) (resource Resource, err error) {
+	var span = startSpan(r, name)
+
+	defer func() { span.End(err) }()
+
+	if api.config.Timeout == 0 {
+		return callRecover(method)
+	} else if err := r.Context().Err(); err != nil {
+		return nil, api.timeoutError(name, err)
+	}
+
+	var resultChan = make(chan callResult, 1)
+
+	go func() {
+		resource, err := callRecover(method)
+
+		resultChan <- callResult{resource, err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		return result.resource, result.err
+
+	case <-r.Context().Done():
+		request.pending = resultChan
+
+		return nil, api.timeoutError(name, r.Context().Err())
+	}
+}
+
+// Return a TimeoutError for the APIConfig.Timeout, or any other context error
+func (api API) timeoutError(name string, err error) error {
+	if err == context.DeadlineExceeded {
+		return TimeoutError{Method: name, Timeout: api.config.Timeout.String()}
+	} else {
+		return err
+	}
+}
+
+// Apply mutable resource, converting any panic into a HTTP 500 error
+func applyRecover(resource MutableResource) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			apiLog.Error("panic in ApplyREST", "resource", fmt.Sprintf("%T", resource), "panic", p, "stack", string(debug.Stack()))
+
+			err = Error{http.StatusInternalServerError, nil}
+		}
+	}()
+
+	return resource.ApplyREST()
 }
 
-func (api API) apply(resource MutableResource, parents []MutableResource) error {
+// Apply mutable resource within a span
+func (api API) applySpan(r *http.Request, resource MutableResource) error {
+	var span = startSpan(r, "ApplyREST")
+
+	span.SetAttribute("resource", fmt.Sprintf("%T", resource))
+
+	err := applyRecover(resource)
+
+	span.End(err)
+
+	return err
+}
+
+func (api API) apply(r *http.Request, resource MutableResource, parents []MutableResource) error {
 	if resource != nil {
-		if err := resource.ApplyREST(); err != nil {
+		if err := api.applySpan(r, resource); err != nil {
 			return err
 		}
 	}
 	for _, resource := range parents {
-		if err := resource.ApplyREST(); err != nil {
+		if err := api.applySpan(r, resource); err != nil {
 			return err
 		}
 	}
@@ -221,20 +732,59 @@ func (api API) apply(resource MutableResource, parents []MutableResource) error
 	return nil
 }
 
-func (api API) handle(w http.ResponseWriter, r *http.Request) error {
-	resource, mutableResources, err := api.lookup(r)
+// Per-request state for hooks
+type apiRequest struct {
+	// resolved resource, or nil on lookup errors
+	resource Resource
 
-	if err != nil {
+	// decoded request body, or nil
+	object interface{}
+
+	// result of any timed out resource method still running
+	pending chan callResult
+}
+
+// Unlock once any pending resource method has returned
+func (request *apiRequest) unlock(locks *requestLocks) {
+	if pending := request.pending; pending == nil {
+		locks.unlock()
+	} else {
+		go func() {
+			<-pending
+			locks.unlock()
+		}()
+	}
+}
+
+// Decode request body, remembering the decoded object
+func (request *apiRequest) read(r *http.Request, resource IntoResource, config APIConfig) error {
+	if err := limitBody(r, config.MaxBodySize); err != nil {
 		return err
 	}
 
+	if bodyResource, ok := resource.(BodyResource); ok {
+		apiLog.Debug("read request body", "content_type", r.Header.Get("Content-Type"), "resource", fmt.Sprintf("%T", resource))
+
+		return bodyResource.BodyREST(r.Body, r.Header.Get("Content-Type"), r.ContentLength)
+	}
+
+	object, err := readRequest(r, resource, config)
+
+	request.object = object
+
+	return err
+}
+
+func (api API) handle(w http.ResponseWriter, r *http.Request, request *apiRequest, mutableResources []MutableResource) error {
+	var resource = request.resource
+	var linksResource, _ = resource.(LinksResource)
+
 	switch r.Method {
 	case "GET":
 		// resolve GET resource
 		if getResource, ok := resource.(GetResource); !ok {
-			log.Warnf("Not a GetResource: %T", resource)
-			return Error{http.StatusMethodNotAllowed, nil}
-		} else if ret, err := getResource.GetREST(); err != nil {
+			return makeMethodError(r.Method, resource)
+		} else if ret, err := api.call(r, request, "GetREST", getResource.GetREST); err != nil {
 			return err
 		} else if ret == nil {
 			return Error{http.StatusNotFound, nil}
@@ -244,11 +794,10 @@ func (api API) handle(w http.ResponseWriter, r *http.Request) error {
 
 	case "POST":
 		if postResource, ok := resource.(PostResource); !ok {
-			log.Warnf("Not a PostResource: %T", resource)
-			return Error{http.StatusMethodNotAllowed, nil}
-		} else if err := readRequest(r, postResource); err != nil {
+			return makeMethodError(r.Method, resource)
+		} else if err := request.read(r, postResource, api.config); err != nil {
 			return err
-		} else if ret, err := postResource.PostREST(); err != nil {
+		} else if ret, err := api.call(r, request, "PostREST", postResource.PostREST); err != nil {
 			return err
 		} else if ret == nil {
 			return Error{http.StatusNoContent, nil}
@@ -259,17 +808,18 @@ func (api API) handle(w http.ResponseWriter, r *http.Request) error {
 		// apply
 		mutableResource, _ := resource.(MutableResource)
 
-		if err := api.apply(mutableResource, mutableResources); err != nil {
+		if err := api.apply(r, mutableResource, mutableResources); err != nil {
 			return err
 		}
 
 	case "PUT":
 		if putResource, ok := resource.(PutResource); !ok {
-			log.Warnf("Not a PutResource: %T", resource)
-			return Error{http.StatusMethodNotAllowed, nil}
-		} else if err := readRequest(r, putResource); err != nil {
+			return makeMethodError(r.Method, resource)
+		} else if err := api.checkIfMatch(r, resource); err != nil {
 			return err
-		} else if ret, err := putResource.PutREST(); err != nil {
+		} else if err := request.read(r, putResource, api.config); err != nil {
+			return err
+		} else if ret, err := api.call(r, request, "PutREST", putResource.PutREST); err != nil {
 			return err
 		} else if ret == nil {
 			return Error{http.StatusNotFound, nil}
@@ -280,15 +830,16 @@ func (api API) handle(w http.ResponseWriter, r *http.Request) error {
 		// apply
 		mutableResource, _ := resource.(MutableResource)
 
-		if err := api.apply(mutableResource, mutableResources); err != nil {
+		if err := api.apply(r, mutableResource, mutableResources); err != nil {
 			return err
 		}
 
 	case "DELETE":
 		if deleteResource, ok := resource.(DeleteResource); !ok {
-			log.Warnf("Not a DeleteResource: %T", resource)
-			return Error{http.StatusMethodNotAllowed, nil}
-		} else if ret, err := deleteResource.DeleteREST(); err != nil {
+			return makeMethodError(r.Method, resource)
+		} else if err := api.checkIfMatch(r, resource); err != nil {
+			return err
+		} else if ret, err := api.call(r, request, "DeleteREST", deleteResource.DeleteREST); err != nil {
 			return err
 		} else if ret == nil {
 			return Error{http.StatusNoContent, nil}
@@ -299,7 +850,7 @@ func (api API) handle(w http.ResponseWriter, r *http.Request) error {
 		// apply
 		mutableResource, _ := resource.(MutableResource)
 
-		if err := api.apply(mutableResource, mutableResources); err != nil {
+		if err := api.apply(r, mutableResource, mutableResources); err != nil {
 			return err
 		}
 
@@ -307,29 +858,186 @@ func (api API) handle(w http.ResponseWriter, r *http.Request) error {
 		return Error{http.StatusNotImplemented, nil}
 	}
 
-	if err := writeResponse(w, resource); err != nil {
+	if err := writeETag(w, r, request.resource); err != nil {
 		return err
+	}
+
+	if api.config.Links {
+		if links, err := api.makeLinks(r, linksResource); err != nil {
+			return err
+		} else {
+			resource = LinksResponse{Links: links, Resource: resource}
+		}
+	}
+
+	return writeResponse(w, r, resource)
+}
+
+func (api API) serve(w http.ResponseWriter, r *http.Request, request *apiRequest) error {
+	if api.config.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), api.config.Timeout)
+
+		defer cancel()
+
+		r = r.WithContext(ctx)
+	}
+
+	var locks requestLocks
+
+	defer request.unlock(&locks)
+
+	api.lockPath(r, &locks)
+
+	var span = startSpan(r, "lookup")
+
+	resource, mutableResources, names, err := api.lookup(r, &locks)
+
+	request.resource = resource
+
+	span.SetAttribute("resource", fmt.Sprintf("%T", resource))
+	span.End(err)
+
+	if err != nil {
+		return err
+	} else if handlerResource, ok := resource.(HandlerResource); ok {
+		// handlers may be long-lived
+		locks.unlock()
+
+		serveHandler(w, r, handlerResource, names)
+
+		return nil
 	} else {
-		log.Infof("%v %v: %T", r.Method, r.URL.Path, resource)
+		locks.lockResource(r, resource)
+
+		return api.handle(w, r, request, mutableResources)
 	}
+}
 
-	return nil
+// Write error with JSON body
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	apiLog.Info("error", "method", r.Method, "path", r.URL.Path, "status", status, "err", err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(err); err != nil {
+		apiLog.Warn("write error", "method", r.Method, "path", r.URL.Path, "err", err)
+	}
 }
 
-func (api API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if err := api.handle(w, r); err == nil {
+// Write error response for handlers, using the same format as API errors
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, r, err)
+}
 
-	} else if httpError, ok := err.(Error); !ok {
-		log.Infof("%v %v: HTTP %v: %v", r.Method, r.URL.Path, 500, err.Error())
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var methodError MethodError
+	var notFoundError NotFoundError
+	var validationError ValidationError
+	var timeoutError TimeoutError
+
+	if errors.As(err, &methodError) {
+		w.Header().Set("Allow", strings.Join(methodError.Allow, ", "))
+
+		writeJSONError(w, r, http.StatusMethodNotAllowed, methodError)
+	} else if errors.As(err, &notFoundError) {
+		writeJSONError(w, r, http.StatusNotFound, notFoundError)
+	} else if errors.As(err, &validationError) {
+		writeJSONError(w, r, StatusUnprocessableEntity, validationError)
+	} else if errors.As(err, &timeoutError) {
+		writeJSONError(w, r, http.StatusGatewayTimeout, timeoutError)
+	} else if httpError, ok := AsError(err); !ok {
+		apiLog.Info("error", "method", r.Method, "path", r.URL.Path, "status", 500, "err", err)
 
 		http.Error(w, err.Error(), 500)
 	} else if httpError.Err != nil {
-		log.Infof("%v %v: HTTP %v: %v", r.Method, r.URL.Path, httpError.Status, httpError.Err.Error())
+		apiLog.Info("error", "method", r.Method, "path", r.URL.Path, "status", httpError.Status, "err", httpError.Err)
 
 		http.Error(w, httpError.Err.Error(), httpError.Status)
 	} else {
-		log.Infof("%v %v: HTTP %v", r.Method, r.URL.Path, httpError.Status)
+		apiLog.Info("error", "method", r.Method, "path", r.URL.Path, "status", httpError.Status)
 
 		http.Error(w, "", httpError.Status)
 	}
 }
+
+func (api API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var startTime = time.Now()
+	var request apiRequest
+	var statusWriter *statusResponseWriter
+	var sessionWriter *sessionResponseWriter
+
+	if api.config.Sessions != nil {
+		sessionWriter, r = api.config.Sessions.serve(w, r)
+		w = sessionWriter
+	}
+
+	if api.config.MetricsFunc != nil || api.config.AuditFunc != nil || apiLog.Enabled(r.Context(), slog.LevelInfo) {
+		statusWriter = &statusResponseWriter{ResponseWriter: w}
+		w = statusWriter
+	}
+
+	var debugWriter *debugResponseWriter
+
+	if api.config.DebugSize > 0 {
+		debugWriter = &debugResponseWriter{ResponseWriter: w, limit: api.config.DebugSize}
+		w = debugWriter
+	}
+
+	var authErr error
+
+	if api.config.AuthFunc == nil {
+
+	} else if identity, err := api.config.AuthFunc(r); err != nil {
+		authErr = err
+	} else {
+		r = WithIdentity(r, identity)
+	}
+
+	var serve = func(w http.ResponseWriter) error {
+		var err = authErr
+
+		if err == nil {
+			err = api.serve(w, r, &request)
+		}
+
+		if err != nil {
+			writeError(w, r, err)
+		}
+
+		return err
+	}
+	var err error
+
+	if key := r.Header.Get("Idempotency-Key"); key != "" && r.Method == "POST" && api.idempotency != nil && authErr == nil {
+		err = api.idempotency.serve(w, r, key, api.config.MaxBodySize, serve)
+	} else {
+		err = serve(w)
+	}
+
+	if debugWriter != nil {
+		var debug = debugWriter.debug(r, request.object)
+
+		apiLog.Debug("debug", "method", debug.Method, "path", debug.Path, "status", debug.Status, "request", debug.Request, "response", debug.Response)
+
+		if api.config.DebugBuffer != nil {
+			api.config.DebugBuffer.push(debug)
+		}
+	}
+
+	if statusWriter != nil && apiLog.Enabled(r.Context(), slog.LevelInfo) {
+		apiLog.Info("request", "method", r.Method, "path", r.URL.Path, "status", statusWriter.status, "duration", time.Since(startTime), "client", r.RemoteAddr, "resource", fmt.Sprintf("%T", request.resource))
+	}
+
+	if api.config.MetricsFunc != nil {
+		api.config.MetricsFunc(statusWriter.metrics(r, request.resource, time.Since(startTime)))
+	}
+
+	if api.config.AuditFunc != nil && auditMethods[r.Method] {
+		api.config.AuditFunc(statusWriter.audit(r, request.object, err))
+	}
+
+	if sessionWriter != nil {
+		sessionWriter.save()
+	}
+}
@@ -0,0 +1,2099 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qmsk/go-logging"
+)
+
+type testResource struct {
+	Name  string
+	Value int
+}
+
+func (resource *testResource) GetREST() (Resource, error) {
+	return resource, nil
+}
+
+type testIndex map[string]*testResource
+
+func (index testIndex) Index(name string) (Resource, error) {
+	if resource, ok := index[name]; !ok {
+		return nil, nil
+	} else {
+		return resource, nil
+	}
+}
+
+func (index testIndex) LinksREST() ([]string, error) {
+	var names []string
+
+	for name := range index {
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+type testTree map[string]Resource
+
+func (tree testTree) Index(name string) (Resource, error) {
+	return tree[name], nil
+}
+
+func makeTestAPI() API {
+	return MakeAPI(testIndex{
+		"foo": &testResource{Name: "foo", Value: 1},
+	})
+}
+
+func testRequest(handler http.Handler, request *http.Request) (*http.Response, string) {
+	var responseWriter = httptest.NewRecorder()
+
+	handler.ServeHTTP(responseWriter, request)
+
+	var response = responseWriter.Result()
+
+	if body, err := ioutil.ReadAll(response.Body); err != nil {
+		panic(err)
+	} else {
+		return response, string(body)
+	}
+}
+
+func TestResponsePretty(t *testing.T) {
+	var api = makeTestAPI()
+
+	for _, test := range []struct {
+		target string
+		accept string
+		body   string
+	}{
+		{"/foo", "", "{\"Name\":\"foo\",\"Value\":1}\n"},
+		{"/foo?pretty=1", "", "{\n  \"Name\": \"foo\",\n  \"Value\": 1\n}\n"},
+		{"/foo?pretty=false", "", "{\"Name\":\"foo\",\"Value\":1}\n"},
+		{"/foo", "application/json; indent=4", "{\n    \"Name\": \"foo\",\n    \"Value\": 1\n}\n"},
+	} {
+		var request = httptest.NewRequest("GET", test.target, nil)
+
+		if test.accept != "" {
+			request.Header.Set("Accept", test.accept)
+		}
+
+		if response, body := testRequest(api, request); response.StatusCode != 200 {
+			t.Errorf("GET %v => HTTP %v", test.target, response.StatusCode)
+		} else if body != test.body {
+			t.Errorf("GET %v (Accept: %v) => %#v, expected %#v", test.target, test.accept, body, test.body)
+		}
+	}
+}
+
+func TestResponseLinks(t *testing.T) {
+	var api = MakeAPIConfig(testIndex{
+		"foo": &testResource{Name: "foo", Value: 1},
+	}, APIConfig{Links: true})
+	var route = RoutePrefix("/api/", api)
+
+	for _, test := range []struct {
+		target string
+		links  Links
+	}{
+		{"/api/foo", Links{Self: "/api/foo", Parent: "/api/"}},
+	} {
+		var request = httptest.NewRequest("GET", test.target, nil)
+		var response, body = testRequest(route.Handler, request)
+		var links struct {
+			Links Links
+		}
+
+		if response.StatusCode != 200 {
+			t.Errorf("GET %v => HTTP %v", test.target, response.StatusCode)
+		} else if err := json.Unmarshal([]byte(body), &links); err != nil {
+			t.Errorf("GET %v => invalid JSON: %v", test.target, err)
+		} else if links.Links.Self != test.links.Self || links.Links.Parent != test.links.Parent {
+			t.Errorf("GET %v => links %#v, expected %#v", test.target, links.Links, test.links)
+		}
+	}
+
+	// as stripped by RoutePrefix
+	var request = httptest.NewRequest("GET", "/api/", nil)
+
+	request.URL.Path = ""
+
+	var links, err = MakeAPI(nil).makeLinks(request, testIndex{"foo": nil})
+
+	if err != nil {
+		t.Fatalf("makeLinks: %v", err)
+	} else if links.Parent != "" {
+		t.Errorf("makeLinks / => parent %#v, expected none", links.Parent)
+	} else if links.Children["foo"] != "/api/foo" {
+		t.Errorf("makeLinks / => children %#v", links.Children)
+	}
+}
+
+func TestAPIVersions(t *testing.T) {
+	var route = Options{}.RouteAPIVersions("/api/", map[string]Resource{
+		"v1":  testIndex{"foo": &testResource{Name: "foo", Value: 1}},
+		"v2":  testIndex{"foo": &testResource{Name: "foo", Value: 2}},
+		"v10": testIndex{"foo": &testResource{Name: "foo", Value: 10}},
+	})
+
+	for _, test := range []struct {
+		target        string
+		acceptVersion string
+		status        int
+		location      string
+		value         int
+	}{
+		{"/api/v1/foo", "", 200, "", 1},
+		{"/api/v2/foo", "", 200, "", 2},
+		{"/api/foo", "v2", 200, "", 2},
+		{"/api/foo", "v3", 406, "", 0},
+		{"/api/foo?pretty=1", "", 307, "/api/v10/foo?pretty=1", 0},
+	} {
+		var request = httptest.NewRequest("GET", test.target, nil)
+		var resource testResource
+
+		if test.acceptVersion != "" {
+			request.Header.Set("Accept-Version", test.acceptVersion)
+		}
+
+		var response, body = testRequest(route.Handler, request)
+
+		if response.StatusCode != test.status {
+			t.Errorf("GET %v => HTTP %v, expected %v", test.target, response.StatusCode, test.status)
+		} else if location := response.Header.Get("Location"); location != test.location {
+			t.Errorf("GET %v => Location %v, expected %v", test.target, location, test.location)
+		} else if test.value == 0 {
+
+		} else if err := json.Unmarshal([]byte(body), &resource); err != nil {
+			t.Errorf("GET %v => invalid JSON: %v", test.target, err)
+		} else if resource.Value != test.value {
+			t.Errorf("GET %v => value %v, expected %v", test.target, resource.Value, test.value)
+		}
+	}
+}
+
+type testPathIndex map[string]*testResource
+
+func (index testPathIndex) IndexPath(path string) (Resource, error) {
+	if resource, ok := index[path]; !ok {
+		return nil, nil
+	} else {
+		return resource, nil
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	var api = MakeAPI(testTree{
+		"files": testPathIndex{
+			"a/b/c":              &testResource{Name: "a/b/c"},
+			"../secret":          &testResource{Name: "../secret"},
+			"a/../../etc/passwd": &testResource{Name: "a/../../etc/passwd"},
+		},
+	})
+
+	for _, test := range []struct {
+		target string
+		status int
+	}{
+		{"/files/a/b/c", 200},
+		{"/files/a/b", 404},
+		{"/files/a/b/c/d", 404},
+		{"/files/..%2Fsecret", 400},
+		{"/files/a%2F..%2F..%2Fetc%2Fpasswd", 400},
+		{"/files/a/..%2F..%2Fetc%2Fpasswd", 400},
+	} {
+		var request = httptest.NewRequest("GET", test.target, nil)
+
+		if response, _ := testRequest(api, request); response.StatusCode != test.status {
+			t.Errorf("GET %v => HTTP %v, expected %v", test.target, response.StatusCode, test.status)
+		}
+	}
+}
+
+type testSlowResource time.Duration
+
+func (resource testSlowResource) GetREST() (Resource, error) {
+	time.Sleep(time.Duration(resource))
+
+	return true, nil
+}
+
+type testContextResource struct {
+	errChan chan error
+}
+
+func (resource testContextResource) RequestREST(r *http.Request) (Resource, error) {
+	return testContextRequest{resource, r.Context()}, nil
+}
+
+type testContextRequest struct {
+	testContextResource
+
+	ctx context.Context
+}
+
+func (resource testContextRequest) GetREST() (Resource, error) {
+	<-resource.ctx.Done()
+
+	resource.errChan <- resource.ctx.Err()
+
+	return nil, resource.ctx.Err()
+}
+
+type testBlockingResource struct {
+	release chan struct{}
+	calls   int32
+}
+
+func (resource *testBlockingResource) IntoREST() interface{} {
+	return &struct{}{}
+}
+
+func (resource *testBlockingResource) PostREST() (Resource, error) {
+	atomic.AddInt32(&resource.calls, 1)
+
+	<-resource.release
+
+	return true, nil
+}
+
+func TestAPITimeout(t *testing.T) {
+	var contextResource = testContextResource{make(chan error, 1)}
+	var api = MakeAPIConfig(testTree{
+		"fast":    testSlowResource(0),
+		"slow":    testSlowResource(1 * time.Second),
+		"context": contextResource,
+	}, APIConfig{Timeout: 100 * time.Millisecond})
+
+	for _, test := range []struct {
+		target string
+		status int
+	}{
+		{"/fast", 200},
+		{"/slow", 504},
+		{"/context", 504},
+	} {
+		var request = httptest.NewRequest("GET", test.target, nil)
+
+		if response, _ := testRequest(api, request); response.StatusCode != test.status {
+			t.Errorf("GET %v => HTTP %v, expected %v", test.target, response.StatusCode, test.status)
+		}
+	}
+
+	var response, body = testRequest(api, httptest.NewRequest("GET", "/slow", nil))
+	var timeoutError TimeoutError
+
+	if response.StatusCode != 504 {
+		t.Errorf("GET /slow => HTTP %v", response.StatusCode)
+	} else if err := json.Unmarshal([]byte(body), &timeoutError); err != nil {
+		t.Errorf("GET /slow => invalid JSON: %v", err)
+	} else if timeoutError.Method != "GetREST" || timeoutError.Timeout != "100ms" {
+		t.Errorf("GET /slow => %#v", timeoutError)
+	}
+
+	select {
+	case err := <-contextResource.errChan:
+		if err != context.DeadlineExceeded {
+			t.Errorf("GET /context => context error %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Errorf("GET /context => context not cancelled")
+	}
+}
+
+func TestAPITimeoutLocking(t *testing.T) {
+	var resource = &testBlockingResource{release: make(chan struct{})}
+	var api = MakeAPIConfig(testTree{
+		"blocking": resource,
+	}, APIConfig{Timeout: 50 * time.Millisecond, Locking: true})
+
+	var request = httptest.NewRequest("POST", "/blocking", strings.NewReader(`{}`))
+
+	request.Header.Set("Content-Type", "application/json")
+
+	if response, _ := testRequest(api, request); response.StatusCode != 504 {
+		t.Fatalf("POST /blocking => HTTP %v", response.StatusCode)
+	}
+
+	// retry waits for the timed out request
+	var retryChan = make(chan int)
+
+	go func() {
+		var request = httptest.NewRequest("POST", "/blocking", strings.NewReader(`{}`))
+
+		request.Header.Set("Content-Type", "application/json")
+
+		response, _ := testRequest(api, request)
+
+		retryChan <- response.StatusCode
+	}()
+
+	select {
+	case status := <-retryChan:
+		t.Fatalf("POST /blocking retry => HTTP %v before the timed out request returned", status)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(resource.release)
+
+	if status := <-retryChan; status != 504 {
+		t.Errorf("POST /blocking retry => HTTP %v", status)
+	}
+
+	if calls := atomic.LoadInt32(&resource.calls); calls != 1 {
+		t.Errorf("POST /blocking => %d calls, expected 1", calls)
+	}
+}
+
+func TestAPIMetrics(t *testing.T) {
+	var metrics []APIMetrics
+	var api = MakeAPIConfig(testIndex{
+		"foo": &testResource{Name: "foo", Value: 1},
+	}, APIConfig{MetricsFunc: func(m APIMetrics) { metrics = append(metrics, m) }})
+
+	testRequest(api, httptest.NewRequest("GET", "/foo", nil))
+	testRequest(api, httptest.NewRequest("GET", "/bar", nil))
+
+	if len(metrics) != 2 {
+		t.Fatalf("metrics: %#v", metrics)
+	}
+
+	if m := metrics[0]; m.Status != 200 || m.StatusClass() != "2xx" || m.Resource != "*web.testResource" || m.ResponseSize != 25 {
+		t.Errorf("GET /foo => metrics %#v", m)
+	}
+	if m := metrics[1]; m.Status != 404 || m.StatusClass() != "4xx" || m.Resource != "" {
+		t.Errorf("GET /bar => metrics %#v", m)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	var api = makeTestAPI()
+	var response, body = testRequest(api, httptest.NewRequest("DELETE", "/foo", nil))
+	var methodError MethodError
+
+	if response.StatusCode != 405 {
+		t.Errorf("DELETE /foo => HTTP %v", response.StatusCode)
+	} else if allow := response.Header.Get("Allow"); allow != "GET" {
+		t.Errorf("DELETE /foo => Allow: %v", allow)
+	} else if err := json.Unmarshal([]byte(body), &methodError); err != nil {
+		t.Errorf("DELETE /foo => invalid JSON: %v", err)
+	} else if methodError.Method != "DELETE" || len(methodError.Allow) != 1 || methodError.Allow[0] != "GET" {
+		t.Errorf("DELETE /foo => %#v", methodError)
+	}
+}
+
+func TestLookupInvalidPath(t *testing.T) {
+	var api = MakeAPIConfig(testTree{
+		"a b": testTree{
+			"c": &testResource{Name: "c"},
+		},
+	}, APIConfig{MaxDepth: 2})
+
+	for _, test := range []struct {
+		target string
+		status int
+	}{
+		{"/a%20b/c", 200},
+		{"/a%20b//c", 200},
+		{"/a%20b/./c", 200},
+		{"/a%20b/../c", 400},
+		{"/a%20b/%2E%2E/c", 400},
+		{"/a%20b/c/", 400},
+		{"/a%2Fb/c", 400},
+	} {
+		var request = httptest.NewRequest("GET", test.target, nil)
+
+		if response, _ := testRequest(api, request); response.StatusCode != test.status {
+			t.Errorf("GET %v => HTTP %v, expected %v", test.target, response.StatusCode, test.status)
+		}
+	}
+}
+
+func TestHandlerResource(t *testing.T) {
+	var paths []string
+	var api = MakeAPI(testTree{
+		"handler": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
+		}),
+	})
+
+	for _, target := range []string{"/handler", "/handler/", "/handler/a/b%20c"} {
+		var request = httptest.NewRequest("GET", target, nil)
+
+		if response, _ := testRequest(api, request); response.StatusCode != 200 {
+			t.Errorf("GET %v => HTTP %v", target, response.StatusCode)
+		}
+	}
+
+	if len(paths) != 3 || paths[0] != "" || paths[1] != "" || paths[2] != "a/b c" {
+		t.Errorf("handler paths: %#v", paths)
+	}
+}
+
+type testPanicResource struct{}
+
+func (resource testPanicResource) GetREST() (Resource, error) {
+	panic("test")
+}
+
+func TestAPIPanic(t *testing.T) {
+	for _, config := range []APIConfig{{}, {Timeout: 1 * time.Second}} {
+		var api = MakeAPIConfig(testTree{"panic": testPanicResource{}}, config)
+		var request = httptest.NewRequest("GET", "/panic", nil)
+
+		if response, _ := testRequest(api, request); response.StatusCode != 500 {
+			t.Errorf("GET /panic => HTTP %v", response.StatusCode)
+		}
+	}
+}
+
+type testPostResource struct {
+	testResource
+}
+
+func (resource *testPostResource) IntoREST() interface{} {
+	return &resource.testResource
+}
+
+func (resource *testPostResource) PostREST() (Resource, error) {
+	return &resource.testResource, nil
+}
+
+func TestAPIAudit(t *testing.T) {
+	var audits []APIAudit
+	var api = MakeAPIConfig(testTree{
+		"foo": &testPostResource{},
+	}, APIConfig{AuditFunc: func(audit APIAudit) { audits = append(audits, audit) }})
+
+	var request = httptest.NewRequest("POST", "/foo", strings.NewReader(`{"Name": "bar"}`))
+
+	request.Header.Set("Content-Type", "application/json")
+
+	testRequest(api, WithIdentity(request, "test"))
+	testRequest(api, httptest.NewRequest("GET", "/foo", nil))
+	testRequest(api, httptest.NewRequest("DELETE", "/foo", nil))
+
+	if len(audits) != 2 {
+		t.Fatalf("audits: %#v", audits)
+	}
+
+	if audit := audits[0]; audit.Method != "POST" || audit.Identity != "test" || audit.Status != 200 || audit.Error != nil {
+		t.Errorf("POST /foo => audit %#v", audit)
+	} else if object, ok := audit.Request.(*testResource); !ok || object.Name != "bar" {
+		t.Errorf("POST /foo => audit request %#v", audit.Request)
+	}
+
+	if audit := audits[1]; audit.Method != "DELETE" || audit.Status != 405 || audit.Error == nil {
+		t.Errorf("DELETE /foo => audit %#v", audit)
+	}
+}
+
+type testFormItem struct {
+	Name string `json:"name"`
+}
+
+type testForm struct {
+	Tags  []string       `json:"tags"`
+	Items []testFormItem `json:"items"`
+	Child struct {
+		Value int `json:"value"`
+	} `json:"child"`
+}
+
+type testFormResource struct {
+	testForm
+}
+
+func (resource *testFormResource) IntoREST() interface{} {
+	return &resource.testForm
+}
+
+func (resource *testFormResource) PostREST() (Resource, error) {
+	return &resource.testForm, nil
+}
+
+func TestDecodeForm(t *testing.T) {
+	var form testForm
+	var values = url.Values{
+		"tags[]":         []string{"a", "b"},
+		"items[0].name":  []string{"x"},
+		"items[1][name]": []string{"y"},
+		"child.value":    []string{"3"},
+	}
+
+	if err := decodeForm(&form, values, true); err != nil {
+		t.Fatalf("decodeForm: %v", err)
+	}
+
+	if len(form.Tags) != 2 || form.Tags[1] != "b" {
+		t.Errorf("decodeForm tags: %#v", form.Tags)
+	}
+	if len(form.Items) != 2 || form.Items[0].Name != "x" || form.Items[1].Name != "y" {
+		t.Errorf("decodeForm items: %#v", form.Items)
+	}
+	if form.Child.Value != 3 {
+		t.Errorf("decodeForm child: %#v", form.Child)
+	}
+
+	if err := decodeForm(&form, url.Values{"child.value": []string{"x"}}, true); err == nil {
+		t.Errorf("decodeForm invalid value: no error")
+	} else if err := validationError(err); !strings.Contains(err.Error(), "child.value") {
+		t.Errorf("decodeForm invalid value: %v", err)
+	}
+}
+
+type testUntaggedForm struct {
+	Name  string `json:"title"`
+	Value int
+}
+
+func TestDecodeFormFieldNames(t *testing.T) {
+	var form testUntaggedForm
+
+	if err := decodeForm(&form, url.Values{"Name": []string{"x"}, "Value": []string{"1"}}, false); err != nil {
+		t.Errorf("decodeForm: %v", err)
+	} else if form.Name != "x" || form.Value != 1 {
+		t.Errorf("decodeForm: %#v", form)
+	}
+
+	form = testUntaggedForm{}
+
+	if err := decodeForm(&form, url.Values{"title": []string{"y"}, "Value": []string{"2"}}, true); err != nil {
+		t.Errorf("decodeForm json names: %v", err)
+	} else if form.Name != "y" || form.Value != 2 {
+		t.Errorf("decodeForm json names: %#v", form)
+	}
+}
+
+func TestAPIMount(t *testing.T) {
+	var api = makeTestAPI().Mount("plugins/foo", MakeAPI(testIndex{
+		"bar": &testResource{Name: "bar", Value: 2},
+	})).Mount("plugins", MakeAPI(testIndex{
+		"baz": &testResource{Name: "baz", Value: 3},
+	}))
+
+	for _, test := range []struct {
+		target string
+		status int
+		value  int
+	}{
+		{"/foo", 200, 1},
+		{"/plugins/foo/bar", 200, 2},
+		{"/plugins/baz", 200, 3},
+		{"/plugins/foo/baz", 404, 0},
+	} {
+		var request = httptest.NewRequest("GET", test.target, nil)
+		var resource testResource
+		var response, body = testRequest(api, request)
+
+		if response.StatusCode != test.status {
+			t.Errorf("GET %v => HTTP %v, expected %v", test.target, response.StatusCode, test.status)
+		} else if test.value == 0 {
+
+		} else if err := json.Unmarshal([]byte(body), &resource); err != nil {
+			t.Errorf("GET %v => invalid JSON: %v", test.target, err)
+		} else if resource.Value != test.value {
+			t.Errorf("GET %v => value %v, expected %v", test.target, resource.Value, test.value)
+		}
+	}
+}
+
+type testCounterResource struct {
+	count int
+	input struct{}
+}
+
+func (resource *testCounterResource) IntoREST() interface{} {
+	return &resource.input
+}
+
+func (resource *testCounterResource) PostREST() (Resource, error) {
+	resource.count++
+
+	return resource.count, nil
+}
+
+func TestAPIIdempotency(t *testing.T) {
+	var resource testCounterResource
+	var api = MakeAPIConfig(testTree{
+		"count": &resource,
+	}, APIConfig{IdempotencyTTL: 1 * time.Minute})
+
+	for _, test := range []struct {
+		key     string
+		request string
+		status  int
+		body    string
+	}{
+		{"", "{}", 200, "1\n"},
+		{"a", "{}", 200, "2\n"},
+		{"a", "{}", 200, "2\n"},
+		{"a", `{"x": 1}`, 422, ""},
+		{"b", `{"x": 1}`, 200, "3\n"},
+	} {
+		var request = httptest.NewRequest("POST", "/count", strings.NewReader(test.request))
+
+		request.Header.Set("Content-Type", "application/json")
+
+		if test.key != "" {
+			request.Header.Set("Idempotency-Key", test.key)
+		}
+
+		if response, body := testRequest(api, request); response.StatusCode != test.status {
+			t.Errorf("POST /count (Idempotency-Key: %v) => HTTP %v, expected %v", test.key, response.StatusCode, test.status)
+		} else if test.status != 200 {
+
+		} else if body != test.body {
+			t.Errorf("POST /count (Idempotency-Key: %v) => %#v, expected %#v", test.key, body, test.body)
+		}
+	}
+}
+
+// ResponseWriter blocking writes until released
+type testBlockingWriter struct {
+	*httptest.ResponseRecorder
+
+	write   chan struct{}
+	release chan struct{}
+}
+
+func (w testBlockingWriter) Write(buf []byte) (int, error) {
+	w.write <- struct{}{}
+	<-w.release
+
+	return w.ResponseRecorder.Write(buf)
+}
+
+// Replaying a response to a slow client does not block other requests
+func TestAPIIdempotencyReplay(t *testing.T) {
+	var resource testCounterResource
+	var api = MakeAPIConfig(testTree{
+		"count": &resource,
+	}, APIConfig{IdempotencyTTL: 1 * time.Minute})
+
+	var makeRequest = func(key string) *http.Request {
+		var request = httptest.NewRequest("POST", "/count", strings.NewReader("{}"))
+
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Idempotency-Key", key)
+
+		return request
+	}
+
+	if response, body := testRequest(api, makeRequest("a")); response.StatusCode != 200 || body != "1\n" {
+		t.Fatalf("POST /count => HTTP %v: %v", response.StatusCode, body)
+	}
+
+	var writer = testBlockingWriter{httptest.NewRecorder(), make(chan struct{}), make(chan struct{})}
+	var done = make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		api.ServeHTTP(writer, makeRequest("a"))
+	}()
+
+	<-writer.write
+
+	var served = make(chan string)
+
+	go func() {
+		_, body := testRequest(api, makeRequest("b"))
+
+		served <- body
+	}()
+
+	select {
+	case body := <-served:
+		if body != "2\n" {
+			t.Errorf("POST /count during replay => %v", body)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("POST /count during replay: blocked")
+	}
+
+	close(writer.release)
+	<-done
+
+	if writer.Header().Get("Idempotent-Replayed") != "true" || writer.Body.String() != "1\n" {
+		t.Errorf("POST /count replay => %#v: %v", writer.Header(), writer.Body.String())
+	}
+}
+
+// Request bodies are hashed as they are read, including any part not read by the request handler
+func TestIdempotencyBody(t *testing.T) {
+	var body = makeIdempotencyBody(io.NopCloser(strings.NewReader("hello world")))
+	var buf = make([]byte, 5)
+
+	if _, err := io.ReadFull(body, buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	} else if err := body.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if sum, err := body.sum(); err != nil {
+		t.Errorf("sum: %v", err)
+	} else if sum != sha256.Sum256([]byte("hello world")) {
+		t.Errorf("sum: %x", sum)
+	}
+
+	// bodies over the MaxBodySize are not cached
+	var cache = makeIdempotencyCache(1 * time.Minute)
+	var serve = func(body string) *httptest.ResponseRecorder {
+		var request = httptest.NewRequest("POST", "/", strings.NewReader(body))
+		var response = httptest.NewRecorder()
+
+		request.ContentLength = -1
+
+		cache.serve(response, request, "a", 8, func(w http.ResponseWriter) error {
+			w.Write([]byte("ok"))
+
+			return nil
+		})
+
+		return response
+	}
+
+	if response := serve("too large body"); response.Code != 200 {
+		t.Errorf("serve too large => HTTP %v", response.Code)
+	} else if len(cache.responses) != 0 {
+		t.Errorf("serve too large => cached %#v", cache.responses)
+	}
+
+	if response := serve("small"); response.Code != 200 {
+		t.Errorf("serve => HTTP %v", response.Code)
+	} else if response := serve("other"); response.Code != 422 {
+		t.Errorf("serve with different body => HTTP %v", response.Code)
+	} else if response := serve("small"); response.Code != 200 || response.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("serve replay => HTTP %v %#v", response.Code, response.Header())
+	}
+}
+
+func TestIdempotencyExpire(t *testing.T) {
+	var cache = makeIdempotencyCache(1 * time.Minute)
+	var hash [32]byte
+
+	for _, key := range []string{"a", "b"} {
+		response, _ := cache.reserve(key)
+
+		response.status = 200
+
+		cache.complete(key, response, hash, nil)
+	}
+
+	cache.reserve("c")
+	cache.expire(time.Now().Add(2 * time.Minute))
+
+	if _, ok := cache.responses["a"]; ok || cache.expiry.Len() != 0 {
+		t.Errorf("expire: %d responses, %d expiring", len(cache.responses), cache.expiry.Len())
+	} else if _, ok := cache.responses["c"]; !ok {
+		t.Errorf("expire: in-progress response expired")
+	}
+}
+
+type testETagResource struct {
+	testPostResource
+	version int
+}
+
+func (resource *testETagResource) ETagREST() (string, error) {
+	return strconv.Itoa(resource.version), nil
+}
+
+func (resource *testETagResource) PutREST() (Resource, error) {
+	resource.version++
+
+	return &resource.testResource, nil
+}
+
+func (resource *testETagResource) DeleteREST() (Resource, error) {
+	return nil, nil
+}
+
+func TestAPIIfMatch(t *testing.T) {
+	var resource = testETagResource{version: 1}
+	var api = MakeAPIConfig(testTree{
+		"foo": &resource,
+	}, APIConfig{RequireIfMatch: true})
+
+	for _, test := range []struct {
+		method  string
+		ifMatch string
+		status  int
+		etag    string
+	}{
+		{"GET", "", 200, `"1"`},
+		{"PUT", "", 428, ""},
+		{"PUT", `"0"`, 412, ""},
+		{"PUT", `"0", "1"`, 200, `"2"`},
+		{"DELETE", `"1"`, 412, ""},
+		{"DELETE", `*`, 204, ""},
+	} {
+		var request = httptest.NewRequest(test.method, "/foo", strings.NewReader("{}"))
+
+		request.Header.Set("Content-Type", "application/json")
+
+		if test.ifMatch != "" {
+			request.Header.Set("If-Match", test.ifMatch)
+		}
+
+		if response, _ := testRequest(api, request); response.StatusCode != test.status {
+			t.Errorf("%v /foo (If-Match: %v) => HTTP %v, expected %v", test.method, test.ifMatch, response.StatusCode, test.status)
+		} else if etag := response.Header.Get("ETag"); etag != test.etag {
+			t.Errorf("%v /foo (If-Match: %v) => ETag %v, expected %v", test.method, test.ifMatch, etag, test.etag)
+		}
+	}
+}
+
+func TestSchemaResource(t *testing.T) {
+	var root = testIndex{
+		"foo": &testResource{Name: "foo", Value: 1},
+	}
+	var api = makeTestAPI().Mount("_schema", MakeAPI(MakeSchemaResource(root)))
+	var response, body = testRequest(api, httptest.NewRequest("GET", "/_schema", nil))
+	var paths []SchemaPath
+
+	if response.StatusCode != 200 {
+		t.Fatalf("GET /_schema => HTTP %v", response.StatusCode)
+	} else if err := json.Unmarshal([]byte(body), &paths); err != nil {
+		t.Fatalf("GET /_schema => invalid JSON: %v", err)
+	}
+
+	if len(paths) != 2 {
+		t.Fatalf("GET /_schema => %#v", paths)
+	}
+	if paths[0].Path != "/" || paths[0].Resource != "web.testIndex" || len(paths[0].Methods) != 0 {
+		t.Errorf("GET /_schema => %#v", paths[0])
+	}
+	if paths[1].Path != "/foo" || len(paths[1].Methods) != 1 || paths[1].Methods[0] != "GET" {
+		t.Errorf("GET /_schema => %#v", paths[1])
+	}
+
+	if fields := structFields(&testForm{}, "json"); strings.Join(fields, " ") != "tags items child.value" {
+		t.Errorf("structFields: %#v", fields)
+	}
+}
+
+type testIntIndex []*testResource
+
+func (index testIntIndex) IndexInt(id int) (Resource, error) {
+	if id < 0 || id >= len(index) {
+		return nil, nil
+	} else {
+		return index[id], nil
+	}
+}
+
+func TestLookupIndexInt(t *testing.T) {
+	var api = MakeAPI(testTree{
+		"items": testIntIndex{&testResource{Name: "0"}, &testResource{Name: "1"}},
+	})
+
+	for _, test := range []struct {
+		target string
+		status int
+	}{
+		{"/items/1", 200},
+		{"/items/2", 404},
+		{"/items/x", 404},
+	} {
+		var request = httptest.NewRequest("GET", test.target, nil)
+
+		if response, _ := testRequest(api, request); response.StatusCode != test.status {
+			t.Errorf("GET %v => HTTP %v, expected %v", test.target, response.StatusCode, test.status)
+		}
+	}
+}
+
+func TestAPILocking(t *testing.T) {
+	var resource testCounterResource
+	var api = MakeAPIConfig(testTree{
+		"count": &resource,
+	}, APIConfig{Locking: true})
+	var waitGroup sync.WaitGroup
+
+	for i := 0; i < 100; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+
+			var request = httptest.NewRequest("POST", "/count", strings.NewReader("{}"))
+
+			request.Header.Set("Content-Type", "application/json")
+
+			testRequest(api, request)
+		}()
+	}
+
+	waitGroup.Wait()
+
+	if resource.count != 100 {
+		t.Errorf("POST /count => count %v", resource.count)
+	}
+	if len(api.locks.locks) != 0 {
+		t.Errorf("locks: %#v", api.locks.locks)
+	}
+}
+
+type testMutableIndex struct {
+	items map[string]*testResource
+	post  testResource
+}
+
+func (index *testMutableIndex) Index(name string) (Resource, error) {
+	if resource, ok := index.items[name]; !ok {
+		return nil, nil
+	} else {
+		return resource, nil
+	}
+}
+
+func (index *testMutableIndex) IntoREST() interface{} {
+	return &index.post
+}
+
+func (index *testMutableIndex) PostREST() (Resource, error) {
+	var resource = index.post
+
+	index.items[resource.Name] = &resource
+
+	return &resource, nil
+}
+
+type testLockableIndex struct {
+	testMutableIndex
+
+	mutex sync.RWMutex
+}
+
+func (index *testLockableIndex) LockREST() *sync.RWMutex {
+	return &index.mutex
+}
+
+func TestAPILockingLookup(t *testing.T) {
+	for _, config := range []APIConfig{{Locking: true}, {}} {
+		var index Resource
+		var items = make(map[string]*testResource)
+
+		if config.Locking {
+			index = &testMutableIndex{items: items}
+		} else {
+			index = &testLockableIndex{testMutableIndex: testMutableIndex{items: items}}
+		}
+
+		var api = MakeAPIConfig(testTree{"items": index}, config)
+		var waitGroup sync.WaitGroup
+
+		for i := 0; i < 50; i++ {
+			var name = strconv.Itoa(i)
+
+			waitGroup.Add(2)
+			go func() {
+				defer waitGroup.Done()
+
+				var request = httptest.NewRequest("POST", "/items", strings.NewReader(`{"Name": "`+name+`"}`))
+
+				request.Header.Set("Content-Type", "application/json")
+
+				if response, _ := testRequest(api, request); response.StatusCode != 200 {
+					t.Errorf("POST /items => HTTP %v", response.StatusCode)
+				}
+			}()
+			go func() {
+				defer waitGroup.Done()
+
+				if response, _ := testRequest(api, httptest.NewRequest("GET", "/items/"+name, nil)); response.StatusCode != 200 && response.StatusCode != 404 {
+					t.Errorf("GET /items/%v => HTTP %v", name, response.StatusCode)
+				}
+			}()
+		}
+
+		waitGroup.Wait()
+
+		if len(items) != 50 {
+			t.Errorf("POST /items => %d items", len(items))
+		}
+	}
+}
+
+type testBodyResource struct {
+	body        string
+	contentType string
+}
+
+func (resource *testBodyResource) IntoREST() interface{} {
+	return nil
+}
+
+func (resource *testBodyResource) BodyREST(body io.Reader, contentType string, contentLength int64) error {
+	if buf, err := ioutil.ReadAll(body); err != nil {
+		return err
+	} else {
+		resource.body = string(buf)
+		resource.contentType = contentType
+	}
+
+	return nil
+}
+
+func (resource *testBodyResource) PostREST() (Resource, error) {
+	return len(resource.body), nil
+}
+
+func TestBodyResource(t *testing.T) {
+	var resource testBodyResource
+	var api = MakeAPI(testTree{"upload": &resource})
+	var request = httptest.NewRequest("POST", "/upload", strings.NewReader("test,data\n"))
+
+	request.Header.Set("Content-Type", "text/csv")
+
+	if response, body := testRequest(api, request); response.StatusCode != 200 {
+		t.Errorf("POST /upload => HTTP %v", response.StatusCode)
+	} else if body != "10\n" {
+		t.Errorf("POST /upload => %#v", body)
+	} else if resource.contentType != "text/csv" {
+		t.Errorf("POST /upload => Content-Type %v", resource.contentType)
+	}
+}
+
+func TestAPIDecodeLimits(t *testing.T) {
+	var api = MakeAPIConfig(testTree{
+		"foo":  &testPostResource{},
+		"form": &testFormResource{},
+	}, APIConfig{MaxBodySize: 64, DisallowUnknownFields: true, MaxBodyDepth: 2})
+
+	for _, test := range []struct {
+		target      string
+		contentType string
+		body        string
+		status      int
+		error       string
+	}{
+		{"/foo", "application/json", `{"Name": "foo"}`, 200, ""},
+		{"/foo", "application/json", `{"Name": "` + strings.Repeat("x", 64) + `"}`, 413, "Request body too large: limit is 64 bytes\n"},
+		{"/foo", "application/json", `{"Foo": "foo"}`, 422, "json: unknown field \"Foo\"\n"},
+		{"/form", "application/json", `{"child": {"value": 1}}`, 200, ""},
+		{"/form", "application/json", `{"items": [{"name": {}}]}`, 422, "Nesting too deep for field items.0: limit is 2\n"},
+		{"/form", "application/x-www-form-urlencoded", "tags=" + strings.Repeat("x", 64), 413, "Request body too large: limit is 64 bytes\n"},
+	} {
+		var request = httptest.NewRequest("POST", test.target, strings.NewReader(test.body))
+
+		request.Header.Set("Content-Type", test.contentType)
+
+		// test streaming limits
+		request.ContentLength = -1
+
+		if response, body := testRequest(api, request); response.StatusCode != test.status {
+			t.Errorf("POST %v %v => HTTP %v, expected %v: %v", test.target, test.body, response.StatusCode, test.status, body)
+		} else if test.error != "" && body != test.error {
+			t.Errorf("POST %v %v => %#v, expected %#v", test.target, test.body, body, test.error)
+		}
+	}
+}
+
+type testSuggestIndex map[string]*testResource
+
+func (index testSuggestIndex) Index(name string) (Resource, error) {
+	if resource, ok := index[name]; ok {
+		return resource, nil
+	}
+
+	var notFoundError = NotFoundError{Name: name, Reason: "unknown"}
+
+	for name := range index {
+		notFoundError.Suggestions = append(notFoundError.Suggestions, name)
+	}
+
+	return nil, notFoundError
+}
+
+func TestNotFoundError(t *testing.T) {
+	var api = MakeAPI(testSuggestIndex{"foo": &testResource{}})
+	var response, body = testRequest(api, httptest.NewRequest("GET", "/bar", nil))
+	var notFoundError NotFoundError
+
+	if response.StatusCode != 404 {
+		t.Errorf("GET /bar => HTTP %v", response.StatusCode)
+	} else if contentType := response.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("GET /bar => Content-Type %v", contentType)
+	} else if err := json.Unmarshal([]byte(body), &notFoundError); err != nil {
+		t.Errorf("GET /bar => invalid JSON: %v", err)
+	} else if notFoundError.Name != "bar" || notFoundError.Reason != "unknown" || len(notFoundError.Suggestions) != 1 || notFoundError.Suggestions[0] != "foo" {
+		t.Errorf("GET /bar => %#v", notFoundError)
+	}
+}
+
+type testQueryResource struct {
+	testResource
+
+	query struct {
+		A int
+		B int
+		C string
+	}
+}
+
+func (resource *testQueryResource) QueryREST() interface{} {
+	return &resource.query
+}
+
+func TestQueryValidationError(t *testing.T) {
+	var api = MakeAPI(testTree{"foo": &testQueryResource{}})
+	var response, body = testRequest(api, httptest.NewRequest("GET", "/foo?a=x&b=y&c=z", nil))
+	var validationError ValidationError
+
+	if response.StatusCode != 422 {
+		t.Errorf("GET /foo => HTTP %v", response.StatusCode)
+	} else if err := json.Unmarshal([]byte(body), &validationError); err != nil {
+		t.Errorf("GET /foo => invalid JSON: %v", err)
+	} else if len(validationError.Fields) != 2 || validationError.Fields["a"] == "" || validationError.Fields["b"] == "" {
+		t.Errorf("GET /foo => %#v", validationError)
+	}
+}
+
+type testFormValuesResource struct {
+	values struct {
+		A int
+		B int
+		C string
+	}
+}
+
+func (resource *testFormValuesResource) IntoREST() interface{} {
+	return &resource.values
+}
+
+func (resource *testFormValuesResource) PostREST() (Resource, error) {
+	return &resource.values, nil
+}
+
+func TestFormValidationError(t *testing.T) {
+	var api = MakeAPI(testTree{"foo": &testFormValuesResource{}})
+	var request = httptest.NewRequest("POST", "/foo", strings.NewReader("A=x&B=y&C=z"))
+	var validationError ValidationError
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var response, body = testRequest(api, request)
+
+	if response.StatusCode != 422 {
+		t.Errorf("POST /foo => HTTP %v", response.StatusCode)
+	} else if contentType := response.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("POST /foo => Content-Type %v: %v", contentType, body)
+	} else if err := json.Unmarshal([]byte(body), &validationError); err != nil {
+		t.Errorf("POST /foo => invalid JSON: %v", err)
+	} else if len(validationError.Fields) != 2 || !strings.Contains(validationError.Fields["A"], "Invalid value for field A") || !strings.Contains(validationError.Fields["B"], "Invalid value for field B") {
+		t.Errorf("POST /foo => %#v", validationError)
+	}
+}
+
+func TestAsError(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		status int
+	}{
+		{Error{404, nil}, 404},
+		{fmt.Errorf("wrapped: %w", Errorf(409, "conflict")), 409},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), 504},
+		{context.Canceled, 499},
+		{fmt.Errorf("other"), 0},
+	} {
+		if httpError, ok := AsError(test.err); test.status == 0 && ok {
+			t.Errorf("AsError(%v) => %#v, expected none", test.err, httpError)
+		} else if test.status != 0 && !IsStatus(test.err, test.status) {
+			t.Errorf("IsStatus(%v, %v) => false", test.err, test.status)
+		}
+	}
+
+	var err = fmt.Errorf("wrapped: %w", Error{500, io.EOF})
+
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("errors.Is(%v, io.EOF) => false", err)
+	}
+}
+
+type testCreateIndex map[string]*testPutResource
+
+func (index testCreateIndex) Index(name string) (Resource, error) {
+	if resource, ok := index[name]; !ok {
+		return nil, nil
+	} else {
+		return resource, nil
+	}
+}
+
+func (index testCreateIndex) CreateIndex(name string) (Resource, error) {
+	var resource = &testPutResource{index: index, name: name}
+
+	return resource, nil
+}
+
+type testPutResource struct {
+	testResource
+
+	index testCreateIndex
+	name  string
+}
+
+func (resource *testPutResource) IntoREST() interface{} {
+	return &resource.testResource
+}
+
+func (resource *testPutResource) PutREST() (Resource, error) {
+	resource.index[resource.name] = resource
+
+	return &resource.testResource, nil
+}
+
+func TestCreateIndexResource(t *testing.T) {
+	var index = testCreateIndex{}
+	var api = MakeAPI(index)
+
+	if response, _ := testRequest(api, httptest.NewRequest("GET", "/foo", nil)); response.StatusCode != 404 {
+		t.Errorf("GET /foo => HTTP %v, expected 404", response.StatusCode)
+	}
+
+	var request = httptest.NewRequest("PUT", "/foo", strings.NewReader(`{"Name": "bar"}`))
+
+	request.Header.Set("Content-Type", "application/json")
+
+	if response, body := testRequest(api, request); response.StatusCode != 200 {
+		t.Errorf("PUT /foo => HTTP %v: %v", response.StatusCode, body)
+	} else if resource, ok := index["foo"]; !ok {
+		t.Errorf("PUT /foo => not created")
+	} else if resource.Name != "bar" {
+		t.Errorf("PUT /foo => created %#v", resource.testResource)
+	}
+
+	if response, body := testRequest(api, httptest.NewRequest("GET", "/foo", nil)); response.StatusCode != 200 {
+		t.Errorf("GET /foo => HTTP %v: %v", response.StatusCode, body)
+	}
+
+	if response, _ := testRequest(api, httptest.NewRequest("PUT", "/bar/baz", strings.NewReader(`{}`))); response.StatusCode != 404 {
+		t.Errorf("PUT /bar/baz => HTTP %v, expected 404", response.StatusCode)
+	}
+}
+
+func TestAPIDebug(t *testing.T) {
+	var debugBuffer = MakeDebugBuffer(2)
+	var api = MakeAPIConfig(testTree{
+		"foo": &testPostResource{},
+	}, APIConfig{DebugSize: 16, DebugBuffer: debugBuffer})
+
+	for _, name := range []string{"a", "b", "quux-quux-quux"} {
+		var request = httptest.NewRequest("POST", "/foo", strings.NewReader(`{"Name": "`+name+`"}`))
+
+		request.Header.Set("Content-Type", "application/json")
+
+		testRequest(api, request)
+	}
+
+	var entries = debugBuffer.Entries()
+
+	if len(entries) != 2 {
+		t.Fatalf("debug entries: %#v", entries)
+	}
+
+	if entries[0].Request != `{"Name":"b","Val...` {
+		t.Errorf("debug request: %#v", entries[0].Request)
+	}
+	if entries[1].Status != 200 || entries[1].Response != `{"Name":"quux-qu...` {
+		t.Errorf("debug response: %#v", entries[1])
+	}
+
+	var debugAPI = MakeAPI(debugBuffer)
+
+	if response, body := testRequest(debugAPI, httptest.NewRequest("GET", "/", nil)); response.StatusCode != 200 {
+		t.Errorf("GET / => HTTP %v: %v", response.StatusCode, body)
+	} else if !strings.Contains(body, `"path":"/foo"`) {
+		t.Errorf("GET / => %v", body)
+	}
+}
+
+// Streaming and hijacking HandlerResources are passed through the debug writer
+func TestAPIDebugHandler(t *testing.T) {
+	var debugBuffer = MakeDebugBuffer(2)
+	var api = MakeAPIConfig(testTree{
+		"stream": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("data: 1\n\n"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("data: 2\n\n"))
+		}),
+		"hijack": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Hijack: %v", err)
+				return
+			}
+			defer conn.Close()
+
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+			buf.Flush()
+		}),
+	}, APIConfig{DebugSize: 64, DebugBuffer: debugBuffer})
+
+	var recorder = httptest.NewRecorder()
+
+	api.ServeHTTP(recorder, httptest.NewRequest("GET", "/stream", nil))
+
+	if !recorder.Flushed || recorder.Body.String() != "data: 1\n\ndata: 2\n\n" {
+		t.Errorf("GET /stream => flushed=%v: %#v", recorder.Flushed, recorder.Body.String())
+	}
+
+	var server = httptest.NewServer(api)
+	defer server.Close()
+
+	if response, err := http.Get(server.URL + "/hijack"); err != nil {
+		t.Errorf("GET /hijack: %v", err)
+	} else if body, err := ioutil.ReadAll(response.Body); err != nil {
+		t.Errorf("GET /hijack: %v", err)
+	} else if string(body) != "hijacked" {
+		t.Errorf("GET /hijack => %v", string(body))
+	}
+
+	// the hijacked request is recorded once the server handler returns
+	var entries = debugBuffer.Entries()
+
+	for start := time.Now(); len(entries) < 2 && time.Since(start) < time.Second; entries = debugBuffer.Entries() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("debug entries: %#v", entries)
+	} else if entries[0].Path != "/stream" || entries[0].Response != "data: 1\n\n" {
+		t.Errorf("debug stream: %#v", entries[0])
+	} else if entries[1].Path != "/hijack" || entries[1].Status != 101 || entries[1].Response != "" {
+		t.Errorf("debug hijack: %#v", entries[1])
+	}
+}
+
+func TestAPILogging(t *testing.T) {
+	var buf bytes.Buffer
+	var api = MakeAPI(testTree{
+		"foo": &testPostResource{},
+	})
+
+	SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer SetLogging(logging.Logging{})
+
+	if levels, err := parseLogLevels("warn,api=info"); err != nil {
+		t.Fatalf("parseLogLevels: %v", err)
+	} else if levels[LogAPI] != slog.LevelInfo || levels[LogEvents] != slog.LevelWarn {
+		t.Fatalf("parseLogLevels: %#v", levels)
+	} else {
+		for component, level := range levels {
+			SetLogLevel(component, level)
+		}
+	}
+
+	if _, err := parseLogLevels("api=loud"); err == nil {
+		t.Errorf("parseLogLevels: expected error")
+	}
+
+	testRequest(api, httptest.NewRequest("GET", "/foo", nil))
+
+	var record struct {
+		Msg       string
+		Component string
+		Method    string
+		Path      string
+		Status    int
+	}
+
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("log %s: %v", buf.String(), err)
+	}
+
+	if record.Msg != "request" || record.Component != LogAPI || record.Method != "GET" || record.Path != "/foo" || record.Status != 200 {
+		t.Errorf("log: %s", buf.String())
+	}
+
+	SetLogLevel(LogAPI, slog.LevelWarn)
+	defer SetLogLevel(LogAPI, slog.LevelInfo)
+
+	buf.Reset()
+	testRequest(api, httptest.NewRequest("GET", "/foo", nil))
+
+	if buf.Len() != 0 {
+		t.Errorf("log at warn level: %s", buf.String())
+	}
+}
+
+type testSpan struct {
+	tracer *testTracer
+	name   string
+	attrs  map[string]interface{}
+}
+
+func (span *testSpan) SetAttribute(key string, value interface{}) {
+	span.attrs[key] = value
+}
+
+func (span *testSpan) End(err error) {
+	span.tracer.spans = append(span.tracer.spans, span.name)
+}
+
+type testTracer struct {
+	parent string
+	spans  []string
+	server *testSpan
+}
+
+func (tracer *testTracer) StartRequest(r *http.Request, name string) (context.Context, Span) {
+	tracer.parent = r.Header.Get("traceparent")
+	tracer.server = &testSpan{tracer, name, make(map[string]interface{})}
+
+	return r.Context(), tracer.server
+}
+
+func (tracer *testTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, &testSpan{tracer, name, make(map[string]interface{})}
+}
+
+type testApplyResource struct {
+	testPostResource
+
+	applied bool
+}
+
+func (resource *testApplyResource) ApplyREST() error {
+	resource.applied = true
+
+	return nil
+}
+
+func TestAPITracing(t *testing.T) {
+	var tracer testTracer
+	var resource = &testApplyResource{}
+	var options = Options{Tracer: &tracer}
+	var handler = options.Handler(options.RouteAPI("/api/", MakeAPI(testTree{
+		"foo": resource,
+	})))
+
+	var request = httptest.NewRequest("POST", "/api/foo", strings.NewReader(`{"Name": "bar"}`))
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	if response, body := testRequest(handler, request); response.StatusCode != 200 {
+		t.Fatalf("POST /api/foo => HTTP %v: %v", response.StatusCode, body)
+	}
+
+	if !resource.applied {
+		t.Errorf("POST /api/foo => not applied")
+	}
+
+	if tracer.parent != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("traceparent: %#v", tracer.parent)
+	}
+
+	if expected := []string{"lookup", "PostREST", "ApplyREST", "POST /api/"}; !reflect.DeepEqual(tracer.spans, expected) {
+		t.Errorf("spans %#v, expected %#v", tracer.spans, expected)
+	}
+
+	if tracer.server.attrs["http.status_code"] != 200 || tracer.server.attrs["http.route"] != "/api/" {
+		t.Errorf("server span attributes: %#v", tracer.server.attrs)
+	}
+}
+
+func TestRouteDebug(t *testing.T) {
+	var options = Options{Debug: true, DebugLocal: true, DebugToken: "secret"}
+	var handler = options.Handler(options.RouteDebug("/debug/"))
+
+	var localRequest = func(target string) *http.Request {
+		var request = httptest.NewRequest("GET", target, nil)
+
+		request.RemoteAddr = "127.0.0.1:1234"
+
+		return request
+	}
+
+	if response, _ := testRequest(handler, httptest.NewRequest("GET", "/debug/vars?token=secret", nil)); response.StatusCode != 403 {
+		t.Errorf("GET /debug/vars from remote => HTTP %v, expected 403", response.StatusCode)
+	}
+	for _, remoteAddr := range []string{"", "@", "localhost", "localhost:1234"} {
+		var request = localRequest("/debug/vars?token=secret")
+
+		request.RemoteAddr = remoteAddr
+
+		if response, _ := testRequest(handler, request); response.StatusCode != 403 {
+			t.Errorf("GET /debug/vars from %#v => HTTP %v, expected 403", remoteAddr, response.StatusCode)
+		}
+	}
+
+	var unixRequest = httptest.NewRequest("GET", "/debug/vars?token=secret", nil).WithContext(
+		context.WithValue(context.Background(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/test.sock", Net: "unix"}),
+	)
+
+	unixRequest.RemoteAddr = "@"
+
+	if response, _ := testRequest(handler, unixRequest); response.StatusCode != 200 {
+		t.Errorf("GET /debug/vars from unix socket => HTTP %v, expected 200", response.StatusCode)
+	}
+	if response, _ := testRequest(handler, localRequest("/debug/vars")); response.StatusCode != 401 {
+		t.Errorf("GET /debug/vars without token => HTTP %v, expected 401", response.StatusCode)
+	}
+	if response, body := testRequest(handler, localRequest("/debug/vars?token=secret")); response.StatusCode != 200 {
+		t.Errorf("GET /debug/vars => HTTP %v: %v", response.StatusCode, body)
+	} else if !strings.Contains(body, `"memstats"`) {
+		t.Errorf("GET /debug/vars => %v", body)
+	}
+
+	var request = localRequest("/debug/pprof/goroutine?debug=1")
+
+	request.Header.Set("Authorization", "Bearer secret")
+
+	if response, body := testRequest(handler, request); response.StatusCode != 200 {
+		t.Errorf("GET /debug/pprof/goroutine => HTTP %v: %v", response.StatusCode, body)
+	} else if !strings.Contains(body, "goroutine profile:") {
+		t.Errorf("GET /debug/pprof/goroutine => %v", body)
+	}
+
+	if response, body := testRequest(handler, localRequest("/debug/pprof/?token=secret")); response.StatusCode != 200 {
+		t.Errorf("GET /debug/pprof/ => HTTP %v: %v", response.StatusCode, body)
+	} else if !strings.Contains(body, `href='goroutine?debug=1'`) {
+		t.Errorf("GET /debug/pprof/ => %v", body)
+	}
+
+	// opt-in
+	var disabledOptions = Options{DebugToken: "secret"}
+	var disabledHandler = disabledOptions.Handler(disabledOptions.RouteDebug("/debug/"))
+
+	if response, _ := testRequest(disabledHandler, localRequest("/debug/pprof/?token=secret")); response.StatusCode != 404 {
+		t.Errorf("GET /debug/pprof/ without --http-debug => HTTP %v, expected 404", response.StatusCode)
+	}
+}
+
+func TestRouteHealth(t *testing.T) {
+	var ready = fmt.Errorf("starting")
+	var options = Options{}
+	var handler = options.Handler(options.RouteHealth("/healthz/",
+		HealthCheck{"db", func(ctx context.Context) error { return nil }},
+		HealthCheck{"backend", func(ctx context.Context) error { return ready }},
+	))
+
+	if response, body := testRequest(handler, httptest.NewRequest("GET", "/healthz/live", nil)); response.StatusCode != 200 {
+		t.Errorf("GET /healthz/live => HTTP %v: %v", response.StatusCode, body)
+	}
+
+	var status HealthStatus
+
+	if response, body := testRequest(handler, httptest.NewRequest("GET", "/healthz/ready", nil)); response.StatusCode != 503 {
+		t.Errorf("GET /healthz/ready => HTTP %v, expected 503", response.StatusCode)
+	} else if contentType := response.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("GET /healthz/ready => Content-Type %v", contentType)
+	} else if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	} else if status.OK || !status.Checks["db"].OK || status.Checks["backend"].OK || status.Checks["backend"].Error != "starting" {
+		t.Errorf("GET /healthz/ready => %#v", status)
+	}
+
+	ready = nil
+
+	if response, body := testRequest(handler, httptest.NewRequest("GET", "/healthz/ready", nil)); response.StatusCode != 200 {
+		t.Errorf("GET /healthz/ready => HTTP %v: %v", response.StatusCode, body)
+	}
+}
+
+func TestLoadOptionsEnv(t *testing.T) {
+	t.Setenv("HTTP_STATIC", "./static")
+	t.Setenv("HTTP_METRICS", "true")
+
+	if options, err := LoadOptionsEnv(); err != nil {
+		t.Fatalf("LoadOptionsEnv: %v", err)
+	} else if options.Listen != ":8284" || options.StaticCacheControl != "no-cache" {
+		t.Errorf("LoadOptionsEnv defaults: %#v", options)
+	} else if options.Static != "./static" || !options.Metrics {
+		t.Errorf("LoadOptionsEnv: %#v", options)
+	}
+
+	t.Setenv("HTTP_METRICS", "maybe")
+
+	if _, err := LoadOptionsEnv(); err == nil {
+		t.Errorf("LoadOptionsEnv with invalid HTTP_METRICS: expected error")
+	}
+}
+
+func TestLoadOptions(t *testing.T) {
+	var dir = t.TempDir()
+	var files = map[string]string{
+		"options.yaml": "# server\nlisten: 127.0.0.1:8080\nread-timeout: 30s\nstatic_cache_control: \"max-age=60\" # cache\ncors-origin:\n  - https://example.com\n  - 'https://other.example.com'\nmetrics: true\n",
+		"options.toml": "listen = \"127.0.0.1:8080\"\nread_timeout = \"30s\"\nstatic-cache-control = 'max-age=60'\ncors-origin = [\"https://example.com\", \"https://other.example.com\"]\nmetrics = true\n",
+		"options.json": `{"listen": "127.0.0.1:8080", "read-timeout": "30s", "static-cache-control": "max-age=60", "cors-origin": ["https://example.com", "https://other.example.com"], "metrics": true}`,
+	}
+
+	for name, content := range files {
+		var path = filepath.Join(dir, name)
+
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+
+		options, err := LoadOptions(path)
+		if err != nil {
+			t.Errorf("LoadOptions %v: %v", name, err)
+			continue
+		}
+
+		if options.Listen != "127.0.0.1:8080" || options.ReadTimeout != 30*time.Second || options.StaticCacheControl != "max-age=60" || !options.Metrics {
+			t.Errorf("LoadOptions %v: %#v", name, options)
+		}
+		if !reflect.DeepEqual(options.CORSOrigins, []string{"https://example.com", "https://other.example.com"}) {
+			t.Errorf("LoadOptions %v: CORSOrigins %#v", name, options.CORSOrigins)
+		}
+	}
+
+	// flags override file values, even if equal to the default
+	var options = DefaultOptions()
+
+	options.Listen = ":9090"
+
+	if err := options.LoadFile(filepath.Join(dir, "options.yaml"), "http-listen"); err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	} else if options.Listen != ":9090" || options.ReadTimeout != 30*time.Second {
+		t.Errorf("LoadFile: %#v", options)
+	}
+
+	options = DefaultOptions()
+
+	if err := options.LoadFile(filepath.Join(dir, "options.toml"), "--http-listen", "static-cache-control"); err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	} else if options.Listen != ":8284" || options.StaticCacheControl != "no-cache" || options.ReadTimeout != 30*time.Second {
+		t.Errorf("LoadFile with default flags: %#v", options)
+	}
+
+	// values differing from the defaults without any flags are overridden
+	options = DefaultOptions()
+	options.Listen = ":9090"
+
+	if err := options.LoadFile(filepath.Join(dir, "options.json")); err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	} else if options.Listen != "127.0.0.1:8080" {
+		t.Errorf("LoadFile without flags: %#v", options)
+	}
+
+	for name, content := range map[string]string{
+		"nested.yaml":  "listen:\n  host: localhost\n",
+		"nested.toml":  "[listen]\nhost = \"localhost\"\n",
+		"invalid.yaml": "listen: [\n",
+		"invalid.toml": "listen = \n",
+	} {
+		var path = filepath.Join(dir, name)
+
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		} else if _, err := LoadOptions(path); err == nil {
+			t.Errorf("LoadOptions %v: expected error", name)
+		}
+	}
+
+	var path = filepath.Join(dir, "unknown.yaml")
+
+	if err := os.WriteFile(path, []byte("listen: :8080\nlisten-port: 8080\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	} else if _, err := LoadOptions(path); err == nil || !strings.Contains(err.Error(), "listen-port") {
+		t.Errorf("LoadOptions with unknown option: %v", err)
+	}
+}
+
+func TestOptionsCORS(t *testing.T) {
+	var options = Options{CORSOrigins: []string{"https://example.com"}}
+	var handler = options.Handler(options.RouteAPI("/api/", MakeAPI(testTree{
+		"foo": &testPostResource{},
+	})))
+
+	var request = httptest.NewRequest("OPTIONS", "/api/foo", nil)
+
+	request.Header.Set("Origin", "https://example.com")
+	request.Header.Set("Access-Control-Request-Method", "POST")
+	request.Header.Set("Access-Control-Request-Headers", "content-type, x-unknown, authorization")
+
+	if response, _ := testRequest(handler, request); response.StatusCode != 204 {
+		t.Errorf("OPTIONS /api/foo => HTTP %v, expected 204", response.StatusCode)
+	} else if response.Header.Get("Access-Control-Allow-Origin") != "https://example.com" || response.Header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("OPTIONS /api/foo => headers %#v", response.Header)
+	} else if headers := response.Header.Get("Access-Control-Allow-Headers"); headers != "Content-Type, Authorization" {
+		t.Errorf("OPTIONS /api/foo => Access-Control-Allow-Headers %v", headers)
+	}
+
+	request = httptest.NewRequest("OPTIONS", "/api/foo", nil)
+	request.Header.Set("Origin", "https://example.com")
+	request.Header.Set("Access-Control-Request-Method", "POST")
+	request.Header.Set("Access-Control-Request-Headers", "X-Unknown")
+
+	if response, _ := testRequest(handler, request); response.StatusCode != 204 {
+		t.Errorf("OPTIONS /api/foo => HTTP %v, expected 204", response.StatusCode)
+	} else if headers, ok := response.Header["Access-Control-Allow-Headers"]; ok {
+		t.Errorf("OPTIONS /api/foo with unknown header => Access-Control-Allow-Headers %v", headers)
+	}
+
+	request = httptest.NewRequest("GET", "/api/foo", nil)
+	request.Header.Set("Origin", "https://other.example.com")
+
+	if response, _ := testRequest(handler, request); response.StatusCode != 200 {
+		t.Errorf("GET /api/foo => HTTP %v", response.StatusCode)
+	} else if origin := response.Header.Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("GET /api/foo from other origin => Access-Control-Allow-Origin %v", origin)
+	}
+
+	// wildcard origins do not allow credentials
+	options = Options{CORSOrigins: []string{"*"}, CORSHeaders: []string{"X-Custom"}}
+	handler = options.Handler(options.RouteAPI("/api/", MakeAPI(testTree{
+		"foo": &testPostResource{},
+	})))
+
+	request = httptest.NewRequest("OPTIONS", "/api/foo", nil)
+	request.Header.Set("Origin", "https://other.example.com")
+	request.Header.Set("Access-Control-Request-Method", "POST")
+	request.Header.Set("Access-Control-Request-Headers", "X-Custom, X-Unknown")
+
+	if response, _ := testRequest(handler, request); response.StatusCode != 204 {
+		t.Errorf("OPTIONS /api/foo => HTTP %v, expected 204", response.StatusCode)
+	} else if origin := response.Header.Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("OPTIONS /api/foo with wildcard => Access-Control-Allow-Origin %v", origin)
+	} else if credentials, ok := response.Header["Access-Control-Allow-Credentials"]; ok {
+		t.Errorf("OPTIONS /api/foo with wildcard => Access-Control-Allow-Credentials %v", credentials)
+	} else if headers := response.Header.Get("Access-Control-Allow-Headers"); headers != "X-Custom" {
+		t.Errorf("OPTIONS /api/foo with wildcard => Access-Control-Allow-Headers %v", headers)
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	var audits []APIAudit
+	var api = MakeAPIConfig(testTree{
+		"foo": &testPostResource{},
+	}, APIConfig{
+		AuthFunc: func(r *http.Request) (string, error) {
+			if token := r.Header.Get("Authorization"); token != "Bearer test" {
+				return "", Errorf(http.StatusUnauthorized, "Invalid token")
+			} else {
+				return "test", nil
+			}
+		},
+		AuditFunc: func(audit APIAudit) { audits = append(audits, audit) },
+	})
+
+	if response, body := testRequest(api, httptest.NewRequest("GET", "/foo", nil)); response.StatusCode != 401 {
+		t.Errorf("GET /foo without token => HTTP %v, expected 401", response.StatusCode)
+	} else if !strings.Contains(body, "Invalid token") {
+		t.Errorf("GET /foo without token => %v", body)
+	}
+
+	var request = httptest.NewRequest("POST", "/foo", strings.NewReader(`{"Name": "bar"}`))
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer test")
+
+	if response, body := testRequest(api, request); response.StatusCode != 200 {
+		t.Errorf("POST /foo => HTTP %v: %v", response.StatusCode, body)
+	}
+
+	if len(audits) != 1 || audits[0].Identity != "test" {
+		t.Errorf("audits: %#v", audits)
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "api-keys")
+
+	if err := os.WriteFile(path, []byte("# test keys\nkey1 alice\nkey2 bob 1 2\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	var options = Options{APIKeys: path}
+	var audits []APIAudit
+
+	auth, err := options.APIKeyAuth()
+	if err != nil {
+		t.Fatalf("APIKeyAuth: %v", err)
+	}
+
+	auth.config.Query = "api_key"
+
+	var api = MakeAPIConfig(testTree{
+		"foo": &testPostResource{},
+	}, APIConfig{
+		AuthFunc:  auth.AuthFunc,
+		AuditFunc: func(audit APIAudit) { audits = append(audits, audit) },
+	})
+
+	var request = func(method string, target string, key string) *http.Request {
+		var request = httptest.NewRequest(method, target, strings.NewReader(`{"Name": "bar"}`))
+
+		request.Header.Set("Content-Type", "application/json")
+
+		if key != "" {
+			request.Header.Set("X-API-Key", key)
+		}
+
+		return request
+	}
+
+	for _, test := range []struct {
+		request *http.Request
+		status  int
+	}{
+		{request("GET", "/foo", ""), 401},
+		{request("GET", "/foo", "wrong"), 401},
+		{request("GET", "/foo", "key1"), 200},
+		{request("GET", "/foo?api_key=key1", ""), 200},
+		{request("POST", "/foo", "key2"), 200},
+		{request("POST", "/foo", "key2"), 200},
+		{request("POST", "/foo", "key2"), 429},
+	} {
+		if response, body := testRequest(api, test.request); response.StatusCode != test.status {
+			t.Errorf("%v %v => HTTP %v, expected %v: %v", test.request.Method, test.request.URL, response.StatusCode, test.status, body)
+		}
+	}
+
+	if len(audits) != 3 || audits[0].Identity != "bob" || audits[2].Status != 429 {
+		t.Errorf("audits: %#v", audits)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	for _, store := range []SessionStore{nil, MakeMemorySessionStore()} {
+		sessions, err := MakeSessions(SessionConfig{
+			Keys:   [][]byte{[]byte("new key"), []byte("old key")},
+			Secure: true,
+			Store:  store,
+		})
+		if err != nil {
+			t.Fatalf("MakeSessions: %v", err)
+		}
+
+		var handler = sessions.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var session = RequestSession(r)
+
+			switch r.URL.Path {
+			case "/login":
+				session.Rotate()
+				session.Set("user", "alice")
+			case "/logout":
+				session.Destroy()
+				return
+			case "/csrf":
+				if !session.VerifyCSRFToken(r.Header.Get("X-CSRF-Token")) {
+					w.WriteHeader(http.StatusForbidden)
+				}
+			}
+
+			if csrfToken, err := session.CSRFToken(); err != nil {
+				WriteError(w, r, err)
+			} else {
+				fmt.Fprintf(w, "%v %v", session.Get("user"), csrfToken)
+			}
+		}))
+
+		var serve = func(path string, cookie *http.Cookie, csrfToken string) (*http.Response, string) {
+			var request = httptest.NewRequest("POST", path, nil)
+
+			if cookie != nil {
+				request.AddCookie(cookie)
+			}
+			if csrfToken != "" {
+				request.Header.Set("X-CSRF-Token", csrfToken)
+			}
+
+			return testRequest(handler, request)
+		}
+
+		response, _ := serve("/login", nil, "")
+		cookies := response.Cookies()
+
+		if len(cookies) != 1 || !cookies[0].Secure || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode {
+			t.Fatalf("POST /login => cookies %#v", cookies)
+		}
+
+		var cookie = cookies[0]
+
+		response, body := serve("/", cookie, "")
+		if !strings.HasPrefix(body, "alice ") {
+			t.Errorf("POST / => %v", body)
+		}
+
+		var csrfToken = strings.TrimPrefix(body, "alice ")
+
+		if response, _ := serve("/csrf", cookie, "wrong"); response.StatusCode != 403 {
+			t.Errorf("POST /csrf with wrong token => HTTP %v", response.StatusCode)
+		}
+		if response, body := serve("/csrf", cookie, csrfToken); response.StatusCode != 200 {
+			t.Errorf("POST /csrf => HTTP %v: %v", response.StatusCode, body)
+		}
+
+		// tampered cookie
+		var tampered = *cookie
+
+		tampered.Value = "x" + tampered.Value
+
+		if _, body := serve("/", &tampered, ""); strings.HasPrefix(body, "alice ") {
+			t.Errorf("POST / with tampered cookie => %v", body)
+		}
+
+		// rotated signing keys
+		rotated, err := MakeSessions(SessionConfig{Keys: [][]byte{[]byte("old key")}, Store: store})
+		if err != nil {
+			t.Fatalf("MakeSessions: %v", err)
+		}
+
+		if session := rotated.load(func() *http.Request {
+			var request = httptest.NewRequest("GET", "/", nil)
+
+			request.AddCookie(cookie)
+
+			return request
+		}()); session.Get("user") != "" {
+			t.Errorf("session signed with unknown key: %#v", session.values)
+		}
+
+		response, _ = serve("/logout", cookie, "")
+
+		if cookies := response.Cookies(); len(cookies) != 1 || cookies[0].MaxAge != -1 {
+			t.Errorf("POST /logout => cookies %#v", cookies)
+		}
+
+		if store != nil {
+			if _, body := serve("/", cookie, ""); strings.HasPrefix(body, "alice ") {
+				t.Errorf("POST / after logout => %v", body)
+			}
+		}
+	}
+}
+
+func TestMakeSessions(t *testing.T) {
+	for _, keys := range [][][]byte{nil, {}, {[]byte("key"), nil}} {
+		if _, err := MakeSessions(SessionConfig{Keys: keys}); err == nil {
+			t.Errorf("MakeSessions with keys %#v: expected error", keys)
+		}
+	}
+}
+
+type testSessionResource struct{}
+
+func (resource testSessionResource) RequestREST(r *http.Request) (Resource, error) {
+	if session := RequestSession(r); session == nil {
+		return nil, nil
+	} else {
+		return &testSessionRequest{session: session}, nil
+	}
+}
+
+type testSessionRequest struct {
+	session *Session
+
+	User string
+}
+
+func (resource *testSessionRequest) GetREST() (Resource, error) {
+	return resource.session.Get("user"), nil
+}
+
+func (resource *testSessionRequest) IntoREST() interface{} {
+	return resource
+}
+
+func (resource *testSessionRequest) PostREST() (Resource, error) {
+	resource.session.Rotate()
+	resource.session.Set("user", resource.User)
+
+	return resource.session.Get("user"), nil
+}
+
+func TestAPISessions(t *testing.T) {
+	var store = MakeMemorySessionStore()
+	var identities []string
+
+	sessions, err := MakeSessions(SessionConfig{Keys: [][]byte{[]byte("key")}, Store: store})
+	if err != nil {
+		t.Fatalf("MakeSessions: %v", err)
+	}
+
+	var api = MakeAPIConfig(testTree{
+		"session": testSessionResource{},
+	}, APIConfig{
+		Sessions: sessions,
+		AuthFunc: func(r *http.Request) (string, error) {
+			identities = append(identities, RequestSession(r).Get("user"))
+
+			return "", nil
+		},
+	})
+
+	// new sessions without any values are not saved
+	if response, body := testRequest(api, httptest.NewRequest("GET", "/session", nil)); response.StatusCode != 200 || body != "\"\"\n" {
+		t.Errorf("GET /session => HTTP %v: %v", response.StatusCode, body)
+	} else if cookies := response.Cookies(); len(cookies) != 0 {
+		t.Errorf("GET /session => cookies %#v", cookies)
+	}
+
+	var request = httptest.NewRequest("POST", "/session", strings.NewReader(`{"User": "alice"}`))
+
+	request.Header.Set("Content-Type", "application/json")
+
+	response, body := testRequest(api, request)
+	if response.StatusCode != 200 || body != "\"alice\"\n" {
+		t.Fatalf("POST /session => HTTP %v: %v", response.StatusCode, body)
+	} else if len(response.Cookies()) != 1 {
+		t.Fatalf("POST /session => cookies %#v", response.Cookies())
+	}
+
+	var cookie = response.Cookies()[0]
+
+	request = httptest.NewRequest("GET", "/session", nil)
+	request.AddCookie(cookie)
+
+	if response, body := testRequest(api, request); response.StatusCode != 200 || body != "\"alice\"\n" {
+		t.Errorf("GET /session with cookie => HTTP %v: %v", response.StatusCode, body)
+	} else if len(identities) != 3 || identities[2] != "alice" {
+		t.Errorf("AuthFunc sessions: %#v", identities)
+	}
+
+	// rotating the session deletes the old session ID
+	var oldSession = sessions.load(request)
+
+	request = httptest.NewRequest("POST", "/session", strings.NewReader(`{"User": "bob"}`))
+	request.Header.Set("Content-Type", "application/json")
+	request.AddCookie(cookie)
+
+	if response, _ := testRequest(api, request); len(response.Cookies()) != 1 {
+		t.Errorf("POST /session rotate => cookies %#v", response.Cookies())
+	} else if newSession := sessions.load(func() *http.Request {
+		var request = httptest.NewRequest("GET", "/", nil)
+
+		request.AddCookie(response.Cookies()[0])
+
+		return request
+	}()); newSession.ID() == "" || newSession.ID() == oldSession.ID() || newSession.Get("user") != "bob" {
+		t.Errorf("POST /session rotate => session %v %#v", newSession.ID(), newSession.values)
+	} else if _, ok, _ := store.Load(oldSession.ID()); ok {
+		t.Errorf("POST /session rotate => old session %v not deleted", oldSession.ID())
+	}
+
+	// resources without any session
+	if response, _ := testRequest(MakeAPI(testTree{"session": testSessionResource{}}), httptest.NewRequest("GET", "/session", nil)); response.StatusCode != 404 {
+		t.Errorf("GET /session without Sessions => HTTP %v", response.StatusCode)
+	}
+}
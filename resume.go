@@ -0,0 +1,72 @@
+package web
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// Disconnected websocket client, kept registered for EventConfig.ResumeTimeout
+type eventsSession struct {
+	snapshot     eventsSnapshot
+	eventsClient eventsClient
+	timer        *time.Timer
+}
+
+type eventsSessions struct {
+	mutex    sync.Mutex
+	sessions map[string]eventsSession
+}
+
+func makeEventsSessions() *eventsSessions {
+	return &eventsSessions{
+		sessions: make(map[string]eventsSession),
+	}
+}
+
+// Return a new random resume token
+func makeResumeToken() (string, error) {
+	var buf = make([]byte, 16)
+
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Keep disconnected client registered for resuming using the snapshot token, until the ResumeTimeout expires
+func (events Events) park(snapshot eventsSnapshot, eventsClient eventsClient) {
+	var sessions = events.sessions
+	var token = snapshot.token
+
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+
+	sessions.sessions[token] = eventsSession{
+		snapshot:     eventsSnapshot{resumed: true, token: token, disconnect: snapshot.disconnect},
+		eventsClient: eventsClient,
+		timer: time.AfterFunc(events.config.ResumeTimeout, func() {
+			if _, eventsClient, ok := sessions.take(token); ok {
+				events.stop(eventsClient)
+			}
+		}),
+	}
+}
+
+// Return parked client for token, with any events buffered since it was disconnected
+func (sessions *eventsSessions) take(token string) (eventsSnapshot, eventsClient, bool) {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+
+	if session, ok := sessions.sessions[token]; !ok {
+		return eventsSnapshot{}, nil, false
+	} else {
+		session.timer.Stop()
+
+		delete(sessions.sessions, token)
+
+		return session.snapshot, session.eventsClient, true
+	}
+}
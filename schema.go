@@ -0,0 +1,162 @@
+package web
+
+import (
+	"encoding"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Maximum depth of resource tree to walk for SchemaResource
+const SCHEMA_DEPTH = 16
+
+// Introspected resource at a path within the resource tree
+type SchemaPath struct {
+	Path     string   `json:"path"`
+	Resource string   `json:"resource"`
+	Methods  []string `json:"methods"`
+	Query    []string `json:"query,omitempty"`
+	Body     []string `json:"body,omitempty"`
+}
+
+// Self-describing API resource, listing each path in the resource tree with the supported methods, query and body fields.
+//
+// Sub-resources are walked using LinksResource, and looked up using IndexResource or IndexIntResource/IndexUintResource.
+type SchemaResource struct {
+	root Resource
+}
+
+func MakeSchemaResource(root Resource) SchemaResource {
+	return SchemaResource{root: root}
+}
+
+// Allow use as the root of a mounted API, e.g. api.Mount("_schema", MakeAPI(MakeSchemaResource(root)))
+func (schema SchemaResource) Index(name string) (Resource, error) {
+	if name == "" {
+		return schema, nil
+	} else {
+		return nil, nil
+	}
+}
+
+func (schema SchemaResource) GetREST() (Resource, error) {
+	var paths []SchemaPath
+
+	if err := schema.walk(&paths, "", schema.root, 0); err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+}
+
+func (schema SchemaResource) walk(paths *[]SchemaPath, path string, resource Resource, depth int) error {
+	var schemaPath = SchemaPath{
+		Path:     "/" + path,
+		Resource: reflect.TypeOf(resource).String(),
+		Methods:  resourceMethods(resource),
+	}
+
+	if queryResource, ok := resource.(QueryResource); ok {
+		schemaPath.Query = structFields(queryResource.QueryREST(), "schema")
+	}
+	if intoResource, ok := resource.(IntoResource); ok {
+		schemaPath.Body = structFields(intoResource.IntoREST(), "json")
+	}
+
+	*paths = append(*paths, schemaPath)
+
+	if depth >= SCHEMA_DEPTH {
+		return nil
+	}
+
+	var linksResource, _ = resource.(LinksResource)
+
+	if linksResource == nil {
+		return nil
+	}
+
+	names, err := linksResource.LinksREST()
+
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		var childPath = url.PathEscape(name)
+
+		if path != "" {
+			childPath = path + "/" + childPath
+		}
+
+		if child, ok, err := lookupIndex(resource, name); !ok {
+			return nil
+		} else if err != nil {
+			return err
+		} else if child == nil {
+			continue
+		} else if err := schema.walk(paths, childPath, child, depth+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Structs implementing encoding.TextUnmarshaler such as time.Time are treated as values
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// Return the names of exported struct fields, using the given tag for aliases; nested structs use dotted names
+func structFields(object interface{}, tag string) []string {
+	var fields []string
+
+	if object != nil {
+		appendStructFields(&fields, reflect.TypeOf(object), tag, "", make(map[reflect.Type]bool))
+	}
+
+	return fields
+}
+
+func appendStructFields(fields *[]string, t reflect.Type, tag string, prefix string, visited map[reflect.Type]bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct || visited[t] {
+		return
+	}
+
+	visited[t] = true
+	defer delete(visited, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		var field = t.Field(i)
+		var name = field.Name
+
+		if field.PkgPath != "" && !field.Anonymous {
+			continue // unexported
+		}
+
+		if alias := strings.Split(field.Tag.Get(tag), ",")[0]; alias == "-" {
+			continue
+		} else if alias != "" {
+			name = alias
+		}
+
+		var fieldType = field.Type
+
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+
+		if field.Anonymous && fieldType.Kind() == reflect.Struct {
+			appendStructFields(fields, fieldType, tag, prefix, visited)
+		} else if fieldType.Kind() == reflect.Struct && !reflect.PtrTo(fieldType).Implements(textUnmarshalerType) {
+			appendStructFields(fields, fieldType, tag, prefix+name+".", visited)
+		} else {
+			*fields = append(*fields, prefix+name)
+		}
+	}
+}
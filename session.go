@@ -0,0 +1,532 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default SessionConfig.CookieName
+const SESSION_COOKIE = "session"
+
+// Default SessionConfig.MaxAge
+const SESSION_MAX_AGE = 24 * time.Hour
+
+// Maximum size of signed session cookies, per browser limits
+const SESSION_COOKIE_SIZE = 4096
+
+// Session key used for Session.CSRFToken
+const SESSION_CSRF_KEY = "_csrf"
+
+type SessionConfig struct {
+	// HMAC-SHA256 keys for signing session cookies. New cookies are signed using the first key,
+	// and cookies signed using any of the keys are accepted, for rotating keys.
+	Keys [][]byte
+
+	// Cookie attributes, defaulting to SESSION_COOKIE, path /, SESSION_MAX_AGE and SameSite=Lax
+	CookieName string
+	Path       string
+	Domain     string
+	MaxAge     time.Duration
+	Secure     bool
+	SameSite   http.SameSite
+
+	// Keep the session values in the server-side store, using the cookie for the session ID only.
+	// Otherwise the session values are stored in the signed cookie, which is limited to SESSION_COOKIE_SIZE.
+	Store SessionStore
+}
+
+// Server-side storage for session values
+type SessionStore interface {
+	// Return false for unknown or expired sessions
+	Load(id string) (map[string]string, bool, error)
+	Save(id string, values map[string]string, expires time.Time) error
+	Delete(id string) error
+}
+
+type memorySession struct {
+	values  map[string]string
+	expires time.Time
+}
+
+// In-memory SessionStore, for use with a single server
+type MemorySessionStore struct {
+	mutex    sync.Mutex
+	sessions map[string]memorySession
+}
+
+func MakeMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]memorySession),
+	}
+}
+
+func (store *MemorySessionStore) Load(id string) (map[string]string, bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if session, ok := store.sessions[id]; !ok {
+		return nil, false, nil
+	} else if time.Now().After(session.expires) {
+		delete(store.sessions, id)
+
+		return nil, false, nil
+	} else {
+		return copySessionValues(session.values), true, nil
+	}
+}
+
+// Also expires any other sessions
+func (store *MemorySessionStore) Save(id string, values map[string]string, expires time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var now = time.Now()
+
+	for id, session := range store.sessions {
+		if now.After(session.expires) {
+			delete(store.sessions, id)
+		}
+	}
+
+	store.sessions[id] = memorySession{copySessionValues(values), expires}
+
+	return nil
+}
+
+func (store *MemorySessionStore) Delete(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.sessions, id)
+
+	return nil
+}
+
+func copySessionValues(values map[string]string) map[string]string {
+	var copied = make(map[string]string, len(values))
+
+	for key, value := range values {
+		copied[key] = value
+	}
+
+	return copied
+}
+
+// Return a random base64url-encoded ID
+func makeSessionID() (string, error) {
+	var buf = make([]byte, 32)
+
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("Session ID: %v", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Session for the request, see RequestSession()
+type Session struct {
+	mutex   sync.Mutex
+	id      string
+	values  map[string]string
+	expires time.Time
+
+	// the old session ID to delete from the SessionStore
+	oldID string
+
+	modified  bool
+	destroyed bool
+}
+
+// Return the session ID, or empty for new or rotated sessions until saved
+func (session *Session) ID() string {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return session.id
+}
+
+// Return true unless the session was loaded from the request cookie
+func (session *Session) IsNew() bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return session.id == "" || session.expires.IsZero()
+}
+
+func (session *Session) Get(key string) string {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return session.values[key]
+}
+
+func (session *Session) Set(key string, value string) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.values[key] = value
+	session.modified = true
+	session.destroyed = false
+}
+
+func (session *Session) Delete(key string) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if _, ok := session.values[key]; ok {
+		delete(session.values, key)
+
+		session.modified = true
+	}
+}
+
+// Change the session ID while keeping the values, e.g. after login to prevent session fixation.
+// The new session ID is generated when saving the session.
+//
+// Also issues a new CSRFToken.
+func (session *Session) Rotate() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.oldID == "" {
+		session.oldID = session.id
+	}
+
+	session.id = ""
+	session.modified = true
+	session.destroyed = false
+
+	delete(session.values, SESSION_CSRF_KEY)
+}
+
+// Clear the session values and expire the session cookie, e.g. for logout
+func (session *Session) Destroy() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.oldID == "" {
+		session.oldID = session.id
+	}
+
+	session.id = ""
+	session.values = make(map[string]string)
+	session.modified = true
+	session.destroyed = true
+}
+
+// Return the CSRF token for the session, generating a new one if needed.
+//
+// Include the token in forms or request headers, and check it using VerifyCSRFToken() for any mutating requests.
+func (session *Session) CSRFToken() (string, error) {
+	if token := session.Get(SESSION_CSRF_KEY); token != "" {
+		return token, nil
+	}
+
+	token, err := makeSessionID()
+	if err != nil {
+		return "", err
+	}
+
+	session.Set(SESSION_CSRF_KEY, token)
+
+	return token, nil
+}
+
+// Check the CSRF token against the session
+func (session *Session) VerifyCSRFToken(token string) bool {
+	var sessionToken = session.Get(SESSION_CSRF_KEY)
+
+	return sessionToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(sessionToken)) == 1
+}
+
+// Signed cookie payload
+type sessionCookie struct {
+	ID      string            `json:"id"`
+	Expires int64             `json:"exp"`
+	Values  map[string]string `json:"values,omitempty"`
+}
+
+// Sessions using signed cookies, and an optional server-side store
+type Sessions struct {
+	config SessionConfig
+}
+
+// Fails if there are no Keys
+func MakeSessions(config SessionConfig) (*Sessions, error) {
+	if len(config.Keys) == 0 {
+		return nil, fmt.Errorf("SessionConfig: missing Keys")
+	}
+
+	for i, key := range config.Keys {
+		if len(key) == 0 {
+			return nil, fmt.Errorf("SessionConfig: empty Keys[%d]", i)
+		}
+	}
+
+	if config.CookieName == "" {
+		config.CookieName = SESSION_COOKIE
+	}
+	if config.Path == "" {
+		config.Path = "/"
+	}
+	if config.MaxAge == 0 {
+		config.MaxAge = SESSION_MAX_AGE
+	}
+	if config.SameSite == 0 {
+		config.SameSite = http.SameSiteLaxMode
+	}
+
+	return &Sessions{config: config}, nil
+}
+
+func (sessions *Sessions) sign(key []byte, payload string) string {
+	var mac = hmac.New(sha256.New, key)
+
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Return the cookie value for the session
+func (sessions *Sessions) encode(cookie sessionCookie) (string, error) {
+	data, err := json.Marshal(cookie)
+	if err != nil {
+		return "", err
+	}
+
+	var payload = base64.RawURLEncoding.EncodeToString(data)
+
+	return payload + "." + sessions.sign(sessions.config.Keys[0], payload), nil
+}
+
+// Verify the cookie value using any of the keys
+func (sessions *Sessions) decode(value string) (sessionCookie, error) {
+	var cookie sessionCookie
+	var payload, signature, _ = strings.Cut(value, ".")
+	var valid = false
+
+	for _, key := range sessions.config.Keys {
+		if hmac.Equal([]byte(signature), []byte(sessions.sign(key, payload))) {
+			valid = true
+		}
+	}
+
+	if !valid {
+		return cookie, fmt.Errorf("Invalid session cookie signature")
+	} else if data, err := base64.RawURLEncoding.DecodeString(payload); err != nil {
+		return cookie, fmt.Errorf("Invalid session cookie: %v", err)
+	} else if err := json.Unmarshal(data, &cookie); err != nil {
+		return cookie, fmt.Errorf("Invalid session cookie: %v", err)
+	} else if time.Now().After(time.Unix(cookie.Expires, 0)) {
+		return cookie, fmt.Errorf("Expired session cookie")
+	}
+
+	return cookie, nil
+}
+
+// Return the session for the request cookie, or a new session
+func (sessions *Sessions) load(r *http.Request) *Session {
+	var session = Session{values: make(map[string]string)}
+
+	httpCookie, err := r.Cookie(sessions.config.CookieName)
+	if err != nil {
+		return &session
+	}
+
+	cookie, err := sessions.decode(httpCookie.Value)
+	if err != nil {
+		apiLog.Debug("session cookie", "path", r.URL.Path, "err", err)
+
+		return &session
+	}
+
+	if sessions.config.Store == nil {
+		session.values = cookie.Values
+	} else if values, ok, err := sessions.config.Store.Load(cookie.ID); err != nil {
+		apiLog.Warn("session store load", "err", err)
+
+		return &session
+	} else if !ok {
+		return &session
+	} else {
+		session.values = values
+	}
+
+	if session.values == nil {
+		session.values = make(map[string]string)
+	}
+
+	session.id = cookie.ID
+	session.expires = time.Unix(cookie.Expires, 0)
+
+	return &session
+}
+
+// Write the Set-Cookie header for any modified session, or to extend the expiry once past half of the MaxAge
+func (sessions *Sessions) save(w http.ResponseWriter, session *Session) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	var now = time.Now()
+	var refresh = session.id != "" && !session.expires.IsZero() && session.expires.Sub(now) < sessions.config.MaxAge/2
+	var httpCookie = http.Cookie{
+		Name:     sessions.config.CookieName,
+		Path:     sessions.config.Path,
+		Domain:   sessions.config.Domain,
+		Secure:   sessions.config.Secure,
+		HttpOnly: true,
+		SameSite: sessions.config.SameSite,
+	}
+
+	if !session.modified && !refresh {
+		return nil
+	} else if session.id == "" && session.oldID == "" && !session.destroyed && len(session.values) == 0 {
+		return nil
+	}
+
+	if session.oldID != "" && session.oldID != session.id && sessions.config.Store != nil {
+		if err := sessions.config.Store.Delete(session.oldID); err != nil {
+			return err
+		}
+	}
+
+	if session.destroyed {
+		httpCookie.MaxAge = -1
+
+		http.SetCookie(w, &httpCookie)
+
+		return nil
+	} else if session.id == "" {
+		if id, err := makeSessionID(); err != nil {
+			return err
+		} else {
+			session.id = id
+		}
+	}
+
+	var cookie = sessionCookie{
+		ID:      session.id,
+		Expires: now.Add(sessions.config.MaxAge).Unix(),
+	}
+
+	if sessions.config.Store == nil {
+		cookie.Values = session.values
+	} else if err := sessions.config.Store.Save(session.id, session.values, time.Unix(cookie.Expires, 0)); err != nil {
+		return err
+	}
+
+	if value, err := sessions.encode(cookie); err != nil {
+		return err
+	} else if len(value) > SESSION_COOKIE_SIZE {
+		return fmt.Errorf("Session cookie is too large: %d bytes", len(value))
+	} else {
+		httpCookie.Value = value
+		httpCookie.Expires = time.Unix(cookie.Expires, 0)
+		httpCookie.MaxAge = int(sessions.config.MaxAge.Seconds())
+	}
+
+	http.SetCookie(w, &httpCookie)
+
+	session.oldID = ""
+	session.modified = false
+
+	return nil
+}
+
+type sessionKey struct{}
+
+// Return request with the session, for use by session handlers
+func WithSession(r *http.Request, session *Session) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionKey{}, session))
+}
+
+// Return the session for a request served by Sessions.Handler or an API with APIConfig.Sessions, or nil.
+//
+// Use within handlers, RequestResources, HandlerResources or hooks like APIConfig.AuthFunc.
+func RequestSession(r *http.Request) *Session {
+	session, _ := r.Context().Value(sessionKey{}).(*Session)
+
+	return session
+}
+
+// Save the session before writing the response headers
+type sessionResponseWriter struct {
+	http.ResponseWriter
+
+	sessions *Sessions
+	session  *Session
+	saved    bool
+}
+
+func (w *sessionResponseWriter) save() {
+	if w.saved {
+		return
+	}
+
+	w.saved = true
+
+	if err := w.sessions.save(w.ResponseWriter, w.session); err != nil {
+		apiLog.Error("session save", "err", err)
+	}
+}
+
+func (w *sessionResponseWriter) WriteHeader(status int) {
+	w.save()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sessionResponseWriter) Write(buf []byte) (int, error) {
+	w.save()
+
+	return w.ResponseWriter.Write(buf)
+}
+
+func (w *sessionResponseWriter) Flush() {
+	w.save()
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *sessionResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("http.Hijacker not supported")
+	}
+
+	w.saved = true
+
+	return hijacker.Hijack()
+}
+
+// Load the session for the request, returning the response writer that saves the session
+func (sessions *Sessions) serve(w http.ResponseWriter, r *http.Request) (*sessionResponseWriter, *http.Request) {
+	var session = sessions.load(r)
+
+	return &sessionResponseWriter{ResponseWriter: w, sessions: sessions, session: session}, WithSession(r, session)
+}
+
+// Return a handler serving the handler with the Session for RequestSession(), saving any changes to the session
+// before writing the response headers.
+func (sessions *Sessions) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionWriter, r := sessions.serve(w, r)
+
+		handler.ServeHTTP(sessionWriter, r)
+
+		sessionWriter.save()
+	})
+}
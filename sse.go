@@ -0,0 +1,126 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Write a single text/event-stream message
+func writeSSE(w io.Writer, id uint64, eventType string, object interface{}) error {
+	buf, err := json.Marshal(object)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %v", err)
+	}
+
+	if _, err := fmt.Fprintf(w, "id: %d\n", id); err != nil {
+		return err
+	}
+
+	if eventType == "" {
+
+	} else if _, err := fmt.Fprintf(w, "event: %s\n", eventType); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", buf); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Return error if aborting, nil if events closed
+func (events Events) serveSSE(w io.Writer, flusher http.Flusher, r *http.Request, eventsClient eventsClient, snapshot eventsSnapshot) error {
+	if events.config.SSERetry > 0 {
+		if _, err := fmt.Fprintf(w, "retry: %d\n\n", events.config.SSERetry.Milliseconds()); err != nil {
+			return err
+		}
+	}
+
+	// initial state
+	if snapshot.resumed {
+
+	} else if err := writeSSE(w, snapshot.seq, "state", snapshot.state); err != nil {
+		return err
+	}
+
+	flusher.Flush()
+
+	// update events
+	for {
+		select {
+		case message, ok := <-eventsClient:
+			if !ok {
+				// tell the client to reconnect without the Last-Event-ID to resync the state
+				if snapshot.disconnect != nil && *snapshot.disconnect != "" {
+					writeSSE(w, 0, "disconnect", *snapshot.disconnect)
+					flusher.Flush()
+				}
+
+				return nil
+			}
+
+			if message.state {
+				if err := writeSSE(w, message.seq, "state", message.event); err != nil {
+					return err
+				}
+			} else if err := writeSSE(w, message.seq, "", message.event); err != nil {
+				return err
+			}
+
+			events.sent(message)
+
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+}
+
+// goroutine-safe Server-Sent Events subscriber, for use with the browser EventSource API
+//
+// The initial state is sent as a "state" event, followed by default "message" events, using the event sequence numbers as IDs.
+// Clients dropped by the server are sent a final "disconnect" event with the DisconnectReason, and an ID of 0 to resync.
+// Subscribes to topic patterns given by any ?topic=... query params, and replays ?history=N events or resumes from the Last-Event-ID.
+func (events Events) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	options, err := events.parseOptions(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if authRequest, err := events.authorize(r); err != nil {
+		writeError(w, r, err)
+		return
+	} else {
+		r = events.withClientID(authRequest)
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	if err := events.acquire(); err != nil {
+		writeError(w, r, err)
+		return
+	} else {
+		defer events.release()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	var snapshot, eventsClient = events.listen(r, options)
+
+	if err := events.serveSSE(w, flusher, r, eventsClient, snapshot); err != nil {
+		eventsLog.Debug("SSE", "method", r.Method, "path", r.URL.Path, "client", r.RemoteAddr, "err", err)
+
+		events.stop(eventsClient)
+	}
+}
@@ -0,0 +1,131 @@
+package web
+
+import (
+	"sync"
+	"time"
+)
+
+// Counters and gauges for Events, suitable for scraping into metrics
+type EventStats struct {
+	// Time the Events was started
+	StartTime time.Time `json:"start_time"`
+
+	// Number of currently registered clients
+	Clients int `json:"clients"`
+
+	// Number of events published, and for each TopicEvent topic
+	Published       uint64            `json:"published"`
+	PublishedTopics map[string]uint64 `json:"published_topics,omitempty"`
+
+	// Sequence number and time of the most recently published event
+	LastSeq  uint64    `json:"last_seq"`
+	LastTime time.Time `json:"last_time"`
+
+	// Number of events dropped for clients using DropOldest, or PriorityLow events
+	DroppedEvents uint64 `json:"dropped_events"`
+
+	// Number of times an event was published to a client with a full buffer, per the DropPolicy
+	Overflows uint64 `json:"overflows"`
+
+	// Number of clients dropped for falling behind, and the most number of events any dropped client was behind
+	DroppedClients uint64 `json:"dropped_clients"`
+	DroppedBehind  uint64 `json:"dropped_behind"`
+
+	// Number of websocket, SSE and long-poll clients rejected for exceeding MaxClients
+	RejectedClients uint64 `json:"rejected_clients"`
+
+	// Number of events sent to clients, and the total latency from publishing to sending
+	Sent         uint64        `json:"sent"`
+	SendDuration time.Duration `json:"send_duration"`
+}
+
+// Return the average latency from publishing events to sending them to clients
+func (stats EventStats) SendLatency() time.Duration {
+	if stats.Sent == 0 {
+		return 0
+	} else {
+		return stats.SendDuration / time.Duration(stats.Sent)
+	}
+}
+
+type eventsStats struct {
+	mutex sync.Mutex
+	stats EventStats
+}
+
+func makeEventsStats() *eventsStats {
+	return &eventsStats{
+		stats: EventStats{StartTime: time.Now()},
+	}
+}
+
+func (eventsStats *eventsStats) update(f func(stats *EventStats)) {
+	eventsStats.mutex.Lock()
+	defer eventsStats.mutex.Unlock()
+
+	f(&eventsStats.stats)
+}
+
+func (eventsStats *eventsStats) get() EventStats {
+	eventsStats.mutex.Lock()
+	defer eventsStats.mutex.Unlock()
+
+	var stats = eventsStats.stats
+
+	if stats.PublishedTopics != nil {
+		stats.PublishedTopics = make(map[string]uint64, len(eventsStats.stats.PublishedTopics))
+
+		for topic, count := range eventsStats.stats.PublishedTopics {
+			stats.PublishedTopics[topic] = count
+		}
+	}
+
+	return stats
+}
+
+// Return current statistics
+func (events Events) Stats() EventStats {
+	return events.stats.get()
+}
+
+// Status reported by the StatusResource
+type EventStatus struct {
+	EventStats
+
+	// Average number of events published per second for each topic since the StartTime
+	TopicRates map[string]float64 `json:"topic_rates,omitempty"`
+}
+
+// Admin resource reporting the EventStatus
+type StatusResource struct {
+	events Events
+}
+
+// Return resource for Stats(), e.g. api.Mount("_events", MakeAPI(events.StatusResource()))
+func (events Events) StatusResource() StatusResource {
+	return StatusResource{events}
+}
+
+// Allow use as the root of a mounted API
+func (resource StatusResource) Index(name string) (Resource, error) {
+	if name == "" {
+		return resource, nil
+	} else {
+		return nil, nil
+	}
+}
+
+func (resource StatusResource) GetREST() (Resource, error) {
+	var status = EventStatus{EventStats: resource.events.Stats()}
+	var uptime = time.Since(status.StartTime).Seconds()
+
+	if status.PublishedTopics != nil && uptime > 0 {
+		status.TopicRates = make(map[string]float64, len(status.PublishedTopics))
+
+		for topic, count := range status.PublishedTopics {
+			status.TopicRates[topic] = float64(count) / uptime
+		}
+	}
+
+	return status, nil
+}
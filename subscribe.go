@@ -0,0 +1,50 @@
+package web
+
+import (
+	"context"
+	"time"
+)
+
+// Subscribe to events for non-HTTP clients, e.g. the webgrpc adapter, returning the initial state and any events matching
+// the topic patterns, using the same EventMessage as for EventConfig.Envelope.
+//
+// The returned chan is closed once the context is done, or if the client is dropped.
+func (events Events) Subscribe(ctx context.Context, topics ...string) (EventMessage, <-chan EventMessage) {
+	var options = eventsOptions{Topics: eventsTopics(topics)}
+	var snapshot, eventsClient = events.listen(nil, options)
+	var messageChan = make(chan EventMessage)
+
+	go func() {
+		defer close(messageChan)
+
+		for {
+			select {
+			case message, ok := <-eventsClient:
+				if !ok {
+					return
+				}
+
+				var eventMessage = events.eventMessage(message)
+
+				if message.state {
+					eventMessage.Type = EventMessageState
+					eventMessage.EventType = ""
+				}
+
+				select {
+				case messageChan <- eventMessage:
+					events.sent(message)
+				case <-ctx.Done():
+					events.stop(eventsClient)
+					return
+				}
+
+			case <-ctx.Done():
+				events.stop(eventsClient)
+				return
+			}
+		}
+	}()
+
+	return EventMessage{Type: EventMessageState, Seq: snapshot.seq, Time: time.Now(), Data: snapshot.state}, messageChan
+}
@@ -0,0 +1,72 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Tracing hooks for Options.Tracer, e.g. using OpenTelemetry, without depending on any tracing library
+type Tracer interface {
+	// Start a server span for the request, returning the context with the span.
+	// Should continue any trace propagated in the incoming traceparent headers.
+	StartRequest(r *http.Request, name string) (context.Context, Span)
+
+	// Start a child span of the span in the context
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span started by a Tracer
+type Span interface {
+	// Set span attribute, e.g. "http.status_code"
+	SetAttribute(key string, value interface{})
+
+	// End span, recording any error
+	End(err error)
+}
+
+type tracerKey struct{}
+
+type noSpan struct{}
+
+func (noSpan) SetAttribute(key string, value interface{}) {}
+func (noSpan) End(err error)                              {}
+
+// Start a child span of the request span, if traced using TraceHandler
+func startSpan(r *http.Request, name string) Span {
+	if tracer, ok := r.Context().Value(tracerKey{}).(Tracer); !ok {
+		return noSpan{}
+	} else {
+		_, span := tracer.StartSpan(r.Context(), name)
+
+		return span
+	}
+}
+
+// Return a handler starting a server span for each request, named by the request method and route pattern.
+//
+// Any API served by the handler starts child spans for the resource lookup, resource methods and ApplyREST.
+func TraceHandler(tracer Tracer, pattern string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var statusWriter = &statusResponseWriter{ResponseWriter: w}
+		var ctx, span = tracer.StartRequest(r, r.Method+" "+pattern)
+
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", pattern)
+		span.SetAttribute("http.target", r.URL.RequestURI())
+
+		handler.ServeHTTP(statusWriter, r.WithContext(context.WithValue(ctx, tracerKey{}, tracer)))
+
+		if statusWriter.status == 0 {
+			statusWriter.status = http.StatusOK
+		}
+
+		span.SetAttribute("http.status_code", statusWriter.status)
+
+		if statusWriter.status >= 500 {
+			span.End(fmt.Errorf("HTTP %d %s", statusWriter.status, http.StatusText(statusWriter.status)))
+		} else {
+			span.End(nil)
+		}
+	})
+}
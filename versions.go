@@ -0,0 +1,98 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Serve multiple API versions under a common prefix, e.g. /api/v1/...
+//
+// Requests without a known version in the path are served using the version given in the Accept-Version header,
+// or redirected to the Default version.
+type APIVersions struct {
+	Versions map[string]API
+	Default  string
+}
+
+// Compare version names like "v1" < "v2" < "v10" < "v10.1", using numeric ordering where possible
+func compareVersion(a string, b string) int {
+	var aParts = strings.Split(strings.TrimPrefix(a, "v"), ".")
+	var bParts = strings.Split(strings.TrimPrefix(b, "v"), ".")
+
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aNum, aErr := strconv.Atoi(aParts[i])
+		bNum, bErr := strconv.Atoi(bParts[i])
+
+		if aErr != nil || bErr != nil {
+			if c := strings.Compare(aParts[i], bParts[i]); c != 0 {
+				return c
+			}
+		} else if aNum < bNum {
+			return -1
+		} else if aNum > bNum {
+			return +1
+		}
+	}
+
+	return len(aParts) - len(bParts)
+}
+
+// Return APIVersions for the given root resources, defaulting to the latest version
+func MakeAPIVersions(versions map[string]Resource) APIVersions {
+	var apiVersions = APIVersions{
+		Versions: make(map[string]API, len(versions)),
+	}
+
+	for version, root := range versions {
+		apiVersions.Versions[version] = MakeAPI(root)
+
+		if apiVersions.Default == "" || compareVersion(version, apiVersions.Default) > 0 {
+			apiVersions.Default = version
+		}
+	}
+
+	return apiVersions
+}
+
+func (apiVersions APIVersions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var path = strings.TrimPrefix(r.URL.Path, "/")
+	var version = path
+
+	if i := strings.Index(path, "/"); i >= 0 {
+		version = path[:i]
+	}
+
+	if api, ok := apiVersions.Versions[version]; ok {
+		http.StripPrefix(version, api).ServeHTTP(w, r)
+
+	} else if version := r.Header.Get("Accept-Version"); version != "" {
+		if api, ok := apiVersions.Versions[version]; !ok {
+			apiLog.Info("unknown Accept-Version", "method", r.Method, "path", r.URL.Path, "version", version)
+
+			http.Error(w, "Unknown API version: "+version, http.StatusNotAcceptable)
+		} else {
+			api.ServeHTTP(w, r)
+		}
+
+	} else if apiVersions.Default != "" {
+		var url = requestPrefix(r) + apiVersions.Default + "/" + path
+
+		if r.URL.RawQuery != "" {
+			url += "?" + r.URL.RawQuery
+		}
+
+		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+// Return a route that serves the versioned root resources under prefix/VERSION/...
+func (options Options) RouteAPIVersions(prefix string, versions map[string]Resource) Route {
+	return Route{
+		Pattern: prefix,
+		Handler: http.StripPrefix(prefix, MakeAPIVersions(versions)),
+	}
+}
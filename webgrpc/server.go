@@ -0,0 +1,101 @@
+// gRPC server-streaming adapter for web.Events
+package webgrpc
+
+import (
+	"encoding/json"
+
+	"github.com/qmsk/go-web"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Serve the qmsk.web.Events service defined in events.proto, using google.protobuf.Struct messages
+type Server struct {
+	events web.Events
+}
+
+// Register the qmsk.web.Events service for the events
+func Register(grpcServer *grpc.Server, events web.Events) {
+	grpcServer.RegisterService(&serviceDesc, Server{events})
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "qmsk.web.Events",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       subscribeHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "events.proto",
+}
+
+func subscribeHandler(srv interface{}, stream grpc.ServerStream) error {
+	var request structpb.Struct
+
+	if err := stream.RecvMsg(&request); err != nil {
+		return err
+	}
+
+	return srv.(Server).Subscribe(&request, stream)
+}
+
+// Return request topic patterns
+func requestTopics(request *structpb.Struct) ([]string, error) {
+	var topics []string
+
+	if value, ok := request.GetFields()["topic"]; !ok {
+		return nil, nil
+	} else if listValue := value.GetListValue(); listValue == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid topic: expected list")
+	} else {
+		for _, value := range listValue.GetValues() {
+			topics = append(topics, value.GetStringValue())
+		}
+	}
+
+	return topics, nil
+}
+
+// Encode web.EventMessage as JSON values
+func encodeMessage(message web.EventMessage) (*structpb.Struct, error) {
+	var object map[string]interface{}
+
+	if buf, err := json.Marshal(message); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(buf, &object); err != nil {
+		return nil, err
+	}
+
+	return structpb.NewStruct(object)
+}
+
+// Stream the initial state and events until the client cancels, or is dropped
+func (server Server) Subscribe(request *structpb.Struct, stream grpc.ServerStream) error {
+	topics, err := requestTopics(request)
+	if err != nil {
+		return err
+	}
+
+	var state, messageChan = server.events.Subscribe(stream.Context(), topics...)
+
+	if msg, err := encodeMessage(state); err != nil {
+		return err
+	} else if err := stream.SendMsg(msg); err != nil {
+		return err
+	}
+
+	for message := range messageChan {
+		if msg, err := encodeMessage(message); err != nil {
+			return err
+		} else if err := stream.SendMsg(msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package webgrpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/qmsk/go-web"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Serve the events over an in-memory gRPC connection
+func testClient(t *testing.T, events web.Events) *grpc.ClientConn {
+	var listener = bufconn.Listen(1024 * 1024)
+	var grpcServer = grpc.NewServer()
+
+	Register(grpcServer, events)
+
+	go grpcServer.Serve(listener)
+
+	var dialer = func(ctx context.Context, addr string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}
+
+	clientConn, err := grpc.Dial("bufconn", grpc.WithContextDialer(dialer), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("grpc.Dial: %v", err)
+	}
+
+	t.Cleanup(func() {
+		clientConn.Close()
+		grpcServer.Stop()
+	})
+
+	return clientConn
+}
+
+func testSubscribe(ctx context.Context, t *testing.T, clientConn *grpc.ClientConn, request map[string]interface{}) grpc.ClientStream {
+	stream, err := clientConn.NewStream(ctx, &serviceDesc.Streams[0], "/qmsk.web.Events/Subscribe")
+	if err != nil {
+		t.Fatalf("NewStream: %v", err)
+	}
+
+	if msg, err := structpb.NewStruct(request); err != nil {
+		t.Fatalf("structpb.NewStruct: %v", err)
+	} else if err := stream.SendMsg(msg); err != nil {
+		t.Fatalf("SendMsg: %v", err)
+	} else if err := stream.CloseSend(); err != nil {
+		t.Fatalf("CloseSend: %v", err)
+	}
+
+	return stream
+}
+
+func TestSubscribe(t *testing.T) {
+	var events = web.MakeEvents(web.EventConfig{
+		StateFunc: func() web.State { return "state" },
+	})
+	defer events.Close()
+
+	var clientConn = testClient(t, events)
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	var stream = testSubscribe(ctx, t, clientConn, map[string]interface{}{"topic": []interface{}{"lights/*"}})
+	var msg structpb.Struct
+
+	if err := stream.RecvMsg(&msg); err != nil {
+		t.Fatalf("RecvMsg state: %v", err)
+	} else if fields := msg.AsMap(); fields["type"] != web.EventMessageState || fields["data"] != "state" {
+		t.Errorf("state: %v", fields)
+	}
+
+	events.Publish(web.TopicEvent{Topic: "sensors/1", Event: "sensor"})
+	events.Publish(web.TopicEvent{Topic: "lights/1", Event: "light"})
+
+	if err := stream.RecvMsg(&msg); err != nil {
+		t.Fatalf("RecvMsg event: %v", err)
+	} else if fields := msg.AsMap(); fields["type"] != web.EventMessageEvent || fields["seq"] != float64(2) {
+		t.Errorf("event: %v", fields)
+	} else if data, ok := fields["data"].(map[string]interface{}); !ok || data["topic"] != "lights/1" || data["event"] != "light" {
+		t.Errorf("event data: %v", fields["data"])
+	}
+
+	// client cancel ends the stream
+	cancel()
+
+	if err := stream.RecvMsg(&msg); status.Code(err) != codes.Canceled {
+		t.Errorf("RecvMsg after cancel: %v", err)
+	}
+}
+
+func TestSubscribeInvalid(t *testing.T) {
+	var events = web.MakeEvents(web.EventConfig{})
+	defer events.Close()
+
+	var clientConn = testClient(t, events)
+	var stream = testSubscribe(context.Background(), t, clientConn, map[string]interface{}{"topic": "lights/*"})
+	var msg structpb.Struct
+
+	if err := stream.RecvMsg(&msg); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("RecvMsg: %v, expected %v", err, codes.InvalidArgument)
+	}
+}
+
+func TestSubscribeClose(t *testing.T) {
+	var events = web.MakeEvents(web.EventConfig{})
+
+	var clientConn = testClient(t, events)
+	var stream = testSubscribe(context.Background(), t, clientConn, map[string]interface{}{})
+	var msg structpb.Struct
+
+	if err := stream.RecvMsg(&msg); err != nil {
+		t.Fatalf("RecvMsg state: %v", err)
+	}
+
+	// closing the events ends the stream
+	events.Close()
+
+	if err := stream.RecvMsg(&msg); err != io.EOF {
+		t.Errorf("RecvMsg after Close: %v", err)
+	}
+}
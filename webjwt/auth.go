@@ -0,0 +1,304 @@
+// JWT bearer token authentication for web.API and web.Events, using HMAC, RSA or ECDSA keys and JSON Web Key Sets
+package webjwt
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/qmsk/go-web"
+)
+
+type Config struct {
+	// Verification keys by key ID, using "" for tokens without any kid header.
+	//
+	// Use []byte for HS256/384/512, *rsa.PublicKey for RS256/384/512 or PS256/384/512, and *ecdsa.PublicKey for ES256/384/512.
+	Keys map[string]interface{}
+
+	// Fetch further RSA and EC keys from the JSON Web Key Set, refreshed every JWKSRefresh, and for any unknown key IDs
+	JWKSURL     string
+	JWKSRefresh time.Duration
+
+	// Require the iss claim, and the aud claim to include the audience
+	Issuer   string
+	Audience string
+
+	// Allowed clock skew for the exp, nbf and iat claims
+	Leeway time.Duration
+
+	// Claim used for web.RequestIdentity, defaults to "sub"
+	IdentityClaim string
+}
+
+// Verifies bearer tokens per the Config
+type Auth struct {
+	config Config
+	jwks   *jwks
+}
+
+func MakeAuth(config Config) *Auth {
+	var auth = Auth{config: config}
+
+	if config.IdentityClaim == "" {
+		auth.config.IdentityClaim = "sub"
+	}
+
+	if config.JWKSURL != "" {
+		auth.jwks = makeJWKS(config.JWKSURL, config.JWKSRefresh)
+	}
+
+	return &auth
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type algorithm struct {
+	hash    crypto.Hash
+	keyType string // hmac, rsa, rsa-pss, ecdsa
+	curve   string // ecdsa curve name
+}
+
+var algorithms = map[string]algorithm{
+	"HS256": {crypto.SHA256, "hmac", ""},
+	"HS384": {crypto.SHA384, "hmac", ""},
+	"HS512": {crypto.SHA512, "hmac", ""},
+	"RS256": {crypto.SHA256, "rsa", ""},
+	"RS384": {crypto.SHA384, "rsa", ""},
+	"RS512": {crypto.SHA512, "rsa", ""},
+	"PS256": {crypto.SHA256, "rsa-pss", ""},
+	"PS384": {crypto.SHA384, "rsa-pss", ""},
+	"PS512": {crypto.SHA512, "rsa-pss", ""},
+	"ES256": {crypto.SHA256, "ecdsa", "P-256"},
+	"ES384": {crypto.SHA384, "ecdsa", "P-384"},
+	"ES512": {crypto.SHA512, "ecdsa", "P-521"},
+}
+
+func decodeSegment(segment string, object interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	var decoder = json.NewDecoder(bytes.NewReader(data))
+
+	decoder.UseNumber()
+
+	return decoder.Decode(object)
+}
+
+// Return the key for the key ID, fetching the JWKS if needed
+func (auth *Auth) key(ctx context.Context, kid string) (interface{}, error) {
+	if key, ok := auth.config.Keys[kid]; ok {
+		return key, nil
+	} else if auth.jwks != nil {
+		return auth.jwks.key(ctx, kid)
+	} else {
+		return nil, fmt.Errorf("Unknown key: %#v", kid)
+	}
+}
+
+// Verify the signature using a key matching the algorithm
+func verifySignature(alg algorithm, key interface{}, signed string, signature []byte) error {
+	var hash = alg.hash.New()
+
+	hash.Write([]byte(signed))
+
+	switch key := key.(type) {
+	case []byte:
+		if alg.keyType != "hmac" {
+			break
+		}
+
+		var mac = hmac.New(alg.hash.New, key)
+
+		mac.Write([]byte(signed))
+
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("Invalid signature")
+		}
+
+		return nil
+
+	case *rsa.PublicKey:
+		if alg.keyType == "rsa" {
+			return rsa.VerifyPKCS1v15(key, alg.hash, hash.Sum(nil), signature)
+		} else if alg.keyType == "rsa-pss" {
+			return rsa.VerifyPSS(key, alg.hash, hash.Sum(nil), signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+
+	case *ecdsa.PublicKey:
+		if alg.keyType != "ecdsa" {
+			break
+		} else if name := key.Curve.Params().Name; name != alg.curve {
+			return fmt.Errorf("Invalid key curve %v for %v", name, alg.curve)
+		}
+
+		var size = (key.Curve.Params().BitSize + 7) / 8
+
+		if len(signature) != 2*size {
+			return fmt.Errorf("Invalid signature")
+		}
+
+		var r = new(big.Int).SetBytes(signature[:size])
+		var s = new(big.Int).SetBytes(signature[size:])
+
+		if !ecdsa.Verify(key, hash.Sum(nil), r, s) {
+			return fmt.Errorf("Invalid signature")
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("Invalid key type %T for %v", key, alg.keyType)
+}
+
+// Verify the token signature and claims, returning the claims
+func (auth *Auth) Verify(ctx context.Context, token string) (Claims, error) {
+	var parts = strings.Split(token, ".")
+	var header header
+	var claims Claims
+
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Invalid token")
+	} else if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("Invalid token header: %v", err)
+	} else if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("Invalid token claims: %v", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token signature: %v", err)
+	}
+
+	alg, ok := algorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported algorithm: %#v", header.Alg)
+	}
+
+	if key, err := auth.key(ctx, header.Kid); err != nil {
+		return nil, err
+	} else if err := verifySignature(alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	if err := auth.validate(claims, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// Validate the exp, nbf, iat, iss and aud claims
+func (auth *Auth) validate(claims Claims, now time.Time) error {
+	if expires, ok, err := claims.time("exp"); err != nil {
+		return err
+	} else if ok && now.After(expires.Add(auth.config.Leeway)) {
+		return fmt.Errorf("Token expired")
+	}
+	if notBefore, ok, err := claims.time("nbf"); err != nil {
+		return err
+	} else if ok && now.Before(notBefore.Add(-auth.config.Leeway)) {
+		return fmt.Errorf("Token not yet valid")
+	}
+	if issuedAt, ok, err := claims.time("iat"); err != nil {
+		return err
+	} else if ok && now.Before(issuedAt.Add(-auth.config.Leeway)) {
+		return fmt.Errorf("Token issued in the future")
+	}
+
+	if auth.config.Issuer != "" && claims.Issuer() != auth.config.Issuer {
+		return fmt.Errorf("Invalid token issuer: %#v", claims.Issuer())
+	}
+
+	if auth.config.Audience == "" {
+		return nil
+	}
+
+	for _, audience := range claims.Audience() {
+		if audience == auth.config.Audience {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Invalid token audience: %#v", claims.Audience())
+}
+
+// Return the bearer token from the Authorization header, or an empty string
+func requestToken(r *http.Request) string {
+	var authorization = r.Header.Get("Authorization")
+
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	} else {
+		return ""
+	}
+}
+
+// Verify the Authorization: Bearer token, returning a web.Error with HTTP 401 if missing or invalid
+func (auth *Auth) Authenticate(r *http.Request) (Claims, error) {
+	if token := requestToken(r); token == "" {
+		return nil, web.Errorf(http.StatusUnauthorized, "Missing bearer token")
+	} else if claims, err := auth.Verify(r.Context(), token); err != nil {
+		return nil, web.Error{Status: http.StatusUnauthorized, Err: err}
+	} else {
+		return claims, nil
+	}
+}
+
+// Authenticate the request, returning the identity claim. Use for web.APIConfig.AuthFunc or web.EventConfig.AuthFunc.
+func (auth *Auth) AuthFunc(r *http.Request) (string, error) {
+	if claims, err := auth.Authenticate(r); err != nil {
+		return "", err
+	} else {
+		return claims.String(auth.config.IdentityClaim), nil
+	}
+}
+
+type claimsKey struct{}
+
+// Return the verified claims for a request served by Auth.Handler, or nil
+func RequestClaims(r *http.Request) Claims {
+	claims, _ := r.Context().Value(claimsKey{}).(Claims)
+
+	return claims
+}
+
+// Return a handler rejecting requests without a valid bearer token with HTTP 401.
+//
+// The handler is served with the claims for RequestClaims(), and the identity claim for web.RequestIdentity().
+func (auth *Auth) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := auth.Authenticate(r)
+		if err != nil {
+			if requestToken(r) == "" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			}
+
+			web.WriteError(w, r, err)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims))
+		r = web.WithIdentity(r, claims.String(auth.config.IdentityClaim))
+
+		handler.ServeHTTP(w, r)
+	})
+}
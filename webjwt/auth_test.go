@@ -0,0 +1,337 @@
+package webjwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qmsk/go-web"
+)
+
+var testRSAKeyOnce sync.Once
+var testRSAKey *rsa.PrivateKey
+
+// Shared RSA key, generated once
+func makeTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	testRSAKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("rsa.GenerateKey: %v", err)
+		}
+
+		testRSAKey = key
+	})
+
+	return testRSAKey
+}
+
+func makeTestECKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+
+	return key
+}
+
+func encodeSegment(t *testing.T, object interface{}) string {
+	data, err := json.Marshal(object)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Sign a token using the alg header, which does not need to match the key type
+func signToken(t *testing.T, alg string, kid string, key interface{}, claims map[string]interface{}) string {
+	var signed = encodeSegment(t, header{Alg: alg, Kid: kid}) + "." + encodeSegment(t, claims)
+	var hash = crypto.SHA256
+	var signature []byte
+
+	if algorithm, ok := algorithms[alg]; ok {
+		hash = algorithm.hash
+	}
+
+	var h = hash.New()
+
+	h.Write([]byte(signed))
+
+	switch key := key.(type) {
+	case nil:
+		// alg none
+
+	case []byte:
+		var mac = hmac.New(hash.New, key)
+
+		mac.Write([]byte(signed))
+
+		signature = mac.Sum(nil)
+
+	case *rsa.PrivateKey:
+		var err error
+
+		if strings.HasPrefix(alg, "PS") {
+			signature, err = rsa.SignPSS(rand.Reader, key, hash, h.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, h.Sum(nil))
+		}
+		if err != nil {
+			t.Fatalf("rsa.Sign: %v", err)
+		}
+
+	case *ecdsa.PrivateKey:
+		var size = (key.Curve.Params().BitSize + 7) / 8
+
+		r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		if err != nil {
+			t.Fatalf("ecdsa.Sign: %v", err)
+		}
+
+		signature = make([]byte, 2*size)
+
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+
+	default:
+		t.Fatalf("Unsupported key type: %T", key)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerify(t *testing.T) {
+	var hmacKey = []byte("secret")
+	var rsaKey = makeTestRSAKey(t)
+	var p256Key = makeTestECKey(t, elliptic.P256())
+	var p384Key = makeTestECKey(t, elliptic.P384())
+	var p521Key = makeTestECKey(t, elliptic.P521())
+	var auth = MakeAuth(Config{Keys: map[string]interface{}{
+		"hmac":  hmacKey,
+		"rsa":   &rsaKey.PublicKey,
+		"p256":  &p256Key.PublicKey,
+		"p384":  &p384Key.PublicKey,
+		"p521":  &p521Key.PublicKey,
+		"":      hmacKey,
+		"other": []byte("other"),
+	}})
+
+	for _, test := range []struct {
+		alg string
+		kid string
+		key interface{}
+	}{
+		{"HS256", "", hmacKey},
+		{"HS256", "hmac", hmacKey},
+		{"HS384", "hmac", hmacKey},
+		{"HS512", "hmac", hmacKey},
+		{"RS256", "rsa", rsaKey},
+		{"RS512", "rsa", rsaKey},
+		{"PS256", "rsa", rsaKey},
+		{"PS384", "rsa", rsaKey},
+		{"ES256", "p256", p256Key},
+		{"ES384", "p384", p384Key},
+		{"ES512", "p521", p521Key},
+	} {
+		var token = signToken(t, test.alg, test.kid, test.key, map[string]interface{}{"sub": "test"})
+
+		if claims, err := auth.Verify(context.Background(), token); err != nil {
+			t.Errorf("Verify %v kid=%v: %v", test.alg, test.kid, err)
+		} else if claims.Subject() != "test" {
+			t.Errorf("Verify %v kid=%v: claims %#v", test.alg, test.kid, claims)
+		}
+	}
+
+	for _, test := range []struct {
+		token string
+		err   string
+	}{
+		{"", "Invalid token"},
+		{"a.b", "Invalid token"},
+		{"!.e30.", "Invalid token header"},
+		{encodeSegment(t, header{Alg: "HS256"}) + ".!.", "Invalid token claims"},
+		{signToken(t, "HS256", "other", hmacKey, nil), "Invalid signature"},
+		{signToken(t, "HS256", "missing", hmacKey, nil), "Unknown key"},
+		{signToken(t, "HS256", "hmac", hmacKey, nil) + "!", "Invalid token signature"},
+	} {
+		if _, err := auth.Verify(context.Background(), test.token); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Verify %v: error %v, expected %v", test.token, err, test.err)
+		}
+	}
+}
+
+// Reject tokens using an algorithm that does not match the key type
+func TestVerifyAlgorithm(t *testing.T) {
+	var rsaKey = makeTestRSAKey(t)
+	var p256Key = makeTestECKey(t, elliptic.P256())
+	var p384Key = makeTestECKey(t, elliptic.P384())
+	var auth = MakeAuth(Config{Keys: map[string]interface{}{
+		"hmac": []byte("secret"),
+		"rsa":  &rsaKey.PublicKey,
+		"p256": &p256Key.PublicKey,
+		"p384": &p384Key.PublicKey,
+	}})
+
+	rsaPublicKey, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKIXPublicKey: %v", err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"none", signToken(t, "none", "hmac", nil, nil), "Unsupported algorithm: \"none\""},
+		{"none for rsa", signToken(t, "none", "rsa", nil, nil), "Unsupported algorithm: \"none\""},
+		{"empty", signToken(t, "", "hmac", nil, nil), "Unsupported algorithm: \"\""},
+		{"HS256 using the RSA public key", signToken(t, "HS256", "rsa", rsaPublicKey, nil), "Invalid key type *rsa.PublicKey for hmac"},
+		{"HS256 using the EC public key", signToken(t, "HS256", "p256", elliptic.Marshal(elliptic.P256(), p256Key.X, p256Key.Y), nil), "Invalid key type *ecdsa.PublicKey for hmac"},
+		{"RS256 for hmac", signToken(t, "RS256", "hmac", rsaKey, nil), "Invalid key type []uint8 for rsa"},
+		{"ES256 for rsa", signToken(t, "ES256", "rsa", p256Key, nil), "Invalid key type *rsa.PublicKey for ecdsa"},
+		{"PS256 for ecdsa", signToken(t, "PS256", "p256", rsaKey, nil), "Invalid key type *ecdsa.PublicKey for rsa-pss"},
+		{"RS256 as PS256", signToken(t, "RS256", "rsa", rsaKey, nil), ""},
+		{"ES384 for P-256", signToken(t, "ES384", "p256", p256Key, nil), "Invalid key curve P-256 for P-384"},
+		{"ES256 for P-384", signToken(t, "ES256", "p384", p384Key, nil), "Invalid key curve P-384 for P-256"},
+	} {
+		if _, err := auth.Verify(context.Background(), test.token); test.err == "" {
+			if err != nil {
+				t.Errorf("Verify %v: %v", test.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Verify %v: error %v, expected %v", test.name, err, test.err)
+		}
+	}
+
+	// ES256 signature using the wrong size
+	var token = signToken(t, "ES256", "p256", p256Key, nil)
+
+	if _, err := auth.Verify(context.Background(), token+"AAAA"); err == nil || err.Error() != "Invalid signature" {
+		t.Errorf("Verify ES256 with long signature: %v", err)
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	var key = []byte("secret")
+	var now = time.Now().Unix()
+	var auth = MakeAuth(Config{
+		Keys:     map[string]interface{}{"": key},
+		Issuer:   "https://issuer.example.com",
+		Audience: "test",
+		Leeway:   time.Minute,
+	})
+
+	for _, test := range []struct {
+		name   string
+		claims map[string]interface{}
+		err    string
+	}{
+		{"valid", map[string]interface{}{"exp": now + 60, "nbf": now, "iat": now}, ""},
+		{"fractional", map[string]interface{}{"exp": float64(now) + 0.5, "iat": float64(now) - 0.5}, ""},
+
+		// leeway
+		{"exp within leeway", map[string]interface{}{"exp": now - 30}, ""},
+		{"exp", map[string]interface{}{"exp": now - 120}, "Token expired"},
+		{"nbf within leeway", map[string]interface{}{"nbf": now + 30}, ""},
+		{"nbf", map[string]interface{}{"nbf": now + 120}, "Token not yet valid"},
+		{"iat within leeway", map[string]interface{}{"iat": now + 30}, ""},
+		{"iat", map[string]interface{}{"iat": now + 120}, "Token issued in the future"},
+
+		// non-numeric dates
+		{"exp string", map[string]interface{}{"exp": "2099-01-01"}, "Invalid exp claim: \"2099-01-01\""},
+		{"exp numeric string", map[string]interface{}{"exp": "4102444800"}, "Invalid exp claim"},
+		{"exp bool", map[string]interface{}{"exp": true}, "Invalid exp claim: true"},
+		{"exp null", map[string]interface{}{"exp": nil}, "Invalid exp claim"},
+		{"exp overflow", map[string]interface{}{"exp": 1e300}, "Invalid exp claim"},
+		{"nbf string", map[string]interface{}{"nbf": "0"}, "Invalid nbf claim"},
+		{"iat object", map[string]interface{}{"iat": map[string]interface{}{}}, "Invalid iat claim"},
+	} {
+		var claims = map[string]interface{}{"iss": "https://issuer.example.com", "aud": "test"}
+
+		for name, value := range test.claims {
+			claims[name] = value
+		}
+
+		if _, err := auth.Verify(context.Background(), signToken(t, "HS256", "", key, claims)); test.err == "" {
+			if err != nil {
+				t.Errorf("Verify %v: %v", test.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Verify %v: error %v, expected %v", test.name, err, test.err)
+		}
+	}
+
+	for _, test := range []struct {
+		name   string
+		claims map[string]interface{}
+		err    string
+	}{
+		{"aud", map[string]interface{}{"iss": "https://issuer.example.com", "aud": "test"}, ""},
+		{"aud list", map[string]interface{}{"iss": "https://issuer.example.com", "aud": []string{"other", "test"}}, ""},
+		{"aud mismatch", map[string]interface{}{"iss": "https://issuer.example.com", "aud": "other"}, "Invalid token audience"},
+		{"aud list mismatch", map[string]interface{}{"iss": "https://issuer.example.com", "aud": []string{"other", "Test"}}, "Invalid token audience"},
+		{"aud missing", map[string]interface{}{"iss": "https://issuer.example.com"}, "Invalid token audience"},
+		{"iss mismatch", map[string]interface{}{"iss": "https://other.example.com", "aud": "test"}, "Invalid token issuer: \"https://other.example.com\""},
+		{"iss missing", map[string]interface{}{"aud": "test"}, "Invalid token issuer"},
+		{"iss not a string", map[string]interface{}{"iss": 1, "aud": "test"}, "Invalid token issuer"},
+	} {
+		if _, err := auth.Verify(context.Background(), signToken(t, "HS256", "", key, test.claims)); test.err == "" {
+			if err != nil {
+				t.Errorf("Verify %v: %v", test.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Verify %v: error %v, expected %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var key = []byte("secret")
+	var auth = MakeAuth(Config{Keys: map[string]interface{}{"": key}, IdentityClaim: "email"})
+	var handler = auth.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(web.RequestIdentity(r) + " " + RequestClaims(r).Subject()))
+	}))
+
+	for _, test := range []struct {
+		authorization   string
+		status          int
+		wwwAuthenticate string
+		body            string
+	}{
+		{"", 401, "Bearer", ""},
+		{"Basic dGVzdA==", 401, "Bearer", ""},
+		{"Bearer invalid", 401, `Bearer error="invalid_token"`, ""},
+		{"Bearer " + signToken(t, "none", "", nil, map[string]interface{}{"sub": "test"}), 401, `Bearer error="invalid_token"`, ""},
+		{"bearer " + signToken(t, "HS256", "", key, map[string]interface{}{"sub": "test", "email": "test@example.com"}), 200, "", "test@example.com test"},
+	} {
+		var request = httptest.NewRequest("GET", "/", nil)
+		var response = httptest.NewRecorder()
+
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+
+		handler.ServeHTTP(response, request)
+
+		if response.Code != test.status {
+			t.Errorf("Authorization %v => HTTP %v, expected %v", test.authorization, response.Code, test.status)
+		} else if header := response.Header().Get("WWW-Authenticate"); header != test.wwwAuthenticate {
+			t.Errorf("Authorization %v => WWW-Authenticate %v, expected %v", test.authorization, header, test.wwwAuthenticate)
+		} else if test.body != "" && response.Body.String() != test.body {
+			t.Errorf("Authorization %v => %v, expected %v", test.authorization, response.Body.String(), test.body)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package webjwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Decoded JWT claims, using json.Number for numeric values
+type Claims map[string]interface{}
+
+// Return the string claim, or an empty string
+func (claims Claims) String(name string) string {
+	value, _ := claims[name].(string)
+
+	return value
+}
+
+// Return the NumericDate claim as a time, if present, failing if not a number
+func (claims Claims) time(name string) (time.Time, bool, error) {
+	if value, ok := claims[name]; !ok {
+		return time.Time{}, false, nil
+	} else if number, ok := value.(json.Number); !ok {
+		return time.Time{}, false, fmt.Errorf("Invalid %v claim: %#v", name, value)
+	} else if seconds, err := number.Float64(); err != nil || math.IsInf(seconds, 0) || math.Abs(seconds) > math.MaxInt64/float64(time.Second) {
+		return time.Time{}, false, fmt.Errorf("Invalid %v claim: %v", name, number)
+	} else {
+		return time.Unix(0, int64(seconds*float64(time.Second))), true, nil
+	}
+}
+
+func (claims Claims) Subject() string {
+	return claims.String("sub")
+}
+
+func (claims Claims) Issuer() string {
+	return claims.String("iss")
+}
+
+// Return the aud claim, which may be either a single string or a list of strings
+func (claims Claims) Audience() []string {
+	switch value := claims["aud"].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var audience []string
+
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+
+		return audience
+	default:
+		return nil
+	}
+}
+
+// Return the exp claim, or the zero time
+func (claims Claims) ExpiresAt() time.Time {
+	expires, _, _ := claims.time("exp")
+
+	return expires
+}
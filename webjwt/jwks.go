@@ -0,0 +1,248 @@
+package webjwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Default Config.JWKSRefresh
+const JWKS_REFRESH = 1 * time.Hour
+
+// Minimum interval between fetching the JWKS for unknown key IDs
+const JWKS_MIN_REFRESH = 1 * time.Minute
+
+// Timeout for fetching the JWKS
+const JWKS_TIMEOUT = 10 * time.Second
+
+// JSON Web Key, for RSA or EC public keys
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	if data, err := base64.RawURLEncoding.DecodeString(s); err != nil {
+		return nil, err
+	} else {
+		return new(big.Int).SetBytes(data), nil
+	}
+}
+
+func (jwk jwk) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid RSA n: %v", err)
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("Invalid RSA e: %v", jwk.E)
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported EC curve: %v", jwk.Crv)
+		}
+
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid EC x: %v", err)
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid EC y: %v", err)
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported key type: %v", jwk.Kty)
+	}
+}
+
+// JSON Web Key Set fetched from a URL, with signature keys by key ID
+type jwks struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	mutex       sync.Mutex
+	keys        map[string]interface{}
+	fetchTime   time.Time
+	attemptTime time.Time
+	fetchChan   chan struct{} // closed once any pending fetch completes
+}
+
+func makeJWKS(url string, refresh time.Duration) *jwks {
+	if refresh == 0 {
+		refresh = JWKS_REFRESH
+	}
+
+	return &jwks{
+		url:     url,
+		refresh: refresh,
+		client:  &http.Client{Timeout: JWKS_TIMEOUT},
+	}
+}
+
+func (jwks *jwks) fetch(ctx context.Context) (map[string]interface{}, error) {
+	var keySet struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "GET", jwks.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := jwks.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("JWKS %v: %v", jwks.url, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("JWKS %v: HTTP %v", jwks.url, response.Status)
+	} else if err := json.NewDecoder(response.Body).Decode(&keySet); err != nil {
+		return nil, fmt.Errorf("JWKS %v: %v", jwks.url, err)
+	}
+
+	var keys = make(map[string]interface{}, len(keySet.Keys))
+
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		} else if key, err := jwk.publicKey(); err != nil {
+			// skip unsupported keys
+			continue
+		} else {
+			keys[jwk.Kid] = key
+		}
+	}
+
+	return keys, nil
+}
+
+// Return key for the key ID, or the only key for tokens without any kid
+func (jwks *jwks) lookup(kid string) (interface{}, bool) {
+	if key, ok := jwks.keys[kid]; ok {
+		return key, true
+	} else if kid != "" || len(jwks.keys) != 1 {
+		return nil, false
+	}
+
+	for _, key := range jwks.keys {
+		return key, true
+	}
+
+	return nil, false
+}
+
+// Return key for the key ID, refreshing the key set if stale, or for unknown keys at most every JWKS_MIN_REFRESH.
+//
+// The key set is fetched without holding the mutex, with any concurrent lookups waiting for the pending fetch.
+func (jwks *jwks) key(ctx context.Context, kid string) (interface{}, error) {
+	jwks.mutex.Lock()
+
+	var key, ok = jwks.lookup(kid)
+
+	if ok && time.Since(jwks.fetchTime) < jwks.refresh {
+		jwks.mutex.Unlock()
+
+		return key, nil
+	} else if fetchChan := jwks.fetchChan; fetchChan != nil {
+		jwks.mutex.Unlock()
+
+		select {
+		case <-fetchChan:
+		case <-ctx.Done():
+			if ok {
+				return key, nil
+			}
+
+			return nil, ctx.Err()
+		}
+
+		return jwks.fetched(kid)
+	} else if !jwks.attemptTime.IsZero() && time.Since(jwks.attemptTime) < JWKS_MIN_REFRESH {
+		jwks.mutex.Unlock()
+
+		if ok {
+			return key, nil
+		}
+
+		return nil, fmt.Errorf("Unknown key: %#v", kid)
+	}
+
+	var fetchChan = make(chan struct{})
+
+	jwks.attemptTime = time.Now()
+	jwks.fetchChan = fetchChan
+	jwks.mutex.Unlock()
+
+	keys, err := jwks.fetch(ctx)
+
+	jwks.mutex.Lock()
+	if err == nil {
+		jwks.keys = keys
+		jwks.fetchTime = time.Now()
+	}
+	jwks.fetchChan = nil
+	jwks.mutex.Unlock()
+
+	close(fetchChan)
+
+	if err != nil {
+		// keep using any stale key
+		if ok {
+			return key, nil
+		}
+
+		return nil, err
+	}
+
+	return jwks.fetched(kid)
+}
+
+// Return key for the key ID after a fetch, including any stale key if the fetch failed
+func (jwks *jwks) fetched(kid string) (interface{}, error) {
+	jwks.mutex.Lock()
+	defer jwks.mutex.Unlock()
+
+	if key, ok := jwks.lookup(kid); !ok {
+		return nil, fmt.Errorf("Unknown key: %#v", kid)
+	} else {
+		return key, nil
+	}
+}
@@ -0,0 +1,285 @@
+package webjwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func makeRSAJWK(kid string, key *rsa.PublicKey) jwk {
+	return jwk{Kty: "RSA", Kid: kid, Use: "sig", N: encodeBigInt(key.N), E: encodeBigInt(big.NewInt(int64(key.E)))}
+}
+
+func makeECJWK(kid string, key *ecdsa.PublicKey) jwk {
+	return jwk{Kty: "EC", Kid: kid, Crv: key.Curve.Params().Name, X: encodeBigInt(key.X), Y: encodeBigInt(key.Y)}
+}
+
+// JWKS server counting fetches, optionally blocking each request until released
+type testJWKSServer struct {
+	*httptest.Server
+
+	mutex   sync.Mutex
+	keys    []jwk
+	fetches int
+	block   chan struct{}
+	request chan struct{}
+}
+
+func makeTestJWKSServer(t *testing.T, keys ...jwk) *testJWKSServer {
+	var server = testJWKSServer{keys: keys}
+
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mutex.Lock()
+		var keys = server.keys
+		var block = server.block
+		var request = server.request
+
+		server.fetches++
+		server.mutex.Unlock()
+
+		if request != nil {
+			request <- struct{}{}
+		}
+		if block != nil {
+			<-block
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+
+	t.Cleanup(server.Close)
+
+	return &server
+}
+
+func (server *testJWKSServer) setKeys(keys ...jwk) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.keys = keys
+}
+
+func (server *testJWKSServer) Fetches() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.fetches
+}
+
+// Allow refreshing the JWKS for unknown keys, as if JWKS_MIN_REFRESH had passed
+func expireAttempt(auth *Auth) {
+	auth.jwks.mutex.Lock()
+	defer auth.jwks.mutex.Unlock()
+
+	auth.jwks.attemptTime = time.Now().Add(-JWKS_MIN_REFRESH)
+}
+
+func TestJWKSKeys(t *testing.T) {
+	var rsaKey = makeTestRSAKey(t)
+	var ecKey = makeTestECKey(t, elliptic.P256())
+	var server = makeTestJWKSServer(t,
+		makeRSAJWK("rsa", &rsaKey.PublicKey),
+		makeECJWK("ec", &ecKey.PublicKey),
+		jwk{Kty: "RSA", Kid: "enc", Use: "enc", N: encodeBigInt(rsaKey.N), E: "AQAB"},
+		jwk{Kty: "oct", Kid: "oct"},
+		jwk{Kty: "EC", Kid: "p224", Crv: "P-224"},
+	)
+	var auth = MakeAuth(Config{JWKSURL: server.URL})
+
+	for _, test := range []struct {
+		alg string
+		kid string
+		key interface{}
+		err string
+	}{
+		{"RS256", "rsa", rsaKey, ""},
+		{"ES256", "ec", ecKey, ""},
+		{"RS256", "enc", rsaKey, "Unknown key"},
+		{"HS256", "oct", []byte("secret"), "Unknown key"},
+		{"ES256", "p224", ecKey, "Unknown key"},
+		{"RS256", "", rsaKey, "Unknown key"},
+	} {
+		if _, err := auth.Verify(context.Background(), signToken(t, test.alg, test.kid, test.key, nil)); test.err == "" {
+			if err != nil {
+				t.Errorf("Verify %v kid=%v: %v", test.alg, test.kid, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Verify %v kid=%v: error %v, expected %v", test.alg, test.kid, err, test.err)
+		}
+	}
+
+	if fetches := server.Fetches(); fetches != 1 {
+		t.Errorf("fetches: %v", fetches)
+	}
+
+	// the only key is used for tokens without any kid
+	server.setKeys(makeRSAJWK("rsa", &rsaKey.PublicKey))
+	expireAttempt(auth)
+
+	if _, err := auth.Verify(context.Background(), signToken(t, "RS256", "", rsaKey, nil)); err != nil {
+		t.Errorf("Verify without kid: %v", err)
+	}
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	var key1 = makeTestECKey(t, elliptic.P256())
+	var key2 = makeTestECKey(t, elliptic.P256())
+	var server = makeTestJWKSServer(t, makeECJWK("1", &key1.PublicKey))
+	var auth = MakeAuth(Config{JWKSURL: server.URL})
+
+	if _, err := auth.Verify(context.Background(), signToken(t, "ES256", "1", key1, nil)); err != nil {
+		t.Fatalf("Verify kid=1: %v", err)
+	}
+
+	// rotated key is not fetched more than every JWKS_MIN_REFRESH
+	server.setKeys(makeECJWK("1", &key1.PublicKey), makeECJWK("2", &key2.PublicKey))
+
+	if _, err := auth.Verify(context.Background(), signToken(t, "ES256", "2", key2, nil)); err == nil || err.Error() != "Unknown key: \"2\"" {
+		t.Errorf("Verify kid=2 before JWKS_MIN_REFRESH: %v", err)
+	} else if fetches := server.Fetches(); fetches != 1 {
+		t.Errorf("fetches: %v", fetches)
+	}
+
+	// kid miss refreshes the key set
+	expireAttempt(auth)
+
+	if _, err := auth.Verify(context.Background(), signToken(t, "ES256", "2", key2, nil)); err != nil {
+		t.Errorf("Verify kid=2: %v", err)
+	} else if fetches := server.Fetches(); fetches != 2 {
+		t.Errorf("fetches: %v", fetches)
+	}
+
+	// known keys are not refreshed
+	if _, err := auth.Verify(context.Background(), signToken(t, "ES256", "1", key1, nil)); err != nil {
+		t.Errorf("Verify kid=1: %v", err)
+	} else if fetches := server.Fetches(); fetches != 2 {
+		t.Errorf("fetches: %v", fetches)
+	}
+
+	// removed keys are rejected after refreshing, without falling back to the stale key
+	server.setKeys(makeECJWK("2", &key2.PublicKey))
+
+	auth.jwks.mutex.Lock()
+	auth.jwks.fetchTime = time.Now().Add(-JWKS_REFRESH)
+	auth.jwks.attemptTime = time.Now().Add(-JWKS_MIN_REFRESH)
+	auth.jwks.mutex.Unlock()
+
+	if _, err := auth.Verify(context.Background(), signToken(t, "ES256", "1", key1, nil)); err == nil || err.Error() != "Unknown key: \"1\"" {
+		t.Errorf("Verify removed kid=1: %v", err)
+	} else if fetches := server.Fetches(); fetches != 3 {
+		t.Errorf("fetches: %v", fetches)
+	}
+
+	// stale keys are used if the refresh fails
+	server.Close()
+
+	auth.jwks.mutex.Lock()
+	auth.jwks.fetchTime = time.Now().Add(-JWKS_REFRESH)
+	auth.jwks.attemptTime = time.Now().Add(-JWKS_MIN_REFRESH)
+	auth.jwks.mutex.Unlock()
+
+	if _, err := auth.Verify(context.Background(), signToken(t, "ES256", "2", key2, nil)); err != nil {
+		t.Errorf("Verify stale kid=2: %v", err)
+	}
+}
+
+// Fetch the key set without holding the mutex, with concurrent lookups waiting for the pending fetch
+func TestJWKSConcurrent(t *testing.T) {
+	var key1 = makeTestECKey(t, elliptic.P256())
+	var key2 = makeTestECKey(t, elliptic.P256())
+	var server = makeTestJWKSServer(t, makeECJWK("1", &key1.PublicKey))
+	var auth = MakeAuth(Config{JWKSURL: server.URL})
+
+	if _, err := auth.Verify(context.Background(), signToken(t, "ES256", "1", key1, nil)); err != nil {
+		t.Fatalf("Verify kid=1: %v", err)
+	}
+
+	var block = make(chan struct{})
+	var request = make(chan struct{}, 1)
+
+	server.mutex.Lock()
+	server.keys = append(server.keys, makeECJWK("2", &key2.PublicKey))
+	server.block = block
+	server.request = request
+	server.mutex.Unlock()
+
+	expireAttempt(auth)
+
+	var token = signToken(t, "ES256", "2", key2, nil)
+	var wg sync.WaitGroup
+	var errs = make(chan error, 10)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := auth.Verify(context.Background(), token)
+
+			errs <- err
+		}()
+	}
+
+	select {
+	case <-request:
+	case <-time.After(time.Second):
+		t.Fatalf("fetch: timeout")
+	}
+
+	// known keys do not wait for the pending fetch
+	var knownToken = signToken(t, "ES256", "1", key1, nil)
+	var done = make(chan error)
+
+	go func() {
+		_, err := auth.Verify(context.Background(), knownToken)
+
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Verify kid=1 during fetch: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Verify kid=1 during fetch: blocked")
+	}
+
+	// lookups with a cancelled context stop waiting
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cancel()
+
+	if _, err := auth.Verify(ctx, token); err != context.Canceled {
+		t.Errorf("Verify cancelled kid=2 during fetch: %v", err)
+	}
+
+	close(block)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Verify kid=2: %v", err)
+		}
+	}
+
+	if fetches := server.Fetches(); fetches != 2 {
+		t.Errorf("fetches: %v", fetches)
+	}
+}
@@ -0,0 +1,194 @@
+// NATS adapter for bridging NATS subjects to web.Events topics
+package webnats
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+	"github.com/qmsk/go-web"
+)
+
+// Map web.TopicEvent topics to NATS subjects under a prefix, e.g. "lights/1" <=> "events.lights.1".
+//
+// Events without any topic use the prefix as the subject.
+type Bridge struct {
+	conn   *nats.Conn
+	prefix string
+
+	mutex         sync.Mutex
+	closed        bool
+	subscriptions []*subscription
+	dropped       uint64
+}
+
+func MakeBridge(conn *nats.Conn, prefix string) *Bridge {
+	return &Bridge{
+		conn:   conn,
+		prefix: prefix,
+	}
+}
+
+// Return NATS subject for topic
+func (bridge *Bridge) Subject(topic string) string {
+	if topic == "" {
+		return bridge.prefix
+	} else {
+		return bridge.prefix + "." + strings.ReplaceAll(topic, "/", ".")
+	}
+}
+
+// Return topic for NATS subject
+func (bridge *Bridge) Topic(subject string) string {
+	if subject == bridge.prefix {
+		return ""
+	} else {
+		return strings.ReplaceAll(strings.TrimPrefix(subject, bridge.prefix+"."), ".", "/")
+	}
+}
+
+// Publish JSON-encoded event to the NATS subject for any web.TopicEvent topic
+func (bridge *Bridge) Publish(event web.Event) error {
+	var topic string
+
+	if topicEvent, ok := event.(web.TopicEvent); ok {
+		topic = topicEvent.Topic
+		event = topicEvent.Event
+	}
+
+	if data, err := json.Marshal(event); err != nil {
+		return err
+	} else {
+		return bridge.conn.Publish(bridge.Subject(topic), data)
+	}
+}
+
+// Return event for NATS message, using json.RawMessage for JSON messages and string otherwise
+func (bridge *Bridge) event(msg *nats.Msg) web.Event {
+	var event web.Event
+
+	if json.Valid(msg.Data) {
+		event = json.RawMessage(msg.Data)
+	} else {
+		event = string(msg.Data)
+	}
+
+	if topic := bridge.Topic(msg.Subject); topic == "" {
+		return event
+	} else {
+		return web.TopicEvent{Topic: topic, Event: event}
+	}
+}
+
+// Events received on the NATS subscriptions for Subscribe()
+type subscription struct {
+	mutex     sync.Mutex
+	closed    bool
+	eventChan chan web.Event
+	subs      []*nats.Subscription
+}
+
+// Send without blocking the NATS subscription, returning false if dropped
+func (subscription *subscription) send(event web.Event) bool {
+	subscription.mutex.Lock()
+	defer subscription.mutex.Unlock()
+
+	if subscription.closed {
+		return true
+	}
+
+	select {
+	case subscription.eventChan <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// Unsubscribe and close the eventChan
+func (subscription *subscription) close() error {
+	var err error
+
+	for _, sub := range subscription.subs {
+		if unsubErr := sub.Unsubscribe(); unsubErr != nil && err == nil {
+			err = unsubErr
+		}
+	}
+
+	subscription.mutex.Lock()
+	defer subscription.mutex.Unlock()
+
+	if !subscription.closed {
+		subscription.closed = true
+		close(subscription.eventChan)
+	}
+
+	return err
+}
+
+// Subscribe to all NATS subjects under the prefix.
+//
+// Use as a web.EventBackend to distribute events between instances, or with web.Events.AddSource() to only send NATS
+// messages to clients. Messages are dropped if the returned chan is not read from, once web.EVENTS_BUFFER events are
+// pending. The returned chan is closed once the bridge is closed.
+func (bridge *Bridge) Subscribe() (<-chan web.Event, error) {
+	var subscription = subscription{
+		eventChan: make(chan web.Event, web.EVENTS_BUFFER),
+	}
+	var handler = func(msg *nats.Msg) {
+		if !subscription.send(bridge.event(msg)) {
+			atomic.AddUint64(&bridge.dropped, 1)
+		}
+	}
+
+	for _, subject := range []string{bridge.prefix, bridge.prefix + ".>"} {
+		if sub, err := bridge.conn.Subscribe(subject, handler); err != nil {
+			subscription.close()
+
+			return nil, err
+		} else {
+			subscription.subs = append(subscription.subs, sub)
+		}
+	}
+
+	bridge.mutex.Lock()
+	defer bridge.mutex.Unlock()
+
+	if bridge.closed {
+		subscription.close()
+
+		return nil, fmt.Errorf("webnats: bridge is closed")
+	}
+
+	bridge.subscriptions = append(bridge.subscriptions, &subscription)
+
+	return subscription.eventChan, nil
+}
+
+// Return the number of NATS messages dropped by Subscribe()
+func (bridge *Bridge) Dropped() uint64 {
+	return atomic.LoadUint64(&bridge.dropped)
+}
+
+// Unsubscribe, closing any Subscribe() chans. The NATS connection is not closed.
+func (bridge *Bridge) Close() error {
+	var err error
+
+	bridge.mutex.Lock()
+	defer bridge.mutex.Unlock()
+
+	bridge.closed = true
+
+	for _, subscription := range bridge.subscriptions {
+		if closeErr := subscription.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	bridge.subscriptions = nil
+
+	return err
+}
@@ -0,0 +1,323 @@
+package webnats
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/qmsk/go-web"
+)
+
+// Minimal NATS protocol server supporting SUB, UNSUB and PUB with exact or trailing ">" subjects
+type testServer struct {
+	listener net.Listener
+
+	mutex  sync.Mutex
+	conns  map[*testServerConn]bool
+	unsubs []string
+}
+
+type testServerConn struct {
+	net.Conn
+
+	writeMutex sync.Mutex
+	subs       map[string]string // sid => subject
+}
+
+func (conn *testServerConn) write(format string, args ...interface{}) {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	fmt.Fprintf(conn, format, args...)
+}
+
+func matchSubject(pattern string, subject string) bool {
+	if strings.HasSuffix(pattern, ".>") {
+		return strings.HasPrefix(subject, strings.TrimSuffix(pattern, ">"))
+	} else {
+		return pattern == subject
+	}
+}
+
+func makeTestServer(t *testing.T) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+
+	var server = testServer{
+		listener: listener,
+		conns:    make(map[*testServerConn]bool),
+	}
+
+	go server.accept()
+
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	return &server
+}
+
+func (server *testServer) accept() {
+	for {
+		netConn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		var conn = &testServerConn{Conn: netConn, subs: make(map[string]string)}
+
+		server.mutex.Lock()
+		server.conns[conn] = true
+		server.mutex.Unlock()
+
+		go server.serve(conn)
+	}
+}
+
+func (server *testServer) serve(conn *testServerConn) {
+	defer conn.Close()
+	defer func() {
+		server.mutex.Lock()
+		delete(server.conns, conn)
+		server.mutex.Unlock()
+	}()
+
+	var reader = bufio.NewReader(conn)
+
+	conn.write("INFO {\"server_id\":\"test\",\"max_payload\":1048576}\r\n")
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		var fields = strings.Fields(line)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			conn.write("PONG\r\n")
+
+		case "SUB":
+			server.mutex.Lock()
+			conn.subs[fields[len(fields)-1]] = fields[1]
+			server.mutex.Unlock()
+
+		case "UNSUB":
+			server.mutex.Lock()
+			server.unsubs = append(server.unsubs, conn.subs[fields[1]])
+			delete(conn.subs, fields[1])
+			server.mutex.Unlock()
+
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+
+			server.publish(fields[1], payload[:size])
+		}
+	}
+}
+
+func (server *testServer) publish(subject string, payload []byte) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for conn := range server.conns {
+		for sid, pattern := range conn.subs {
+			if matchSubject(pattern, subject) {
+				conn.write("MSG %s %s %d\r\n%s\r\n", subject, sid, len(payload), payload)
+			}
+		}
+	}
+}
+
+func (server *testServer) Unsubs() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return append([]string(nil), server.unsubs...)
+}
+
+func makeTestBridge(t *testing.T) (*testServer, *nats.Conn, *Bridge) {
+	var server = makeTestServer(t)
+
+	conn, err := nats.Connect("nats://" + server.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("nats.Connect: %v", err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	return server, conn, MakeBridge(conn, "events")
+}
+
+func receiveEvent(t *testing.T, eventChan <-chan web.Event) web.Event {
+	t.Helper()
+
+	select {
+	case event, ok := <-eventChan:
+		if !ok {
+			t.Fatalf("receive: closed")
+		}
+
+		return event
+
+	case <-time.After(time.Second):
+		t.Fatalf("receive: timeout")
+	}
+
+	return nil
+}
+
+func TestBridgeSubject(t *testing.T) {
+	var bridge = MakeBridge(nil, "events")
+
+	for _, test := range []struct {
+		topic   string
+		subject string
+	}{
+		{"", "events"},
+		{"lights", "events.lights"},
+		{"lights/1", "events.lights.1"},
+	} {
+		if subject := bridge.Subject(test.topic); subject != test.subject {
+			t.Errorf("Subject(%#v): %#v, expected %#v", test.topic, subject, test.subject)
+		}
+
+		if topic := bridge.Topic(test.subject); topic != test.topic {
+			t.Errorf("Topic(%#v): %#v, expected %#v", test.subject, topic, test.topic)
+		}
+	}
+}
+
+func TestBridge(t *testing.T) {
+	var _, conn, bridge = makeTestBridge(t)
+	defer bridge.Close()
+
+	eventChan, err := bridge.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	// the subjects use separate subscriptions, without any ordering between them
+	if err := bridge.Publish("test"); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	if event, ok := receiveEvent(t, eventChan).(json.RawMessage); !ok || string(event) != `"test"` {
+		t.Errorf("event: %#v", event)
+	}
+
+	if err := bridge.Publish(web.TopicEvent{Topic: "lights/1", Event: 1}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	if err := conn.Publish("events.lights.2", []byte("not json")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	if event, ok := receiveEvent(t, eventChan).(web.TopicEvent); !ok || event.Topic != "lights/1" || string(event.Event.(json.RawMessage)) != `1` {
+		t.Errorf("topic event: %#v", event)
+	}
+
+	if event, ok := receiveEvent(t, eventChan).(web.TopicEvent); !ok || event.Topic != "lights/2" || event.Event != "not json" {
+		t.Errorf("string event: %#v", event)
+	}
+}
+
+func TestBridgeDrop(t *testing.T) {
+	var _, conn, bridge = makeTestBridge(t)
+	defer bridge.Close()
+
+	eventChan, err := bridge.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	// not read, does not block the NATS subscription
+	for i := 0; i < web.EVENTS_BUFFER+10; i++ {
+		if err := bridge.Publish(i); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	for start := time.Now(); bridge.Dropped() != 10; {
+		if time.Since(start) > time.Second {
+			t.Fatalf("dropped: %v", bridge.Dropped())
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < web.EVENTS_BUFFER; i++ {
+		if event, ok := receiveEvent(t, eventChan).(json.RawMessage); !ok || string(event) != strconv.Itoa(i) {
+			t.Fatalf("event %d: %#v", i, event)
+		}
+	}
+
+	// further messages are received
+	if err := bridge.Publish("test"); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	if event, ok := receiveEvent(t, eventChan).(json.RawMessage); !ok || string(event) != `"test"` {
+		t.Errorf("event: %#v", event)
+	}
+}
+
+func TestBridgeClose(t *testing.T) {
+	var server, conn, bridge = makeTestBridge(t)
+
+	eventChan, err := bridge.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	if err := bridge.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if _, ok := <-eventChan; ok {
+		t.Errorf("Close: chan not closed")
+	}
+
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	if unsubs := server.Unsubs(); len(unsubs) != 2 || unsubs[0] != "events" || unsubs[1] != "events.>" {
+		t.Errorf("unsubscribed: %#v", unsubs)
+	}
+
+	if _, err := bridge.Subscribe(); err == nil {
+		t.Errorf("Subscribe after Close: expected error")
+	}
+
+	if n := conn.NumSubscriptions(); n != 0 {
+		t.Errorf("subscriptions: %d", n)
+	}
+}
@@ -0,0 +1,107 @@
+// Redis pub/sub backend for distributing web.Events between multiple instances
+package webredis
+
+import (
+	"context"
+	"sync"
+
+	"github.com/qmsk/go-web"
+	"github.com/redis/go-redis/v9"
+)
+
+// web.EventBackend using Redis pub/sub on the given channel
+type Backend struct {
+	client  redis.UniversalClient
+	channel string
+
+	mutex    sync.Mutex
+	closed   bool
+	doneChan chan struct{}
+	pubsubs  []*redis.PubSub
+}
+
+func MakeBackend(client redis.UniversalClient, channel string) *Backend {
+	return &Backend{
+		client:   client,
+		channel:  channel,
+		doneChan: make(chan struct{}),
+	}
+}
+
+func (backend *Backend) Publish(event web.Event) error {
+	if buf, err := web.MarshalBackendEvent(event); err != nil {
+		return err
+	} else {
+		return backend.client.Publish(context.Background(), backend.channel, buf).Err()
+	}
+}
+
+// The returned chan is closed once the backend or redis client is closed
+func (backend *Backend) Subscribe() (<-chan web.Event, error) {
+	var ctx = context.Background()
+	var pubsub = backend.client.Subscribe(ctx, backend.channel)
+
+	// wait for confirmation
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+
+		return nil, err
+	}
+
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if backend.closed {
+		pubsub.Close()
+
+		return nil, redis.ErrClosed
+	}
+
+	backend.pubsubs = append(backend.pubsubs, pubsub)
+
+	var eventChan = make(chan web.Event)
+
+	go func() {
+		defer close(eventChan)
+
+		for message := range pubsub.Channel() {
+			if event, err := web.UnmarshalBackendEvent([]byte(message.Payload)); err != nil {
+				// ignore messages not published using web.MarshalBackendEvent
+				continue
+			} else {
+				select {
+				case eventChan <- event:
+				case <-backend.doneChan:
+					return
+				}
+			}
+		}
+	}()
+
+	return eventChan, nil
+}
+
+// Unsubscribe, stopping any Subscribe() goroutines and closing their chans. The redis client is not closed.
+func (backend *Backend) Close() error {
+	var err error
+
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if backend.closed {
+		return nil
+	}
+
+	backend.closed = true
+	close(backend.doneChan)
+
+	for _, pubsub := range backend.pubsubs {
+		if closeErr := pubsub.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	backend.pubsubs = nil
+
+	return err
+}
@@ -0,0 +1,106 @@
+package webredis
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/qmsk/go-web"
+	"github.com/redis/go-redis/v9"
+)
+
+func makeTestBackend(t *testing.T) (*miniredis.Miniredis, *Backend) {
+	var server = miniredis.RunT(t)
+	var client = redis.NewClient(&redis.Options{Addr: server.Addr()})
+
+	t.Cleanup(func() {
+		client.Close()
+	})
+
+	return server, MakeBackend(client, "events")
+}
+
+func receiveEvent(t *testing.T, eventChan <-chan web.Event) web.Event {
+	t.Helper()
+
+	select {
+	case event, ok := <-eventChan:
+		if !ok {
+			t.Fatalf("receive: closed")
+		}
+
+		return event
+
+	case <-time.After(time.Second):
+		t.Fatalf("receive: timeout")
+	}
+
+	return nil
+}
+
+func TestBackend(t *testing.T) {
+	var server, backend = makeTestBackend(t)
+	defer backend.Close()
+
+	eventChan, err := backend.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	// ignored
+	server.Publish("events", "not json")
+
+	if err := backend.Publish("test"); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	if err := backend.Publish(web.TopicEvent{Topic: "lights/1", Event: 1}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	if event, ok := receiveEvent(t, eventChan).(json.RawMessage); !ok || string(event) != `"test"` {
+		t.Errorf("event: %#v", event)
+	}
+
+	if event, ok := receiveEvent(t, eventChan).(web.TopicEvent); !ok || event.Topic != "lights/1" || string(event.Event.(json.RawMessage)) != `1` {
+		t.Errorf("topic event: %#v", event)
+	}
+}
+
+func TestBackendClose(t *testing.T) {
+	var _, backend = makeTestBackend(t)
+
+	eventChan, err := backend.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	// not received, blocks the goroutine until closed
+	if err := backend.Publish("test"); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if err := backend.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-eventChan:
+			closed = !ok
+		case <-time.After(time.Second):
+			t.Fatalf("Close: chan not closed")
+		}
+	}
+
+	if _, err := backend.Subscribe(); err == nil {
+		t.Errorf("Subscribe after Close: expected error")
+	}
+
+	if err := backend.Close(); err != nil {
+		t.Errorf("Close again: %v", err)
+	}
+}
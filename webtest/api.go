@@ -3,34 +3,188 @@ package webtest
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/gorilla/schema"
 )
 
 type APIRequest struct {
 	Method string
 	Target string
+
+	// Optional query params merged into the Target, either url.Values or a struct encoded using github.com/gorilla/schema
+	Query interface{}
+
+	// Optional cookies sent in addition to any from the APITest Jar
+	Cookies []*http.Cookie
+
+	// Optional Authorization using HTTP basic auth, or a bearer token
+	Username    string
+	Password    string
+	BearerToken string
+
+	// Send an application/x-www-form-urlencoded body, or a multipart/form-data body if there are any Files
+	Form  url.Values
+	Files []APIFile
+
+	// Send a raw body with the given Content-Type, instead of the JSON Object
+	Body        []byte
+	ContentType string
+
 	Object interface{}
 }
+
+// File part for a multipart/form-data APIRequest
+type APIFile struct {
+	Field       string
+	Filename    string
+	ContentType string // defaults to application/octet-stream
+	Content     []byte
+}
+
+// Write multipart/form-data body, returning the Content-Type with the boundary
+func (request APIRequest) writeMultipart(buffer *bytes.Buffer) (string, error) {
+	var writer = multipart.NewWriter(buffer)
+
+	for field, values := range request.Form {
+		for _, value := range values {
+			if err := writer.WriteField(field, value); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	for _, file := range request.Files {
+		var header = make(textproto.MIMEHeader)
+		var contentType = file.ContentType
+
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": file.Field, "filename": file.Filename}))
+		header.Set("Content-Type", contentType)
+
+		if part, err := writer.CreatePart(header); err != nil {
+			return "", err
+		} else if _, err := part.Write(file.Content); err != nil {
+			return "", err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	return writer.FormDataContentType(), nil
+}
+
 type APIResponse struct {
 	StatusCode int
 	Text       string
 
+	// Expect the exact Content-Type header, including any parameters, e.g. "text/csv; charset=utf-8"
+	ContentType string
+
+	// Compare the raw response body, or pass it to the check func, e.g. for CSV, NDJSON or static files
+	Body  []byte
+	Check func(body []byte) error
+
+	// Validate the JSON response body against the schema
+	Schema *JSONSchema
+
+	// Pointer to decode the JSON response into, or any other value to compare against the decoded response
 	Object interface{}
+
+	// Expect a non-2xx response with an error body containing the given message, either plain-text or JSON.
+	// Use the Object to decode or compare structured JSON errors.
+	Error string
+
+	// Expect Set-Cookie headers with the given cookie names and values
+	Cookies map[string]string
+
+	// Expect the Location header of the (final) response, e.g. for a redirect when not using FollowRedirects
+	Location string
+
+	// Expect the Location of each redirect followed using FollowRedirects, in order; use an empty slice to expect no redirects
+	Redirects []string
+
+	// Only compare the JSON fields present in the expected Object, ignoring any other fields in the response.
+	// Use a map or omitempty struct fields for the expected Object, as any zero-valued fields are also compared.
+	Subset bool
 }
 
 type APITest struct {
+	// Optional subtest name for TestAPIs, defaults to the request method and target
+	Name string
+
 	Handler http.Handler
 
+	// Optional cookie jar for sending and storing cookies, shared across the tests in TestAPIs
+	Jar http.CookieJar
+
 	Request  APIRequest
 	Response APIResponse
+
+	// Optional OpenAPI document for validating JSON responses against the documented response schemas
+	OpenAPI *OpenAPI
+
+	// Follow any redirects within the handler, up to MAX_REDIRECTS, using GET for any 301, 302 or 303 redirects
+	FollowRedirects bool
+
+	// Optional func to modify the request before sending, for anything not covered by the APIRequest,
+	// e.g. trailers, transfer encodings or malformed headers
+	ModifyRequest func(request *http.Request)
 }
 
-func (test APITest) makeRequest() *http.Request {
+// Return the Target with any Query params
+func (request APIRequest) target() (string, error) {
+	var query = make(url.Values)
+
+	switch value := request.Query.(type) {
+	case nil:
+		return request.Target, nil
+	case url.Values:
+		query = value
+	default:
+		if err := schema.NewEncoder().Encode(value, query); err != nil {
+			return "", fmt.Errorf("Encode query: %v", err)
+		}
+	}
+
+	target, err := url.Parse(request.Target)
+	if err != nil {
+		return "", err
+	}
+
+	var targetQuery = target.Query()
+
+	for key, values := range query {
+		for _, value := range values {
+			targetQuery.Add(key, value)
+		}
+	}
+
+	target.RawQuery = targetQuery.Encode()
+
+	return target.String(), nil
+}
+
+func (test APITest) makeRequest(t testing.TB, target string) *http.Request {
+	t.Helper()
+
 	var request *http.Request
 	var requestBody io.Reader
 	var requestBuffer bytes.Buffer
@@ -38,49 +192,229 @@ func (test APITest) makeRequest() *http.Request {
 
 	if test.Request.Object != nil {
 		if err := json.NewEncoder(&requestBuffer).Encode(test.Request.Object); err != nil {
-			panic(err)
+			t.Fatalf("%v %v: json.Encode: %v", test.Request.Method, target, err)
 		} else {
 			contentType = "application/json"
 			requestBody = &requestBuffer
 		}
+	} else if test.Request.Files != nil {
+		if multipartType, err := test.Request.writeMultipart(&requestBuffer); err != nil {
+			t.Fatalf("%v %v: multipart: %v", test.Request.Method, target, err)
+		} else {
+			contentType = multipartType
+			requestBody = &requestBuffer
+		}
+	} else if test.Request.Form != nil {
+		contentType = "application/x-www-form-urlencoded"
+		requestBody = strings.NewReader(test.Request.Form.Encode())
+	} else if test.Request.Body != nil {
+		contentType = test.Request.ContentType
+		requestBody = bytes.NewReader(test.Request.Body)
 	}
 
-	request = httptest.NewRequest(test.Request.Method, test.Request.Target, requestBody)
+	request = httptest.NewRequest(test.Request.Method, target, requestBody)
 
 	// headers
 	if contentType != "" {
 		request.Header.Set("Content-Type", contentType)
 	}
 
+	if test.Request.Username != "" || test.Request.Password != "" {
+		request.SetBasicAuth(test.Request.Username, test.Request.Password)
+	} else if test.Request.BearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+test.Request.BearerToken)
+	}
+
+	if test.Jar != nil {
+		for _, cookie := range test.Jar.Cookies(requestURL(request)) {
+			request.AddCookie(cookie)
+		}
+	}
+	for _, cookie := range test.Request.Cookies {
+		request.AddCookie(cookie)
+	}
+
+	if test.ModifyRequest != nil {
+		test.ModifyRequest(request)
+	}
+
 	return request
 }
 
+// Return absolute URL for the request, as used for the cookie jar
+func requestURL(request *http.Request) *url.URL {
+	return &url.URL{Scheme: "http", Host: request.Host, Path: request.URL.Path}
+}
+
 func (test APITest) testRequest(request *http.Request) *http.Response {
 	var responseWriter = httptest.NewRecorder()
 
 	test.Handler.ServeHTTP(responseWriter, request)
 
-	return responseWriter.Result()
+	var response = responseWriter.Result()
+
+	if test.Jar != nil {
+		test.Jar.SetCookies(requestURL(request), response.Cookies())
+	}
+
+	return response
 }
 
-func TestAPI(t *testing.T, test APITest) {
-	var request = test.makeRequest()
+// Maximum number of redirects for FollowRedirects
+const MAX_REDIRECTS = 10
+
+// Return the final response after following any redirects, and the Location of each redirect
+func (test APITest) testRedirects(t testing.TB, request *http.Request) (*http.Response, []string) {
+	t.Helper()
+
 	var response = test.testRequest(request)
+	var redirects []string
+
+	for test.FollowRedirects {
+		var location = response.Header.Get("Location")
+
+		if response.StatusCode < 300 || response.StatusCode >= 400 || location == "" {
+			break
+		} else if len(redirects) >= MAX_REDIRECTS {
+			t.Fatalf("%v %v => HTTP %v: stopped after %d redirects", request.Method, request.URL, response.StatusCode, len(redirects))
+		}
+
+		redirects = append(redirects, location)
+
+		var method = request.Method
+		var redirectURL, err = request.URL.Parse(location)
+
+		if err != nil {
+			t.Fatalf("%v %v => HTTP %v with invalid Location %v: %v", request.Method, request.URL, response.StatusCode, location, err)
+		}
+
+		switch response.StatusCode {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+			if method != "HEAD" {
+				method = "GET"
+			}
+		}
+
+		var redirectRequest = httptest.NewRequest(method, redirectURL.RequestURI(), nil)
+
+		if test.Jar != nil {
+			for _, cookie := range test.Jar.Cookies(requestURL(redirectRequest)) {
+				redirectRequest.AddCookie(cookie)
+			}
+		}
+
+		request = redirectRequest
+		response = test.testRequest(request)
+	}
+
+	return response, redirects
+}
+
+func TestAPI(t testing.TB, test APITest) {
+	t.Helper()
+
+	testAPI(t, test)
+}
+
+// Returns the response and body
+func testAPI(t testing.TB, test APITest) (*http.Response, []byte) {
+	t.Helper()
+
+	target, err := test.Request.target()
+	if err != nil {
+		t.Fatalf("%v %v: %v", test.Request.Method, test.Request.Target, err)
+	}
+
+	var request = test.makeRequest(t, target)
+	var response, redirects = test.testRedirects(t, request)
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("%v %v => HTTP %v: read body: %v", test.Request.Method, target, response.StatusCode, err)
+	}
 
 	if test.Response.StatusCode != 0 && test.Response.StatusCode != response.StatusCode {
-		t.Errorf("%v %v => HTTP %v, expected %v", test.Request.Method, test.Request.Target, response.StatusCode, test.Response.StatusCode)
+		t.Errorf("%v %v => HTTP %v, expected %v", test.Request.Method, target, response.StatusCode, test.Response.StatusCode)
+	}
+
+	if test.Response.Location == "" {
+
+	} else if location := response.Header.Get("Location"); location != test.Response.Location {
+		t.Errorf("%v %v => HTTP %v with incorrect Location: %#v", test.Request.Method, target, response.StatusCode, location)
+	}
+
+	if test.Response.Redirects == nil {
+
+	} else if len(redirects) == 0 && len(test.Response.Redirects) == 0 {
+
+	} else if !reflect.DeepEqual(redirects, test.Response.Redirects) {
+		t.Errorf("%v %v => HTTP %v with incorrect redirects: %#v", test.Request.Method, target, response.StatusCode, redirects)
+	}
+
+	if test.Response.ContentType == "" {
+
+	} else if contentType := response.Header.Get("Content-Type"); contentType != test.Response.ContentType {
+		t.Errorf("%v %v => HTTP %v with incorrect Content-Type: %v", test.Request.Method, target, response.StatusCode, contentType)
+	}
+
+	if test.Response.Body == nil {
+
+	} else if !bytes.Equal(body, test.Response.Body) {
+		t.Errorf("%v %v => HTTP %v with incorrect body: %q", test.Request.Method, target, response.StatusCode, body)
+	}
+
+	if test.Response.Check == nil {
+
+	} else if err := test.Response.Check(body); err != nil {
+		t.Errorf("%v %v => HTTP %v with invalid body: %v", test.Request.Method, target, response.StatusCode, err)
+	}
+
+	if test.Response.Schema == nil {
+
+	} else if errors := validateJSON(test.Response.Schema, body); errors != nil {
+		t.Errorf("%v %v => HTTP %v with invalid response:\n\t%v", test.Request.Method, target, response.StatusCode, strings.Join(errors, "\n\t"))
+	}
+
+	if test.OpenAPI == nil {
+
+	} else if contentType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type")); contentType != "application/json" {
+
+	} else if errors := test.OpenAPI.Validate(test.Request.Method, request.URL.Path, response.StatusCode, body); errors != nil {
+		t.Errorf("%v %v => HTTP %v does not match OpenAPI:\n\t%v", test.Request.Method, target, response.StatusCode, strings.Join(errors, "\n\t"))
+	}
+
+	if test.Response.Cookies != nil {
+		var cookies = make(map[string]string)
+
+		for _, cookie := range response.Cookies() {
+			cookies[cookie.Name] = cookie.Value
+		}
+
+		for name, value := range test.Response.Cookies {
+			if cookie, ok := cookies[name]; !ok {
+				t.Errorf("%v %v => HTTP %v without expected Set-Cookie: %v", test.Request.Method, target, response.StatusCode, name)
+			} else if cookie != value {
+				t.Errorf("%v %v => HTTP %v with incorrect Set-Cookie %v: %#v", test.Request.Method, target, response.StatusCode, name, cookie)
+			}
+		}
+	}
+
+	if test.Response.Error == "" {
+
+	} else if response.StatusCode >= 200 && response.StatusCode < 300 {
+		t.Errorf("%v %v => HTTP %v, expected error: %v", test.Request.Method, target, response.StatusCode, test.Response.Error)
+	} else if message := strings.TrimSpace(string(body)); !strings.Contains(message, test.Response.Error) {
+		t.Errorf("%v %v => HTTP %v with incorrect error: %#v", test.Request.Method, target, response.StatusCode, message)
 	}
 
 	if test.Response.Text == "" {
 
 	} else if contentType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type")); err != nil {
-		panic(err)
+		t.Errorf("%v %v => HTTP %v with invalid Content-Type: %v", test.Request.Method, target, response.StatusCode, err)
 	} else if contentType != "text/plain" {
-		t.Errorf("%v %v => HTTP %v with unexpected non-text Content-Type:%v", test.Request.Method, test.Request.Target, response.StatusCode, contentType)
-	} else if bytes, err := ioutil.ReadAll(response.Body); err != nil {
-		panic(err)
-	} else if string(bytes) != test.Response.Text {
-		t.Errorf("%v %v => HTTP %v with incorrect response: %#v", test.Request.Method, test.Request.Target, response.StatusCode, string(bytes))
+		t.Errorf("%v %v => HTTP %v with unexpected non-text Content-Type:%v", test.Request.Method, target, response.StatusCode, contentType)
+	} else if string(body) != test.Response.Text {
+		t.Errorf("%v %v => HTTP %v with incorrect response: %#v", test.Request.Method, target, response.StatusCode, string(body))
 	}
 
 	if test.Response.Object == nil {
@@ -88,11 +422,68 @@ func TestAPI(t *testing.T, test APITest) {
 	} else {
 		switch contentType := response.Header.Get("Content-Type"); contentType {
 		case "application/json":
-			if err := json.NewDecoder(response.Body).Decode(test.Response.Object); err != nil {
-				panic(err)
+			if reflect.TypeOf(test.Response.Object).Kind() == reflect.Ptr {
+				if err := json.Unmarshal(body, test.Response.Object); err != nil {
+					t.Fatalf("%v %v => HTTP %v with invalid JSON: %v", test.Request.Method, target, response.StatusCode, err)
+				}
+			} else if test.Response.Subset {
+				if expected, object, err := decodeSubset(bytes.NewReader(body), test.Response.Object); err != nil {
+					t.Fatalf("%v %v => HTTP %v with invalid JSON: %v", test.Request.Method, target, response.StatusCode, err)
+				} else if !reflect.DeepEqual(object, expected) {
+					t.Errorf("%v %v => HTTP %v with incorrect response:\n%v", test.Request.Method, target, response.StatusCode, diffJSON(expected, object))
+				}
+			} else if object, err := decodeExpected(bytes.NewReader(body), test.Response.Object); err != nil {
+				t.Fatalf("%v %v => HTTP %v with invalid JSON: %v", test.Request.Method, target, response.StatusCode, err)
+			} else if !reflect.DeepEqual(object, test.Response.Object) {
+				t.Errorf("%v %v => HTTP %v with incorrect response:\n%v", test.Request.Method, target, response.StatusCode, diffJSON(test.Response.Object, object))
 			}
 		default:
-			t.Errorf("%v %v => HTTP %v with unsupported Content-Type:%v", test.Request.Method, test.Request.Target, response.StatusCode, contentType)
+			t.Errorf("%v %v => HTTP %v with unsupported Content-Type:%v", test.Request.Method, target, response.StatusCode, contentType)
+		}
+	}
+
+	return response, body
+}
+
+func (test APITest) name() string {
+	if test.Name != "" {
+		return test.Name
+	} else {
+		return fmt.Sprintf("%v %v", test.Request.Method, test.Request.Target)
+	}
+}
+
+// Run the func as a subtest if supported, or directly for benchmarks and fuzz targets, returning false if failed
+func run(t testing.TB, name string, f func(t testing.TB)) bool {
+	if subtest, ok := t.(*testing.T); ok {
+		return subtest.Run(name, func(t *testing.T) { f(t) })
+	} else {
+		f(t)
+
+		return !t.Failed()
+	}
+}
+
+// Run each test in order as a subtest, using the handler for any tests without a Handler.
+// Cookies set by earlier responses are sent with later requests, for any tests without a Jar.
+//
+// Stops at the first failed test, as later requests in a scenario typically depend on the earlier ones.
+func TestAPIs(t testing.TB, handler http.Handler, tests []APITest) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("cookiejar.New: %v", err)
+	}
+
+	for _, test := range tests {
+		if test.Handler == nil {
+			test.Handler = handler
+		}
+		if test.Jar == nil {
+			test.Jar = jar
+		}
+
+		if !run(t, test.name(), func(t testing.TB) { TestAPI(t, test) }) {
+			break
 		}
 	}
 }
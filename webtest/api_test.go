@@ -0,0 +1,738 @@
+package webtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Record test failures instead of failing the test, for testing the webtest helpers
+type recordTB struct {
+	testing.TB
+
+	mutex  sync.Mutex
+	errors []string
+}
+
+func (t *recordTB) Helper() {}
+
+func (t *recordTB) Errorf(format string, args ...interface{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func (t *recordTB) Fatalf(format string, args ...interface{}) {
+	t.Errorf(format, args...)
+
+	runtime.Goexit()
+}
+
+func (t *recordTB) Failed() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return len(t.errors) > 0
+}
+
+// Run the func using a recordTB, returning any failures
+func recordFailures(t *testing.T, f func(t testing.TB)) []string {
+	var recordTB = recordTB{TB: t}
+	var done = make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		f(&recordTB)
+	}()
+
+	<-done
+
+	return recordTB.errors
+}
+
+// Expect a failure containing the message, or no failures
+func expectFailure(t *testing.T, failures []string, message string) {
+	t.Helper()
+
+	if message == "" {
+		if len(failures) > 0 {
+			t.Errorf("unexpected failures:\n%v", strings.Join(failures, "\n"))
+		}
+	} else if len(failures) == 0 {
+		t.Errorf("expected failure: %v", message)
+	} else if !strings.Contains(strings.Join(failures, "\n"), message) {
+		t.Errorf("expected failure %#v:\n%v", message, strings.Join(failures, "\n"))
+	}
+}
+
+type testObject struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Tags []string
+}
+
+func testObjectHandler(object interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(object)
+	})
+}
+
+func TestAPIObject(t *testing.T) {
+	var handler = testObjectHandler(testObject{ID: 1, Name: "test", Tags: []string{"a", "b"}})
+
+	for _, test := range []struct {
+		object  interface{}
+		failure string
+	}{
+		{testObject{ID: 1, Name: "test", Tags: []string{"a", "b"}}, ""},
+		{map[string]interface{}{"id": 1.0, "name": "test", "Tags": []interface{}{"a", "b"}}, ""},
+		{testObject{ID: 1, Name: "wrong", Tags: []string{"a", "b"}}, "-   \"name\": \"wrong\",\n+   \"name\": \"test\","},
+		{testObject{ID: 1, Name: "test"}, "-   \"Tags\": null\n+   \"Tags\": [\n+     \"a\",\n+     \"b\"\n+   ]"},
+		{[]testObject{}, "invalid JSON"},
+	} {
+		var failures = recordFailures(t, func(t testing.TB) {
+			TestAPI(t, APITest{
+				Handler:  handler,
+				Request:  APIRequest{Method: "GET", Target: "/"},
+				Response: APIResponse{StatusCode: 200, Object: test.object},
+			})
+		})
+
+		expectFailure(t, failures, test.failure)
+	}
+
+	// pointers are decoded into
+	var object testObject
+
+	expectFailure(t, recordFailures(t, func(t testing.TB) {
+		TestAPI(t, APITest{
+			Handler:  handler,
+			Request:  APIRequest{Method: "GET", Target: "/"},
+			Response: APIResponse{StatusCode: 200, Object: &object},
+		})
+	}), "")
+
+	if object.ID != 1 || object.Name != "test" || len(object.Tags) != 2 {
+		t.Errorf("decoded object: %#v", object)
+	}
+}
+
+func TestDiffJSON(t *testing.T) {
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+		diff     string
+	}{
+		{1, 1, "  1\n"},
+		{1, 2, "- 1\n+ 2\n"},
+		{
+			[]string{"a", "b", "c"},
+			[]string{"a", "c", "d"},
+			"  [\n    \"a\",\n-   \"b\",\n-   \"c\"\n+   \"c\",\n+   \"d\"\n  ]\n",
+		},
+		{
+			map[string]int{"a": 1, "b": 2},
+			map[string]int{"a": 1, "b": 3},
+			"  {\n    \"a\": 1,\n-   \"b\": 2\n+   \"b\": 3\n  }\n",
+		},
+	} {
+		if diff := diffJSON(test.expected, test.actual); diff != test.diff {
+			t.Errorf("diffJSON(%#v, %#v):\n%v\nexpected:\n%v", test.expected, test.actual, diff, test.diff)
+		}
+	}
+}
+
+func TestAPISubset(t *testing.T) {
+	var handler = testObjectHandler(map[string]interface{}{
+		"id":    1,
+		"name":  "test",
+		"extra": true,
+		"items": []interface{}{
+			map[string]interface{}{"id": 1, "extra": true},
+			map[string]interface{}{"id": 2, "extra": true},
+		},
+	})
+
+	for _, test := range []struct {
+		object  interface{}
+		failure string
+	}{
+		{map[string]interface{}{"id": 1}, ""},
+		{map[string]interface{}{"id": 1, "name": "test"}, ""},
+		{map[string]interface{}{"items": []interface{}{map[string]interface{}{"id": 1}, map[string]interface{}{"id": 2}}}, ""},
+		{map[string]interface{}{"name": "wrong"}, "-   \"name\": \"wrong\"\n+   \"name\": \"test\""},
+		{map[string]interface{}{"missing": 1}, "-   \"missing\": 1\n- }\n+ {}"},
+		{map[string]interface{}{"items": []interface{}{map[string]interface{}{"id": 1}}}, "incorrect response"},
+		{struct {
+			ID   int    `json:"id"`
+			Name string `json:"name,omitempty"`
+		}{ID: 1}, ""},
+		{testObject{ID: 1, Name: "test"}, "-   \"Tags\": null,\n    \"id\": 1,"},
+	} {
+		var failures = recordFailures(t, func(t testing.TB) {
+			TestAPI(t, APITest{
+				Handler:  handler,
+				Request:  APIRequest{Method: "GET", Target: "/"},
+				Response: APIResponse{StatusCode: 200, Object: test.object, Subset: true},
+			})
+		})
+
+		expectFailure(t, failures, test.failure)
+	}
+}
+
+func TestAPIEncodeErrors(t *testing.T) {
+	for _, test := range []struct {
+		request APIRequest
+		failure string
+	}{
+		{APIRequest{Method: "POST", Target: "/", Object: make(chan int)}, "POST /: json.Encode: json: unsupported type: chan int"},
+		{APIRequest{Method: "GET", Target: "/", Query: 1}, "GET /: Encode query: "},
+	} {
+		var failures = recordFailures(t, func(t testing.TB) {
+			TestAPI(t, APITest{
+				Handler: testObjectHandler(nil),
+				Request: test.request,
+			})
+
+			t.Errorf("not aborted")
+		})
+
+		expectFailure(t, failures, test.failure)
+
+		if len(failures) != 1 {
+			t.Errorf("failures: %v", strings.Join(failures, "\n"))
+		}
+	}
+}
+
+// Run TestAPIs steps directly for a testing.TB without subtests
+func TestAPIsTB(t *testing.T) {
+	var requests int
+	var handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	})
+
+	expectFailure(t, recordFailures(t, func(t testing.TB) {
+		TestAPIs(t, handler, []APITest{
+			{Request: APIRequest{Method: "GET", Target: "/a"}, Response: APIResponse{StatusCode: 200}},
+			{Request: APIRequest{Method: "GET", Target: "/b"}, Response: APIResponse{StatusCode: 200}},
+		})
+	}), "")
+
+	if requests != 2 {
+		t.Errorf("requests: %d", requests)
+	}
+}
+
+func BenchmarkAPI(b *testing.B) {
+	var handler = testObjectHandler(testObject{ID: 1, Name: "test"})
+
+	for i := 0; i < b.N; i++ {
+		TestAPI(b, APITest{
+			Handler:  handler,
+			Request:  APIRequest{Method: "GET", Target: "/"},
+			Response: APIResponse{StatusCode: 200, Object: testObject{ID: 1, Name: "test"}},
+		})
+	}
+}
+
+// Handler storing POSTed objects, returning them for GET
+func testObjectsHandler() http.Handler {
+	var mutex sync.Mutex
+	var objects = []testObject{}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(objects)
+
+		case "POST":
+			var object testObject
+
+			if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			object.ID = len(objects) + 1
+			objects = append(objects, object)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(object)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func TestAPIsScenario(t *testing.T) {
+	TestAPIs(t, testObjectsHandler(), []APITest{
+		{
+			Request:  APIRequest{Method: "POST", Target: "/", Object: testObject{Name: "a"}},
+			Response: APIResponse{StatusCode: 201, Object: testObject{ID: 1, Name: "a"}},
+		},
+		{
+			Name:     "POST second",
+			Request:  APIRequest{Method: "POST", Target: "/", Object: testObject{Name: "b"}},
+			Response: APIResponse{StatusCode: 201, Object: testObject{ID: 2, Name: "b"}},
+		},
+		{
+			Request:  APIRequest{Method: "GET", Target: "/"},
+			Response: APIResponse{StatusCode: 200, Object: []testObject{{ID: 1, Name: "a"}, {ID: 2, Name: "b"}}},
+		},
+	})
+
+	for _, test := range []struct {
+		test APITest
+		name string
+	}{
+		{APITest{Request: APIRequest{Method: "GET", Target: "/items"}}, "GET /items"},
+		{APITest{Name: "list", Request: APIRequest{Method: "GET", Target: "/items"}}, "list"},
+	} {
+		if name := test.test.name(); name != test.name {
+			t.Errorf("name %#v, expected %#v", name, test.name)
+		}
+	}
+}
+
+func TestAPIsAbort(t *testing.T) {
+	var handler = testObjectsHandler()
+	var failures = recordFailures(t, func(t testing.TB) {
+		TestAPIs(t, handler, []APITest{
+			{
+				Request:  APIRequest{Method: "POST", Target: "/", Object: testObject{Name: "a"}},
+				Response: APIResponse{StatusCode: 201},
+			},
+			{
+				Request:  APIRequest{Method: "PUT", Target: "/", Object: testObject{Name: "b"}},
+				Response: APIResponse{StatusCode: 201},
+			},
+			{
+				Request:  APIRequest{Method: "POST", Target: "/", Object: testObject{Name: "c"}},
+				Response: APIResponse{StatusCode: 201},
+			},
+		})
+	})
+
+	expectFailure(t, failures, "PUT / => HTTP 405, expected 201")
+
+	// the remaining tests are not run after a failure
+	TestAPI(t, APITest{
+		Handler:  handler,
+		Request:  APIRequest{Method: "GET", Target: "/"},
+		Response: APIResponse{StatusCode: 200, Object: []testObject{{ID: 1, Name: "a"}}},
+	})
+}
+
+// Return the request query as text
+var testQueryHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(r.URL.RawQuery))
+})
+
+type testQuery struct {
+	Limit int      `schema:"limit"`
+	Topic []string `schema:"topic"`
+}
+
+func TestAPIQuery(t *testing.T) {
+	for _, test := range []struct {
+		target string
+		query  interface{}
+		text   string
+	}{
+		{"/", nil, ""},
+		{"/?b=2", nil, "b=2"},
+		{"/", url.Values{"a": {"1"}}, "a=1"},
+		{"/?b=2", url.Values{"a": {"1", "x y"}}, "a=1&a=x+y&b=2"},
+		{"/?limit=1", testQuery{Limit: 10, Topic: []string{"a", "b"}}, "limit=1&limit=10&topic=a&topic=b"},
+	} {
+		expectFailure(t, recordFailures(t, func(t testing.TB) {
+			TestAPI(t, APITest{
+				Handler:  testQueryHandler,
+				Request:  APIRequest{Method: "GET", Target: test.target, Query: test.query},
+				Response: APIResponse{StatusCode: 200, Body: []byte(test.text)},
+			})
+		}), "")
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	var handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/text":
+			http.Error(w, "Not Found: test", http.StatusNotFound)
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"error":"Invalid name"}`))
+		default:
+			w.Write([]byte("OK"))
+		}
+	})
+
+	for _, test := range []struct {
+		target   string
+		response APIResponse
+		failure  string
+	}{
+		{"/text", APIResponse{StatusCode: 404, Error: "Not Found"}, ""},
+		{"/text", APIResponse{Error: "Not Found: test"}, ""},
+		{"/text", APIResponse{StatusCode: 404, Error: "Forbidden"}, "GET /text => HTTP 404 with incorrect error: \"Not Found: test\""},
+		{"/json", APIResponse{StatusCode: 422, Error: "Invalid name"}, ""},
+		{"/json", APIResponse{StatusCode: 422, Error: "Invalid name", Object: map[string]interface{}{"error": "Invalid name"}}, ""},
+		{"/json", APIResponse{StatusCode: 422, Error: "Invalid id"}, "GET /json => HTTP 422 with incorrect error: \"{\\\"error\\\":\\\"Invalid name\\\"}\""},
+		{"/", APIResponse{Error: "Not Found"}, "GET / => HTTP 200, expected error: Not Found"},
+	} {
+		var failures = recordFailures(t, func(t testing.TB) {
+			TestAPI(t, APITest{
+				Handler:  handler,
+				Request:  APIRequest{Method: "GET", Target: test.target},
+				Response: test.response,
+			})
+		})
+
+		expectFailure(t, failures, test.failure)
+	}
+}
+
+// Set a session cookie on POST /login, and return the request cookies as text
+var testCookieHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/login" {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: r.FormValue("name"), Path: "/"})
+	}
+
+	var cookies []string
+
+	for _, cookie := range r.Cookies() {
+		cookies = append(cookies, cookie.Name+"="+cookie.Value)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(strings.Join(cookies, "; ")))
+})
+
+func TestAPICookies(t *testing.T) {
+	TestAPIs(t, testCookieHandler, []APITest{
+		{
+			Request:  APIRequest{Method: "GET", Target: "/"},
+			Response: APIResponse{StatusCode: 200, Body: []byte("")},
+		},
+		{
+			Request:  APIRequest{Method: "POST", Target: "/login", Form: url.Values{"name": {"test"}}},
+			Response: APIResponse{StatusCode: 200, Cookies: map[string]string{"session": "test"}},
+		},
+		{
+			Request:  APIRequest{Method: "GET", Target: "/"},
+			Response: APIResponse{StatusCode: 200, Body: []byte("session=test")},
+		},
+		{
+			Request:  APIRequest{Method: "GET", Target: "/", Cookies: []*http.Cookie{{Name: "csrf", Value: "x"}}},
+			Response: APIResponse{StatusCode: 200, Body: []byte("session=test; csrf=x")},
+		},
+	})
+
+	// tests with their own jar, or without any jar
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("cookiejar.New: %v", err)
+	}
+
+	TestAPI(t, APITest{
+		Handler: testCookieHandler,
+		Jar:     jar,
+		Request: APIRequest{Method: "POST", Target: "/login", Form: url.Values{"name": {"jar"}}},
+	})
+	TestAPI(t, APITest{
+		Handler:  testCookieHandler,
+		Jar:      jar,
+		Request:  APIRequest{Method: "GET", Target: "/"},
+		Response: APIResponse{Body: []byte("session=jar")},
+	})
+	TestAPI(t, APITest{
+		Handler:  testCookieHandler,
+		Request:  APIRequest{Method: "GET", Target: "/"},
+		Response: APIResponse{Body: []byte("")},
+	})
+
+	for _, test := range []struct {
+		cookies map[string]string
+		failure string
+	}{
+		{map[string]string{"session": "wrong"}, "POST /login => HTTP 200 with incorrect Set-Cookie session: \"test\""},
+		{map[string]string{"csrf": "x"}, "POST /login => HTTP 200 without expected Set-Cookie: csrf"},
+	} {
+		expectFailure(t, recordFailures(t, func(t testing.TB) {
+			TestAPI(t, APITest{
+				Handler:  testCookieHandler,
+				Request:  APIRequest{Method: "POST", Target: "/login", Form: url.Values{"name": {"test"}}},
+				Response: APIResponse{Cookies: test.cookies},
+			})
+		}), test.failure)
+	}
+}
+
+type testUpload struct {
+	ContentType   string              `json:"content_type"`
+	ContentLength int64               `json:"content_length"`
+	Length        int                 `json:"length"`
+	Form          map[string][]string `json:"form"`
+	Files         map[string]string   `json:"files"`
+}
+
+// Return the parsed form and multipart files
+var testUploadHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	var upload = testUpload{ContentLength: r.ContentLength}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upload.Length = len(body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if contentType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if contentType == "multipart/form-data" {
+		if params["boundary"] == "" {
+			http.Error(w, "Missing boundary", http.StatusBadRequest)
+			return
+		} else if err := r.ParseMultipartForm(1024); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		upload.ContentType = contentType
+		upload.Form = r.MultipartForm.Value
+		upload.Files = make(map[string]string)
+
+		for field, headers := range r.MultipartForm.File {
+			for _, header := range headers {
+				if file, err := header.Open(); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				} else if content, err := ioutil.ReadAll(file); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				} else {
+					upload.Files[field] = header.Filename + " " + header.Header.Get("Content-Type") + ": " + string(content)
+				}
+			}
+		}
+	} else if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else {
+		upload.ContentType = contentType
+		upload.Form = r.PostForm
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(upload)
+})
+
+func TestAPIForm(t *testing.T) {
+	var upload testUpload
+
+	TestAPI(t, APITest{
+		Handler:  testUploadHandler,
+		Request:  APIRequest{Method: "POST", Target: "/", Form: url.Values{"name": {"test"}, "tags": {"a", "b"}}},
+		Response: APIResponse{StatusCode: 200, Object: &upload},
+	})
+
+	if upload.ContentType != "application/x-www-form-urlencoded" {
+		t.Errorf("Content-Type: %v", upload.ContentType)
+	} else if upload.ContentLength != int64(upload.Length) {
+		t.Errorf("Content-Length %v for %d bytes", upload.ContentLength, upload.Length)
+	} else if fmt.Sprint(upload.Form) != "map[name:[test] tags:[a b]]" {
+		t.Errorf("form: %v", upload.Form)
+	}
+}
+
+func TestAPIMultipart(t *testing.T) {
+	var upload testUpload
+
+	TestAPI(t, APITest{
+		Handler: testUploadHandler,
+		Request: APIRequest{Method: "POST", Target: "/",
+			Form: url.Values{"name": {"test"}},
+			Files: []APIFile{
+				{Field: "file", Filename: "test.txt", ContentType: "text/plain", Content: []byte("hello")},
+				{Field: "data", Filename: "test.bin", Content: []byte{0, 1}},
+			},
+		},
+		Response: APIResponse{StatusCode: 200, Object: &upload},
+	})
+
+	if upload.ContentType != "multipart/form-data" {
+		t.Errorf("Content-Type: %v", upload.ContentType)
+	} else if upload.ContentLength != int64(upload.Length) {
+		t.Errorf("Content-Length %v for %d bytes", upload.ContentLength, upload.Length)
+	} else if fmt.Sprint(upload.Form) != "map[name:[test]]" {
+		t.Errorf("form: %v", upload.Form)
+	} else if upload.Files["file"] != "test.txt text/plain: hello" {
+		t.Errorf("file: %#v", upload.Files["file"])
+	} else if upload.Files["data"] != "test.bin application/octet-stream: \x00\x01" {
+		t.Errorf("data: %#v", upload.Files["data"])
+	}
+}
+
+func TestAPIBody(t *testing.T) {
+	var handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Write([]byte("id,name\n1,test\n"))
+	})
+
+	for _, test := range []struct {
+		response APIResponse
+		failure  string
+	}{
+		{APIResponse{ContentType: "text/csv; charset=utf-8", Body: []byte("id,name\n1,test\n")}, ""},
+		{APIResponse{ContentType: "text/csv"}, "GET / => HTTP 200 with incorrect Content-Type: text/csv; charset=utf-8"},
+		{APIResponse{Body: []byte("id,name\n")}, "GET / => HTTP 200 with incorrect body: \"id,name\\n1,test\\n\""},
+		{APIResponse{Body: []byte{}}, "GET / => HTTP 200 with incorrect body: "},
+		{APIResponse{Check: func(body []byte) error {
+			if lines := strings.Count(string(body), "\n"); lines != 2 {
+				return fmt.Errorf("%d lines", lines)
+			}
+			return nil
+		}}, ""},
+		{APIResponse{Check: func(body []byte) error {
+			return fmt.Errorf("invalid CSV")
+		}}, "GET / => HTTP 200 with invalid body: invalid CSV"},
+	} {
+		var failures = recordFailures(t, func(t testing.TB) {
+			TestAPI(t, APITest{
+				Handler:  handler,
+				Request:  APIRequest{Method: "GET", Target: "/"},
+				Response: test.response,
+			})
+		})
+
+		expectFailure(t, failures, test.failure)
+	}
+}
+
+func TestAPIModifyRequest(t *testing.T) {
+	var handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%v %v %v", r.Header.Get("Content-Type"), r.Header.Get("X-Test"), r.Trailer.Get("X-Checksum"))
+	})
+
+	// applied after the other request fields
+	TestAPI(t, APITest{
+		Handler: handler,
+		Request: APIRequest{Method: "POST", Target: "/", Object: testObject{Name: "test"}},
+		ModifyRequest: func(request *http.Request) {
+			request.Header.Set("Content-Type", "application/json; charset=utf-8")
+			request.Header.Set("X-Test", "test")
+			request.Trailer = http.Header{"X-Checksum": {"1234"}}
+		},
+		Response: APIResponse{StatusCode: 200, Text: "application/json; charset=utf-8 test 1234"},
+	})
+}
+
+func TestAPIRedirects(t *testing.T) {
+	var handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusTemporaryRedirect)
+		case "/dir/a":
+			w.Header().Set("Location", "c")
+			w.WriteHeader(http.StatusSeeOther)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(r.Method + " " + r.URL.Path))
+		}
+	})
+
+	for _, test := range []struct {
+		method   string
+		target   string
+		follow   bool
+		response APIResponse
+		failure  string
+	}{
+		{"GET", "/a", false, APIResponse{StatusCode: 302, Location: "/b"}, ""},
+		{"GET", "/a", false, APIResponse{StatusCode: 302, Location: "/c"}, "GET /a => HTTP 302 with incorrect Location: \"/b\""},
+		{"POST", "/a", true, APIResponse{StatusCode: 200, Redirects: []string{"/b", "/c"}, Text: "GET /c"}, ""},
+		{"POST", "/b", true, APIResponse{StatusCode: 200, Redirects: []string{"/c"}, Text: "POST /c"}, ""},
+		{"GET", "/dir/a", true, APIResponse{StatusCode: 200, Redirects: []string{"c"}, Text: "GET /dir/c"}, ""},
+		{"GET", "/c", true, APIResponse{StatusCode: 200, Redirects: []string{}}, ""},
+		{"GET", "/a", true, APIResponse{StatusCode: 200, Redirects: []string{}}, "GET /a => HTTP 200 with incorrect redirects: []string{\"/b\", \"/c\"}"},
+		{"GET", "/a", true, APIResponse{StatusCode: 200, Redirects: []string{"/b"}}, "GET /a => HTTP 200 with incorrect redirects: []string{\"/b\", \"/c\"}"},
+		{"GET", "/loop", true, APIResponse{}, "GET /loop => HTTP 302: stopped after 10 redirects"},
+	} {
+		var failures = recordFailures(t, func(t testing.TB) {
+			TestAPI(t, APITest{
+				Handler:         handler,
+				Request:         APIRequest{Method: test.method, Target: test.target},
+				Response:        test.response,
+				FollowRedirects: test.follow,
+			})
+		})
+
+		expectFailure(t, failures, test.failure)
+	}
+}
+
+func TestAPIAuthorization(t *testing.T) {
+	var handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+
+		if username, password, ok := r.BasicAuth(); ok {
+			fmt.Fprintf(w, "basic %v:%v", username, password)
+		} else {
+			w.Write([]byte(r.Header.Get("Authorization")))
+		}
+	})
+
+	for _, test := range []struct {
+		request APIRequest
+		body    string
+	}{
+		{APIRequest{}, ""},
+		{APIRequest{Username: "user", Password: "pass:word"}, "basic user:pass:word"},
+		{APIRequest{Password: "token"}, "basic :token"},
+		{APIRequest{BearerToken: "abc.def"}, "Bearer abc.def"},
+	} {
+		test.request.Method = "GET"
+		test.request.Target = "/"
+
+		expectFailure(t, recordFailures(t, func(t testing.TB) {
+			TestAPI(t, APITest{
+				Handler:  handler,
+				Request:  test.request,
+				Response: APIResponse{StatusCode: 200, Body: []byte(test.body)},
+			})
+		}), "")
+	}
+}
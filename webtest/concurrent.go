@@ -0,0 +1,106 @@
+package webtest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"sync"
+	"testing"
+)
+
+type concurrentResult struct {
+	statusCode int
+	body       []byte
+	panic      string
+}
+
+// Serve the request, recovering any panic
+func serveConcurrent(handler http.Handler, request *http.Request) (result concurrentResult) {
+	var responseWriter = httptest.NewRecorder()
+
+	defer func() {
+		if err := recover(); err != nil {
+			result.panic = fmt.Sprintf("%v\n%s", err, debug.Stack())
+		}
+	}()
+
+	handler.ServeHTTP(responseWriter, request)
+
+	return concurrentResult{
+		statusCode: responseWriter.Code,
+		body:       responseWriter.Body.Bytes(),
+	}
+}
+
+// Send the tests from the given number of concurrent goroutines, each sending each test in order, using the handler
+// for any tests without a Handler. Use with go test -race to check for data races.
+//
+// Fails the test on any panics, or responses without the expected StatusCode. The responses to each GET or HEAD
+// test must also be consistent across all goroutines.
+func TestAPIConcurrent(t testing.TB, handler http.Handler, concurrency int, tests ...APITest) {
+	t.Helper()
+
+	var requests = make([][]*http.Request, concurrency)
+	var results = make([][]concurrentResult, concurrency)
+
+	for i := range tests {
+		if tests[i].Handler == nil {
+			tests[i].Handler = handler
+		}
+	}
+
+	// requests are not safe to reuse
+	for g := 0; g < concurrency; g++ {
+		requests[g] = make([]*http.Request, len(tests))
+		results[g] = make([]concurrentResult, len(tests))
+
+		for i, test := range tests {
+			target, err := test.Request.target()
+			if err != nil {
+				t.Fatalf("%v %v: %v", test.Request.Method, test.Request.Target, err)
+			}
+
+			requests[g][i] = test.makeRequest(t, target)
+		}
+	}
+
+	var startChan = make(chan struct{})
+	var waitGroup sync.WaitGroup
+
+	for g := 0; g < concurrency; g++ {
+		waitGroup.Add(1)
+
+		go func(g int) {
+			defer waitGroup.Done()
+
+			<-startChan
+
+			for i, test := range tests {
+				results[g][i] = serveConcurrent(test.Handler, requests[g][i])
+			}
+		}(g)
+	}
+
+	close(startChan)
+	waitGroup.Wait()
+
+	for i, test := range tests {
+		var expected = results[0][i]
+
+		for g := 0; g < concurrency; g++ {
+			var result = results[g][i]
+
+			if result.panic != "" {
+				t.Errorf("%v %v => panic in goroutine %d: %v", test.Request.Method, test.Request.Target, g, result.panic)
+			} else if test.Response.StatusCode != 0 && result.statusCode != test.Response.StatusCode {
+				t.Errorf("%v %v => HTTP %v in goroutine %d, expected %v", test.Request.Method, test.Request.Target, result.statusCode, g, test.Response.StatusCode)
+			} else if test.Request.Method != "GET" && test.Request.Method != "HEAD" {
+
+			} else if result.statusCode != expected.statusCode || !bytes.Equal(result.body, expected.body) {
+				t.Errorf("%v %v => HTTP %v in goroutine %d inconsistent with HTTP %v in goroutine 0: %q != %q", test.Request.Method, test.Request.Target, result.statusCode, g, expected.statusCode, result.body, expected.body)
+			}
+		}
+	}
+}
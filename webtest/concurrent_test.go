@@ -0,0 +1,67 @@
+package webtest
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// Counter incremented by POST, returned by GET or also incremented by GET /next, panicking on DELETE
+type testCounter struct {
+	mutex sync.Mutex
+	count int
+}
+
+func (counter *testCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	switch r.Method {
+	case "GET":
+		fmt.Fprintf(w, "%d", counter.count)
+
+		if r.URL.Path == "/next" {
+			counter.count++
+		}
+	case "POST":
+		counter.count++
+	case "DELETE":
+		panic("test")
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	var counter testCounter
+
+	expectFailure(t, recordFailures(t, func(t testing.TB) {
+		TestAPIConcurrent(t, &counter, 10, APITest{
+			Request:  APIRequest{Method: "POST", Target: "/"},
+			Response: APIResponse{StatusCode: 200},
+		})
+	}), "")
+
+	if counter.count != 10 {
+		t.Errorf("count: %d", counter.count)
+	}
+
+	expectFailure(t, recordFailures(t, func(t testing.TB) {
+		TestAPIConcurrent(t, &counter, 10, APITest{Request: APIRequest{Method: "GET", Target: "/"}})
+	}), "")
+
+	expectFailure(t, recordFailures(t, func(t testing.TB) {
+		TestAPIConcurrent(t, &counter, 2, APITest{Request: APIRequest{Method: "DELETE", Target: "/"}})
+	}), "DELETE / => panic in goroutine 0: test")
+
+	expectFailure(t, recordFailures(t, func(t testing.TB) {
+		TestAPIConcurrent(t, &counter, 2, APITest{
+			Request:  APIRequest{Method: "POST", Target: "/"},
+			Response: APIResponse{StatusCode: 201},
+		})
+	}), "POST / => HTTP 200 in goroutine 0, expected 201")
+
+	// GET responses change between goroutines
+	expectFailure(t, recordFailures(t, func(t testing.TB) {
+		TestAPIConcurrent(t, &counter, 2, APITest{Request: APIRequest{Method: "GET", Target: "/next"}})
+	}), "GET /next => HTTP 200 in goroutine 1 inconsistent with HTTP 200 in goroutine 0")
+}
@@ -0,0 +1,132 @@
+package webtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// Decode JSON into a new value of the same type as the expected value
+func decodeExpected(reader io.Reader, expected interface{}) (interface{}, error) {
+	var value = reflect.New(reflect.TypeOf(expected))
+
+	if err := json.NewDecoder(reader).Decode(value.Interface()); err != nil {
+		return nil, err
+	}
+
+	return value.Elem().Interface(), nil
+}
+
+// Decode JSON and return the generic JSON values of the expected value, and the decoded value with only the fields
+// present in the expected value
+func decodeSubset(reader io.Reader, expected interface{}) (interface{}, interface{}, error) {
+	var expectedValue, value interface{}
+
+	if buf, err := json.Marshal(expected); err != nil {
+		return nil, nil, err
+	} else if err := json.Unmarshal(buf, &expectedValue); err != nil {
+		return nil, nil, err
+	}
+
+	if err := json.NewDecoder(reader).Decode(&value); err != nil {
+		return nil, nil, err
+	}
+
+	return expectedValue, subsetJSON(expectedValue, value), nil
+}
+
+// Return the generic JSON value with only the object fields present in the expected value
+func subsetJSON(expected interface{}, value interface{}) interface{} {
+	switch expected := expected.(type) {
+	case map[string]interface{}:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return value
+		}
+
+		var subset = make(map[string]interface{}, len(expected))
+
+		for key, expectedValue := range expected {
+			if value, ok := object[key]; ok {
+				subset[key] = subsetJSON(expectedValue, value)
+			}
+		}
+
+		return subset
+
+	case []interface{}:
+		array, ok := value.([]interface{})
+		if !ok {
+			return value
+		}
+
+		var subset = make([]interface{}, len(array))
+
+		for i, value := range array {
+			if i < len(expected) {
+				subset[i] = subsetJSON(expected[i], value)
+			} else {
+				subset[i] = value
+			}
+		}
+
+		return subset
+
+	default:
+		return value
+	}
+}
+
+// Return a line diff of the expected and actual values as indented JSON, with -expected and +actual lines
+func diffJSON(expected interface{}, actual interface{}) string {
+	var expectedLines = jsonLines(expected)
+	var actualLines = jsonLines(actual)
+
+	// longest common subsequence lengths for each suffix
+	var lcs = make([][]int, len(expectedLines)+1)
+
+	for i := range lcs {
+		lcs[i] = make([]int, len(actualLines)+1)
+	}
+
+	for i := len(expectedLines) - 1; i >= 0; i-- {
+		for j := len(actualLines) - 1; j >= 0; j-- {
+			if expectedLines[i] == actualLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff strings.Builder
+	var i, j = 0, 0
+
+	for i < len(expectedLines) || j < len(actualLines) {
+		if i < len(expectedLines) && j < len(actualLines) && expectedLines[i] == actualLines[j] {
+			diff.WriteString("  " + expectedLines[i] + "\n")
+			i++
+			j++
+		} else if j == len(actualLines) || (i < len(expectedLines) && lcs[i+1][j] >= lcs[i][j+1]) {
+			diff.WriteString("- " + expectedLines[i] + "\n")
+			i++
+		} else {
+			diff.WriteString("+ " + actualLines[j] + "\n")
+			j++
+		}
+	}
+
+	return diff.String()
+}
+
+func jsonLines(value interface{}) []string {
+	if buf, err := json.MarshalIndent(value, "", "  "); err != nil {
+		return []string{fmt.Sprintf("%#v", value)}
+	} else {
+		return strings.Split(string(buf), "\n")
+	}
+}
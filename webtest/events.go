@@ -0,0 +1,208 @@
+package webtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/qmsk/go-web"
+)
+
+// Timeout for receiving websocket messages in EventsClient
+const EVENTS_TIMEOUT = 1 * time.Second
+
+// Test fixture serving web.Events over websockets and Server-Sent Events, using a controllable state and published events.
+//
+// The Events and test server are closed once the test completes.
+type EventsTest struct {
+	Events web.Events
+
+	t      testing.TB
+	server *httptest.Server
+
+	mutex sync.Mutex
+	state web.State
+}
+
+// Make an EventsTest for the given config, using the SetState() state unless the config has a StateFunc or ClientStateFunc
+func MakeEvents(t testing.TB, config web.EventConfig) *EventsTest {
+	var eventsTest = EventsTest{t: t}
+
+	if config.StateFunc == nil && config.ClientStateFunc == nil {
+		config.StateFunc = eventsTest.getState
+	}
+
+	var serveMux = http.NewServeMux()
+
+	eventsTest.Events = web.MakeEvents(config)
+
+	serveMux.Handle("/", eventsTest.Events)
+	serveMux.HandleFunc("/sse", eventsTest.Events.ServeSSE)
+
+	eventsTest.server = httptest.NewServer(serveMux)
+
+	t.Cleanup(func() {
+		eventsTest.server.Close()
+		eventsTest.Events.Close()
+	})
+
+	return &eventsTest
+}
+
+func (eventsTest *EventsTest) getState() web.State {
+	eventsTest.mutex.Lock()
+	defer eventsTest.mutex.Unlock()
+
+	return eventsTest.state
+}
+
+// Set the initial state sent to any further clients
+func (eventsTest *EventsTest) SetState(state web.State) {
+	eventsTest.mutex.Lock()
+	defer eventsTest.mutex.Unlock()
+
+	eventsTest.state = state
+}
+
+// Publish event to connected clients
+func (eventsTest *EventsTest) Publish(event web.Event) {
+	eventsTest.Events.Publish(event)
+}
+
+// Return the http:// URL of the test server
+func (eventsTest *EventsTest) URL() string {
+	return eventsTest.server.URL
+}
+
+// Connect a websocket client using the given query, e.g. "topic=lights/*", failing the test on errors.
+//
+// The client is closed once the test completes.
+func (eventsTest *EventsTest) Connect(query string) *EventsClient {
+	eventsTest.t.Helper()
+
+	var url = "ws" + strings.TrimPrefix(eventsTest.server.URL, "http") + "/"
+
+	if query != "" {
+		url += "?" + query
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {eventsTest.server.URL}})
+	if err != nil {
+		eventsTest.t.Fatalf("websocket Dial %v: %v", url, err)
+	}
+
+	eventsTest.t.Cleanup(func() {
+		conn.Close()
+	})
+
+	var client = EventsClient{t: eventsTest.t, conn: conn, recvChan: make(chan []byte, web.EVENTS_BUFFER)}
+
+	go client.read()
+
+	return &client
+}
+
+// Connect a Server-Sent Events client using the given query, failing the test on errors.
+//
+// The client is closed once the test completes.
+func (eventsTest *EventsTest) ConnectSSE(query string) *SSEClient {
+	eventsTest.t.Helper()
+
+	var url = eventsTest.server.URL + "/sse"
+
+	if query != "" {
+		url += "?" + query
+	}
+
+	return ConnectSSE(eventsTest.t, url)
+}
+
+// Websocket client connected to an EventsTest
+type EventsClient struct {
+	t        testing.TB
+	conn     *websocket.Conn
+	recvChan chan []byte
+	recvErr  error
+
+	// all messages received so far, including the initial state
+	received []json.RawMessage
+}
+
+// Return all JSON messages received so far, including the initial state
+func (client *EventsClient) Received() []json.RawMessage {
+	return client.received
+}
+
+// Read messages in the background until the conn is closed, as the websocket.Conn cannot be read from again after a read timeout
+func (client *EventsClient) read() {
+	defer close(client.recvChan)
+
+	for {
+		_, buf, err := client.conn.ReadMessage()
+		if err != nil {
+			client.recvErr = err
+			return
+		}
+
+		client.recvChan <- buf
+	}
+}
+
+// Receive the next JSON message into the object, failing the test on errors or the EVENTS_TIMEOUT
+func (client *EventsClient) Receive(object interface{}) {
+	client.t.Helper()
+
+	var buf []byte
+
+	select {
+	case recv, ok := <-client.recvChan:
+		if !ok {
+			client.t.Fatalf("websocket Receive: %v", client.recvErr)
+		}
+
+		buf = recv
+
+	case <-time.After(EVENTS_TIMEOUT):
+		client.t.Fatalf("websocket Receive: timeout after %v", EVENTS_TIMEOUT)
+	}
+
+	client.received = append(client.received, json.RawMessage(buf))
+
+	if err := json.Unmarshal(buf, object); err != nil {
+		client.t.Fatalf("websocket Receive: json.Unmarshal: %v", err)
+	}
+}
+
+// Receive the next JSON message, failing the test unless it equals the expected value, as for APIResponse.Object
+func (client *EventsClient) Expect(expected interface{}) {
+	client.t.Helper()
+
+	var value = reflect.New(reflect.TypeOf(expected))
+
+	client.Receive(value.Interface())
+
+	if object := value.Elem().Interface(); !reflect.DeepEqual(object, expected) {
+		client.t.Errorf("websocket Receive incorrect message:\n%v", diffJSON(expected, object))
+	}
+}
+
+// Fail the test if any message is received within the timeout
+func (client *EventsClient) ExpectNone(timeout time.Duration) {
+	client.t.Helper()
+
+	select {
+	case buf, ok := <-client.recvChan:
+		if ok {
+			client.received = append(client.received, json.RawMessage(buf))
+			client.t.Errorf("websocket Receive unexpected message: %s", buf)
+		}
+
+	case <-time.After(timeout):
+	}
+}
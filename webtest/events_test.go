@@ -0,0 +1,93 @@
+package webtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qmsk/go-web"
+)
+
+type testLightsState struct {
+	Lights map[string]bool `json:"lights"`
+}
+
+func TestEvents(t *testing.T) {
+	var eventsTest = MakeEvents(t, web.EventConfig{})
+
+	eventsTest.SetState(testLightsState{Lights: map[string]bool{"1": false}})
+
+	var client = eventsTest.Connect("")
+	var lightsClient = eventsTest.Connect("topic=lights/*")
+
+	client.Expect(testLightsState{Lights: map[string]bool{"1": false}})
+	lightsClient.Expect(testLightsState{Lights: map[string]bool{"1": false}})
+
+	eventsTest.Publish(web.TopicEvent{Topic: "sensors/1", Event: 1.5})
+	eventsTest.Publish(web.TopicEvent{Topic: "lights/1", Event: true})
+
+	client.Expect(map[string]interface{}{"topic": "sensors/1", "event": 1.5})
+	client.Expect(map[string]interface{}{"topic": "lights/1", "event": true})
+	lightsClient.Expect(map[string]interface{}{"topic": "lights/1", "event": true})
+	lightsClient.ExpectNone(10 * time.Millisecond)
+
+	if received := client.Received(); len(received) != 3 || string(received[0]) != `{"lights":{"1":false}}` {
+		t.Errorf("received: %s", received)
+	}
+
+	// later clients get the updated state
+	eventsTest.SetState(testLightsState{Lights: map[string]bool{"1": true}})
+
+	eventsTest.Connect("").Expect(testLightsState{Lights: map[string]bool{"1": true}})
+}
+
+func TestEventsStateFunc(t *testing.T) {
+	var eventsTest = MakeEvents(t, web.EventConfig{
+		StateFunc: func() web.State { return "config" },
+	})
+
+	eventsTest.SetState("ignored")
+	eventsTest.Connect("").Expect("config")
+}
+
+// Record failures for the events fixture and its clients
+func recordEventsFailures(t *testing.T, f func(eventsTest *EventsTest)) []string {
+	return recordFailures(t, func(t testing.TB) {
+		var eventsTest = MakeEvents(t, web.EventConfig{})
+
+		eventsTest.SetState("state")
+
+		f(eventsTest)
+	})
+}
+
+func TestEventsFailures(t *testing.T) {
+	expectFailure(t, recordEventsFailures(t, func(eventsTest *EventsTest) {
+		eventsTest.Connect("").Expect("wrong")
+	}), "websocket Receive incorrect message:\n- \"wrong\"\n+ \"state\"")
+
+	expectFailure(t, recordEventsFailures(t, func(eventsTest *EventsTest) {
+		var client = eventsTest.Connect("")
+
+		client.Expect("state")
+
+		eventsTest.Publish("event")
+
+		client.ExpectNone(time.Second)
+	}), "websocket Receive unexpected message: \"event\"")
+
+	expectFailure(t, recordEventsFailures(t, func(eventsTest *EventsTest) {
+		var value int
+
+		eventsTest.Connect("").Receive(&value)
+	}), "websocket Receive: json.Unmarshal: ")
+
+	expectFailure(t, recordEventsFailures(t, func(eventsTest *EventsTest) {
+		var client = eventsTest.Connect("")
+
+		client.Expect("state")
+
+		eventsTest.Events.Close()
+
+		client.Expect("event")
+	}), "websocket Receive: websocket: close ")
+}
@@ -0,0 +1,197 @@
+package webtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Number of random requests for FuzzAPI
+const FUZZ_COUNT = 1000
+
+// Environment variable for the FuzzAPI seed, to replay the requests of a failed test
+const FUZZ_SEED_ENV = "WEBTEST_FUZZ_SEED"
+
+var fuzzMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "FOO"}
+var fuzzNames = []string{"", ".", "..", "foo", "0", "-1", "18446744073709551616", "%00", "%2F", "a b", "\xff", "/", "?", "*"}
+var fuzzContentTypes = []string{"", "application/json", "application/json; charset=utf-8", "text/plain", "application/x-www-form-urlencoded", "multipart/form-data"}
+
+// Serve the request, failing the test on panics or 5xx responses, other than 501 for unknown methods
+func fuzzRequest(t testing.TB, handler http.Handler, request *http.Request) {
+	var responseWriter = httptest.NewRecorder()
+
+	defer func() {
+		if err := recover(); err != nil {
+			t.Errorf("%v %v => panic: %v\n%s", request.Method, request.URL, err, debug.Stack())
+		}
+	}()
+
+	handler.ServeHTTP(responseWriter, request)
+
+	if responseWriter.Code == http.StatusNotImplemented {
+
+	} else if responseWriter.Code >= 500 {
+		t.Errorf("%v %v => HTTP %v: %v", request.Method, request.URL, responseWriter.Code, responseWriter.Body.String())
+	}
+}
+
+// Make a request using the method, path and query, bypassing any URL parsing
+func fuzzMakeRequest(method string, path string, query string, contentType string, body []byte) *http.Request {
+	var request = httptest.NewRequest("GET", "/", bytes.NewReader(body))
+
+	request.Method = method
+	request.URL.Path = path
+	request.URL.RawQuery = query
+
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	return request
+}
+
+// Fuzz entry point for a single request decoded from arbitrary data, failing the test on panics or 5xx responses.
+//
+// The data is split into lines for the method, path, query, Content-Type and body, for use with native fuzzing, e.g.
+//
+//	f.Fuzz(func(t *testing.T, data []byte) { webtest.FuzzRequest(t, api, data) })
+func FuzzRequest(t testing.TB, handler http.Handler, data []byte) {
+	var parts = bytes.SplitN(data, []byte("\n"), 5)
+
+	for len(parts) < 5 {
+		parts = append(parts, nil)
+	}
+
+	var method = string(parts[0])
+	var path = "/" + strings.TrimPrefix(string(parts[1]), "/")
+
+	if method == "" {
+		method = "GET"
+	}
+
+	fuzzRequest(t, handler, fuzzMakeRequest(method, path, string(parts[2]), string(parts[3]), parts[4]))
+}
+
+// Send FUZZ_COUNT randomized requests with methods, paths relative to the given paths, query strings and JSON bodies,
+// failing the test on panics or 5xx responses.
+//
+// Uses a random seed, unless replaying a failed test using the seed from the FUZZ_SEED_ENV environment variable.
+func FuzzAPI(t testing.TB, handler http.Handler, paths ...string) {
+	var seed = time.Now().UnixNano()
+
+	if value := os.Getenv(FUZZ_SEED_ENV); value == "" {
+
+	} else if envSeed, err := strconv.ParseInt(value, 10, 64); err != nil {
+		t.Fatalf("Invalid %v=%v: %v", FUZZ_SEED_ENV, value, err)
+	} else {
+		seed = envSeed
+	}
+
+	FuzzAPISeed(t, seed, handler, paths...)
+}
+
+// Send the same FUZZ_COUNT randomized requests as FuzzAPI for the given seed
+func FuzzAPISeed(t testing.TB, seed int64, handler http.Handler, paths ...string) {
+	var random = rand.New(rand.NewSource(seed))
+
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+
+	for i := 0; i < FUZZ_COUNT; i++ {
+		var method = fuzzMethods[random.Intn(len(fuzzMethods))]
+		var path = strings.TrimSuffix(paths[random.Intn(len(paths))], "/")
+		var query = fuzzQuery(random)
+		var contentType = fuzzContentTypes[random.Intn(len(fuzzContentTypes))]
+		var body []byte
+
+		for n := random.Intn(3); n > 0; n-- {
+			path += "/" + fuzzNames[random.Intn(len(fuzzNames))]
+		}
+		if path == "" {
+			path = "/"
+		}
+
+		if random.Intn(4) == 0 {
+			body = fuzzBytes(random)
+		} else if buf, err := json.Marshal(fuzzJSON(random, 3)); err != nil {
+			t.Fatalf("json.Marshal: %v", err)
+		} else {
+			body = buf
+		}
+
+		fuzzRequest(t, handler, fuzzMakeRequest(method, path, query, contentType, body))
+
+		if t.Failed() {
+			t.Logf("FuzzAPI seed %v, request %d: replay using %v=%v", seed, i, FUZZ_SEED_ENV, seed)
+			return
+		}
+	}
+}
+
+func fuzzQuery(random *rand.Rand) string {
+	var params []string
+
+	for n := random.Intn(4); n > 0; n-- {
+		var name = fuzzNames[random.Intn(len(fuzzNames))]
+		var value = fuzzNames[random.Intn(len(fuzzNames))]
+
+		params = append(params, name+"="+value)
+	}
+
+	return strings.Join(params, "&")
+}
+
+func fuzzBytes(random *rand.Rand) []byte {
+	var buf = make([]byte, random.Intn(64))
+
+	random.Read(buf)
+
+	return buf
+}
+
+// Return a random JSON value, nested up to the given depth
+func fuzzJSON(random *rand.Rand, depth int) interface{} {
+	var kind = random.Intn(7)
+
+	if depth <= 0 {
+		kind = kind % 5
+	}
+
+	switch kind {
+	case 0:
+		return nil
+	case 1:
+		return random.Intn(2) == 0
+	case 2:
+		return random.NormFloat64() * 1e6
+	case 3:
+		return random.Int63() - random.Int63()
+	case 4:
+		return fuzzNames[random.Intn(len(fuzzNames))]
+	case 5:
+		var array = make([]interface{}, random.Intn(4))
+
+		for i := range array {
+			array[i] = fuzzJSON(random, depth-1)
+		}
+
+		return array
+	default:
+		var object = make(map[string]interface{})
+
+		for n := random.Intn(4); n > 0; n-- {
+			object[fuzzNames[random.Intn(len(fuzzNames))]] = fuzzJSON(random, depth-1)
+		}
+
+		return object
+	}
+}
@@ -0,0 +1,91 @@
+package webtest
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Record the method and URL of each request, failing requests for paths containing any fail string
+type testFuzzHandler struct {
+	fail string
+
+	mutex    sync.Mutex
+	requests []string
+}
+
+func (handler *testFuzzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+
+	handler.requests = append(handler.requests, r.Method+" "+r.URL.String())
+
+	if handler.fail != "" && strings.Contains(r.URL.Path, handler.fail) {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	} else if r.Method == "FOO" {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+	}
+}
+
+func TestFuzzAPISeed(t *testing.T) {
+	var handler1, handler2 testFuzzHandler
+
+	expectFailure(t, recordFailures(t, func(t testing.TB) { FuzzAPISeed(t, 1, &handler1, "/test/") }), "")
+	expectFailure(t, recordFailures(t, func(t testing.TB) { FuzzAPISeed(t, 1, &handler2, "/test/") }), "")
+
+	if len(handler1.requests) != FUZZ_COUNT {
+		t.Fatalf("requests: %d", len(handler1.requests))
+	} else if !reflect.DeepEqual(handler1.requests, handler2.requests) {
+		t.Errorf("requests differ for the same seed:\n%v\n%v", handler1.requests, handler2.requests)
+	}
+
+	t.Setenv(FUZZ_SEED_ENV, "1")
+
+	var handler3 testFuzzHandler
+
+	expectFailure(t, recordFailures(t, func(t testing.TB) { FuzzAPI(t, &handler3, "/test/") }), "")
+
+	if !reflect.DeepEqual(handler1.requests, handler3.requests) {
+		t.Errorf("requests differ for the %v seed:\n%v\n%v", FUZZ_SEED_ENV, handler1.requests, handler3.requests)
+	}
+}
+
+func TestFuzzAPIInvalidSeed(t *testing.T) {
+	var handler testFuzzHandler
+
+	t.Setenv(FUZZ_SEED_ENV, "x")
+
+	expectFailure(t, recordFailures(t, func(t testing.TB) { FuzzAPI(t, &handler) }), "Invalid WEBTEST_FUZZ_SEED=x")
+}
+
+func TestFuzzAPIFailure(t *testing.T) {
+	var handler = testFuzzHandler{fail: ".."}
+
+	// stops at the first failing request
+	expectFailure(t, recordFailures(t, func(t testing.TB) { FuzzAPISeed(t, 1, &handler) }), "=> HTTP 500")
+
+	if last := handler.requests[len(handler.requests)-1]; !strings.Contains(last, "..") {
+		t.Errorf("last request: %v", last)
+	}
+}
+
+func TestFuzzRequest(t *testing.T) {
+	var panicHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("test")
+		}
+	})
+
+	for _, test := range []struct {
+		data    string
+		failure string
+	}{
+		{"", ""},
+		{"GET\n/test\na=b\napplication/json\n{}", ""},
+		{"POST\npanic", "POST /panic => panic: test"},
+	} {
+		expectFailure(t, recordFailures(t, func(t testing.TB) { FuzzRequest(t, panicHandler, []byte(test.data)) }), test.failure)
+	}
+}
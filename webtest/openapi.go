@@ -0,0 +1,379 @@
+package webtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Subset of JSON Schema used for validating responses, as found in OpenAPI documents
+type JSONSchema struct {
+	Ref      string        `json:"$ref,omitempty"`
+	Type     interface{}   `json:"type,omitempty"` // string or []string
+	Nullable bool          `json:"nullable,omitempty"`
+	Enum     []interface{} `json:"enum,omitempty"`
+
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties,omitempty"` // false or schema
+	Items                *JSONSchema            `json:"items,omitempty"`
+
+	AllOf []*JSONSchema `json:"allOf,omitempty"`
+	AnyOf []*JSONSchema `json:"anyOf,omitempty"`
+	OneOf []*JSONSchema `json:"oneOf,omitempty"`
+
+	// $ref definitions for plain JSON Schema documents
+	Definitions map[string]*JSONSchema `json:"definitions,omitempty"`
+}
+
+// Load a JSON Schema document from the file
+func LoadJSONSchema(t testing.TB, path string) *JSONSchema {
+	t.Helper()
+
+	var schema JSONSchema
+
+	if err := loadJSON(path, &schema); err != nil {
+		t.Fatalf("Load JSON Schema %v: %v", path, err)
+	}
+
+	return &schema
+}
+
+func loadJSON(path string, object interface{}) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewDecoder(file).Decode(object)
+}
+
+// Validate the generic JSON value, returning a list of errors
+func (schema *JSONSchema) Validate(value interface{}) []string {
+	var validator = jsonSchemaValidator{root: schema}
+
+	validator.validate(schema, value, "")
+
+	return validator.errors
+}
+
+// Validate the JSON body, returning a list of errors
+func validateJSON(schema *JSONSchema, body []byte) []string {
+	var value interface{}
+
+	if err := json.Unmarshal(body, &value); err != nil {
+		return []string{fmt.Sprintf("Invalid JSON: %v", err)}
+	}
+
+	return schema.Validate(value)
+}
+
+type jsonSchemaValidator struct {
+	root       *JSONSchema
+	components map[string]*JSONSchema
+	errors     []string
+}
+
+func (validator *jsonSchemaValidator) errorf(path string, format string, args ...interface{}) {
+	if path == "" {
+		path = "/"
+	}
+
+	validator.errors = append(validator.errors, path+": "+fmt.Sprintf(format, args...))
+}
+
+// Resolve local #/definitions/... or #/components/schemas/... references
+func (validator *jsonSchemaValidator) resolve(ref string) (*JSONSchema, error) {
+	if strings.HasPrefix(ref, "#/components/schemas/") {
+		if schema := validator.components[strings.TrimPrefix(ref, "#/components/schemas/")]; schema != nil {
+			return schema, nil
+		}
+	} else if strings.HasPrefix(ref, "#/definitions/") {
+		if schema := validator.root.Definitions[strings.TrimPrefix(ref, "#/definitions/")]; schema != nil {
+			return schema, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown $ref: %v", ref)
+}
+
+// Return the JSON Schema type name for the generic JSON value
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == float64(int64(value)) {
+			return "integer"
+		} else {
+			return "number"
+		}
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func (schema *JSONSchema) types() []string {
+	switch value := schema.Type.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var types []string
+
+		for _, t := range value {
+			types = append(types, fmt.Sprint(t))
+		}
+
+		return types
+	default:
+		return nil
+	}
+}
+
+func (schema *JSONSchema) allowsType(valueType string) bool {
+	var types = schema.types()
+
+	if types == nil {
+		return true
+	} else if valueType == "null" && schema.Nullable {
+		return true
+	}
+
+	for _, t := range types {
+		if t == valueType || (t == "number" && valueType == "integer") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (validator *jsonSchemaValidator) validate(schema *JSONSchema, value interface{}, path string) {
+	if schema.Ref != "" {
+		if refSchema, err := validator.resolve(schema.Ref); err != nil {
+			validator.errorf(path, "%v", err)
+		} else {
+			validator.validate(refSchema, value, path)
+		}
+
+		return
+	}
+
+	if valueType := jsonType(value); !schema.allowsType(valueType) {
+		validator.errorf(path, "invalid type %v, expected %v", valueType, strings.Join(schema.types(), " or "))
+
+		return
+	}
+
+	if schema.Enum != nil {
+		var found = false
+
+		for _, enum := range schema.Enum {
+			if reflect.DeepEqual(enum, value) {
+				found = true
+			}
+		}
+
+		if !found {
+			validator.errorf(path, "invalid value %#v, expected one of %v", value, schema.Enum)
+		}
+	}
+
+	for _, subSchema := range schema.AllOf {
+		validator.validate(subSchema, value, path)
+	}
+
+	if schema.AnyOf != nil && validator.count(schema.AnyOf, value, path) == 0 {
+		validator.errorf(path, "does not match anyOf schemas")
+	}
+	if schema.OneOf != nil && validator.count(schema.OneOf, value, path) != 1 {
+		validator.errorf(path, "does not match exactly one of the oneOf schemas")
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		validator.validateObject(schema, value, path)
+
+	case []interface{}:
+		if schema.Items != nil {
+			for i, item := range value {
+				validator.validate(schema.Items, item, path+"/"+strconv.Itoa(i))
+			}
+		}
+	}
+}
+
+func (validator *jsonSchemaValidator) validateObject(schema *JSONSchema, object map[string]interface{}, path string) {
+	var additionalProperties *JSONSchema
+	var noAdditionalProperties = string(schema.AdditionalProperties) == "false"
+
+	if len(schema.AdditionalProperties) > 0 && !noAdditionalProperties && string(schema.AdditionalProperties) != "true" {
+		if err := json.Unmarshal(schema.AdditionalProperties, &additionalProperties); err != nil {
+			validator.errorf(path, "invalid additionalProperties schema: %v", err)
+		}
+	}
+
+	for _, name := range schema.Required {
+		if _, ok := object[name]; !ok {
+			validator.errorf(path, "missing required property: %v", name)
+		}
+	}
+
+	var names = make([]string, 0, len(object))
+
+	for name := range object {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if propertySchema, ok := schema.Properties[name]; ok {
+			validator.validate(propertySchema, object[name], path+"/"+name)
+		} else if additionalProperties != nil {
+			validator.validate(additionalProperties, object[name], path+"/"+name)
+		} else if noAdditionalProperties {
+			validator.errorf(path, "unexpected property: %v", name)
+		}
+	}
+}
+
+// Return the number of schemas matching the value
+func (validator *jsonSchemaValidator) count(schemas []*JSONSchema, value interface{}, path string) int {
+	var count = 0
+
+	for _, schema := range schemas {
+		var subValidator = jsonSchemaValidator{root: validator.root, components: validator.components}
+
+		subValidator.validate(schema, value, path)
+
+		if subValidator.errors == nil {
+			count++
+		}
+	}
+
+	return count
+}
+
+type openAPIResponse struct {
+	Content map[string]struct {
+		Schema *JSONSchema `json:"schema"`
+	} `json:"content"`
+}
+
+type openAPIOperation struct {
+	Responses map[string]openAPIResponse `json:"responses"`
+}
+
+// OpenAPI 3 document, for validating JSON response bodies against the response schemas of each path and method
+type OpenAPI struct {
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components struct {
+		Schemas map[string]*JSONSchema `json:"schemas"`
+	} `json:"components"`
+}
+
+// Load an OpenAPI 3 document in JSON format from the file
+func LoadOpenAPI(t testing.TB, path string) *OpenAPI {
+	t.Helper()
+
+	var openAPI OpenAPI
+
+	if err := loadJSON(path, &openAPI); err != nil {
+		t.Fatalf("Load OpenAPI %v: %v", path, err)
+	}
+
+	return &openAPI
+}
+
+// Match the request path against a path template like /items/{id}
+func matchOpenAPIPath(template string, path string) bool {
+	var templateParts = strings.Split(strings.Trim(template, "/"), "/")
+	var pathParts = strings.Split(strings.Trim(path, "/"), "/")
+
+	if len(templateParts) != len(pathParts) {
+		return false
+	}
+
+	for i, part := range templateParts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			continue
+		} else if part != pathParts[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Return the response schema for the method, path and status, or an error if not documented
+func (openAPI *OpenAPI) responseSchema(method string, path string, status int) (*JSONSchema, error) {
+	var operation *openAPIOperation
+	var operationParams int
+
+	// prefer the most specific template, e.g. /items/new over /items/{id}
+	for template, operations := range openAPI.Paths {
+		var params = strings.Count(template, "{")
+
+		if !matchOpenAPIPath(template, path) {
+			continue
+		} else if operation != nil && params >= operationParams {
+			continue
+		} else if op, ok := operations[strings.ToLower(method)]; ok {
+			operation = &op
+			operationParams = params
+		}
+	}
+
+	if operation == nil {
+		return nil, fmt.Errorf("Undocumented operation: %v %v", method, path)
+	}
+
+	var statusCode = strconv.Itoa(status)
+
+	for _, key := range []string{statusCode, statusCode[:1] + "XX", "default"} {
+		if response, ok := operation.Responses[key]; !ok {
+			continue
+		} else if content, ok := response.Content["application/json"]; !ok {
+			return nil, nil
+		} else {
+			return content.Schema, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Undocumented response: %v %v => HTTP %v", method, path, status)
+}
+
+// Validate the JSON response body for the method, path and status, returning a list of errors
+func (openAPI *OpenAPI) Validate(method string, path string, status int, body []byte) []string {
+	var value interface{}
+
+	schema, err := openAPI.responseSchema(method, path, status)
+	if err != nil {
+		return []string{err.Error()}
+	} else if schema == nil {
+		return nil
+	} else if err := json.Unmarshal(body, &value); err != nil {
+		return []string{fmt.Sprintf("Invalid JSON: %v", err)}
+	}
+
+	var validator = jsonSchemaValidator{root: schema, components: openAPI.Components.Schemas}
+
+	validator.validate(schema, value, "")
+
+	return validator.errors
+}
@@ -0,0 +1,208 @@
+package webtest
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func parseTestSchema(t *testing.T, doc string) *JSONSchema {
+	var schema JSONSchema
+
+	if err := json.Unmarshal([]byte(doc), &schema); err != nil {
+		t.Fatalf("json.Unmarshal %v: %v", doc, err)
+	}
+
+	return &schema
+}
+
+func TestJSONSchema(t *testing.T) {
+	var schema = parseTestSchema(t, `{
+		"type": "object",
+		"required": ["id", "kind"],
+		"additionalProperties": false,
+		"properties": {
+			"id":       {"type": "integer"},
+			"kind":     {"enum": ["a", "b"]},
+			"name":     {"type": "string", "nullable": true},
+			"ratio":    {"type": "number"},
+			"parent":   {"$ref": "#/definitions/ref"},
+			"tags":     {"type": "array", "items": {"type": "string"}},
+			"labels":   {"type": "object", "additionalProperties": {"type": "string"}},
+			"extra":    {"type": "object", "additionalProperties": true},
+			"value":    {"oneOf": [{"type": "integer"}, {"type": "number"}, {"type": "string"}]},
+			"either":   {"anyOf": [{"type": "integer"}, {"type": "number"}]},
+			"both":     {"allOf": [{"$ref": "#/definitions/ref"}, {"required": ["name"]}]},
+			"multi":    {"type": ["string", "null"]},
+			"missing":  {"$ref": "#/definitions/missing"}
+		},
+		"definitions": {
+			"ref": {"type": "object", "required": ["id"], "properties": {"id": {"type": "integer"}}}
+		}
+	}`)
+
+	for _, test := range []struct {
+		value  string
+		errors []string
+	}{
+		{`{"id": 1, "kind": "a"}`, nil},
+		{`{"id": 1, "kind": "a", "name": null, "ratio": 1}`, nil},
+		{`[]`, []string{"/: invalid type array, expected object"}},
+		{`null`, []string{"/: invalid type null, expected object"}},
+
+		// required
+		{`{"id": 1}`, []string{"/: missing required property: kind"}},
+		{`{}`, []string{"/: missing required property: id", "/: missing required property: kind"}},
+
+		// types
+		{`{"id": 1.5, "kind": "a"}`, []string{"/id: invalid type number, expected integer"}},
+		{`{"id": "1", "kind": "a", "ratio": "1"}`, []string{"/id: invalid type string, expected integer", "/ratio: invalid type string, expected number"}},
+		{`{"id": 1, "kind": "a", "multi": null}`, nil},
+		{`{"id": 1, "kind": "a", "multi": 1}`, []string{"/multi: invalid type integer, expected string or null"}},
+
+		// enum
+		{`{"id": 1, "kind": "c"}`, []string{`/kind: invalid value "c", expected one of [a b]`}},
+
+		// nullable
+		{`{"id": 1, "kind": "a", "name": "test"}`, nil},
+		{`{"id": 1, "kind": "a", "name": 1}`, []string{"/name: invalid type integer, expected string"}},
+
+		// $ref
+		{`{"id": 1, "kind": "a", "parent": {"id": 2}}`, nil},
+		{`{"id": 1, "kind": "a", "parent": {}}`, []string{"/parent: missing required property: id"}},
+		{`{"id": 1, "kind": "a", "missing": {}}`, []string{"/missing: Unknown $ref: #/definitions/missing"}},
+
+		// items
+		{`{"id": 1, "kind": "a", "tags": ["a", "b"]}`, nil},
+		{`{"id": 1, "kind": "a", "tags": ["a", 2]}`, []string{"/tags/1: invalid type integer, expected string"}},
+
+		// additionalProperties
+		{`{"id": 1, "kind": "a", "other": true}`, []string{"/: unexpected property: other"}},
+		{`{"id": 1, "kind": "a", "labels": {"a": "b"}}`, nil},
+		{`{"id": 1, "kind": "a", "labels": {"a": 1}}`, []string{"/labels/a: invalid type integer, expected string"}},
+		{`{"id": 1, "kind": "a", "extra": {"a": 1}}`, nil},
+
+		// oneOf: integers are also numbers
+		{`{"id": 1, "kind": "a", "value": "1"}`, nil},
+		{`{"id": 1, "kind": "a", "value": 1.5}`, nil},
+		{`{"id": 1, "kind": "a", "value": 1}`, []string{"/value: does not match exactly one of the oneOf schemas"}},
+		{`{"id": 1, "kind": "a", "value": true}`, []string{"/value: does not match exactly one of the oneOf schemas"}},
+
+		// anyOf
+		{`{"id": 1, "kind": "a", "either": 1}`, nil},
+		{`{"id": 1, "kind": "a", "either": "1"}`, []string{"/either: does not match anyOf schemas"}},
+
+		// allOf
+		{`{"id": 1, "kind": "a", "both": {"id": 1, "name": "test"}}`, nil},
+		{`{"id": 1, "kind": "a", "both": {"id": 1}}`, []string{"/both: missing required property: name"}},
+	} {
+		var errors = validateJSON(schema, []byte(test.value))
+
+		if strings.Join(errors, "\n") != strings.Join(test.errors, "\n") {
+			t.Errorf("validate %v:\n\t%v\nexpected:\n\t%v", test.value, strings.Join(errors, "\n\t"), strings.Join(test.errors, "\n\t"))
+		}
+	}
+
+	if errors := validateJSON(schema, []byte(`{`)); len(errors) != 1 || !strings.HasPrefix(errors[0], "Invalid JSON") {
+		t.Errorf("validate invalid JSON: %v", errors)
+	}
+}
+
+const testOpenAPI = `{
+	"openapi": "3.0.0",
+	"paths": {
+		"/items": {
+			"get": {"responses": {
+				"200": {"content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/item"}}}}}
+			}}
+		},
+		"/items/{id}": {
+			"get": {"responses": {
+				"200": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/item"}}}},
+				"4XX": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/error"}}}}
+			}},
+			"delete": {"responses": {
+				"204": {"description": "No Content"}
+			}}
+		},
+		"/items/new": {
+			"get": {"responses": {
+				"default": {"content": {"application/json": {"schema": {"type": "object", "required": ["template"]}}}}
+			}}
+		}
+	},
+	"components": {
+		"schemas": {
+			"item": {"type": "object", "required": ["id"], "properties": {"id": {"type": "integer"}, "parent": {"$ref": "#/components/schemas/item", "nullable": true}}},
+			"error": {"type": "object", "required": ["error"], "properties": {"error": {"type": "string"}}}
+		}
+	}
+}`
+
+func loadTestOpenAPI(t *testing.T) *OpenAPI {
+	var path = filepath.Join(t.TempDir(), "openapi.json")
+
+	if err := os.WriteFile(path, []byte(testOpenAPI), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	return LoadOpenAPI(t, path)
+}
+
+func TestOpenAPI(t *testing.T) {
+	var openAPI = loadTestOpenAPI(t)
+
+	for _, test := range []struct {
+		method string
+		path   string
+		status int
+		body   string
+		errors []string
+	}{
+		{"GET", "/items", 200, `[{"id": 1}, {"id": 2, "parent": {"id": 1}}]`, nil},
+		{"GET", "/items", 200, `[{"id": 1}, {}]`, []string{"/1: missing required property: id"}},
+		{"GET", "/items/", 200, `[]`, nil},
+		{"GET", "/items/1", 200, `{"id": 1}`, nil},
+		{"GET", "/items/1", 200, `{"id": 1, "parent": {"id": "0"}}`, []string{"/parent/id: invalid type string, expected integer"}},
+		{"GET", "/items/1", 404, `{"error": "Not Found"}`, nil},
+		{"GET", "/items/1", 404, `{}`, []string{"/: missing required property: error"}},
+		{"GET", "/items/1", 500, `{}`, []string{"Undocumented response: GET /items/1 => HTTP 500"}},
+		{"GET", "/items/new", 200, `{"template": {}}`, nil},
+		{"GET", "/items/new", 200, `{"id": 1}`, []string{"/: missing required property: template"}},
+		{"GET", "/items/1", 200, `{`, []string{"Invalid JSON: unexpected end of JSON input"}},
+		{"DELETE", "/items/1", 204, ``, nil},
+		{"POST", "/items", 201, `{}`, []string{"Undocumented operation: POST /items"}},
+		{"GET", "/other", 200, `{}`, []string{"Undocumented operation: GET /other"}},
+	} {
+		var errors = openAPI.Validate(test.method, test.path, test.status, []byte(test.body))
+
+		if strings.Join(errors, "\n") != strings.Join(test.errors, "\n") {
+			t.Errorf("%v %v => HTTP %v %v:\n\t%v\nexpected:\n\t%v", test.method, test.path, test.status, test.body, strings.Join(errors, "\n\t"), strings.Join(test.errors, "\n\t"))
+		}
+	}
+}
+
+func TestAPIOpenAPI(t *testing.T) {
+	var openAPI = loadTestOpenAPI(t)
+
+	for _, test := range []struct {
+		object  interface{}
+		failure string
+	}{
+		{map[string]interface{}{"id": 1}, ""},
+		{map[string]interface{}{"id": "1"}, "does not match OpenAPI:\n\t/id: invalid type string, expected integer"},
+	} {
+		var handler = testObjectHandler(test.object)
+
+		expectFailure(t, recordFailures(t, func(t testing.TB) {
+			TestAPI(t, APITest{
+				Handler:  handler,
+				OpenAPI:  openAPI,
+				Request:  APIRequest{Method: "GET", Target: "/items/1"},
+				Response: APIResponse{StatusCode: 200},
+			})
+		}), test.failure)
+	}
+}
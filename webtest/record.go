@@ -0,0 +1,191 @@
+package webtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Recorded request or response body, as JSON if valid, or raw bytes
+type FixtureBody struct {
+	ContentType string          `json:"content_type,omitempty"`
+	JSON        json.RawMessage `json:"json,omitempty"`
+	Data        []byte          `json:"data,omitempty"`
+}
+
+func makeFixtureBody(contentType string, body []byte) FixtureBody {
+	var fixtureBody = FixtureBody{ContentType: contentType}
+
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/json" && json.Valid(body) {
+		fixtureBody.JSON = json.RawMessage(bytes.TrimSpace(body))
+	} else if len(body) > 0 {
+		fixtureBody.Data = body
+	}
+
+	return fixtureBody
+}
+
+func (body FixtureBody) bytes() []byte {
+	if body.JSON != nil {
+		return body.JSON
+	} else {
+		return body.Data
+	}
+}
+
+// Recorded request and response
+type Fixture struct {
+	Method  string      `json:"method"`
+	Target  string      `json:"target"`
+	Request FixtureBody `json:"request"`
+
+	StatusCode int         `json:"status_code"`
+	Location   string      `json:"location,omitempty"`
+	Response   FixtureBody `json:"response"`
+}
+
+// Return an APITest replaying the request, and expecting the same response.
+//
+// JSON responses are compared as decoded values, other responses using the raw body.
+func (fixture Fixture) APITest() APITest {
+	var test = APITest{
+		Request: APIRequest{
+			Method:      fixture.Method,
+			Target:      fixture.Target,
+			Body:        fixture.Request.bytes(),
+			ContentType: fixture.Request.ContentType,
+		},
+		Response: APIResponse{
+			StatusCode:  fixture.StatusCode,
+			Location:    fixture.Location,
+			ContentType: fixture.Response.ContentType,
+		},
+	}
+
+	if fixture.Response.JSON == nil {
+		test.Response.Body = fixture.Response.Data
+
+		if test.Response.Body == nil {
+			test.Response.Body = []byte{}
+		}
+	} else if err := json.Unmarshal(fixture.Response.JSON, &test.Response.Object); err != nil {
+		test.Response.Body = fixture.Response.JSON
+	} else if test.Response.Object == nil {
+		test.Response.Body = fixture.Response.JSON
+	}
+
+	return test
+}
+
+// Handler recording each request and response served by the wrapped handler, for saving as replayable fixtures.
+//
+// Responses are buffered, so streaming responses are not supported. Websocket requests are not recorded.
+type Recorder struct {
+	handler http.Handler
+
+	mutex    sync.Mutex
+	fixtures []Fixture
+}
+
+func MakeRecorder(handler http.Handler) *Recorder {
+	return &Recorder{handler: handler}
+}
+
+func (recorder *Recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		recorder.handler.ServeHTTP(w, r)
+		return
+	}
+
+	var fixture = Fixture{
+		Method: r.Method,
+		Target: r.URL.RequestURI(),
+	}
+
+	if r.Body != nil {
+		if body, err := ioutil.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else {
+			fixture.Request = makeFixtureBody(r.Header.Get("Content-Type"), body)
+
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+	}
+
+	var responseRecorder = httptest.NewRecorder()
+
+	recorder.handler.ServeHTTP(responseRecorder, r)
+
+	var response = responseRecorder.Result()
+	var body = responseRecorder.Body.Bytes()
+
+	fixture.StatusCode = response.StatusCode
+	fixture.Location = response.Header.Get("Location")
+	fixture.Response = makeFixtureBody(response.Header.Get("Content-Type"), body)
+
+	recorder.mutex.Lock()
+	recorder.fixtures = append(recorder.fixtures, fixture)
+	recorder.mutex.Unlock()
+
+	for name, values := range response.Header {
+		w.Header()[name] = values
+	}
+
+	w.WriteHeader(response.StatusCode)
+	w.Write(body)
+}
+
+// Return the recorded fixtures
+func (recorder *Recorder) Fixtures() []Fixture {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	return append([]Fixture(nil), recorder.fixtures...)
+}
+
+// Write the recorded fixtures to a JSON file, for LoadFixtures
+func (recorder *Recorder) Save(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	var encoder = json.NewEncoder(file)
+
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(recorder.Fixtures()); err != nil {
+		file.Close()
+
+		return fmt.Errorf("Encode %v: %v", path, err)
+	}
+
+	return file.Close()
+}
+
+// Load fixtures saved by the Recorder, returning APITests for use with TestAPIs
+func LoadFixtures(t testing.TB, path string) []APITest {
+	t.Helper()
+
+	var fixtures []Fixture
+	var tests []APITest
+
+	if err := loadJSON(path, &fixtures); err != nil {
+		t.Fatalf("Load fixtures %v: %v", path, err)
+	}
+
+	for _, fixture := range fixtures {
+		tests = append(tests, fixture.APITest())
+	}
+
+	return tests
+}
@@ -0,0 +1,161 @@
+package webtest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testRecordHandler(name string) http.Handler {
+	var serveMux = http.NewServeMux()
+
+	serveMux.HandleFunc("/items", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode([]testObject{{ID: 1, Name: name}})
+
+		case "POST":
+			var object testObject
+
+			if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(object)
+		}
+	})
+	serveMux.HandleFunc("/text", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("hello " + name))
+	})
+	serveMux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/text")
+		w.WriteHeader(http.StatusSeeOther)
+	})
+
+	return serveMux
+}
+
+func recordRequest(handler http.Handler, method string, target string, contentType string, body string) string {
+	var request = httptest.NewRequest(method, target, strings.NewReader(body))
+	var response = httptest.NewRecorder()
+
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	handler.ServeHTTP(response, request)
+
+	return response.Body.String()
+}
+
+func TestRecorder(t *testing.T) {
+	var recorder = MakeRecorder(testRecordHandler("test"))
+
+	// responses are passed through
+	if body := recordRequest(recorder, "GET", "/items", "", ""); body != "[{\"id\":1,\"name\":\"test\",\"Tags\":null}]\n" {
+		t.Errorf("GET /items => %#v", body)
+	}
+	if body := recordRequest(recorder, "POST", "/items", "application/json", `{"id": 2, "name": "new"}`); body != "{\"id\":2,\"name\":\"new\",\"Tags\":null}\n" {
+		t.Errorf("POST /items => %#v", body)
+	}
+
+	recordRequest(recorder, "POST", "/items", "text/plain", "invalid")
+	recordRequest(recorder, "GET", "/text?q=1", "", "")
+	recordRequest(recorder, "GET", "/redirect", "", "")
+
+	var fixtures = recorder.Fixtures()
+
+	if len(fixtures) != 5 {
+		t.Fatalf("fixtures: %#v", fixtures)
+	}
+
+	for i, expected := range []Fixture{
+		{Method: "GET", Target: "/items", StatusCode: 200, Response: FixtureBody{ContentType: "application/json", JSON: json.RawMessage(`[{"id":1,"name":"test","Tags":null}]`)}},
+		{Method: "POST", Target: "/items", StatusCode: 201, Request: FixtureBody{ContentType: "application/json", JSON: json.RawMessage(`{"id": 2, "name": "new"}`)}, Response: FixtureBody{ContentType: "application/json", JSON: json.RawMessage(`{"id":2,"name":"new","Tags":null}`)}},
+		{Method: "POST", Target: "/items", StatusCode: 400, Request: FixtureBody{ContentType: "text/plain", Data: []byte("invalid")}, Response: FixtureBody{ContentType: "text/plain; charset=utf-8", Data: []byte("invalid character 'i' looking for beginning of value\n")}},
+		{Method: "GET", Target: "/text?q=1", StatusCode: 200, Response: FixtureBody{ContentType: "text/plain; charset=utf-8", Data: []byte("hello test")}},
+		{Method: "GET", Target: "/redirect", StatusCode: 303, Location: "/text"},
+	} {
+		if got, _ := json.Marshal(fixtures[i]); string(got) != string(mustMarshal(t, expected)) {
+			t.Errorf("fixture %d:\n%s\nexpected:\n%s", i, got, mustMarshal(t, expected))
+		}
+	}
+
+	var path = filepath.Join(t.TempDir(), "fixtures.json")
+
+	if err := recorder.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	} else if buf, err := ioutil.ReadFile(path); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if !strings.Contains(string(buf), "\n  {\n    \"method\": \"GET\",") {
+		t.Errorf("saved fixtures are not indented:\n%s", buf)
+	}
+
+	var tests = LoadFixtures(t, path)
+
+	if len(tests) != len(fixtures) {
+		t.Fatalf("loaded tests: %#v", tests)
+	}
+
+	// replay against the same handler
+	expectFailure(t, recordFailures(t, func(t testing.TB) {
+		for _, test := range tests {
+			test.Handler = testRecordHandler("test")
+
+			TestAPI(t, test)
+		}
+	}), "")
+
+	// replay against a changed handler
+	var failures = recordFailures(t, func(t testing.TB) {
+		for _, test := range tests {
+			test.Handler = testRecordHandler("changed")
+
+			TestAPI(t, test)
+		}
+	})
+
+	if len(failures) != 2 {
+		t.Errorf("replay changed: %v", strings.Join(failures, "\n"))
+	}
+
+	expectFailure(t, failures, "GET /items => HTTP 200 with incorrect response:\n  [\n    {\n      \"Tags\": null,\n      \"id\": 1,\n-     \"name\": \"test\"\n+     \"name\": \"changed\"")
+	expectFailure(t, failures, "GET /text?q=1 => HTTP 200 with incorrect body: \"hello changed\"")
+}
+
+func mustMarshal(t *testing.T, value interface{}) []byte {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+
+	return buf
+}
+
+func TestRecorderWebsocket(t *testing.T) {
+	var upgraded bool
+	var recorder = MakeRecorder(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgraded = true
+	}))
+
+	var request = httptest.NewRequest("GET", "/events", nil)
+
+	request.Header.Set("Upgrade", "websocket")
+
+	recorder.ServeHTTP(httptest.NewRecorder(), request)
+
+	if !upgraded {
+		t.Errorf("websocket request not passed through")
+	} else if fixtures := recorder.Fixtures(); len(fixtures) != 0 {
+		t.Errorf("websocket request recorded: %#v", fixtures)
+	}
+}
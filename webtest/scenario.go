@@ -0,0 +1,106 @@
+package webtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"strconv"
+	"testing"
+)
+
+// Response of a completed ScenarioStep
+type ScenarioResult struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Decode the JSON response body into the object
+func (result ScenarioResult) Decode(object interface{}) error {
+	return json.Unmarshal(result.Body, object)
+}
+
+// Return a field of the JSON response object as a string, e.g. the "id" of a created resource; empty if missing
+func (result ScenarioResult) Field(name string) string {
+	var object map[string]interface{}
+
+	if err := result.Decode(&object); err != nil {
+		return ""
+	}
+
+	switch value := object[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// Results of the completed steps, by ScenarioStep Name
+type ScenarioResults map[string]ScenarioResult
+
+type ScenarioStep struct {
+	// Used for the subtest name, and the ScenarioResults
+	Name string
+
+	Test APITest
+
+	// Optional func returning the APITest using the results of the previous steps, instead of the Test,
+	// e.g. to GET the resource at the "id" returned by an earlier POST
+	Func func(results ScenarioResults) APITest
+}
+
+// Sequence of API requests, sharing a cookie jar
+type Scenario struct {
+	Handler http.Handler
+	Steps   []ScenarioStep
+
+	// Optional OpenAPI document for validating the responses of any steps without an OpenAPI
+	OpenAPI *OpenAPI
+}
+
+// Run each step in order as a numbered subtest, aborting the remaining steps after any failed step
+func TestScenario(t testing.TB, scenario Scenario) {
+	var results = make(ScenarioResults)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("cookiejar.New: %v", err)
+	}
+
+	for i, step := range scenario.Steps {
+		var test = step.Test
+		var name = fmt.Sprintf("%d %v", i+1, step.Name)
+
+		if !run(t, name, func(t testing.TB) {
+			if step.Func != nil {
+				test = step.Func(results)
+			}
+			if test.Handler == nil {
+				test.Handler = scenario.Handler
+			}
+			if test.Jar == nil {
+				test.Jar = jar
+			}
+			if test.OpenAPI == nil {
+				test.OpenAPI = scenario.OpenAPI
+			}
+
+			var response, body = testAPI(t, test)
+
+			results[step.Name] = ScenarioResult{
+				StatusCode: response.StatusCode,
+				Header:     response.Header,
+				Body:       body,
+			}
+		}) {
+			t.Logf("Scenario aborted at step %v, skipping %d remaining steps", name, len(scenario.Steps)-i-1)
+			break
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package webtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Handler creating objects with POST /items, and returning them with GET /items/:id
+func testItemsHandler() http.Handler {
+	var mutex sync.Mutex
+	var items = make(map[int]testObject)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		var object testObject
+
+		if r.Method == "POST" && r.URL.Path == "/items" {
+			if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			object.ID = len(items) + 1
+			items[object.ID] = object
+
+			w.WriteHeader(http.StatusCreated)
+		} else if id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/items/")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if item, ok := items[id]; !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		} else {
+			object = item
+		}
+
+		json.NewEncoder(w).Encode(object)
+	})
+}
+
+func TestScenarioSteps(t *testing.T) {
+	TestScenario(t, Scenario{
+		Handler: testItemsHandler(),
+		Steps: []ScenarioStep{
+			{
+				Name: "create a",
+				Test: APITest{
+					Request:  APIRequest{Method: "POST", Target: "/items", Object: testObject{Name: "a"}},
+					Response: APIResponse{StatusCode: 201},
+				},
+			},
+			{
+				Name: "create b",
+				Test: APITest{
+					Request:  APIRequest{Method: "POST", Target: "/items", Object: testObject{Name: "b"}},
+					Response: APIResponse{StatusCode: 201},
+				},
+			},
+			{
+				Name: "get b",
+				Func: func(results ScenarioResults) APITest {
+					return APITest{
+						Request:  APIRequest{Method: "GET", Target: "/items/" + results["create b"].Field("id")},
+						Response: APIResponse{StatusCode: 200, Body: []byte("{\"id\":2,\"name\":\"b\",\"Tags\":null}\n")},
+					}
+				},
+			},
+		},
+	})
+}
+
+func TestScenarioAbort(t *testing.T) {
+	var called bool
+	var failures = recordFailures(t, func(t testing.TB) {
+		TestScenario(t, Scenario{
+			Handler: testItemsHandler(),
+			Steps: []ScenarioStep{
+				{
+					Name: "get missing",
+					Test: APITest{
+						Request:  APIRequest{Method: "GET", Target: "/items/1"},
+						Response: APIResponse{StatusCode: 200},
+					},
+				},
+				{
+					Name: "get",
+					Func: func(results ScenarioResults) APITest {
+						called = true
+
+						return APITest{Request: APIRequest{Method: "GET", Target: "/items/1"}}
+					},
+				},
+			},
+		})
+	})
+
+	expectFailure(t, failures, "GET /items/1 => HTTP 404, expected 200")
+
+	if called {
+		t.Errorf("remaining steps were run after a failed step")
+	}
+}
+
+func TestScenarioResult(t *testing.T) {
+	var result = ScenarioResult{Body: []byte(`{"id": 1, "ratio": 0.5, "name": "test", "ok": true, "tags": ["a"]}`)}
+
+	for _, test := range []struct {
+		field string
+		value string
+	}{
+		{"id", "1"},
+		{"ratio", "0.5"},
+		{"name", "test"},
+		{"ok", "true"},
+		{"tags", "[a]"},
+		{"missing", ""},
+	} {
+		if value := result.Field(test.field); value != test.value {
+			t.Errorf("Field(%#v) => %#v, expected %#v", test.field, value, test.value)
+		}
+	}
+
+	if value := (ScenarioResult{Body: []byte("invalid")}).Field("id"); value != "" {
+		t.Errorf("Field(\"id\") for invalid JSON => %#v", value)
+	}
+
+	var object testObject
+
+	if err := result.Decode(&object); err != nil {
+		t.Errorf("Decode: %v", err)
+	} else if object.ID != 1 || object.Name != "test" {
+		t.Errorf("Decode: %#v", object)
+	}
+}
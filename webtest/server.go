@@ -0,0 +1,31 @@
+package webtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/qmsk/go-web"
+)
+
+// Serve the routes as for web.Options.Server on an ephemeral localhost port, returning the http:// base URL.
+//
+// The server is closed once the test completes.
+func Server(t testing.TB, routes ...web.Route) string {
+	var server = httptest.NewServer(web.Options{}.Handler(routes...))
+
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+// Serve the routes over TLS using a self-signed certificate, returning the https:// base URL and a client trusting it.
+//
+// The server is closed once the test completes.
+func TLSServer(t testing.TB, routes ...web.Route) (string, *http.Client) {
+	var server = httptest.NewTLSServer(web.Options{}.Handler(routes...))
+
+	t.Cleanup(server.Close)
+
+	return server.URL, server.Client()
+}
@@ -0,0 +1,94 @@
+package webtest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/qmsk/go-web"
+)
+
+// Return the request path as text
+var testPathHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(r.URL.Path))
+})
+
+func testGet(t *testing.T, client *http.Client, url string) (int, string) {
+	t.Helper()
+
+	response, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("GET %v: %v", url, err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("GET %v: read body: %v", url, err)
+	}
+
+	return response.StatusCode, string(body)
+}
+
+func TestServer(t *testing.T) {
+	var url string
+
+	t.Run("serve", func(t *testing.T) {
+		url = Server(t, web.RoutePrefix("/api/", testPathHandler))
+
+		if !strings.HasPrefix(url, "http://127.0.0.1:") {
+			t.Errorf("url: %v", url)
+		}
+
+		if status, body := testGet(t, http.DefaultClient, url+"/api/test"); status != 200 || body != "test" {
+			t.Errorf("GET /api/test => HTTP %v: %#v", status, body)
+		}
+		if status, _ := testGet(t, http.DefaultClient, url+"/other"); status != 404 {
+			t.Errorf("GET /other => HTTP %v", status)
+		}
+	})
+
+	// closed once the test completes
+	if response, err := http.Get(url + "/api/test"); err == nil {
+		response.Body.Close()
+		t.Errorf("GET after test => HTTP %v", response.StatusCode)
+	}
+}
+
+func TestServerWebsocket(t *testing.T) {
+	var events = web.MakeEvents(web.EventConfig{
+		StateFunc: func() web.State { return "state" },
+	})
+	defer events.Close()
+
+	var url = Server(t, web.Route{Pattern: "/events", Handler: events})
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/events", http.Header{"Origin": {url}})
+	if err != nil {
+		t.Fatalf("websocket Dial: %v", err)
+	}
+	defer conn.Close()
+
+	var state string
+
+	if err := conn.ReadJSON(&state); err != nil {
+		t.Fatalf("websocket ReadJSON: %v", err)
+	} else if state != "state" {
+		t.Errorf("state: %#v", state)
+	}
+}
+
+func TestTLSServer(t *testing.T) {
+	var url, client = TLSServer(t, web.RoutePrefix("/api/", testPathHandler))
+
+	if !strings.HasPrefix(url, "https://") {
+		t.Errorf("url: %v", url)
+	}
+
+	if status, body := testGet(t, client, url+"/api/test"); status != 200 || body != "test" {
+		t.Errorf("GET /api/test => HTTP %v: %#v", status, body)
+	}
+}
@@ -0,0 +1,176 @@
+package webtest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Event received from a text/event-stream
+type SSEEvent struct {
+	ID    string
+	Event string // empty for the default "message" events
+	Data  string
+}
+
+// Decode the JSON event data into the object
+func (event SSEEvent) Decode(object interface{}) error {
+	return json.Unmarshal([]byte(event.Data), object)
+}
+
+// Read events from the text/event-stream until the context is done, returning any read error
+func readSSE(ctx context.Context, reader *bufio.Reader, eventChan chan<- SSEEvent) error {
+	defer close(eventChan)
+
+	var event SSEEvent
+	var data []string
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			// dispatch
+			if data != nil {
+				event.Data = strings.Join(data, "\n")
+
+				select {
+				case eventChan <- event:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+
+			event = SSEEvent{ID: event.ID}
+			data = nil
+
+			continue
+		} else if strings.HasPrefix(line, ":") {
+			// comment
+			continue
+		}
+
+		var field, value = line, ""
+
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "id":
+			event.ID = value
+		case "event":
+			event.Event = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
+
+// Server-Sent Events client, consuming the text/event-stream incrementally
+type SSEClient struct {
+	t         testing.TB
+	eventChan chan SSEEvent
+}
+
+// Connect to the text/event-stream at the URL, failing the test on errors or any non-200 response.
+//
+// The client is closed once the test completes.
+func ConnectSSE(t testing.TB, url string) *SSEClient {
+	t.Helper()
+
+	var ctx, cancel = context.WithCancel(context.Background())
+
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		cancel()
+		t.Fatalf("GET %v: %v", url, err)
+	}
+
+	request.Header.Set("Accept", "text/event-stream")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		cancel()
+		t.Fatalf("GET %v: %v", url, err)
+	} else if response.StatusCode != 200 {
+		cancel()
+		response.Body.Close()
+		t.Fatalf("GET %v => HTTP %v", url, response.StatusCode)
+	}
+
+	var client = SSEClient{
+		t:         t,
+		eventChan: make(chan SSEEvent),
+	}
+
+	go readSSE(ctx, bufio.NewReader(response.Body), client.eventChan)
+
+	t.Cleanup(func() {
+		cancel()
+		response.Body.Close()
+	})
+
+	return &client
+}
+
+// Return the next event, failing the test if the stream is closed, or on the EVENTS_TIMEOUT
+func (client *SSEClient) Next() SSEEvent {
+	client.t.Helper()
+
+	select {
+	case event, ok := <-client.eventChan:
+		if !ok {
+			client.t.Fatalf("SSE stream closed")
+		}
+
+		return event
+
+	case <-time.After(EVENTS_TIMEOUT):
+		client.t.Fatalf("SSE timeout")
+	}
+
+	return SSEEvent{}
+}
+
+// Receive the next event, failing the test unless it has the given event type and JSON data equal to the expected value
+func (client *SSEClient) Expect(eventType string, expected interface{}) SSEEvent {
+	client.t.Helper()
+
+	var event = client.Next()
+	var value = reflect.New(reflect.TypeOf(expected))
+
+	if event.Event != eventType {
+		client.t.Errorf("SSE event type %#v, expected %#v", event.Event, eventType)
+	}
+
+	if err := event.Decode(value.Interface()); err != nil {
+		client.t.Errorf("SSE event data: %v", err)
+	} else if object := value.Elem().Interface(); !reflect.DeepEqual(object, expected) {
+		client.t.Errorf("SSE event incorrect data:\n%v", diffJSON(expected, object))
+	}
+
+	return event
+}
+
+// Fail the test if any event is received within the timeout
+func (client *SSEClient) ExpectNone(timeout time.Duration) {
+	client.t.Helper()
+
+	select {
+	case event, ok := <-client.eventChan:
+		if ok {
+			client.t.Errorf("SSE unexpected event: %#v", event)
+		}
+	case <-time.After(timeout):
+	}
+}
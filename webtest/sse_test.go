@@ -0,0 +1,109 @@
+package webtest
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qmsk/go-web"
+)
+
+func TestReadSSE(t *testing.T) {
+	var stream = "retry: 1000\n\n" +
+		": comment\n" +
+		"id: 1\n" +
+		"event: state\n" +
+		"data: {\"a\":1}\n\n" +
+		"data: first\r\n" +
+		"data:second\r\n\r\n" +
+		"id: 3\n" +
+		"event: ignored\n\n" +
+		"data\n\n"
+	var eventChan = make(chan SSEEvent, 10)
+
+	if err := readSSE(context.Background(), bufio.NewReader(strings.NewReader(stream)), eventChan); err != io.EOF {
+		t.Errorf("readSSE: %v", err)
+	}
+
+	var events []SSEEvent
+
+	for event := range eventChan {
+		events = append(events, event)
+	}
+
+	// the last event ID is kept, but not the event type
+	var expected = []SSEEvent{
+		{ID: "1", Event: "state", Data: `{"a":1}`},
+		{ID: "1", Data: "first\nsecond"},
+		{ID: "3", Data: ""},
+	}
+
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("events:\n%#v\nexpected:\n%#v", events, expected)
+	}
+}
+
+func TestSSE(t *testing.T) {
+	var eventsTest = MakeEvents(t, web.EventConfig{})
+
+	eventsTest.SetState(testLightsState{Lights: map[string]bool{"1": false}})
+
+	var client = eventsTest.ConnectSSE("topic=lights/*")
+
+	if event := client.Expect("state", testLightsState{Lights: map[string]bool{"1": false}}); event.ID != "0" {
+		t.Errorf("state event ID: %#v", event.ID)
+	}
+
+	eventsTest.Publish(web.TopicEvent{Topic: "sensors/1", Event: 1.5})
+	eventsTest.Publish(web.TopicEvent{Topic: "lights/1", Event: true})
+
+	if event := client.Expect("", map[string]interface{}{"topic": "lights/1", "event": true}); event.ID != "2" {
+		t.Errorf("event ID: %#v", event.ID)
+	}
+
+	client.ExpectNone(10 * time.Millisecond)
+}
+
+func TestSSEFailures(t *testing.T) {
+	expectFailure(t, recordEventsFailures(t, func(eventsTest *EventsTest) {
+		eventsTest.ConnectSSE("").Expect("state", "wrong")
+	}), "SSE event incorrect data:\n- \"wrong\"\n+ \"state\"")
+
+	expectFailure(t, recordEventsFailures(t, func(eventsTest *EventsTest) {
+		eventsTest.ConnectSSE("").Expect("message", "state")
+	}), "SSE event type \"state\", expected \"message\"")
+
+	expectFailure(t, recordEventsFailures(t, func(eventsTest *EventsTest) {
+		var client = eventsTest.ConnectSSE("")
+
+		client.Next()
+
+		eventsTest.Publish("event")
+
+		client.ExpectNone(time.Second)
+	}), "SSE unexpected event: ")
+
+	expectFailure(t, recordEventsFailures(t, func(eventsTest *EventsTest) {
+		var client = eventsTest.ConnectSSE("")
+
+		client.Next()
+
+		eventsTest.Events.Close()
+
+		client.Expect("disconnect", "shutdown")
+		client.Next()
+	}), "SSE stream closed")
+
+	var server = httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	expectFailure(t, recordFailures(t, func(t testing.TB) {
+		ConnectSSE(t, server.URL)
+	}), "GET "+server.URL+" => HTTP 404")
+}